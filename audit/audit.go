@@ -0,0 +1,232 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"encore.app/authz"
+	encore "encore.dev"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+type Events struct {
+	Items      []Event
+	NextCursor int // pass as Cursor to get the next page, 0 when there are no more events
+}
+
+type Event struct {
+	Id         int
+	Actor      *string // the auth UID, nil for changes made by the system itself (e.g. cron jobs)
+	Action     string  // e.g. schedule.delete
+	EntityType string
+	EntityId   string
+	Before     json.RawMessage
+	After      json.RawMessage
+	Service    string
+	Endpoint   string
+	Path       string
+	CreatedAt  time.Time
+}
+
+type RecordParams struct {
+	Actor      *string
+	Action     string
+	EntityType string
+	EntityId   string
+	Before     json.RawMessage
+	After      json.RawMessage
+	Service    string
+	Endpoint   string
+	Path       string
+}
+
+type ListParams struct {
+	Actor      string
+	Action     string
+	EntityType string
+	EntityId   string
+	Since      time.Time
+	Until      time.Time
+	Cursor     int // only return events older than this id
+	Limit      int // defaults to 50, at most 500
+}
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+// Log Helper function recording a change made by the current request. before and after are
+// marshalled to JSON and may be nil, e.g. there is nothing before something is created.
+// Failing to record is logged rather than failing the change, which has already been made.
+func Log(ctx context.Context, action string, entityType string, entityId interface{}, before interface{}, after interface{}) {
+	params := &RecordParams{
+		Action:     action,
+		EntityType: entityType,
+		EntityId:   fmt.Sprint(entityId),
+	}
+	if uid, ok := auth.UserID(); ok {
+		actor := string(uid)
+		params.Actor = &actor
+	}
+	if req := encore.CurrentRequest(); req != nil {
+		params.Service, params.Endpoint, params.Path = req.Service, req.Endpoint, req.Path
+	}
+
+	var err error
+	if params.Before, err = marshal(before); err == nil {
+		params.After, err = marshal(after)
+	}
+	if err == nil {
+		err = Record(ctx, params)
+	}
+	if err != nil {
+		rlog.Error("FAIL to record audit event", "action", action, "entityType", entityType, "entityId", params.EntityId, "err", err)
+	}
+}
+
+func marshal(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+//encore:api private
+func Record(ctx context.Context, params *RecordParams) error {
+	eb := errs.B().Meta("action", params.Action, "entityType", params.EntityType, "entityId", params.EntityId)
+	_, err := sqldb.Exec(ctx, `
+		INSERT INTO audit_events (actor, action, entity_type, entity_id, before, after, service, endpoint, path)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, params.Actor, params.Action, params.EntityType, params.EntityId, nullJSON(params.Before), nullJSON(params.After), params.Service, params.Endpoint, params.Path)
+	if err != nil {
+		return eb.Code(errs.Unavailable).Cause(err).Msg("insert audit event").Err()
+	}
+	return nil
+}
+
+// nullJSON stores missing JSON as NULL rather than an empty string, which is not valid JSONB
+func nullJSON(raw json.RawMessage) *string {
+	if len(raw) == 0 {
+		return nil
+	}
+	s := string(raw)
+	return &s
+}
+
+// List returns audit events matching all the given filters, newest first
+//
+//encore:api auth method=GET path=/audit
+func List(ctx context.Context, params *ListParams) (*Events, error) {
+	if err := authz.RequireAdmin("view the audit log"); err != nil {
+		return nil, err
+	}
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	// empty filters match everything
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, actor, action, entity_type, entity_id, before, after, service, endpoint, path, created_at
+		FROM audit_events
+		WHERE ($1 = '' OR actor = $1)
+		  AND ($2 = '' OR action = $2)
+		  AND ($3 = '' OR entity_type = $3)
+		  AND ($4 = '' OR entity_id = $4)
+		  AND ($5::TIMESTAMPTZ IS NULL OR created_at >= $5)
+		  AND ($6::TIMESTAMPTZ IS NULL OR created_at < $6)
+		  AND ($7 = 0 OR id < $7)
+		ORDER BY id DESC
+		LIMIT $8
+	`, params.Actor, params.Action, params.EntityType, params.EntityId, nullTime(params.Since), nullTime(params.Until), params.Cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := rowsToEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events.Items) == limit {
+		events.NextCursor = events.Items[len(events.Items)-1].Id
+	}
+
+	return events, nil
+}
+
+type HistoryParams struct {
+	EntityType string
+	EntityId   string
+	Cursor     int // only return events newer than this id
+}
+
+// History returns the events of an entity in the order they happened, e.g. for the timeline of
+// an incident's postmortem, at most 500 at a time. It is private as only admins may view the
+// audit log.
+//
+//encore:api private
+func History(ctx context.Context, params *HistoryParams) (*Events, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, actor, action, entity_type, entity_id, before, after, service, endpoint, path, created_at
+		FROM audit_events
+		WHERE entity_type = $1
+		  AND entity_id = $2
+		  AND id > $3
+		ORDER BY id ASC
+		LIMIT $4
+	`, params.EntityType, params.EntityId, params.Cursor, maxLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := rowsToEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events.Items) == maxLimit {
+		events.NextCursor = events.Items[len(events.Items)-1].Id
+	}
+
+	return events, nil
+}
+
+func rowsToEvents(rows *sqldb.Rows) (*Events, error) {
+	defer rows.Close()
+
+	events := &Events{}
+	for rows.Next() {
+		var event Event
+		var before, after *string
+		err := rows.Scan(&event.Id, &event.Actor, &event.Action, &event.EntityType, &event.EntityId, &before, &after, &event.Service, &event.Endpoint, &event.Path, &event.CreatedAt)
+		if err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		if before != nil {
+			event.Before = json.RawMessage(*before)
+		}
+		if after != nil {
+			event.After = json.RawMessage(*after)
+		}
+		events.Items = append(events.Items, event)
+	}
+	return events, nil
+}
+
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
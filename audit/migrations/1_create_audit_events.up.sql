@@ -0,0 +1,31 @@
+CREATE TABLE audit_events
+(
+    id          BIGSERIAL PRIMARY KEY,
+    actor       VARCHAR(255),
+    action      VARCHAR(255) NOT NULL,
+    entity_type VARCHAR(255) NOT NULL,
+    entity_id   VARCHAR(255) NOT NULL,
+    before      JSONB,
+    after       JSONB,
+    service     VARCHAR(255) NOT NULL,
+    endpoint    VARCHAR(255) NOT NULL,
+    path        TEXT         NOT NULL,
+    created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_events_entity_index ON audit_events (entity_type, entity_id);
+CREATE INDEX audit_events_actor_index ON audit_events (actor);
+
+-- the audit log is append-only, nobody gets to rewrite history
+CREATE FUNCTION audit_events_append_only() RETURNS TRIGGER AS
+$$
+BEGIN
+    RAISE EXCEPTION 'audit events are append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only
+    BEFORE UPDATE OR DELETE
+    ON audit_events
+    FOR EACH ROW
+EXECUTE FUNCTION audit_events_append_only();
@@ -0,0 +1,373 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/authz"
+	"encore.app/users"
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	apiKeyPrefix    = "oncall_key_"
+	userTokenPrefix = "oncall_usr_"
+
+	// BootstrapUID is the actor when authenticating with the BootstrapAPIKey secret
+	BootstrapUID auth.UID = "bootstrap"
+)
+
+const (
+	APIKeyRoleAdmin       = "admin"
+	APIKeyRoleIntegration = "integration"
+)
+
+// Data describes who is making a request. Exactly one of User and APIKeyId is set, unless the
+// request was authenticated with the bootstrap key or is made by the app itself.
+type Data struct {
+	User     *users.User        // set when authenticated with a user token
+	APIKeyId *int               // set when authenticated with an API key
+	Name     string             // the user's name or the API key's name
+	Admin    bool               // admin users, admin API keys and the bootstrap key
+	Teams    []users.Membership // the teams of the user
+	System   bool               // set for calls of cron jobs, see AsSystem
+}
+
+func (d *Data) IsAdmin() bool {
+	return d.Admin
+}
+
+func (d *Data) IsIntegration() bool {
+	return (d.APIKeyId != nil || d.System) && !d.Admin
+}
+
+func (d *Data) TeamRoles() map[int]authz.Role {
+	roles := make(map[int]authz.Role, len(d.Teams))
+	for _, membership := range d.Teams {
+		roles[membership.TeamId] = membership.Role
+	}
+	return roles
+}
+
+type APIKeys struct {
+	Items []APIKey
+}
+
+type APIKey struct {
+	Id        int
+	Name      string
+	Role      string
+	CreatedBy *string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+type CreateAPIKeyParams struct {
+	Name string
+	Role string // either admin or integration (the default), which can only create incidents
+}
+
+type CreatedAPIKey struct {
+	Id        int
+	Name      string
+	Role      string
+	Key       string // only returned once, we only store its hash
+	CreatedAt time.Time
+}
+
+type CreateUserTokenParams struct {
+	UserId         int
+	ExpiresInHours int // defaults to 30 days
+}
+
+type UserToken struct {
+	Id        int
+	User      users.User
+	Token     string // only returned once, we only store its hash
+	ExpiresAt time.Time
+}
+
+// AuthHandler accepts either an API key (for integrations such as monitoring), a user token
+// or the BootstrapAPIKey secret, which is used to create the first API key.
+//
+//encore:authhandler
+func AuthHandler(ctx context.Context, token string) (auth.UID, *Data, error) {
+	eb := errs.B()
+
+	if secrets.BootstrapAPIKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secrets.BootstrapAPIKey)) == 1 {
+		return BootstrapUID, &Data{Name: "bootstrap", Admin: true}, nil
+	}
+
+	switch {
+	case strings.HasPrefix(token, apiKeyPrefix):
+		data := &Data{}
+		var id int
+		var role string
+		err := sqldb.QueryRow(ctx, `
+			SELECT id, name, role
+			FROM api_keys
+			WHERE key_hash = $1
+			  AND revoked_at IS NULL
+		`, hashToken(token)).Scan(&id, &data.Name, &role)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return "", nil, eb.Code(errs.Unauthenticated).Msg("invalid api key").Err()
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		data.APIKeyId = &id
+		data.Admin = role == APIKeyRoleAdmin
+		return auth.UID(fmt.Sprintf("apikey:%d", id)), data, nil
+
+	case strings.HasPrefix(token, userTokenPrefix):
+		var userId int
+		err := sqldb.QueryRow(ctx, `
+			SELECT user_id
+			FROM user_tokens
+			WHERE token_hash = $1
+			  AND revoked_at IS NULL
+			  AND expires_at > NOW()
+		`, hashToken(token)).Scan(&userId)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return "", nil, eb.Code(errs.Unauthenticated).Msg("invalid or expired user token").Err()
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		user, err := users.Get(ctx, userId)
+		if err != nil {
+			return "", nil, eb.Code(errs.Unauthenticated).Msg("user of token no longer exists").Err()
+		}
+		if user.DeactivatedAt != nil {
+			return "", nil, eb.Code(errs.Unauthenticated).Msg("user of token is deactivated").Err()
+		}
+		memberships, err := users.ListMemberships(ctx, user.Id)
+		if err != nil {
+			return "", nil, err
+		}
+		return UserUID(user.Id), &Data{User: user, Name: user.FirstName + " " + user.LastName, Admin: user.Admin, Teams: memberships.Items}, nil
+	}
+
+	return "", nil, eb.Code(errs.Unauthenticated).Msg("unknown token").Err()
+}
+
+//encore:api auth method=POST path=/auth/api-keys
+func CreateAPIKey(ctx context.Context, params *CreateAPIKeyParams) (*CreatedAPIKey, error) {
+	eb := errs.B().Meta("name", params.Name, "role", params.Role)
+	if err := authz.RequireAdmin("manage integrations"); err != nil {
+		return nil, err
+	}
+	if len(params.Name) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("name is empty").Err()
+	}
+	role := params.Role
+	if role == "" {
+		role = APIKeyRoleIntegration
+	}
+	if role != APIKeyRoleAdmin && role != APIKeyRoleIntegration {
+		return nil, eb.Code(errs.InvalidArgument).Msgf("unknown role %q, expected %q or %q", role, APIKeyRoleAdmin, APIKeyRoleIntegration).Err()
+	}
+
+	key, err := generateToken(apiKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	created := &CreatedAPIKey{Key: key}
+	err = sqldb.QueryRow(ctx, `
+		INSERT INTO api_keys (name, role, key_hash, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, name, role, created_at
+	`, params.Name, role, hashToken(key), Actor()).Scan(&created.Id, &created.Name, &created.Role, &created.CreatedAt)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert api key").Err()
+	}
+
+	// never record the key itself
+	audit.Log(ctx, "api_key.create", "api_key", created.Id, nil, &APIKey{Id: created.Id, Name: created.Name, Role: created.Role, CreatedBy: Actor(), CreatedAt: created.CreatedAt})
+	return created, nil
+}
+
+//encore:api auth method=GET path=/auth/api-keys
+func ListAPIKeys(ctx context.Context) (*APIKeys, error) {
+	eb := errs.B()
+	if err := authz.RequireAdmin("manage integrations"); err != nil {
+		return nil, err
+	}
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, name, role, created_by, created_at, revoked_at
+		FROM api_keys
+		ORDER BY id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.Id, &key.Name, &key.Role, &key.CreatedBy, &key.CreatedAt, &key.RevokedAt); err != nil {
+			return nil, eb.Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		keys = append(keys, key)
+	}
+
+	return &APIKeys{Items: keys}, nil
+}
+
+//encore:api auth method=DELETE path=/auth/api-keys/:id
+func RevokeAPIKey(ctx context.Context, id int) (*APIKey, error) {
+	eb := errs.B().Meta("apiKeyId", id)
+	if err := authz.RequireAdmin("manage integrations"); err != nil {
+		return nil, err
+	}
+	key := &APIKey{}
+	err := sqldb.QueryRow(ctx, `
+		UPDATE api_keys
+		SET revoked_at = NOW()
+		WHERE id = $1
+		  AND revoked_at IS NULL
+		RETURNING id, name, role, created_by, created_at, revoked_at
+	`, id).Scan(&key.Id, &key.Name, &key.Role, &key.CreatedBy, &key.CreatedAt, &key.RevokedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no active api key found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "api_key.revoke", "api_key", key.Id, nil, key)
+	return key, nil
+}
+
+//encore:api auth method=POST path=/auth/tokens
+func CreateUserToken(ctx context.Context, params *CreateUserTokenParams) (*UserToken, error) {
+	eb := errs.B().Meta("userId", params.UserId)
+
+	// users can create tokens for themselves, admins for anyone
+	if data := CurrentData(); data == nil || data.User == nil || data.User.Id != params.UserId {
+		if err := authz.RequireAdmin("create tokens for other users"); err != nil {
+			return nil, err
+		}
+	}
+
+	user, err := users.Get(ctx, params.UserId)
+	if err != nil {
+		return nil, eb.Code(errs.NotFound).Msg("user not found").Err()
+	}
+
+	expiresIn := time.Duration(params.ExpiresInHours) * time.Hour
+	if expiresIn <= 0 {
+		expiresIn = 30 * 24 * time.Hour
+	}
+
+	token, err := generateToken(userTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	created := &UserToken{User: *user, Token: token}
+	err = sqldb.QueryRow(ctx, `
+		INSERT INTO user_tokens (user_id, token_hash, created_by, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, expires_at
+	`, user.Id, hashToken(token), Actor(), time.Now().Add(expiresIn)).Scan(&created.Id, &created.ExpiresAt)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert user token").Err()
+	}
+
+	// never record the token itself
+	audit.Log(ctx, "user_token.create", "user_token", created.Id, nil, &UserToken{Id: created.Id, User: created.User, ExpiresAt: created.ExpiresAt})
+	return created, nil
+}
+
+//encore:api auth method=DELETE path=/auth/tokens/:id
+func RevokeUserToken(ctx context.Context, id int) error {
+	eb := errs.B().Meta("userTokenId", id)
+	var userId int
+	err := sqldb.QueryRow(ctx, `SELECT user_id FROM user_tokens WHERE id = $1 AND revoked_at IS NULL`, id).Scan(&userId)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return eb.Code(errs.NotFound).Msg("no active user token found").Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	if data := CurrentData(); data == nil || data.User == nil || data.User.Id != userId {
+		if err := authz.RequireAdmin("revoke tokens of other users"); err != nil {
+			return err
+		}
+	}
+
+	_, err = sqldb.Exec(ctx, `UPDATE user_tokens SET revoked_at = NOW() WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	audit.Log(ctx, "user_token.revoke", "user_token", id, nil, nil)
+	return nil
+}
+
+//encore:api auth method=GET path=/auth/me
+func Me(ctx context.Context) (*Data, error) {
+	return CurrentData(), nil
+}
+
+// CurrentData Helper function returning who is making the current request, or nil for
+// unauthenticated requests and cron jobs.
+func CurrentData() *Data {
+	data, _ := auth.Data().(*Data)
+	return data
+}
+
+// Actor Helper function returning the UID of whoever is making the current request, for
+// recording who made a change. It is nil for changes made by the system itself (e.g. cron jobs).
+func Actor() *string {
+	uid, ok := auth.UserID()
+	if !ok {
+		return nil
+	}
+	actor := string(uid)
+	return &actor
+}
+
+// AsSystem Helper function authenticating the calls a cron job makes with the context, e.g.
+// heartbeat monitors creating incidents. The app may do what integrations may do, and is the
+// actor "system:<component>" in the audit log.
+func AsSystem(ctx context.Context, component string) context.Context {
+	return auth.WithContext(ctx, auth.UID("system:"+component), &Data{Name: component, System: true})
+}
+
+// UserUID Helper function returning the UID of a user authenticated with a user token
+func UserUID(userId int) auth.UID {
+	return auth.UID("user:" + strconv.Itoa(userId))
+}
+
+func generateToken(prefix string) (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(random), nil
+}
+
+// hashToken Helper function for the value we store instead of the token itself
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+var secrets struct {
+	BootstrapAPIKey string
+}
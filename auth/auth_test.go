@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateToken(t *testing.T) {
+	first, err := generateToken(apiKeyPrefix)
+	if err != nil {
+		t.Fatal("failed to generate token", err)
+	}
+	second, err := generateToken(apiKeyPrefix)
+	if err != nil {
+		t.Fatal("failed to generate token", err)
+	}
+
+	if !strings.HasPrefix(first, apiKeyPrefix) {
+		t.Errorf("expected token %q to start with %q", first, apiKeyPrefix)
+	}
+	if first == second {
+		t.Errorf("expected tokens to be unique, got %q twice", first)
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	hash := hashToken("oncall_key_abc")
+	if len(hash) != 64 {
+		t.Errorf("expected a hex encoded sha256 hash, got %q", hash)
+	}
+	if hash != hashToken("oncall_key_abc") {
+		t.Error("expected hashing to be deterministic")
+	}
+	if hash == hashToken("oncall_key_abd") {
+		t.Error("expected different tokens to have different hashes")
+	}
+}
+
+func TestIsIntegration(t *testing.T) {
+	id := 1
+	cases := []struct {
+		data     Data
+		expected bool
+	}{
+		{Data{APIKeyId: &id}, true},
+		{Data{APIKeyId: &id, Admin: true}, false},
+		{Data{System: true}, true},
+		{Data{Name: "bootstrap", Admin: true}, false},
+		{Data{Name: "Jane Doe"}, false},
+	}
+	for _, c := range cases {
+		if c.data.IsIntegration() != c.expected {
+			t.Errorf("expected IsIntegration of %+v to be %v", c.data, c.expected)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+CREATE TABLE api_keys
+(
+    id         BIGSERIAL PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    key_hash   CHAR(64)     NOT NULL UNIQUE,
+    created_by VARCHAR(255),
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE TABLE user_tokens
+(
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    INTEGER     NOT NULL,
+    token_hash CHAR(64)    NOT NULL UNIQUE,
+    created_by VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
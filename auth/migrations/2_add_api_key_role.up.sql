@@ -0,0 +1,3 @@
+-- integrations can only create incidents, admin keys can do anything
+ALTER TABLE api_keys
+    ADD COLUMN role VARCHAR(255) NOT NULL DEFAULT 'integration';
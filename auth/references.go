@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+
+	"encore.app/audit"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// UserReference is an active token of a user of the users service, which the database can't enforce
+type UserReference struct {
+	Table  string // user_tokens
+	Id     int
+	UserId int
+}
+
+type UserReferences struct {
+	Items []UserReference
+}
+
+type RevokeUserReferencesParams struct {
+	UserIds []int
+}
+
+// ListUserReferences returns every token which can still be used, with the user it belongs to
+//
+//encore:api private
+func ListUserReferences(ctx context.Context) (*UserReferences, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, user_id
+		FROM user_tokens
+		WHERE revoked_at IS NULL
+		  AND expires_at > NOW()
+		ORDER BY id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	references := &UserReferences{}
+	for rows.Next() {
+		reference := UserReference{Table: "user_tokens"}
+		if err := rows.Scan(&reference.Id, &reference.UserId); err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		references.Items = append(references.Items, reference)
+	}
+
+	return references, nil
+}
+
+// RevokeUserReferences revokes the tokens of users who don't exist, which can't authenticate anyway
+//
+//encore:api private
+func RevokeUserReferences(ctx context.Context, params *RevokeUserReferencesParams) (*UserReferences, error) {
+	eb := errs.B().Meta("userIds", params.UserIds)
+	revoked := &UserReferences{}
+	for _, userId := range params.UserIds {
+		rows, err := sqldb.Query(ctx, `
+			UPDATE user_tokens
+			SET revoked_at = NOW()
+			WHERE user_id = $1
+			  AND revoked_at IS NULL
+			RETURNING id
+		`, userId)
+		if err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msg("revoke user tokens").Err()
+		}
+
+		for rows.Next() {
+			reference := UserReference{Table: "user_tokens", UserId: userId}
+			if err := rows.Scan(&reference.Id); err != nil {
+				rows.Close()
+				return nil, eb.Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+			}
+			revoked.Items = append(revoked.Items, reference)
+		}
+		rows.Close()
+	}
+
+	for _, reference := range revoked.Items {
+		audit.Log(ctx, "user_token.revoke", "user_token", reference.Id, reference, nil)
+	}
+	return revoked, nil
+}
@@ -0,0 +1,127 @@
+// Package authz checks whether the authenticated caller of a request is allowed to do something.
+//
+// Users get a role within each team they belong to, and a few are admins who can do anything.
+// Integrations authenticated with an API key can only create incidents, unless it's an admin key.
+package authz
+
+import (
+	"fmt"
+
+	"encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+type Role string
+
+// Team roles build on each other: a scheduler can also respond to incidents, and everyone can view.
+const (
+	RoleViewer    Role = "viewer"    // read-only stakeholders
+	RoleResponder Role = "responder" // acknowledge and assign the team's incidents
+	RoleScheduler Role = "scheduler" // edit the team's schedules
+)
+
+var Roles = []Role{RoleViewer, RoleResponder, RoleScheduler}
+
+// Principal is implemented by the auth data of a request
+type Principal interface {
+	IsAdmin() bool
+	IsIntegration() bool
+	TeamRoles() map[int]Role
+}
+
+// Includes reports whether a role grants everything the other role does
+func (r Role) Includes(other Role) bool {
+	return r.rank() >= other.rank() && other.rank() > 0
+}
+
+func (r Role) rank() int {
+	for i, role := range Roles {
+		if role == r {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// VerifyRole Helper function for making sure a role is one we know about
+func VerifyRole(role Role) error {
+	if role.rank() == 0 {
+		return errs.B().Meta("role", role).Code(errs.InvalidArgument).Msgf("unknown role %q, expected one of %v", role, Roles).Err()
+	}
+	return nil
+}
+
+// RequireAdmin Helper function for endpoints only admins may use. action describes what is being
+// done, e.g. "manage users", and is used in the error message.
+func RequireAdmin(action string) error {
+	principal, err := current()
+	if err != nil {
+		return err
+	}
+	if principal.IsAdmin() {
+		return nil
+	}
+	return errs.B().Code(errs.PermissionDenied).Msgf("only admins can %s", action).Err()
+}
+
+// RequireTeamRole Helper function making sure the caller has at least the role in one of the teams.
+// With no teams, having the role in any team is enough, e.g. for incidents nobody is assigned to yet.
+func RequireTeamRole(role Role, teamIds []int, action string) error {
+	principal, err := current()
+	if err != nil {
+		return err
+	}
+	if principal.IsAdmin() {
+		return nil
+	}
+	if principal.IsIntegration() {
+		return errs.B().Code(errs.PermissionDenied).Msgf("integrations cannot %s, use a user token or an admin api key", action).Err()
+	}
+
+	for teamId, granted := range principal.TeamRoles() {
+		if !granted.Includes(role) {
+			continue
+		}
+		if len(teamIds) == 0 {
+			return nil
+		}
+		for _, id := range teamIds {
+			if id == teamId {
+				return nil
+			}
+		}
+	}
+
+	if len(teamIds) == 0 {
+		return errs.B().Code(errs.PermissionDenied).Msgf("you need the %s role in a team to %s", role, action).Err()
+	}
+	return errs.B().Meta("teamIds", teamIds).Code(errs.PermissionDenied).Msgf("you need the %s role in %s to %s", role, describeTeams(teamIds), action).Err()
+}
+
+// RequireIntegrationOrTeamRole Helper function for endpoints integrations may use, such as
+// creating incidents, which otherwise need at least the role in any team.
+func RequireIntegrationOrTeamRole(role Role, action string) error {
+	principal, err := current()
+	if err != nil {
+		return err
+	}
+	if principal.IsIntegration() {
+		return nil
+	}
+	return RequireTeamRole(role, nil, action)
+}
+
+func current() (Principal, error) {
+	principal, ok := auth.Data().(Principal)
+	if !ok {
+		return nil, errs.B().Code(errs.Unauthenticated).Msg("not authenticated").Err()
+	}
+	return principal, nil
+}
+
+func describeTeams(teamIds []int) string {
+	if len(teamIds) == 1 {
+		return fmt.Sprintf("team #%d", teamIds[0])
+	}
+	return fmt.Sprintf("one of teams %v", teamIds)
+}
@@ -0,0 +1,24 @@
+package authz
+
+import "testing"
+
+func TestRoleIncludes(t *testing.T) {
+	tests := []struct {
+		role  Role
+		other Role
+		want  bool
+	}{
+		{RoleScheduler, RoleResponder, true},
+		{RoleScheduler, RoleViewer, true},
+		{RoleResponder, RoleResponder, true},
+		{RoleResponder, RoleScheduler, false},
+		{RoleViewer, RoleResponder, false},
+		{Role("owner"), RoleViewer, false},
+		{RoleScheduler, Role("owner"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.role.Includes(tt.other); got != tt.want {
+			t.Errorf("%q.Includes(%q) = %v, want %v", tt.role, tt.other, got, tt.want)
+		}
+	}
+}
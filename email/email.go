@@ -0,0 +1,67 @@
+// Package email sends plain text emails over SMTP, e.g. to status page subscribers. During
+// development a local stand-in such as Mailpit can be used as the SMTP server.
+package email
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+type SendParams struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+//encore:api private
+func Send(ctx context.Context, p *SendParams) error {
+	if err := SendRaw(secrets.SMTPAddr, secrets.SMTPFrom, smtpAuth(), p); err != nil {
+		return errs.B().Code(errs.Unavailable).Cause(err).Msgf("send email: %v", err).Err()
+	}
+	return nil
+}
+
+func SendRaw(addr string, from string, auth smtp.Auth, p *SendParams) error {
+	if addr == "" {
+		return fmt.Errorf("no SMTP server configured")
+	}
+	return smtp.SendMail(addr, auth, from, []string{p.To}, message(from, p))
+}
+
+func message(from string, p *SendParams) []byte {
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", p.To)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", p.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(p.Body, "\n", "\r\n"))
+	message.WriteString("\r\n")
+	return []byte(message.String())
+}
+
+// smtpAuth Helper function returning how to log in to the SMTP server, if at all, e.g. a local
+// stand-in such as Mailpit doesn't need it
+func smtpAuth() smtp.Auth {
+	if secrets.SMTPUsername == "" {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(secrets.SMTPAddr)
+	return smtp.PlainAuth("", secrets.SMTPUsername, secrets.SMTPPassword, host)
+}
+
+var secrets struct {
+	SMTPAddr     string // host:port, e.g. localhost:1025 for Mailpit during development
+	SMTPFrom     string // e.g. oncall@example.com
+	SMTPUsername string // may be empty if the server needs no login
+	SMTPPassword string
+}
@@ -0,0 +1,95 @@
+package email
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSendRaw(t *testing.T) {
+	server := startSMTP(t)
+	err := SendRaw(server.addr, "status@example.com", nil, &SendParams{
+		To:      "jane@example.com",
+		Subject: "Checkout is failing [investigating]",
+		Body:    "Some payments fail\nUnsubscribe: http://localhost:4000/status/subscribers/unsubscribe/abc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := <-server.messages
+	for _, expected := range []string{
+		"MAIL FROM:<status@example.com>",
+		"RCPT TO:<jane@example.com>",
+		"Subject: Checkout is failing [investigating]\r\n",
+		"Some payments fail\r\nUnsubscribe: http://localhost:4000/status/subscribers/unsubscribe/abc\r\n",
+	} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("expected email to contain %q, got %s", expected, message)
+		}
+	}
+
+	if err := SendRaw("", "status@example.com", nil, &SendParams{To: "jane@example.com"}); err == nil {
+		t.Error("expected an error without an SMTP server")
+	}
+}
+
+type smtpServer struct {
+	addr     string
+	messages chan string
+}
+
+// startSMTP is a local stand-in for an SMTP server, accepting a single email
+func startSMTP(t *testing.T) *smtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	server := &smtpServer{addr: listener.Addr().String(), messages: make(chan string, 1)}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var transcript strings.Builder
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case command == "DATA":
+				reply("354 end with .")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 queued")
+			case command == "QUIT":
+				reply("221 bye")
+				server.messages <- transcript.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return server
+}
@@ -3,7 +3,8 @@ module encore.app
 go 1.19
 
 require (
-	encore.dev v1.7.0 // indirect
-	github.com/h2non/parth v0.0.0-20190131123155-b4df798d6542 // indirect
-	gopkg.in/h2non/gock.v1 v1.1.2 // indirect
+	encore.dev v1.7.0
+	gopkg.in/h2non/gock.v1 v1.1.2
 )
+
+require github.com/h2non/parth v0.0.0-20190131123155-b4df798d6542 // indirect
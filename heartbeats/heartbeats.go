@@ -0,0 +1,418 @@
+// Package heartbeats watches jobs which have to run regularly, e.g. the nightly backup. The jobs
+// ping their heartbeat when they succeed, and an incident is created when a ping is overdue, so a
+// job failing silently is noticed too.
+package heartbeats
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/incidents"
+	"encore.app/rules"
+	"encore.app/services"
+	"encore.app/users"
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	StatusNew  = "new" // not pinged yet
+	StatusUp   = "up"
+	StatusDown = "down"
+)
+
+// heartbeatLabel is the label of incidents naming the heartbeat, for the rules to route them
+const heartbeatLabel = "heartbeat"
+
+type Heartbeats struct {
+	Items []Heartbeat
+}
+
+type Heartbeat struct {
+	Id         int
+	Name       string
+	TeamId     int    // the owning team, whose schedulers manage it
+	ServiceId  *int   // the service whose on-call is paged when it is overdue
+	Interval   string // how often the job pings, e.g. 24h
+	Grace      string // how late a ping may be before it is overdue, e.g. 30m
+	Severity   string // of the incident, defaults to the default severity of the rules
+	Status     string // new, up or down
+	LastPingAt *time.Time
+	DueAt      time.Time // when it is overdue without a ping
+	IncidentId *int      // the incident created when it went down
+}
+
+type HeartbeatParams struct {
+	Name      string
+	TeamId    int
+	ServiceId *int
+	Interval  string
+	Grace     string
+	Severity  string
+}
+
+type CreatedHeartbeat struct {
+	Heartbeat Heartbeat
+	Token     string // only returned once, we only store its hash
+	PingURL   string // for the job to POST to
+}
+
+// Create adds a heartbeat monitor. Schedulers can manage the heartbeats of their teams.
+//
+//encore:api auth method=POST path=/heartbeat-monitors
+func Create(ctx context.Context, params *HeartbeatParams) (*CreatedHeartbeat, error) {
+	eb := errs.B().Meta("params", params)
+	if err := authz.RequireTeamRole(authz.RoleScheduler, []int{params.TeamId}, "manage heartbeats"); err != nil {
+		return nil, err
+	}
+	interval, grace, err := VerifyHeartbeat(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(random)
+	heartbeat, err := RowToHeartbeat(sqldb.QueryRow(ctx, `
+		INSERT INTO heartbeats (name, token_hash, team_id, service_id, interval_seconds, grace_seconds, severity, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, name, team_id, service_id, interval_seconds, grace_seconds, severity, status, last_ping_at, created_at, incident_id
+	`, params.Name, hashToken(token), params.TeamId, params.ServiceId, int(interval.Seconds()), int(grace.Seconds()), params.Severity, auth.Actor()))
+	if isUniqueViolation(err) {
+		return nil, eb.Code(errs.AlreadyExists).Cause(err).Msg("heartbeat already exists").Err()
+	}
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert heartbeat").Err()
+	}
+
+	audit.Log(ctx, "heartbeat.create", "heartbeat", heartbeat.Id, nil, heartbeat)
+	return &CreatedHeartbeat{
+		Heartbeat: *heartbeat,
+		Token:     token,
+		PingURL:   encore.Meta().APIBaseURL.JoinPath("heartbeats", token).String(),
+	}, nil
+}
+
+//encore:api public method=GET path=/heartbeat-monitors
+func List(ctx context.Context) (*Heartbeats, error) {
+	return list(ctx, `ORDER BY name ASC`)
+}
+
+//encore:api public method=GET path=/heartbeat-monitors/:id
+func Get(ctx context.Context, id int) (*Heartbeat, error) {
+	eb := errs.B().Meta("heartbeatId", id)
+	heartbeat, err := RowToHeartbeat(sqldb.QueryRow(ctx, `
+		SELECT id, name, team_id, service_id, interval_seconds, grace_seconds, severity, status, last_ping_at, created_at, incident_id
+		FROM heartbeats
+		WHERE id = $1
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no heartbeat found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return heartbeat, nil
+}
+
+//encore:api auth method=PUT path=/heartbeat-monitors/:id
+func Update(ctx context.Context, id int, params *HeartbeatParams) (*Heartbeat, error) {
+	eb := errs.B().Meta("heartbeatId", id, "params", params)
+	before, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authz.RequireTeamRole(authz.RoleScheduler, []int{before.TeamId}, "manage heartbeats"); err != nil {
+		return nil, err
+	}
+	if err := authz.RequireTeamRole(authz.RoleScheduler, []int{params.TeamId}, "hand heartbeats over to a team"); err != nil {
+		return nil, err
+	}
+	interval, grace, err := VerifyHeartbeat(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeat, err := RowToHeartbeat(sqldb.QueryRow(ctx, `
+		UPDATE heartbeats
+		SET name = $1, team_id = $2, service_id = $3, interval_seconds = $4, grace_seconds = $5, severity = $6, updated_by = $7
+		WHERE id = $8
+		RETURNING id, name, team_id, service_id, interval_seconds, grace_seconds, severity, status, last_ping_at, created_at, incident_id
+	`, params.Name, params.TeamId, params.ServiceId, int(interval.Seconds()), int(grace.Seconds()), params.Severity, auth.Actor(), id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no heartbeat found").Err()
+	}
+	if isUniqueViolation(err) {
+		return nil, eb.Code(errs.AlreadyExists).Cause(err).Msg("heartbeat already exists").Err()
+	}
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update heartbeat").Err()
+	}
+
+	audit.Log(ctx, "heartbeat.update", "heartbeat", id, before, heartbeat)
+	return heartbeat, nil
+}
+
+// Delete removes a heartbeat monitor. An incident it created stays open until it's acknowledged.
+//
+//encore:api auth method=DELETE path=/heartbeat-monitors/:id
+func Delete(ctx context.Context, id int) (*Heartbeat, error) {
+	heartbeat, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authz.RequireTeamRole(authz.RoleScheduler, []int{heartbeat.TeamId}, "manage heartbeats"); err != nil {
+		return nil, err
+	}
+	if _, err := sqldb.Exec(ctx, `DELETE FROM heartbeats WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+
+	audit.Log(ctx, "heartbeat.delete", "heartbeat", id, heartbeat, nil)
+	return heartbeat, nil
+}
+
+// Ping is called by the job whenever it succeeded, authenticated by the token in the path. If the
+// heartbeat was down, its incident is resolved.
+//
+//encore:api public method=POST path=/heartbeats/:token
+func Ping(ctx context.Context, token string) error {
+	eb := errs.B()
+	var id int
+	var name, status string
+	var incidentId *int
+	err := sqldb.QueryRow(ctx, `
+		WITH before AS (
+			SELECT id, status, incident_id
+			FROM heartbeats
+			WHERE token_hash = $1
+			FOR UPDATE
+		)
+		UPDATE heartbeats h
+		SET last_ping_at = NOW(), status = 'up', incident_id = NULL
+		FROM before
+		WHERE h.id = before.id
+		RETURNING h.id, h.name, before.status, before.incident_id
+	`, hashToken(token)).Scan(&id, &name, &status, &incidentId)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return eb.Code(errs.NotFound).Msg("no heartbeat found").Err()
+	}
+	if err != nil {
+		return eb.Code(errs.Unavailable).Cause(err).Msg("record ping").Err()
+	}
+
+	if status == StatusDown {
+		rlog.Info("heartbeat is up again", "heartbeat", id)
+		if after, err := Get(ctx, id); err == nil {
+			audit.Log(ctx, "heartbeat.up", "heartbeat", id, nil, after)
+		}
+		if incidentId != nil {
+			resolve(ctx, *incidentId, fmt.Sprintf("heartbeat %q is pinged again", name))
+		}
+	}
+	return nil
+}
+
+var _ = cron.NewJob("check-heartbeats", cron.JobConfig{
+	Title:    "Create incidents for heartbeats which are overdue",
+	Every:    cron.Minute,
+	Endpoint: CheckHeartbeats,
+})
+
+//encore:api private
+func CheckHeartbeats(ctx context.Context) error {
+	heartbeats, err := list(ctx, `WHERE status <> 'down' ORDER BY id ASC`)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, heartbeat := range heartbeats.Items {
+		if now.Before(heartbeat.DueAt) {
+			continue
+		}
+
+		incident, err := incidents.Create(auth.AsSystem(ctx, "heartbeats"), &incidents.CreateParams{
+			Body:      describeOverdue(&heartbeat),
+			Source:    "heartbeat",
+			Severity:  heartbeat.Severity,
+			Labels:    map[string]string{heartbeatLabel: heartbeat.Name},
+			ServiceId: heartbeat.ServiceId,
+		})
+		if err != nil {
+			rlog.Error("FAIL to create incident for overdue heartbeat", "heartbeat", heartbeat.Id, "err", err)
+			continue
+		}
+
+		down, err := markDown(ctx, &heartbeat, incident.Id)
+		if err != nil {
+			// the heartbeat stays up, so it would open another incident next time
+			rlog.Error("FAIL to mark heartbeat as down", "heartbeat", heartbeat.Id, "incident", incident.Id, "err", err)
+			resolve(ctx, incident.Id, fmt.Sprintf("heartbeat %q could not be marked as down", heartbeat.Name))
+			continue
+		}
+		if !down {
+			resolve(ctx, incident.Id, fmt.Sprintf("heartbeat %q is pinged again", heartbeat.Name))
+		}
+	}
+	return nil
+}
+
+// markDown Helper function recording that a heartbeat went down with an incident, returning
+// whether it did. The job may have pinged since the heartbeat was read, e.g. while the incident
+// was created, then it stays up.
+func markDown(ctx context.Context, heartbeat *Heartbeat, incidentId int) (bool, error) {
+	after, err := RowToHeartbeat(sqldb.QueryRow(ctx, `
+		UPDATE heartbeats
+		SET status = 'down', incident_id = $1
+		WHERE id = $2
+		  AND last_ping_at IS NOT DISTINCT FROM $3
+		RETURNING id, name, team_id, service_id, interval_seconds, grace_seconds, severity, status, last_ping_at, created_at, incident_id
+	`, incidentId, heartbeat.Id, heartbeat.LastPingAt))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	audit.Log(ctx, "heartbeat.down", "heartbeat", heartbeat.Id, heartbeat, after)
+	return true, nil
+}
+
+// VerifyHeartbeat Helper function for making sure a heartbeat has a name, durations which can be
+// parsed and a team, service and severity which exist, returning the durations
+func VerifyHeartbeat(ctx context.Context, params *HeartbeatParams) (interval time.Duration, grace time.Duration, err error) {
+	eb := errs.B().Meta("params", params)
+	if len(params.Name) == 0 {
+		return 0, 0, eb.Code(errs.InvalidArgument).Msg("name is empty").Err()
+	}
+	interval, err = time.ParseDuration(params.Interval)
+	if err != nil || interval < time.Minute {
+		return 0, 0, eb.Code(errs.InvalidArgument).Msg("interval is not a duration of at least a minute, e.g. 24h").Err()
+	}
+	grace = 0
+	if params.Grace != "" {
+		grace, err = time.ParseDuration(params.Grace)
+		if err != nil || grace < 0 {
+			return 0, 0, eb.Code(errs.InvalidArgument).Msg("grace is not a duration, e.g. 30m").Err()
+		}
+	}
+	if _, err := users.GetTeam(ctx, params.TeamId); err != nil {
+		return 0, 0, err
+	}
+	if params.ServiceId != nil {
+		if _, err := services.Get(ctx, *params.ServiceId); err != nil {
+			return 0, 0, err
+		}
+	}
+	if params.Severity != "" {
+		if err := rules.VerifySeverity(params.Severity); err != nil {
+			return 0, 0, err
+		}
+	}
+	return interval, grace, nil
+}
+
+// resolve Helper function resolving the incident of a heartbeat, e.g. which is pinged again, unless
+// somebody acknowledged it already
+func resolve(ctx context.Context, incidentId int, reason string) {
+	_, err := incidents.Resolve(ctx, incidentId, &incidents.ResolveParams{Reason: reason})
+	if err != nil && errs.Code(err) != errs.NotFound && errs.Code(err) != errs.FailedPrecondition {
+		rlog.Error("FAIL to resolve incident of heartbeat", "incident", incidentId, "err", err)
+	}
+}
+
+// uniqueViolation is the SQLSTATE of a violated unique constraint, e.g. of the name of a heartbeat
+const uniqueViolation = "23505"
+
+// isUniqueViolation Helper function telling whether the database rejected a heartbeat because
+// another one already has its name
+func isUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return pgErr.SQLState() == uniqueViolation
+	}
+	return strings.Contains(err.Error(), "SQLSTATE "+uniqueViolation)
+}
+
+// describeOverdue Helper function for the body of the incident of an overdue heartbeat
+func describeOverdue(heartbeat *Heartbeat) string {
+	if heartbeat.LastPingAt == nil {
+		return fmt.Sprintf("Heartbeat %q has never been pinged, it's expected every %s", heartbeat.Name, heartbeat.Interval)
+	}
+	return fmt.Sprintf("Heartbeat %q is overdue: the last ping was at %s, it's expected every %s with %s grace", heartbeat.Name, heartbeat.LastPingAt.UTC().Format(time.RFC1123), heartbeat.Interval, heartbeat.Grace)
+}
+
+func list(ctx context.Context, where string) (*Heartbeats, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, name, team_id, service_id, interval_seconds, grace_seconds, severity, status, last_ping_at, created_at, incident_id
+		FROM heartbeats
+	`+where)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var heartbeats []Heartbeat
+	for rows.Next() {
+		heartbeat, err := RowToHeartbeat(rows)
+		if err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		heartbeats = append(heartbeats, *heartbeat)
+	}
+	return &Heartbeats{Items: heartbeats}, nil
+}
+
+// hashToken Helper function for the value we store instead of the token itself
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// dueAt Helper function returning when a heartbeat is overdue: an interval and the grace period
+// after the last ping, or after it was created if it hasn't been pinged yet
+func dueAt(lastPingAt *time.Time, createdAt time.Time, interval time.Duration, grace time.Duration) time.Time {
+	since := createdAt
+	if lastPingAt != nil {
+		since = *lastPingAt
+	}
+	return since.Add(interval + grace)
+}
+
+// RowToHeartbeat Helper function from Row to Heartbeat
+func RowToHeartbeat(row interface {
+	Scan(dest ...interface{}) error
+}) (*Heartbeat, error) {
+	var heartbeat = &Heartbeat{}
+	var intervalSeconds, graceSeconds int
+	var createdAt time.Time
+	err := row.Scan(&heartbeat.Id, &heartbeat.Name, &heartbeat.TeamId, &heartbeat.ServiceId, &intervalSeconds, &graceSeconds, &heartbeat.Severity, &heartbeat.Status, &heartbeat.LastPingAt, &createdAt, &heartbeat.IncidentId)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(intervalSeconds) * time.Second
+	grace := time.Duration(graceSeconds) * time.Second
+	heartbeat.Interval = interval.String()
+	heartbeat.Grace = grace.String()
+	heartbeat.DueAt = dueAt(heartbeat.LastPingAt, createdAt, interval, grace)
+	return heartbeat, nil
+}
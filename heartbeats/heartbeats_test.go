@@ -0,0 +1,199 @@
+package heartbeats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/incidents"
+	"encore.app/users"
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+func TestDueAt(t *testing.T) {
+	createdAt := time.Date(2024, 3, 1, 2, 0, 0, 0, time.UTC)
+	if due := dueAt(nil, createdAt, 24*time.Hour, 30*time.Minute); !due.Equal(time.Date(2024, 3, 2, 2, 30, 0, 0, time.UTC)) {
+		t.Fatalf("expected a heartbeat which was never pinged to be due a day and the grace after it was created, got %v", due)
+	}
+	lastPingAt := time.Date(2024, 3, 5, 3, 12, 0, 0, time.UTC)
+	if due := dueAt(&lastPingAt, createdAt, 24*time.Hour, 30*time.Minute); !due.Equal(time.Date(2024, 3, 6, 3, 42, 0, 0, time.UTC)) {
+		t.Fatalf("expected a heartbeat to be due a day and the grace after the last ping, got %v", due)
+	}
+}
+
+func TestDescribeOverdue(t *testing.T) {
+	heartbeat := &Heartbeat{Name: "nightly-backup", Interval: "24h0m0s", Grace: "30m0s"}
+	if text := describeOverdue(heartbeat); text != `Heartbeat "nightly-backup" has never been pinged, it's expected every 24h0m0s` {
+		t.Fatalf("unexpected description: %q", text)
+	}
+	lastPingAt := time.Date(2024, 3, 5, 3, 12, 0, 0, time.UTC)
+	heartbeat.LastPingAt = &lastPingAt
+	if text := describeOverdue(heartbeat); text != `Heartbeat "nightly-backup" is overdue: the last ping was at Tue, 05 Mar 2024 03:12:00 UTC, it's expected every 24h0m0s with 30m0s grace` {
+		t.Fatalf("unexpected description: %q", text)
+	}
+}
+
+// authenticated is the context of a request made with an admin API key, as mutating endpoints require auth
+type sqlStateError struct {
+	code string
+}
+
+func (e *sqlStateError) Error() string    { return "ERROR: database error (SQLSTATE " + e.code + ")" }
+func (e *sqlStateError) SQLState() string { return e.code }
+
+func TestIsUniqueViolation(t *testing.T) {
+	if !isUniqueViolation(fmt.Errorf("insert: %w", &sqlStateError{code: uniqueViolation})) {
+		t.Error("expected a wrapped unique violation to be detected")
+	}
+	if isUniqueViolation(&sqlStateError{code: "08006"}) {
+		t.Error("expected a connection failure not to be a unique violation")
+	}
+	if !isUniqueViolation(errors.New(`ERROR: duplicate key value violates unique constraint "heartbeats_name_index" (SQLSTATE 23505)`)) {
+		t.Error("expected a unique violation to be detected by its message")
+	}
+	if isUniqueViolation(nil) {
+		t.Error("expected no error not to be a unique violation")
+	}
+}
+
+func authenticated() context.Context {
+	apiKeyId := 1
+	return encoreauth.WithContext(context.Background(), "apikey:1", &auth.Data{APIKeyId: &apiKeyId, Name: "test", Admin: true})
+}
+
+// createOverdue Helper function creating a heartbeat which was due a minute ago
+func createOverdue(t *testing.T) *CreatedHeartbeat {
+	ctx := authenticated()
+	name := "nightly-backup " + time.Now().Format(time.RFC3339Nano)
+	team, err := users.CreateTeam(ctx, &users.CreateTeamParams{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := Create(ctx, &HeartbeatParams{Name: name, TeamId: team.Id, Interval: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqldb.Exec(ctx, `UPDATE heartbeats SET created_at = NOW() - INTERVAL '2 minutes' WHERE id = $1`, created.Heartbeat.Id); err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+func TestCreateHeartbeatOfUnknownTeamIsRejected(t *testing.T) {
+	_, err := Create(authenticated(), &HeartbeatParams{Name: "orphan " + time.Now().Format(time.RFC3339Nano), TeamId: 2147483000, Interval: "1h"})
+	if err == nil {
+		t.Error("expected a heartbeat of a team which doesn't exist to be rejected")
+	}
+}
+
+func TestCheckHeartbeats(t *testing.T) {
+	ctx := authenticated()
+	created := createOverdue(t)
+
+	if err := CheckHeartbeats(ctx); err != nil {
+		t.Fatal(err)
+	}
+	heartbeat, err := Get(ctx, created.Heartbeat.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat.Status != StatusDown || heartbeat.IncidentId == nil {
+		t.Fatalf("expected the overdue heartbeat to be down with an incident, got %+v", heartbeat)
+	}
+	incident, err := incidents.GetById(ctx, *heartbeat.IncidentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(incident.Body, heartbeat.Name) || incident.Acknowledged {
+		t.Errorf("expected an open incident about the heartbeat, got %+v", incident)
+	}
+
+	// the audit log has the heartbeat after it went down
+	history, err := audit.History(ctx, &audit.HistoryParams{EntityType: "heartbeat", EntityId: strconv.Itoa(heartbeat.Id)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := history.Items[len(history.Items)-1]
+	var after Heartbeat
+	if err := json.Unmarshal(last.After, &after); err != nil {
+		t.Fatal(err)
+	}
+	if last.Action != "heartbeat.down" || after.Status != StatusDown {
+		t.Errorf("expected the heartbeat going down to be audited, got %s %+v", last.Action, after)
+	}
+
+	// checking again doesn't create another incident
+	if err := CheckHeartbeats(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := Get(ctx, heartbeat.Id); err != nil || *again.IncidentId != *heartbeat.IncidentId {
+		t.Errorf("expected the heartbeat to keep its incident, got %+v %v", again, err)
+	}
+
+	if err := Ping(context.Background(), created.Token); err != nil {
+		t.Fatal(err)
+	}
+	up, err := Get(ctx, heartbeat.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Status != StatusUp || up.IncidentId != nil {
+		t.Errorf("expected the pinged heartbeat to be up, got %+v", up)
+	}
+	// only open incidents are found, a resolved one is acknowledged
+	if open, err := incidents.GetById(ctx, incident.Id); errs.Code(err) != errs.NotFound {
+		t.Errorf("expected the incident to be resolved, got %+v %v", open, err)
+	}
+}
+
+func TestCheckHeartbeatsLeavesHeartbeatsWhichAreNotDue(t *testing.T) {
+	ctx := authenticated()
+	team, err := users.CreateTeam(ctx, &users.CreateTeamParams{Name: "hourly-export " + time.Now().Format(time.RFC3339Nano)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := Create(ctx, &HeartbeatParams{Name: team.Name, TeamId: team.Id, Interval: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckHeartbeats(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat, err := Get(ctx, created.Heartbeat.Id); err != nil || heartbeat.Status != StatusNew {
+		t.Errorf("expected the heartbeat to stay new, got %+v %v", heartbeat, err)
+	}
+}
+
+func TestPingWhileCheckingKeepsHeartbeatUp(t *testing.T) {
+	ctx := authenticated()
+	created := createOverdue(t)
+	// read by the check before the job pinged
+	stale, err := Get(ctx, created.Heartbeat.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Ping(context.Background(), created.Token); err != nil {
+		t.Fatal(err)
+	}
+	down, err := markDown(ctx, stale, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if down {
+		t.Error("expected a heartbeat pinged during the check not to go down")
+	}
+	if heartbeat, err := Get(ctx, stale.Id); err != nil || heartbeat.Status != StatusUp || heartbeat.IncidentId != nil {
+		t.Errorf("expected the heartbeat to stay up, got %+v %v", heartbeat, err)
+	}
+}
@@ -0,0 +1,20 @@
+CREATE TABLE heartbeats
+(
+    id               BIGSERIAL PRIMARY KEY,
+    name             VARCHAR(255) NOT NULL,
+    token_hash       VARCHAR(64)  NOT NULL, -- the token itself is only returned once
+    team_id          BIGINT       NOT NULL, -- the owning team
+    service_id       BIGINT,                -- incidents are paged to its on-call
+    interval_seconds INT          NOT NULL CHECK (interval_seconds > 0),
+    grace_seconds    INT          NOT NULL CHECK (grace_seconds >= 0),
+    severity         VARCHAR(8)   NOT NULL DEFAULT '',
+    status           VARCHAR(8)   NOT NULL DEFAULT 'new', -- new, up or down
+    last_ping_at     TIMESTAMPTZ,
+    incident_id      BIGINT,                -- the incident created when it went down
+    created_by       VARCHAR(255),
+    updated_by       VARCHAR(255),
+    created_at       TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX heartbeats_token_hash_index ON heartbeats (token_hash);
+CREATE UNIQUE INDEX heartbeats_name_index ON heartbeats (LOWER(name));
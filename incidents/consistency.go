@@ -0,0 +1,197 @@
+package incidents
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/schedules"
+	"encore.app/slack"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// DanglingReference is a row in one of the services' databases pointing at a user who doesn't
+// exist. Each service has its own database, so there are no foreign keys to prevent them.
+type DanglingReference struct {
+	Service string
+	Table   string
+	Id      int
+	UserId  int
+}
+
+type ConsistencyReport struct {
+	Items    []DanglingReference
+	Repaired bool
+}
+
+type CheckConsistencyParams struct {
+	// Repair unassigns open incidents, removes responders and roles from open incidents, and deletes
+	// action items, schedules and rotations of users who don't exist, and revokes their tokens.
+	// Unassigned open incidents are then assigned to whoever is on call.
+	Repair bool
+}
+
+// CheckConsistency lives here because incidents is the only service which depends on all others
+//
+//encore:api auth method=POST path=/consistency
+func CheckConsistency(ctx context.Context, params *CheckConsistencyParams) (*ConsistencyReport, error) {
+	if err := authz.RequireAdmin("check consistency"); err != nil {
+		return nil, err
+	}
+	return checkConsistency(ctx, params.Repair)
+}
+
+var _ = cron.NewJob("consistency-check", cron.JobConfig{
+	Title:    "Notify on Slack about references to users who don't exist",
+	Every:    24 * cron.Hour,
+	Endpoint: ReportInconsistencies,
+})
+
+//encore:api private
+func ReportInconsistencies(ctx context.Context) error {
+	report, err := checkConsistency(ctx, false)
+	if err != nil {
+		return err
+	}
+	if len(report.Items) == 0 {
+		return nil
+	}
+
+	var items = []string{"These rows point at users who don't exist. Please repair them with POST /consistency:"}
+	for _, reference := range report.Items {
+		items = append(items, fmt.Sprintf("[%s] %s #%d -> user #%d", reference.Service, reference.Table, reference.Id, reference.UserId))
+	}
+	rlog.Error("dangling user references", "count", len(report.Items))
+	_ = slack.Notify(ctx, &slack.NotifyParams{Text: strings.Join(items, "\n")})
+	return nil
+}
+
+func checkConsistency(ctx context.Context, repair bool) (*ConsistencyReport, error) {
+	eb := errs.B().Meta("repair", repair)
+	everyone, err := users.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[int]bool)
+	for _, user := range everyone.Items {
+		exists[user.Id] = true
+	}
+
+	report := &ConsistencyReport{Repaired: repair}
+	missing := make(map[int]bool)
+
+	scheduleReferences, err := schedules.ListUserReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, reference := range scheduleReferences.Items {
+		if !exists[reference.UserId] {
+			missing[reference.UserId] = true
+			report.Items = append(report.Items, DanglingReference{Service: "schedules", Table: reference.Table, Id: reference.Id, UserId: reference.UserId})
+		}
+	}
+
+	tokenReferences, err := auth.ListUserReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, reference := range tokenReferences.Items {
+		if !exists[reference.UserId] {
+			missing[reference.UserId] = true
+			report.Items = append(report.Items, DanglingReference{Service: "auth", Table: reference.Table, Id: reference.Id, UserId: reference.UserId})
+		}
+	}
+
+	// not using RowsToIncidents, which fails on the very rows we are looking for. Responders and
+	// roles have no id of their own, so they are reported with the id of their incident.
+	rows, err := sqldb.Query(ctx, `
+		SELECT 'incidents', id, assigned_user_id FROM incidents WHERE assigned_user_id IS NOT NULL
+		UNION ALL
+		SELECT 'responders', incident_id, user_id FROM responders
+		UNION ALL
+		SELECT 'roles', incident_id, user_id FROM roles
+		UNION ALL
+		SELECT 'action_items', id, owner_id FROM action_items
+		ORDER BY 1, 2
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		reference := DanglingReference{Service: "incidents"}
+		if err := rows.Scan(&reference.Table, &reference.Id, &reference.UserId); err != nil {
+			rows.Close()
+			return nil, eb.Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		if !exists[reference.UserId] {
+			report.Items = append(report.Items, reference)
+		}
+	}
+	rows.Close()
+
+	if !repair {
+		return report, nil
+	}
+
+	var userIds []int
+	for userId := range missing {
+		userIds = append(userIds, userId)
+	}
+	if len(userIds) > 0 {
+		if _, err := schedules.RemoveUserReferences(ctx, &schedules.RemoveUserReferencesParams{UserIds: userIds}); err != nil {
+			return nil, err
+		}
+		if _, err := auth.RevokeUserReferences(ctx, &auth.RevokeUserReferencesParams{UserIds: userIds}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, reference := range report.Items {
+		if reference.Service != "incidents" {
+			continue
+		}
+		if err := repairReference(ctx, reference); err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msgf("repair %s #%d", reference.Table, reference.Id).Err()
+		}
+	}
+
+	return report, nil
+}
+
+// repairReference Helper function removing a user who doesn't exist from an incident. Acknowledged
+// incidents are history, so only open incidents are unassigned and lose the responders and roles.
+// Action items can't be handed to anyone else, so they are deleted, with the audit log keeping them.
+func repairReference(ctx context.Context, reference DanglingReference) error {
+	var query, action, entityType string
+	switch reference.Table {
+	case "incidents":
+		query = `UPDATE incidents SET assigned_user_id = NULL WHERE id = $1 AND assigned_user_id = $2 AND acknowledged_at IS NULL`
+		action, entityType = "incident.unassign", "incident"
+	case "responders":
+		query = `DELETE FROM responders WHERE incident_id = $1 AND user_id = $2 AND incident_id IN (SELECT id FROM incidents WHERE acknowledged_at IS NULL)`
+		action, entityType = "incident.remove_responder", "incident"
+	case "roles":
+		query = `DELETE FROM roles WHERE incident_id = $1 AND user_id = $2 AND incident_id IN (SELECT id FROM incidents WHERE acknowledged_at IS NULL)`
+		action, entityType = "incident.remove_role", "incident"
+	case "action_items":
+		query = `DELETE FROM action_items WHERE id = $1 AND owner_id = $2`
+		action, entityType = "action_item.delete", "action_item"
+	default:
+		return nil
+	}
+	result, err := sqldb.Exec(ctx, query, reference.Id, reference.UserId)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() > 0 {
+		audit.Log(ctx, action, entityType, reference.Id, reference, nil)
+	}
+	return nil
+}
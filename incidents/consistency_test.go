@@ -0,0 +1,174 @@
+package incidents
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"encore.app/audit"
+	"encore.dev/storage/sqldb"
+)
+
+// missingUserId is never handed out by the users service
+const missingUserId = 2147483000
+
+func TestCheckConsistencyFindsAndRepairsDanglingAssignees(t *testing.T) {
+	ctx := context.Background()
+	user := createUser(t)
+
+	// suppressed, so listing the open incidents meanwhile doesn't trip over the missing assignee
+	var openId, acknowledgedId, assignedId int
+	err := sqldb.QueryRow(ctx, `
+		INSERT INTO incidents (assigned_user_id, body, suppressed) VALUES ($1, 'open and assigned to nobody', TRUE) RETURNING id
+	`, missingUserId).Scan(&openId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqldb.QueryRow(ctx, `
+		INSERT INTO incidents (assigned_user_id, body, acknowledged_at) VALUES ($1, 'assigned to nobody', NOW()) RETURNING id
+	`, missingUserId).Scan(&acknowledgedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqldb.QueryRow(ctx, `
+		INSERT INTO incidents (assigned_user_id, body, acknowledged_at) VALUES ($1, 'assigned to someone', NOW()) RETURNING id
+	`, user.Id).Scan(&assignedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := CheckConsistency(authenticated(), &CheckConsistencyParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []DanglingReference{
+		{Service: "incidents", Table: "incidents", Id: openId, UserId: missingUserId},
+		{Service: "incidents", Table: "incidents", Id: acknowledgedId, UserId: missingUserId},
+	} {
+		if !reported(report, expected) {
+			t.Fatalf("expected %v to be reported, got %v", expected, report.Items)
+		}
+	}
+	for _, reference := range report.Items {
+		if reference.Id == assignedId && reference.Table == "incidents" {
+			t.Errorf("expected incident #%d of an existing user not to be reported", assignedId)
+		}
+	}
+
+	// checking alone doesn't change anything
+	if assignee := assigneeOf(t, openId); assignee == nil {
+		t.Fatal("expected the check without repair to keep the assignee")
+	}
+
+	if _, err := CheckConsistency(authenticated(), &CheckConsistencyParams{Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	if assignee := assigneeOf(t, openId); assignee != nil {
+		t.Errorf("expected open incident #%d to be unassigned, got user #%d", openId, *assignee)
+	}
+	if assignee := assigneeOf(t, acknowledgedId); assignee == nil || *assignee != missingUserId {
+		t.Errorf("expected acknowledged incident #%d to be left as it was, got %v", acknowledgedId, assignee)
+	}
+	if assignee := assigneeOf(t, assignedId); assignee == nil || *assignee != user.Id {
+		t.Errorf("expected incident #%d to stay assigned to user #%d", assignedId, user.Id)
+	}
+
+	history, err := audit.History(ctx, &audit.HistoryParams{EntityType: "incident", EntityId: strconv.Itoa(openId)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Items) == 0 || history.Items[len(history.Items)-1].Action != "incident.unassign" {
+		t.Errorf("expected the repair to be audited, got %v", history.Items)
+	}
+}
+
+func TestCheckConsistencyFindsAndRepairsDanglingRespondersRolesAndActionItems(t *testing.T) {
+	ctx := context.Background()
+	var openId, acknowledgedId, postmortemId, actionItemId int
+	err := sqldb.QueryRow(ctx, `INSERT INTO incidents (body, suppressed) VALUES ('open with a missing responder', TRUE) RETURNING id`).Scan(&openId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqldb.QueryRow(ctx, `INSERT INTO incidents (body, acknowledged_at) VALUES ('acknowledged with a missing responder', NOW()) RETURNING id`).Scan(&acknowledgedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{openId, acknowledgedId} {
+		if _, err := sqldb.Exec(ctx, `INSERT INTO responders (incident_id, user_id) VALUES ($1, $2)`, id, missingUserId); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sqldb.Exec(ctx, `INSERT INTO roles (incident_id, role, user_id) VALUES ($1, 'scribe', $2)`, id, missingUserId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sqldb.QueryRow(ctx, `INSERT INTO postmortems (incident_id, body) VALUES ($1, 'draft') RETURNING id`, acknowledgedId).Scan(&postmortemId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqldb.QueryRow(ctx, `
+		INSERT INTO action_items (postmortem_id, title, owner_id, due_date) VALUES ($1, 'add an alert', $2, CURRENT_DATE) RETURNING id
+	`, postmortemId, missingUserId).Scan(&actionItemId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := CheckConsistency(authenticated(), &CheckConsistencyParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []DanglingReference{
+		{Service: "incidents", Table: "responders", Id: openId, UserId: missingUserId},
+		{Service: "incidents", Table: "roles", Id: acknowledgedId, UserId: missingUserId},
+		{Service: "incidents", Table: "action_items", Id: actionItemId, UserId: missingUserId},
+	} {
+		if !reported(report, expected) {
+			t.Errorf("expected %v to be reported, got %v", expected, report.Items)
+		}
+	}
+
+	if _, err := CheckConsistency(authenticated(), &CheckConsistencyParams{Repair: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		query    string
+		id       int
+		expected int
+	}{
+		{`SELECT COUNT(*) FROM responders WHERE incident_id = $1`, openId, 0},
+		{`SELECT COUNT(*) FROM roles WHERE incident_id = $1`, openId, 0},
+		{`SELECT COUNT(*) FROM responders WHERE incident_id = $1`, acknowledgedId, 1},
+		{`SELECT COUNT(*) FROM roles WHERE incident_id = $1`, acknowledgedId, 1},
+		{`SELECT COUNT(*) FROM action_items WHERE id = $1`, actionItemId, 0},
+	} {
+		var count int
+		if err := sqldb.QueryRow(ctx, test.query, test.id).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != test.expected {
+			t.Errorf("expected %q of #%d to count %d, got %d", test.query, test.id, test.expected, count)
+		}
+	}
+}
+
+func reported(report *ConsistencyReport, expected DanglingReference) bool {
+	for _, reference := range report.Items {
+		if reference == expected {
+			return true
+		}
+	}
+	return false
+}
+
+func assigneeOf(t *testing.T, id int) *int {
+	var assignee *int
+	if err := sqldb.QueryRow(context.Background(), `SELECT assigned_user_id FROM incidents WHERE id = $1`, id).Scan(&assignee); err != nil {
+		t.Fatal(err)
+	}
+	return assignee
+}
+
+func TestCheckConsistencyRequiresAdmin(t *testing.T) {
+	if _, err := CheckConsistency(context.Background(), &CheckConsistencyParams{}); err == nil {
+		t.Fatal("expected checking consistency to require an admin")
+	}
+}
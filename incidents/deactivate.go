@@ -0,0 +1,190 @@
+package incidents
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/schedules"
+	"encore.app/slack"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type DeactivateUserParams struct {
+	// ReassignTo takes over the user's upcoming shifts, rotations and open incidents. Without it,
+	// users who still have any of them can't be deactivated, unless they are released.
+	ReassignTo *int
+	// Release deactivates the user even though nobody takes over, e.g. when their identity
+	// provider deprovisions them. Their upcoming shifts and rotations are removed, their open
+	// incidents are unassigned so they go to whoever is on call, and Slack is asked to cover
+	// the shifts.
+	Release bool
+}
+
+type DeactivatedUser struct {
+	User      users.User
+	Schedules []schedules.Schedule // shifts handed over to ReassignTo, or released
+	Incidents []Incident           // incidents handed over to ReassignTo, or unassigned
+}
+
+// DeactivateUser lives here rather than in the users service, because it is the only service
+// which knows about both a user's shifts and their incidents. Past incidents and shifts keep
+// pointing at the deactivated user.
+//
+// The services can't share a transaction, so every step only hands over what is still left and
+// the user is deactivated last. A request which fails half-way can be retried to finish, also for
+// a user who was deactivated while they still had shifts or incidents.
+//
+//encore:api auth method=POST path=/users/:userId/deactivate
+func DeactivateUser(ctx context.Context, userId int, params *DeactivateUserParams) (*DeactivatedUser, error) {
+	eb := errs.B().Meta("userId", userId, "params", params)
+	if err := authz.RequireAdmin("deactivate users"); err != nil {
+		return nil, err
+	}
+	user, err := users.Get(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	upcoming, err := schedules.ListUpcomingByUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	open, err := openByAssignee(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	// check everything before handing anything over, so we don't stop half-way
+	handover := len(upcoming.Items) > 0 || len(open.Items) > 0
+	if params.ReassignTo != nil && params.Release {
+		return nil, eb.Code(errs.InvalidArgument).Msg("set either ReassignTo or Release").Err()
+	}
+	if handover && params.ReassignTo == nil && !params.Release {
+		return nil, eb.Code(errs.FailedPrecondition).Msgf("user still has %d upcoming shifts and %d open incidents, set ReassignTo to hand them over or Release to give them up", len(upcoming.Items), len(open.Items)).Err()
+	}
+	if !handover && user.DeactivatedAt != nil {
+		return nil, eb.Code(errs.FailedPrecondition).Msg("user is already deactivated").Err()
+	}
+	if params.ReassignTo != nil {
+		if *params.ReassignTo == userId {
+			return nil, eb.Code(errs.InvalidArgument).Msg("cannot hand over to the user being deactivated").Err()
+		}
+		if _, err := users.GetAssignable(ctx, *params.ReassignTo); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &DeactivatedUser{User: *user}
+	if params.ReassignTo != nil {
+		reassigned, err := schedules.ReassignUser(ctx, userId, &schedules.ReassignParams{ToUserId: *params.ReassignTo})
+		if err != nil {
+			return nil, err
+		}
+		result.Schedules = reassigned.Items
+	}
+	if params.Release {
+		released, err := schedules.ReleaseUser(ctx, userId)
+		if err != nil {
+			return nil, err
+		}
+		result.Schedules = released.Items
+	}
+	for _, incident := range open.Items {
+		var handedOver *Incident
+		if params.Release {
+			handedOver, err = unassign(ctx, incident.Id, userId)
+		} else {
+			handedOver, err = assign(ctx, incident.Id, *params.ReassignTo)
+		}
+		if errs.Code(err) == errs.NotFound {
+			continue // acknowledged in the meantime
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Incidents = append(result.Incidents, *handedOver)
+	}
+
+	if user.DeactivatedAt == nil {
+		deactivated, err := users.Deactivate(ctx, userId)
+		if err != nil {
+			return nil, err
+		}
+		result.User = *deactivated
+	}
+	if params.Release && handover {
+		_ = slack.Notify(ctx, &slack.NotifyParams{Text: describeRelease(&result.User, result.Schedules, result.Incidents)})
+	}
+	return result, nil
+}
+
+// unassign Helper function taking an open incident away from a user, so it is assigned to whoever
+// is on call
+func unassign(ctx context.Context, id int, userId int) (*Incident, error) {
+	eb := errs.B().Meta("id", id, "userId", userId)
+	before, _ := getOpenIncident(ctx, id)
+	rows, err := sqldb.Query(ctx, `
+		UPDATE incidents
+		SET assigned_user_id = NULL, assigned_by = $1
+		WHERE acknowledged_at IS NULL
+		  AND assigned_user_id = $2
+		  AND id = $3
+		RETURNING id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+	`, auth.Actor(), userId, id)
+	if err != nil {
+		return nil, err
+	}
+
+	incidents, err := RowsToIncidents(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	if incidents.Items == nil {
+		return nil, eb.Code(errs.NotFound).Msg("no incident found").Err()
+	}
+
+	incident := &incidents.Items[0]
+	audit.Log(ctx, "incident.unassign", "incident", incident.Id, before, incident)
+	return incident, nil
+}
+
+// describeRelease Helper function asking on Slack for someone to cover the shifts of a user who
+// was deactivated without handing them over
+func describeRelease(user *users.User, released []schedules.Schedule, unassigned []Incident) string {
+	lines := []string{fmt.Sprintf("%s %s was deactivated without anyone taking over.", user.FirstName, user.LastName)}
+	if len(unassigned) > 0 {
+		lines = append(lines, fmt.Sprintf("%d open incidents were unassigned and go to whoever is on call.", len(unassigned)))
+	}
+	if len(released) > 0 {
+		lines = append(lines, "These shifts need someone to cover them:")
+		for _, schedule := range released {
+			start := schedule.Time.Start
+			if start.Before(time.Now()) {
+				start = time.Now()
+			}
+			lines = append(lines, fmt.Sprintf("• %s from %s to %s", schedule.Layer, start.UTC().Format(time.RFC1123), schedule.Time.End.UTC().Format(time.RFC1123)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// openByAssignee Helper function returning the open incidents assigned to a user
+func openByAssignee(ctx context.Context, userId int) (*Incidents, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+		FROM incidents
+		WHERE acknowledged_at IS NULL
+		  AND assigned_user_id = $1
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+	return RowsToIncidents(ctx, rows)
+}
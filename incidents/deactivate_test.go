@@ -0,0 +1,152 @@
+package incidents
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"encore.app/authz"
+	"encore.app/schedules"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+)
+
+func TestDeactivateUserWithShiftsNeedsHandover(t *testing.T) {
+	user := createUser(t)
+	createSchedule(t, user, time.Now().AddDate(20, 0, 0))
+
+	_, err := DeactivateUser(authenticated(), user.Id, &DeactivateUserParams{})
+	if errs.Code(err) != errs.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition, got %v", err)
+	}
+	if _, err := users.GetAssignable(context.Background(), user.Id); err != nil {
+		t.Fatalf("expected the user to stay active, got %v", err)
+	}
+}
+
+func TestDeactivateUserHandsOverShifts(t *testing.T) {
+	user := createUser(t)
+	other := createUser(t)
+	schedule := createSchedule(t, user, time.Now().AddDate(21, 0, 0))
+
+	deactivated, err := DeactivateUser(authenticated(), user.Id, &DeactivateUserParams{ReassignTo: &other.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deactivated.User.DeactivatedAt == nil {
+		t.Error("expected the user to be deactivated")
+	}
+	if len(deactivated.Schedules) != 1 || deactivated.Schedules[0].User.Id != other.Id {
+		t.Fatalf("expected schedule #%d to be handed to user #%d, got %v", schedule.Id, other.Id, deactivated.Schedules)
+	}
+
+	// nothing is left to finish
+	_, err = DeactivateUser(authenticated(), user.Id, &DeactivateUserParams{ReassignTo: &other.Id})
+	if errs.Code(err) != errs.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition for a user who is already deactivated, got %v", err)
+	}
+}
+
+func TestDeactivateUserFinishesHandoverOfDeactivatedUser(t *testing.T) {
+	user := createUser(t)
+	other := createUser(t)
+	schedule := createSchedule(t, user, time.Now().AddDate(22, 0, 0))
+	if _, err := users.Deactivate(authenticated(), user.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	deactivated, err := DeactivateUser(authenticated(), user.Id, &DeactivateUserParams{ReassignTo: &other.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deactivated.Schedules) != 1 {
+		t.Fatalf("expected schedule #%d to be handed over, got %v", schedule.Id, deactivated.Schedules)
+	}
+	got, err := schedules.Get(context.Background(), schedule.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.User.Id != other.Id {
+		t.Errorf("expected schedule #%d to belong to user #%d, got #%d", schedule.Id, other.Id, got.User.Id)
+	}
+}
+
+func TestDeactivateUserCannotHandOverToThemselves(t *testing.T) {
+	user := createUser(t)
+	createSchedule(t, user, time.Now().AddDate(23, 0, 0))
+
+	_, err := DeactivateUser(authenticated(), user.Id, &DeactivateUserParams{ReassignTo: &user.Id})
+	if errs.Code(err) != errs.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestDeactivateUserReleasesShiftsAndIncidents(t *testing.T) {
+	user := createUser(t)
+	schedule := createSchedule(t, user, time.Now().AddDate(24, 0, 0))
+	incident, err := Create(authenticated(), &CreateParams{Body: "Released with its assignee"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := assign(authenticated(), incident.Id, user.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	deactivated, err := DeactivateUser(authenticated(), user.Id, &DeactivateUserParams{Release: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deactivated.User.DeactivatedAt == nil {
+		t.Error("expected the user to be deactivated")
+	}
+	if len(deactivated.Schedules) != 1 || deactivated.Schedules[0].Id != schedule.Id {
+		t.Errorf("expected schedule #%d to be released, got %v", schedule.Id, deactivated.Schedules)
+	}
+	if _, err := schedules.Get(context.Background(), schedule.Id); errs.Code(err) != errs.NotFound {
+		t.Errorf("expected the released schedule to be removed, got %v", err)
+	}
+	if len(deactivated.Incidents) != 1 || deactivated.Incidents[0].Assignee != nil {
+		t.Errorf("expected incident #%d to be unassigned, got %v", incident.Id, deactivated.Incidents)
+	}
+}
+
+func TestDeactivateUserCannotReassignAndRelease(t *testing.T) {
+	user := createUser(t)
+	other := createUser(t)
+	_, err := DeactivateUser(authenticated(), user.Id, &DeactivateUserParams{ReassignTo: &other.Id, Release: true})
+	if errs.Code(err) != errs.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestDeactivateUserCannotHandOverTeamShiftsToOutsiders(t *testing.T) {
+	user := createUser(t)
+	outsider := createUser(t)
+	team, err := users.CreateTeam(authenticated(), &users.CreateTeamParams{Name: "handover " + time.Now().Format(time.RFC3339Nano)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.AddMember(authenticated(), team.Id, &users.AddMemberParams{UserId: user.Id, Role: authz.RoleResponder}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().AddDate(25, 0, 0)
+	schedule, err := schedules.Create(authenticated(), user.Id, &schedules.CreateParams{Start: start, End: start.Add(time.Hour), TeamId: &team.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = DeactivateUser(authenticated(), user.Id, &DeactivateUserParams{ReassignTo: &outsider.Id})
+	if errs.Code(err) != errs.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	got, err := schedules.Get(context.Background(), schedule.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.User.Id != user.Id {
+		t.Errorf("expected schedule #%d to stay with user #%d, got #%d", schedule.Id, user.Id, got.User.Id)
+	}
+	if _, err := users.GetAssignable(context.Background(), user.Id); err != nil {
+		t.Fatalf("expected the user to stay active, got %v", err)
+	}
+}
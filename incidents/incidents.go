@@ -2,7 +2,14 @@ package incidents
 
 import (
 	"context"
+	"encoding/json"
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/maintenance"
+	"encore.app/rules"
 	"encore.app/schedules"
+	"encore.app/services"
 	"encore.app/slack"
 	"encore.app/users"
 	"encore.dev/beta/errs"
@@ -25,14 +32,67 @@ type Incident struct {
 	Acknowledged   bool
 	AcknowledgedAt *time.Time
 	Assignee       *users.User
+	Source         string
+	Severity       string
+	Labels         map[string]string
+	TeamId         *int // the team the rules routed the incident to
+	Tags           []string
+	Suppressed     bool // by a rule or maintenance window, stored but nobody is assigned or notified
+	SnoozedUntil   *time.Time
+	ServiceId      *int
+	Roles          []RoleAssignment // e.g. the commander of a major incident, besides the assignee
+	Responders     []Responder      // people paged into the incident to help
+	ParentId       *int             // the incident this one was merged into, which resolved it
+	ChildIds       []int            // the incidents merged into this one
+	RelatedIds     []int            // incidents linked as related
 }
 
+// List returns the open incidents, with the contact details of the people working on them only
+// for authenticated callers
+//
 //encore:api public method=GET path=/incidents
 func List(ctx context.Context) (*Incidents, error) {
+	incidents, err := listOpen(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range incidents.Items {
+		incidents.Items[i].redact()
+	}
+	return incidents, nil
+}
+
+//encore:api public method=GET path=/incidents/:id
+func GetById(ctx context.Context, id int) (*Incident, error) {
+	incident, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	incident.redact()
+	return incident, nil
+}
+
+// redact Helper function hiding the contact details of the people working on an incident from
+// callers who aren't authenticated
+func (incident *Incident) redact() {
+	if incident.Assignee != nil {
+		users.Redact(incident.Assignee)
+	}
+	for i := range incident.Roles {
+		users.Redact(&incident.Roles[i].User)
+	}
+	for i := range incident.Responders {
+		users.Redact(&incident.Responders[i].User)
+	}
+}
+
+// listOpen Helper function returning the incidents which are neither acknowledged nor suppressed
+func listOpen(ctx context.Context) (*Incidents, error) {
 	rows, err := sqldb.Query(ctx, `
-		SELECT id, assigned_user_id, body, created_at, acknowledged_at
+		SELECT id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
 		FROM incidents
 		WHERE acknowledged_at IS NULL
+		  AND NOT suppressed
 	`)
 	if err != nil {
 		return nil, err
@@ -40,11 +100,11 @@ func List(ctx context.Context) (*Incidents, error) {
 	return RowsToIncidents(ctx, rows)
 }
 
-//encore:api public method=GET path=/incidents/:id
-func GetById(ctx context.Context, id int) (*Incident, error) {
+// getOpenIncident Helper function returning an incident which isn't acknowledged
+func getOpenIncident(ctx context.Context, id int) (*Incident, error) {
 	eb := errs.B().Meta("id", id)
 	rows, err := sqldb.Query(ctx, `
-		SELECT id, assigned_user_id, body, created_at, acknowledged_at
+		SELECT id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
 		FROM incidents
 		WHERE acknowledged_at IS NULL
 		  AND id = $1
@@ -65,16 +125,49 @@ func GetById(ctx context.Context, id int) (*Incident, error) {
 	return incident, err
 }
 
-//encore:api public method=PUT path=/incidents/:id/assign
+// getIncident Helper function returning an incident even after it was acknowledged, unlike
+// getOpenIncident
+func getIncident(ctx context.Context, id int) (*Incident, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+		FROM incidents
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	incidents, err := RowsToIncidents(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	if incidents.Items == nil {
+		return nil, errs.B().Meta("id", id).Code(errs.NotFound).Msg("no incident found").Err()
+	}
+	return &incidents.Items[0], nil
+}
+
+//encore:api auth method=PUT path=/incidents/:id/assign
 func Assign(ctx context.Context, id int, params *AssignParams) (*Incident, error) {
-	eb := errs.B().Meta("id", id, "params", params)
+	if err := requireResponder(ctx, id, "assign"); err != nil {
+		return nil, err
+	}
+	if _, err := users.GetAssignable(ctx, params.UserId); err != nil {
+		return nil, err
+	}
+	return assign(ctx, id, params.UserId)
+}
+
+// assign is shared with the cron jobs, which cannot call the authenticated Assign endpoint
+func assign(ctx context.Context, id int, userId int) (*Incident, error) {
+	eb := errs.B().Meta("id", id, "userId", userId)
+	before, _ := getOpenIncident(ctx, id)
 	rows, err := sqldb.Query(ctx, `
 		UPDATE incidents
-		SET assigned_user_id = $1
+		SET assigned_user_id = $1, assigned_by = $2
 		WHERE acknowledged_at IS NULL
-		  AND id = $2
-		RETURNING id, assigned_user_id, body, created_at, acknowledged_at
-	`, params.UserId, id)
+		  AND id = $3
+		RETURNING id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+	`, userId, auth.Actor(), id)
 	if err != nil {
 		return nil, err
 	}
@@ -88,8 +181,9 @@ func Assign(ctx context.Context, id int, params *AssignParams) (*Incident, error
 	}
 
 	incident := &incidents.Items[0]
+	audit.Log(ctx, "incident.assign", "incident", incident.Id, before, incident)
 	_ = slack.Notify(ctx, &slack.NotifyParams{
-		Text: fmt.Sprintf("Incident #%d is re-assigned to %s %s <@%s>\n%s", incident.Id, incident.Assignee.FirstName, incident.Assignee.LastName, incident.Assignee.SlackHandle, incident.Body),
+		Text: withRoles(fmt.Sprintf("Incident #%d is re-assigned to %s %s %s\n%s", incident.Id, incident.Assignee.FirstName, incident.Assignee.LastName, users.Mention(ctx, incident.Assignee), incident.Body), incident),
 	})
 
 	return incident, err
@@ -99,16 +193,20 @@ type AssignParams struct {
 	UserId int
 }
 
-//encore:api public method=PUT path=/incidents/:id/acknowledge
+//encore:api auth method=PUT path=/incidents/:id/acknowledge
 func Acknowledge(ctx context.Context, id int) (*Incident, error) {
 	eb := errs.B().Meta("incidentId", id)
+	if err := requireResponder(ctx, id, "acknowledge"); err != nil {
+		return nil, err
+	}
+	before, _ := getOpenIncident(ctx, id)
 	rows, err := sqldb.Query(ctx, `
 		UPDATE incidents
-		SET acknowledged_at = NOW()
+		SET acknowledged_at = NOW(), acknowledged_by = $2, snoozed_until = NULL
 		WHERE acknowledged_at IS NULL
 		  AND id = $1
-		RETURNING id, assigned_user_id, body, created_at, acknowledged_at
-	`, id)
+		RETURNING id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+	`, id, auth.Actor())
 	if err != nil {
 		return nil, err
 	}
@@ -122,22 +220,73 @@ func Acknowledge(ctx context.Context, id int) (*Incident, error) {
 	}
 
 	incident := &incidents.Items[0]
-	_ = slack.Notify(ctx, &slack.NotifyParams{
-		Text: fmt.Sprintf("Incident #%d assigned to %s %s <@%s> has been acknowledged:\n%s", incident.Id, incident.Assignee.FirstName, incident.Assignee.LastName, incident.Assignee.SlackHandle, incident.Body),
-	})
+	audit.Log(ctx, "incident.acknowledge", "incident", incident.Id, before, incident)
+	var text string
+	if incident.Assignee != nil {
+		text = fmt.Sprintf("Incident #%d assigned to %s %s %s has been acknowledged:\n%s", incident.Id, incident.Assignee.FirstName, incident.Assignee.LastName, users.Mention(ctx, incident.Assignee), incident.Body)
+	} else {
+		text = fmt.Sprintf("Incident #%d, unassigned, has been acknowledged:\n%s", incident.Id, incident.Body)
+	}
+	_ = slack.Notify(ctx, &slack.NotifyParams{Text: withRoles(text, incident)})
 
 	return incident, err
 }
 
-//encore:api public method=POST path=/incidents/acknowledge_all
+type ResolveParams struct {
+	Reason string // e.g. that the heartbeat is pinged again
+}
+
+// Resolve is called by monitors which noticed the problem of an incident they created went away,
+// unlike Acknowledge nobody has to be assigned. Incidents acknowledged before are left as they are.
+//
+//encore:api private
+func Resolve(ctx context.Context, id int, params *ResolveParams) (*Incident, error) {
+	eb := errs.B().Meta("incidentId", id, "params", params)
+	before, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sqldb.Query(ctx, `
+		UPDATE incidents
+		SET acknowledged_at = NOW(), acknowledged_by = $2, snoozed_until = NULL
+		WHERE acknowledged_at IS NULL
+		  AND id = $1
+		RETURNING id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+	`, id, auth.Actor())
+	if err != nil {
+		return nil, err
+	}
+
+	incidents, err := RowsToIncidents(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	if incidents.Items == nil {
+		return nil, eb.Code(errs.FailedPrecondition).Msg("incident has already been acknowledged").Err()
+	}
+
+	incident := &incidents.Items[0]
+	audit.Log(ctx, "incident.resolve", "incident", incident.Id, before, incident)
+	if !incident.Suppressed {
+		_ = slack.Notify(ctx, &slack.NotifyParams{
+			Text: withRoles(fmt.Sprintf("Incident #%d has been resolved automatically: %s\n%s", incident.Id, params.Reason, incident.Body), incident),
+		})
+	}
+	return incident, nil
+}
+
+//encore:api auth method=POST path=/incidents/acknowledge_all
 func AcknowledgeAll(ctx context.Context) (*Incident, error) {
 	eb := errs.B()
+	if err := authz.RequireAdmin("acknowledge all incidents at once"); err != nil {
+		return nil, err
+	}
 	rows, err := sqldb.Query(ctx, `
 		UPDATE incidents
-		SET acknowledged_at = NOW()
+		SET acknowledged_at = NOW(), acknowledged_by = $1, snoozed_until = NULL
 		WHERE acknowledged_at IS NULL
-		RETURNING id, assigned_user_id, body, created_at, acknowledged_at
-	`)
+		RETURNING id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+	`, auth.Actor())
 	if err != nil {
 		return nil, err
 	}
@@ -149,46 +298,153 @@ func AcknowledgeAll(ctx context.Context) (*Incident, error) {
 	if incidents.Items == nil {
 		return nil, eb.Code(errs.NotFound).Msg("no incident found").Err()
 	}
+	for _, incident := range incidents.Items {
+		audit.Log(ctx, "incident.acknowledge", "incident", incident.Id, nil, incident)
+	}
 
 	return &incidents.Items[0], err
 }
 
-//encore:api public method=POST path=/incidents
+//encore:api auth method=POST path=/incidents
 func Create(ctx context.Context, params *CreateParams) (*Incident, error) {
-	// check who is on-call
-	schedule, err := schedules.ScheduledNow(ctx)
+	if err := authz.RequireIntegrationOrTeamRole(authz.RoleResponder, "create incidents"); err != nil {
+		return nil, err
+	}
 
-	incident := Incident{}
-	if schedule != nil {
-		incident.Assignee = &schedule.User
+	eb := errs.B().Meta("params", params)
+	if params.Severity != "" {
+		if err := rules.VerifySeverity(params.Severity); err != nil {
+			return nil, err
+		}
 	}
 
-	var row *sqldb.Row
-	if schedule != nil {
-		// Someone is on-call
-		row = sqldb.QueryRow(ctx, `
-			INSERT INTO incidents (assigned_user_id, body)
-			VALUES ($1, $2)
-			RETURNING id, body, created_at
-		`, &schedule.User.Id, params.Body)
-	} else {
-		// Nobody is on-call
-		row = sqldb.QueryRow(ctx, `
-			INSERT INTO incidents (body)
-			VALUES ($1)
-			RETURNING id, body, created_at
-		`, params.Body)
+	var service *services.Service
+	labels := params.Labels
+	if params.ServiceId != nil {
+		var err error
+		if service, err = services.Get(ctx, *params.ServiceId); err != nil {
+			return nil, err
+		}
+		// the rules and maintenance windows match the service by its label
+		if labels[serviceLabel] == "" {
+			labels = map[string]string{serviceLabel: service.Name}
+			for name, value := range params.Labels {
+				if name != serviceLabel {
+					labels[name] = value
+				}
+			}
+		}
+	}
+
+	routing, err := rules.Evaluate(ctx, &rules.Event{Body: params.Body, Source: params.Source, Severity: params.Severity, Labels: labels})
+	if err != nil {
+		// rather page whoever is on-call than lose the incident because of a broken rule
+		rlog.Error("FAIL to evaluate rules", "err", err)
+		routing = &rules.Result{Severity: params.Severity}
+		if routing.Severity == "" {
+			routing.Severity = rules.DefaultSeverity
+		}
+	}
+	if routing.TeamId == nil && service != nil {
+		routing.TeamId = &service.TeamId
+	}
+
+	// planned maintenance suppresses paging like a rule does
+	var windowId *int
+	if !routing.Suppressed {
+		windows, err := maintenance.Matching(ctx, &maintenance.MatchParams{TeamId: routing.TeamId, Labels: labels})
+		if err != nil {
+			rlog.Error("FAIL to check maintenance windows", "err", err)
+		} else if len(windows.Items) > 0 {
+			windowId = &windows.Items[0].Id
+			routing.Suppressed = true
+		}
+	}
+
+	// duplicates of an open incident are attached to it, and during an alert storm new incidents
+	// are grouped under one umbrella, instead of each paging
+	signature := fingerprint(params.Body)
+	var similar []SimilarIncident
+	var parentId *int
+	var openedStorm, joinedStorm bool
+	if !routing.Suppressed {
+		similar, err = findSimilar(ctx, signature, params.ServiceId, time.Now(), 0)
+		if err != nil {
+			rlog.Error("FAIL to find similar incidents", "err", err)
+		} else if len(similar) > 0 && similar[0].Similarity >= attachSimilarity && !moreSevere(routing.Severity, similar[0].Severity) {
+			// a more severe duplicate pages on its own, rather than hiding behind the milder incident
+			parentId = &similar[0].IncidentId
+		}
+	}
+	if !routing.Suppressed && parentId == nil {
+		parentId, openedStorm, err = joinStorm(ctx, routing, service)
+		if err != nil {
+			rlog.Error("FAIL to check for an alert storm", "err", err)
+			parentId = nil
+		}
+		joinedStorm = parentId != nil && !openedStorm
 	}
 
-	if err = row.Scan(&incident.Id, &incident.Body, &incident.CreatedAt); err != nil {
+	var assigneeId *int
+	if parentId == nil {
+		assigneeId = assigneeFor(ctx, routing, service)
+	}
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := json.Marshal(routing.Tags)
+	if err != nil {
+		return nil, err
+	}
+	ruleIds, err := json.Marshal(routing.MatchedRuleIds)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+		INSERT INTO incidents (assigned_user_id, body, source, severity, labels, team_id, tags, suppressed, rule_ids, maintenance_window_id, service_id, created_by, merged_into_id, acknowledged_at, fingerprint)
+		VALUES ($1, $2, $3, $4, COALESCE($5::JSONB, '{}'), $6, COALESCE($7::JSONB, '[]'), $8, COALESCE($9::JSONB, '[]'), $10, $11, $12, $13, CASE WHEN $13::BIGINT IS NOT NULL THEN NOW() END, $14)
+		RETURNING id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+	`, assigneeId, params.Body, params.Source, routing.Severity, nullJSON(labelsJSON), routing.TeamId, nullJSON(tags), routing.Suppressed, nullJSON(ruleIds), windowId, params.ServiceId, auth.Actor(), parentId, encodeFingerprint(signature))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert incident").Err()
+	}
+	incidents, err := RowsToIncidents(ctx, rows)
+	if err != nil {
 		return nil, err
 	}
+	incident := incidents.Items[0]
+	audit.Log(ctx, "incident.create", "incident", incident.Id, nil, incident)
+
+	if incident.Suppressed {
+		rlog.Info("suppressed incident", "incident", incident.Id, "rule", routing.SuppressedBy, "maintenanceWindow", windowId)
+		return &incident, nil
+	}
+	if parentId != nil {
+		rlog.Info("grouped incident", "incident", incident.Id, "parent", *parentId)
+		if openedStorm {
+			announceStorm(ctx, *parentId)
+		} else if joinedStorm {
+			escalateStorm(ctx, *parentId, &incident)
+		}
+		return &incident, nil
+	}
 
 	var text string
 	if incident.Assignee != nil {
-		text = fmt.Sprintf("Incident #%d created and assigned to %s %s <@%s>\n%s", incident.Id, incident.Assignee.FirstName, incident.Assignee.LastName, incident.Assignee.SlackHandle, incident.Body)
+		text = fmt.Sprintf("Incident #%d [%s] created and assigned to %s %s %s\n%s", incident.Id, incident.Severity, incident.Assignee.FirstName, incident.Assignee.LastName, users.Mention(ctx, incident.Assignee), incident.Body)
 	} else {
-		text = fmt.Sprintf("Incident #%d created and unassigned\n%s", incident.Id, incident.Body)
+		text = fmt.Sprintf("Incident #%d [%s] created and unassigned\n%s", incident.Id, incident.Severity, incident.Body)
+	}
+	if service != nil {
+		text = fmt.Sprintf("%s\nService: %s", text, service.Name)
+		if service.RunbookURL != "" {
+			text = fmt.Sprintf("%s, runbook: %s", text, service.RunbookURL)
+		}
+	}
+	if len(similar) > 0 {
+		text = fmt.Sprintf("%s\nLooks like a duplicate of incident #%d (%.0f%% similar), merge them if it is", text, similar[0].IncidentId, 100*similar[0].Similarity)
 	}
 	_ = slack.Notify(ctx, &slack.NotifyParams{Text: text})
 
@@ -196,7 +452,108 @@ func Create(ctx context.Context, params *CreateParams) (*Incident, error) {
 }
 
 type CreateParams struct {
-	Body string
+	Body      string
+	Source    string            // e.g. the monitoring system or environment, such as staging
+	Severity  string            // one of SEV1 to SEV4, the rules may change it
+	Labels    map[string]string // e.g. {"service":"payments"}, for the rules to match on
+	ServiceId *int              // the service from the catalogue which is broken, its team's on-call is assigned
+}
+
+// serviceLabel is the label naming the service an incident is about
+const serviceLabel = "service"
+
+// assigneeFor Helper function deciding who a new incident is assigned to: nobody if the rules
+// suppressed it, the assignee the rules chose if they can be assigned, the on-call of the team the
+// rules routed it to, the on-call of the team owning the service, or else whoever is on-call
+func assigneeFor(ctx context.Context, routing *rules.Result, service *services.Service) *int {
+	if routing.Suppressed {
+		return nil
+	}
+	if routing.AssigneeId != nil {
+		_, err := users.GetAssignable(ctx, *routing.AssigneeId)
+		if err == nil {
+			return routing.AssigneeId
+		}
+		rlog.Error("FAIL to assign incident to the assignee of a rule", "user", *routing.AssigneeId, "err", err)
+	}
+	var serviceId *int
+	if service != nil {
+		serviceId = &service.Id
+	}
+	return onCallFor(ctx, routing.TeamId, serviceId)
+}
+
+// onCallFor Helper function returning who is on-call for an incident: the on-call of the service
+// following its escalation policy, unless the rules routed it to another team, then the on-call
+// of the team, or else whoever is on-call in the primary layer. Nil when nobody is.
+func onCallFor(ctx context.Context, teamId *int, serviceId *int) *int {
+	if serviceId != nil {
+		service, err := services.Get(ctx, *serviceId)
+		if err != nil {
+			rlog.Error("FAIL to get the service of an incident", "service", *serviceId, "err", err)
+		} else if teamId == nil || *teamId == service.TeamId {
+			schedule, err := services.OnCall(ctx, service.Id)
+			if err == nil {
+				return &schedule.User.Id
+			}
+			rlog.Info("nobody of the owning team is on-call", "service", service.Id, "err", err)
+			teamId = nil // the escalation policy already tried the team
+		}
+	}
+	if teamId != nil {
+		schedule, err := schedules.TeamOnCall(ctx, *teamId, &schedules.TeamOnCallParams{})
+		if err == nil {
+			return &schedule.User.Id
+		}
+		rlog.Info("nobody of the team is on-call", "team", *teamId, "err", err)
+	}
+
+	// check who is on-call
+	schedule, err := schedules.ScheduledNow(ctx, &schedules.ScheduledParams{Layer: schedules.LayerPrimary})
+	if err != nil || schedule == nil {
+		return nil // nobody is on-call
+	}
+	return &schedule.User.Id
+}
+
+// nullJSON stores missing JSON as NULL, so the column default is used
+func nullJSON(raw []byte) *string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	s := string(raw)
+	return &s
+}
+
+// requireResponder Helper function making sure the caller is a responder in one of the teams of
+// whoever the incident is assigned to. Any responder may act on unassigned incidents.
+func requireResponder(ctx context.Context, id int, action string) error {
+	return requireRole(ctx, id, authz.RoleResponder, action)
+}
+
+// requireRole Helper function making sure the caller has the role in one of the teams of the
+// incident, like requireResponder, or accepted to help with it
+func requireRole(ctx context.Context, id int, role authz.Role, action string) error {
+	incident, err := getIncident(ctx, id)
+	if err != nil {
+		return err
+	}
+	if isAcceptedResponder(incident) {
+		return nil
+	}
+
+	var teamIds []int
+	if incident.Assignee != nil {
+		teamIds, err = users.TeamIds(ctx, incident.Assignee.Id)
+		if err != nil {
+			return err
+		}
+	}
+	if incident.TeamId != nil {
+		teamIds = append(teamIds, *incident.TeamId)
+	}
+
+	return authz.RequireTeamRole(role, teamIds, fmt.Sprintf("%s incident #%d", action, id))
 }
 
 // Helper to take a sqldb.Rows instance and convert it into a list of Incidents
@@ -209,9 +566,16 @@ func RowsToIncidents(ctx context.Context, rows *sqldb.Rows) (*Incidents, error)
 	for rows.Next() {
 		var incident = Incident{}
 		var assignedUserId *int
-		if err := rows.Scan(&incident.Id, &assignedUserId, &incident.Body, &incident.CreatedAt, &incident.AcknowledgedAt); err != nil {
+		var labels, tags []byte
+		if err := rows.Scan(&incident.Id, &assignedUserId, &incident.Body, &incident.CreatedAt, &incident.AcknowledgedAt, &incident.Source, &incident.Severity, &labels, &incident.TeamId, &tags, &incident.Suppressed, &incident.SnoozedUntil, &incident.ServiceId); err != nil {
 			return nil, eb.Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
 		}
+		if err := json.Unmarshal(labels, &incident.Labels); err != nil {
+			return nil, eb.Code(errs.Unknown).Msgf("could not parse labels: %v", err).Err()
+		}
+		if err := json.Unmarshal(tags, &incident.Tags); err != nil {
+			return nil, eb.Code(errs.Unknown).Msgf("could not parse tags: %v", err).Err()
+		}
 		if assignedUserId != nil {
 			user, err := users.Get(ctx, *assignedUserId)
 			if err != nil {
@@ -222,6 +586,15 @@ func RowsToIncidents(ctx context.Context, rows *sqldb.Rows) (*Incidents, error)
 		incident.Acknowledged = incident.AcknowledgedAt != nil
 		incidents = append(incidents, incident)
 	}
+	if err := loadRoles(ctx, incidents); err != nil {
+		return nil, eb.Code(errs.Unknown).Msgf("could not load roles: %v", err).Err()
+	}
+	if err := loadResponders(ctx, incidents); err != nil {
+		return nil, eb.Code(errs.Unknown).Msgf("could not load responders: %v", err).Err()
+	}
+	if err := loadLinks(ctx, incidents); err != nil {
+		return nil, eb.Code(errs.Unknown).Msgf("could not load links: %v", err).Err()
+	}
 
 	return &Incidents{Items: incidents}, nil
 }
@@ -234,7 +607,7 @@ var _ = cron.NewJob("unacknowledged-incidents-reminder", cron.JobConfig{
 
 //encore:api private
 func RemindUnacknowledgedIncidents(ctx context.Context) error {
-	incidents, err := List(ctx) // we never query for acknowledged incidents
+	incidents, err := listOpen(ctx) // we never query for acknowledged incidents
 	if err != nil {
 		return err
 	}
@@ -244,17 +617,25 @@ func RemindUnacknowledgedIncidents(ctx context.Context) error {
 
 	var items = []string{"These incidents have not been acknowledged yet. Please acknowledge them otherwise you will be reminded every 10 minutes:"}
 	for _, incident := range incidents.Items {
+		if incident.SnoozedUntil != nil {
+			continue // reminded about once the snooze expires
+		}
+
 		var assignee string
 		if incident.Assignee != nil {
-			assignee = fmt.Sprintf("%s %s (<@%s>)", incident.Assignee.FirstName, incident.Assignee.LastName, incident.Assignee.SlackHandle)
+			assignee = fmt.Sprintf("%s %s (%s)", incident.Assignee.FirstName, incident.Assignee.LastName, users.Mention(ctx, incident.Assignee))
 		} else {
 			assignee = "Unassigned"
 		}
 
+		if roles := describeRoles(incident.Roles); roles != "" {
+			assignee = fmt.Sprintf("%s, %s", assignee, roles)
+		}
+
 		items = append(items, fmt.Sprintf("[%s] [#%d] %s", assignee, incident.Id, incident.Body))
 	}
 
-	if len(incidents.Items) > 0 {
+	if len(items) > 1 {
 		_ = slack.Notify(ctx, &slack.NotifyParams{Text: strings.Join(items, "\n")})
 	}
 
@@ -269,30 +650,33 @@ var _ = cron.NewJob("assign-unassigned-incidents", cron.JobConfig{
 
 //encore:api private
 func AssignUnassignedIncidents(ctx context.Context) error {
-	// If this code fail, it is either a server error or someone isn't on-call
-	schedule, err := schedules.ScheduledNow(ctx)
-	if err != nil {
-		return err
-	}
-
-	incidents, err := List(ctx) // we never query for acknowledged incidents
+	incidents, err := listOpen(ctx) // we never query for acknowledged incidents
 	if err != nil {
 		return err
 	}
 
+	failed := 0
 	for _, incident := range incidents.Items {
 		if incident.Assignee != nil {
 			continue // this incident has already been assigned
 		}
+		if incident.SnoozedUntil != nil {
+			continue // assigned to whoever is on-call once the snooze expires
+		}
 
-		_, err := Assign(ctx, incident.Id, &AssignParams{UserId: schedule.User.Id})
-		if err == nil {
-			rlog.Info("OK assigned unassigned incident", "incident", incident, "user", schedule.User)
-		} else {
-			rlog.Error("FAIL to assign unassigned incident", "incident", incident, "user", schedule.User, "err", err)
-			return err
+		assigneeId := onCallFor(ctx, incident.TeamId, incident.ServiceId)
+		if assigneeId == nil {
+			continue // nobody is on-call for it, tried again on the next run
+		}
+		if _, err := assign(ctx, incident.Id, *assigneeId); err != nil {
+			rlog.Error("FAIL to assign unassigned incident", "incident", incident.Id, "user", *assigneeId, "err", err)
+			failed++
+			continue
 		}
+		rlog.Info("OK assigned unassigned incident", "incident", incident.Id, "user", *assigneeId)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d unassigned incidents could not be assigned", failed)
 	}
-
 	return nil
 }
@@ -6,8 +6,14 @@ import (
 	"testing"
 	"time"
 
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/rules"
 	"encore.app/schedules"
+	"encore.app/services"
 	"encore.app/users"
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/storage/sqldb"
 )
 
 func TestCreateIncidents(t *testing.T) {
@@ -33,8 +39,14 @@ func TestCreateIncidents(t *testing.T) {
 	})
 }
 
+// authenticated is the context of a request made with an admin API key, as mutating endpoints require auth
+func authenticated() context.Context {
+	apiKeyId := 1
+	return encoreauth.WithContext(context.Background(), "apikey:1", &auth.Data{APIKeyId: &apiKeyId, Name: "test", Admin: true})
+}
+
 func createUser(t *testing.T) *users.User {
-	user, err := users.Create(context.Background(), users.CreateParams{
+	user, err := users.Create(authenticated(), users.CreateParams{
 		FirstName:   "Bilawal",
 		LastName:    "Hameed",
 		SlackHandle: "bil",
@@ -46,7 +58,7 @@ func createUser(t *testing.T) *users.User {
 }
 
 func createSchedule(t *testing.T, user *users.User, startTime time.Time) *schedules.Schedule {
-	schedule, err := schedules.Create(context.Background(), user.Id, schedules.TimeRange{
+	schedule, err := schedules.Create(authenticated(), user.Id, &schedules.CreateParams{
 		Start: startTime.UTC(),
 		End:   startTime.UTC().Add(time.Duration(5000 * 1000 * 1000)),
 	})
@@ -57,7 +69,7 @@ func createSchedule(t *testing.T, user *users.User, startTime time.Time) *schedu
 }
 
 func createIncident(t *testing.T, body string) *Incident {
-	incident, err := Create(context.Background(), &CreateParams{Body: body})
+	incident, err := Create(authenticated(), &CreateParams{Body: body})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,14 +82,120 @@ func incidentEquals(t *testing.T, actual *Incident, expected Incident) {
 	}
 
 	if !reflect.DeepEqual(actual.Assignee, expected.Assignee) {
-		t.Errorf("Assignee does not match provided value. got %q, want %q", actual.Assignee, expected.Assignee)
+		t.Errorf("Assignee does not match provided value. got %v, want %v", actual.Assignee, expected.Assignee)
 	}
 
 	if actual.Acknowledged != expected.Acknowledged {
-		t.Errorf("Acknowledged does not match provided value. got %q, want %q", actual.Acknowledged, expected.Acknowledged)
+		t.Errorf("Acknowledged does not match provided value. got %v, want %v", actual.Acknowledged, expected.Acknowledged)
 	}
 
 	if actual.AcknowledgedAt != expected.AcknowledgedAt {
-		t.Errorf("AcknowledgedAt does not match provided value. got %q, want %q", actual.AcknowledgedAt, expected.AcknowledgedAt)
+		t.Errorf("AcknowledgedAt does not match provided value. got %v, want %v", actual.AcknowledgedAt, expected.AcknowledgedAt)
+	}
+}
+
+// createTeamOnCall Helper function creating a team whose only member is on-call in a layer of the
+// team's own shifts for the next minute
+func createTeamOnCall(t *testing.T, name string, layer string) (*users.Team, *users.User) {
+	member := createUser(t)
+	team, err := users.CreateTeam(authenticated(), &users.CreateTeamParams{Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.AddMember(authenticated(), team.Id, &users.AddMemberParams{UserId: member.Id, Role: authz.RoleResponder}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(100 * time.Millisecond)
+	_, err = schedules.Create(authenticated(), member.Id, &schedules.CreateParams{Start: start, End: start.Add(time.Minute), Layer: layer, TeamId: &team.Id})
+	if err != nil {
+		t.Fatal("failed to create schedule", err)
+	}
+	time.Sleep(time.Until(start))
+	return team, member
+}
+
+func TestCreateIncidentAssignsOnCallOfRuleTeam(t *testing.T) {
+	team, member := createTeamOnCall(t, "Payments "+time.Now().Format(time.RFC3339Nano), schedules.LayerManager)
+	rule, err := rules.Create(authenticated(), &rules.RuleParams{
+		Name:       "route payments",
+		Position:   1,
+		Conditions: rules.Conditions{BodyRegex: "^Payments routing test"},
+		Actions:    rules.Actions{TeamId: &team.Id},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rules.Delete(authenticated(), rule.Id)
+
+	incident := createIncident(t, "Payments routing test: card authorizations are failing")
+	if incident.Assignee == nil || incident.Assignee.Id != member.Id {
+		t.Fatalf("expected the incident to be assigned to user #%d of the team, got %v", member.Id, incident.Assignee)
+	}
+}
+
+func TestCreateIncidentAssignsOnCallOfServiceTeam(t *testing.T) {
+	team, member := createTeamOnCall(t, "Checkout "+time.Now().Format(time.RFC3339Nano), schedules.LayerPrimary)
+	service, err := services.Create(authenticated(), &services.ServiceParams{Name: "checkout " + time.Now().Format(time.RFC3339Nano), TeamId: team.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	incident, err := Create(authenticated(), &CreateParams{Body: "Checkout is down", ServiceId: &service.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incident.Assignee == nil || incident.Assignee.Id != member.Id {
+		t.Fatalf("expected the incident to be assigned to user #%d of the owning team, got %v", member.Id, incident.Assignee)
+	}
+}
+
+func TestAssignUnassignedIncidentsThroughService(t *testing.T) {
+	team, member := createTeamOnCall(t, "Search "+time.Now().Format(time.RFC3339Nano), schedules.LayerPrimary)
+	service, err := services.Create(authenticated(), &services.ServiceParams{Name: "search " + time.Now().Format(time.RFC3339Nano), TeamId: team.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	incident, err := Create(authenticated(), &CreateParams{Body: "Search is slow", ServiceId: &service.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqldb.Exec(context.Background(), `UPDATE incidents SET assigned_user_id = NULL WHERE id = $1`, incident.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AssignUnassignedIncidents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assigned, err := GetById(context.Background(), incident.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assigned.Assignee == nil || assigned.Assignee.Id != member.Id {
+		t.Fatalf("expected the incident to be assigned to user #%d of the owning team, got %v", member.Id, assigned.Assignee)
+	}
+}
+
+func TestAcknowledgeSuppressedIncident(t *testing.T) {
+	rule, err := rules.Create(authenticated(), &rules.RuleParams{
+		Name:       "suppress staging",
+		Position:   1,
+		Conditions: rules.Conditions{BodyRegex: "^Suppression test"},
+		Actions:    rules.Actions{Suppress: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rules.Delete(authenticated(), rule.Id)
+
+	incident := createIncident(t, "Suppression test: staging database is restarting")
+	if !incident.Suppressed || incident.Assignee != nil {
+		t.Fatalf("expected incident #%d to be suppressed and unassigned, got %v", incident.Id, incident)
+	}
+	acknowledged, err := Acknowledge(authenticated(), incident.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acknowledged.AcknowledgedAt == nil {
+		t.Fatalf("expected incident #%d to be acknowledged", incident.Id)
 	}
 }
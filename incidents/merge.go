@@ -0,0 +1,329 @@
+package incidents
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/slack"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type MergeParams struct {
+	IncidentIds []int // the children to fold into the incident
+}
+
+type LinkParams struct {
+	IncidentId int // the related incident
+}
+
+// Merge folds incidents about the same outage into one. The children are resolved as merged, and
+// their notes, responders and links move to the parent, which gets the highest severity of them.
+// Only open incidents can be merged, into an incident which wasn't merged itself.
+//
+//encore:api auth method=POST path=/incidents/:id/merge
+func Merge(ctx context.Context, id int, params *MergeParams) (*Incident, error) {
+	eb := errs.B().Meta("incidentId", id, "params", params)
+	if len(params.IncidentIds) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("no incidents to merge").Err()
+	}
+	if err := requireResponder(ctx, id, "merge into"); err != nil {
+		return nil, err
+	}
+	before, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []Incident
+	var ids []string
+	for _, childId := range params.IncidentIds {
+		if childId == id {
+			return nil, eb.Code(errs.InvalidArgument).Msg("cannot merge an incident into itself").Err()
+		}
+		if err := requireResponder(ctx, childId, "merge"); err != nil {
+			return nil, err
+		}
+		child, err := getOpenIncident(ctx, childId)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, *child)
+		ids = append(ids, fmt.Sprint(childId))
+	}
+	childIds := strings.Join(ids, ",")
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	if err := lockMerge(ctx, tx, id, childIds); err != nil {
+		return nil, err
+	}
+	_, err = sqldb.ExecTx(tx, ctx, `
+		UPDATE incidents
+		SET merged_into_id = $1, acknowledged_at = NOW(), acknowledged_by = $2, snoozed_until = NULL
+		WHERE id = ANY(STRING_TO_ARRAY($3, ',')::BIGINT[])
+		  AND acknowledged_at IS NULL
+	`, id, auth.Actor(), childIds)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("resolve merged incidents").Err()
+	}
+	// incidents merged into the children before are folded into the parent too
+	_, err = sqldb.ExecTx(tx, ctx, `
+		UPDATE incidents
+		SET merged_into_id = $1
+		WHERE merged_into_id = ANY(STRING_TO_ARRAY($2, ',')::BIGINT[])
+	`, id, childIds)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("re-point merged incidents").Err()
+	}
+	_, err = sqldb.ExecTx(tx, ctx, `
+		UPDATE incidents
+		SET severity = LEAST(severity, (SELECT MIN(severity) FROM incidents WHERE id = ANY(STRING_TO_ARRAY($2, ',')::BIGINT[])))
+		WHERE id = $1
+	`, id, childIds)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update severity").Err()
+	}
+	_, err = sqldb.ExecTx(tx, ctx, `
+		UPDATE notes
+		SET incident_id = $1
+		WHERE incident_id = ANY(STRING_TO_ARRAY($2, ',')::BIGINT[])
+	`, id, childIds)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("move notes").Err()
+	}
+	// responders who are already on the parent keep their status there
+	_, err = sqldb.ExecTx(tx, ctx, `
+		INSERT INTO responders (incident_id, user_id, status, message, requested_by, requested_at, responded_at)
+		SELECT $1, user_id, status, message, requested_by, requested_at, responded_at
+		FROM responders
+		WHERE incident_id = ANY(STRING_TO_ARRAY($2, ',')::BIGINT[])
+		ON CONFLICT (incident_id, user_id) DO NOTHING
+	`, id, childIds)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("move responders").Err()
+	}
+	_, err = sqldb.ExecTx(tx, ctx, `
+		INSERT INTO links (incident_id, related_id, created_by, created_at)
+		SELECT LEAST($1, other), GREATEST($1, other), created_by, created_at
+		FROM (
+			SELECT CASE WHEN incident_id = ANY(STRING_TO_ARRAY($2, ',')::BIGINT[]) THEN related_id ELSE incident_id END AS other, created_by, created_at
+			FROM links
+			WHERE incident_id = ANY(STRING_TO_ARRAY($2, ',')::BIGINT[])
+			   OR related_id = ANY(STRING_TO_ARRAY($2, ',')::BIGINT[])
+		) AS child_links
+		WHERE other <> $1
+		  AND NOT other = ANY(STRING_TO_ARRAY($2, ',')::BIGINT[])
+		ON CONFLICT (incident_id, related_id) DO NOTHING
+	`, id, childIds)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("move links").Err()
+	}
+	_, err = sqldb.ExecTx(tx, ctx, `
+		DELETE FROM links
+		WHERE incident_id = ANY(STRING_TO_ARRAY($1, ',')::BIGINT[])
+		   OR related_id = ANY(STRING_TO_ARRAY($1, ',')::BIGINT[])
+	`, childIds)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("remove links of merged incidents").Err()
+	}
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("commit merge").Err()
+	}
+
+	incident, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		merged, err := getIncident(ctx, child.Id)
+		if err != nil {
+			return nil, err
+		}
+		audit.Log(ctx, "incident.merge", "incident", child.Id, child, merged)
+	}
+	audit.Log(ctx, "incident.merge_into", "incident", id, before, incident)
+
+	var merged []string
+	for _, child := range children {
+		merged = append(merged, fmt.Sprintf("#%d", child.Id))
+	}
+	_ = slack.Notify(ctx, &slack.NotifyParams{
+		Text: withRoles(fmt.Sprintf("Incidents %s are merged into incident #%d [%s]\n%s", strings.Join(merged, ", "), incident.Id, incident.Severity, incident.Body), incident),
+	})
+	return incident, nil
+}
+
+// lockMerge Helper function locking the incidents of a merge until the transaction ends, so none
+// of them is resolved or merged elsewhere meanwhile, and making sure the children are still open
+// and the parent wasn't merged itself
+func lockMerge(ctx context.Context, tx *sqldb.Tx, id int, childIds string) error {
+	rows, err := sqldb.QueryTx(tx, ctx, `
+		SELECT id, acknowledged_at IS NOT NULL, merged_into_id
+		FROM incidents
+		WHERE id = $1
+		   OR id = ANY(STRING_TO_ARRAY($2, ',')::BIGINT[])
+		ORDER BY id ASC
+		FOR UPDATE
+	`, id, childIds)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var incidentId int
+		var acknowledged bool
+		var mergedIntoId *int
+		if err := rows.Scan(&incidentId, &acknowledged, &mergedIntoId); err != nil {
+			return err
+		}
+		eb := errs.B().Meta("incidentId", incidentId)
+		switch {
+		case mergedIntoId != nil:
+			return eb.Code(errs.FailedPrecondition).Msgf("incident #%d is already merged into incident #%d", incidentId, *mergedIntoId).Err()
+		case incidentId != id && acknowledged:
+			return eb.Code(errs.FailedPrecondition).Msgf("incident #%d is already acknowledged", incidentId).Err()
+		}
+	}
+	return rows.Err()
+}
+
+// Link marks incidents as related, e.g. a database incident causing an incident of checkout,
+// without merging them
+//
+//encore:api auth method=POST path=/incidents/:id/links
+func Link(ctx context.Context, id int, params *LinkParams) (*Incident, error) {
+	eb := errs.B().Meta("incidentId", id, "params", params)
+	if params.IncidentId == id {
+		return nil, eb.Code(errs.InvalidArgument).Msg("cannot link an incident to itself").Err()
+	}
+	if err := requireResponder(ctx, id, "link"); err != nil {
+		return nil, err
+	}
+	before, err := getIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := getIncident(ctx, params.IncidentId); err != nil {
+		return nil, err
+	}
+
+	_, err = sqldb.Exec(ctx, `
+		INSERT INTO links (incident_id, related_id, created_by)
+		VALUES (LEAST($1::BIGINT, $2::BIGINT), GREATEST($1::BIGINT, $2::BIGINT), $3)
+		ON CONFLICT (incident_id, related_id) DO NOTHING
+	`, id, params.IncidentId, auth.Actor())
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert link").Err()
+	}
+
+	incident, err := getIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "incident.link", "incident", id, before, incident)
+	return incident, nil
+}
+
+//encore:api auth method=DELETE path=/incidents/:id/links/:relatedId
+func Unlink(ctx context.Context, id int, relatedId int) (*Incident, error) {
+	eb := errs.B().Meta("incidentId", id, "relatedId", relatedId)
+	if err := requireResponder(ctx, id, "unlink"); err != nil {
+		return nil, err
+	}
+	before, err := getIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sqldb.Exec(ctx, `
+		DELETE FROM links
+		WHERE incident_id = LEAST($1::BIGINT, $2::BIGINT)
+		  AND related_id = GREATEST($1::BIGINT, $2::BIGINT)
+	`, id, relatedId)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("delete link").Err()
+	}
+
+	incident, err := getIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "incident.unlink", "incident", id, before, incident)
+	return incident, nil
+}
+
+// loadLinks Helper function adding the parent an incident was merged into, the children merged
+// into it and the related incidents to incidents
+func loadLinks(ctx context.Context, incidents []Incident) error {
+	if len(incidents) == 0 {
+		return nil
+	}
+	byId := map[int]*Incident{}
+	var ids []string
+	for i := range incidents {
+		byId[incidents[i].Id] = &incidents[i]
+		ids = append(ids, fmt.Sprint(incidents[i].Id))
+	}
+
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, merged_into_id
+		FROM incidents
+		WHERE merged_into_id IS NOT NULL
+		  AND (id = ANY(STRING_TO_ARRAY($1, ',')::BIGINT[]) OR merged_into_id = ANY(STRING_TO_ARRAY($1, ',')::BIGINT[]))
+		ORDER BY id ASC
+	`, strings.Join(ids, ","))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var childId, parentId int
+		if err := rows.Scan(&childId, &parentId); err != nil {
+			rows.Close()
+			return err
+		}
+		if child, ok := byId[childId]; ok {
+			child.ParentId = &parentId
+		}
+		if parent, ok := byId[parentId]; ok {
+			parent.ChildIds = append(parent.ChildIds, childId)
+		}
+	}
+	rows.Close()
+
+	rows, err = sqldb.Query(ctx, `
+		SELECT incident_id, related_id
+		FROM links
+		WHERE incident_id = ANY(STRING_TO_ARRAY($1, ',')::BIGINT[])
+		   OR related_id = ANY(STRING_TO_ARRAY($1, ',')::BIGINT[])
+		ORDER BY incident_id ASC, related_id ASC
+	`, strings.Join(ids, ","))
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var a, b int
+		if err := rows.Scan(&a, &b); err != nil {
+			return err
+		}
+		if incident, ok := byId[a]; ok {
+			incident.RelatedIds = append(incident.RelatedIds, b)
+		}
+		if incident, ok := byId[b]; ok {
+			incident.RelatedIds = append(incident.RelatedIds, a)
+		}
+	}
+	return nil
+}
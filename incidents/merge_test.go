@@ -0,0 +1,101 @@
+package incidents
+
+import (
+	"testing"
+
+	"encore.dev/beta/errs"
+)
+
+func TestMerge(t *testing.T) {
+	ctx := authenticated()
+	responder := createUser(t)
+	parent, err := Create(ctx, &CreateParams{Body: "Checkout fails", Severity: "SEV3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := Create(ctx, &CreateParams{Body: "Payment provider unreachable", Severity: "SEV1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddNote(ctx, child.Id, &AddNoteParams{Text: "the provider's status page is red"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddResponders(ctx, child.Id, &AddRespondersParams{UserId: &responder.Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := Merge(ctx, parent.Id, &MergeParams{IncidentIds: []int{child.Id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(merged.ChildIds) != 1 || merged.ChildIds[0] != child.Id {
+		t.Errorf("expected incident #%d to be merged, got children %v", child.Id, merged.ChildIds)
+	}
+	if merged.Severity != "SEV1" {
+		t.Errorf("expected the parent to get the highest severity, got %s", merged.Severity)
+	}
+	if len(merged.Responders) != 1 || merged.Responders[0].User.Id != responder.Id {
+		t.Errorf("expected the responder to move to the parent, got %+v", merged.Responders)
+	}
+	notes, err := listNotes(ctx, parent.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notes.Items) != 1 || notes.Items[0].Text != "the provider's status page is red" {
+		t.Errorf("expected the note to move to the parent, got %+v", notes.Items)
+	}
+
+	resolved, err := getIncident(ctx, child.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resolved.Acknowledged || resolved.ParentId == nil || *resolved.ParentId != parent.Id {
+		t.Errorf("expected the child to be resolved as merged into #%d, got %+v", parent.Id, resolved)
+	}
+}
+
+func TestMergeAcknowledgedIncidentIsRejected(t *testing.T) {
+	ctx := authenticated()
+	parent := createIncident(t, "Search is slow")
+	child := createIncident(t, "Index rebuild stalled")
+	if _, err := Acknowledge(ctx, child.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Merge(ctx, parent.Id, &MergeParams{IncidentIds: []int{child.Id}})
+	if errs.Code(err) != errs.FailedPrecondition {
+		t.Errorf("expected merging an acknowledged incident to fail, got %v", err)
+	}
+	unchanged, err := getIncident(ctx, child.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged.ParentId != nil {
+		t.Errorf("expected the acknowledged incident not to be merged, got parent #%d", *unchanged.ParentId)
+	}
+}
+
+func TestMergeIntoMergedIncidentIsRejected(t *testing.T) {
+	ctx := authenticated()
+	parent := createIncident(t, "Login page errors")
+	child := createIncident(t, "Session store full")
+	other := createIncident(t, "Password resets bounce")
+	if _, err := Merge(ctx, parent.Id, &MergeParams{IncidentIds: []int{child.Id}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Merge(ctx, child.Id, &MergeParams{IncidentIds: []int{other.Id}})
+	if errs.Code(err) != errs.FailedPrecondition {
+		t.Errorf("expected merging into a merged incident to fail, got %v", err)
+	}
+}
+
+func TestMergeIntoItselfIsRejected(t *testing.T) {
+	incident := createIncident(t, "Emails are delayed")
+
+	_, err := Merge(authenticated(), incident.Id, &MergeParams{IncidentIds: []int{incident.Id}})
+	if errs.Code(err) != errs.InvalidArgument {
+		t.Errorf("expected merging an incident into itself to fail, got %v", err)
+	}
+}
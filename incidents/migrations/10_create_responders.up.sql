@@ -0,0 +1,12 @@
+-- responders are people paged into an incident to help, besides the assignee
+CREATE TABLE responders
+(
+    incident_id  BIGINT       NOT NULL REFERENCES incidents (id) ON DELETE CASCADE,
+    user_id      BIGINT       NOT NULL,
+    status       VARCHAR(16)  NOT NULL DEFAULT 'requested', -- requested, accepted or declined
+    message      TEXT         NOT NULL DEFAULT '',
+    requested_by VARCHAR(255),
+    requested_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    responded_at TIMESTAMPTZ,
+    PRIMARY KEY (incident_id, user_id)
+);
@@ -0,0 +1,18 @@
+-- merged incidents are acknowledged and point to the incident they were folded into
+ALTER TABLE incidents
+    ADD COLUMN merged_into_id BIGINT REFERENCES incidents (id);
+
+CREATE INDEX incidents_merged_into_id_index ON incidents (merged_into_id);
+
+-- related incidents are linked both ways, stored once with the lower id first
+CREATE TABLE links
+(
+    incident_id BIGINT      NOT NULL REFERENCES incidents (id) ON DELETE CASCADE,
+    related_id  BIGINT      NOT NULL REFERENCES incidents (id) ON DELETE CASCADE,
+    created_by  VARCHAR(255),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (incident_id, related_id),
+    CHECK (incident_id < related_id)
+);
+
+CREATE INDEX links_related_id_index ON links (related_id);
@@ -0,0 +1,22 @@
+-- how many incidents within a window make an alert storm, for a service, a team or everything
+CREATE TABLE storm_thresholds
+(
+    id             BIGSERIAL PRIMARY KEY,
+    team_id        BIGINT,
+    service_id     BIGINT,
+    max_incidents  INT          NOT NULL CHECK (max_incidents > 0),
+    window_seconds INT          NOT NULL CHECK (window_seconds > 0),
+    created_by     VARCHAR(255),
+    updated_by     VARCHAR(255),
+    CHECK (team_id IS NULL OR service_id IS NULL)
+);
+
+CREATE UNIQUE INDEX storm_thresholds_scope_index ON storm_thresholds (COALESCE(team_id, 0), COALESCE(service_id, 0));
+
+-- umbrella incidents group the incidents of an alert storm, e.g. service:3, team:2 or all
+ALTER TABLE incidents
+    ADD COLUMN storm_scope          VARCHAR(64),
+    ADD COLUMN storm_notified_count INT NOT NULL DEFAULT 0;
+
+CREATE INDEX incidents_storm_scope_index ON incidents (storm_scope) WHERE acknowledged_at IS NULL;
+CREATE INDEX incidents_created_at_index ON incidents (created_at);
@@ -0,0 +1,5 @@
+-- MinHash signature of the masked body, to find open incidents which are about the same problem
+ALTER TABLE incidents
+    ADD COLUMN fingerprint BYTEA;
+
+CREATE INDEX incidents_open_created_at_index ON incidents (created_at) WHERE acknowledged_at IS NULL;
@@ -0,0 +1,4 @@
+-- existing timestamps were written in UTC
+ALTER TABLE incidents
+    ALTER COLUMN created_at TYPE TIMESTAMPTZ USING created_at AT TIME ZONE 'UTC',
+    ALTER COLUMN acknowledged_at TYPE TIMESTAMPTZ USING acknowledged_at AT TIME ZONE 'UTC';
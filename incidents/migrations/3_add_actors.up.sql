@@ -0,0 +1,5 @@
+-- the auth UID of whoever made the change, NULL when it was made by the system itself
+ALTER TABLE incidents
+    ADD COLUMN created_by      VARCHAR(255),
+    ADD COLUMN assigned_by     VARCHAR(255),
+    ADD COLUMN acknowledged_by VARCHAR(255);
@@ -0,0 +1,9 @@
+ALTER TABLE incidents
+    ADD COLUMN source     VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN severity   VARCHAR(16)  NOT NULL DEFAULT 'SEV3',
+    ADD COLUMN labels     JSONB        NOT NULL DEFAULT '{}',
+    ADD COLUMN team_id    BIGINT,
+    ADD COLUMN tags       JSONB        NOT NULL DEFAULT '[]',
+    -- suppressed incidents are stored, but nobody is assigned or notified
+    ADD COLUMN suppressed BOOLEAN      NOT NULL DEFAULT FALSE,
+    ADD COLUMN rule_ids   JSONB        NOT NULL DEFAULT '[]';
@@ -0,0 +1,3 @@
+-- the maintenance window which suppressed the incident
+ALTER TABLE incidents
+    ADD COLUMN maintenance_window_id BIGINT;
@@ -0,0 +1,4 @@
+-- snoozed incidents are not reminded about or escalated until then
+ALTER TABLE incidents
+    ADD COLUMN snoozed_until TIMESTAMPTZ,
+    ADD COLUMN snoozed_by    VARCHAR(255);
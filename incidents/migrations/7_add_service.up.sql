@@ -0,0 +1,4 @@
+ALTER TABLE incidents
+    ADD COLUMN service_id BIGINT;
+
+CREATE INDEX incidents_service_id_index ON incidents (service_id) WHERE acknowledged_at IS NULL;
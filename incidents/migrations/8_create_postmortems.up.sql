@@ -0,0 +1,37 @@
+-- notes are what responders found out while working on an incident, for them rather than customers
+CREATE TABLE notes
+(
+    id          BIGSERIAL PRIMARY KEY,
+    incident_id BIGINT      NOT NULL REFERENCES incidents (id) ON DELETE CASCADE,
+    text        TEXT        NOT NULL,
+    created_by  VARCHAR(255),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX notes_incident_id_index ON notes (incident_id, created_at);
+
+CREATE TABLE postmortems
+(
+    id          BIGSERIAL PRIMARY KEY,
+    incident_id BIGINT      NOT NULL UNIQUE REFERENCES incidents (id) ON DELETE CASCADE,
+    body        TEXT        NOT NULL, -- Markdown, generated as a draft and edited afterwards
+    created_by  VARCHAR(255),
+    updated_by  VARCHAR(255),
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE action_items
+(
+    id            BIGSERIAL PRIMARY KEY,
+    postmortem_id BIGINT       NOT NULL REFERENCES postmortems (id) ON DELETE CASCADE,
+    title         VARCHAR(255) NOT NULL,
+    owner_id      BIGINT       NOT NULL,
+    due_date      DATE         NOT NULL,
+    done_at       TIMESTAMPTZ,
+    created_by    VARCHAR(255),
+    updated_by    VARCHAR(255),
+    created_at    TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX action_items_open_index ON action_items (due_date) WHERE done_at IS NULL;
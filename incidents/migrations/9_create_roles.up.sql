@@ -0,0 +1,10 @@
+-- major incidents have more people in roles besides the assignee, each role is held by one user
+CREATE TABLE roles
+(
+    incident_id BIGINT       NOT NULL REFERENCES incidents (id) ON DELETE CASCADE,
+    role        VARCHAR(32)  NOT NULL,
+    user_id     BIGINT       NOT NULL,
+    assigned_by VARCHAR(255),
+    assigned_at TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (incident_id, role)
+);
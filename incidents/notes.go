@@ -0,0 +1,95 @@
+package incidents
+
+import (
+	"context"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type Notes struct {
+	Items []Note
+}
+
+// Note is what a responder found out while working on an incident. Notes are internal, customers
+// are told about incidents on the status page.
+type Note struct {
+	Id        int
+	Author    *string // the auth UID
+	Text      string
+	CreatedAt time.Time
+}
+
+type AddNoteParams struct {
+	Text string
+}
+
+//encore:api auth method=POST path=/incidents/:id/notes
+func AddNote(ctx context.Context, id int, params *AddNoteParams) (*Note, error) {
+	eb := errs.B().Meta("incidentId", id)
+	if err := requireResponder(ctx, id, "add notes to"); err != nil {
+		return nil, err
+	}
+	if len(params.Text) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("text is empty").Err()
+	}
+
+	note, err := RowToNote(sqldb.QueryRow(ctx, `
+		INSERT INTO notes (incident_id, text, created_by)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_by, text, created_at
+	`, id, params.Text, auth.Actor()))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert note").Err()
+	}
+	audit.Log(ctx, "incident.note", "incident", id, nil, note)
+	return note, nil
+}
+
+//encore:api auth method=GET path=/incidents/:id/notes
+func ListNotes(ctx context.Context, id int) (*Notes, error) {
+	if err := requireRole(ctx, id, authz.RoleViewer, "view notes of"); err != nil {
+		return nil, err
+	}
+	return listNotes(ctx, id)
+}
+
+func listNotes(ctx context.Context, id int) (*Notes, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, created_by, text, created_at
+		FROM notes
+		WHERE incident_id = $1
+		ORDER BY created_at ASC, id ASC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	notes := &Notes{}
+	for rows.Next() {
+		note, err := RowToNote(rows)
+		if err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		notes.Items = append(notes.Items, *note)
+	}
+	return notes, nil
+}
+
+// RowToNote Helper function from Row to Note
+func RowToNote(row interface {
+	Scan(dest ...interface{}) error
+}) (*Note, error) {
+	var note = &Note{}
+	err := row.Scan(&note.Id, &note.Author, &note.Text, &note.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return note, nil
+}
@@ -0,0 +1,629 @@
+package incidents
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/services"
+	"encore.app/slack"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Postmortem is a Markdown document about what happened during an incident and what we learn from
+// it. It is generated as a draft from the incident's history, and edited by the responders.
+type Postmortem struct {
+	Id          int
+	IncidentId  int
+	Body        string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	ActionItems []ActionItem
+}
+
+type ActionItems struct {
+	Items []ActionItem
+}
+
+// ActionItem is a follow-up of a postmortem, e.g. adding an alert, which an owner has to do by the due date
+type ActionItem struct {
+	Id           int
+	PostmortemId int
+	IncidentId   int
+	Title        string
+	Owner        users.User
+	DueDate      string // 2006-01-02
+	Done         bool
+	DoneAt       *time.Time
+}
+
+type UpdatePostmortemParams struct {
+	Body string
+}
+
+type ActionItemParams struct {
+	Title   string
+	OwnerId int
+	DueDate string // 2006-01-02
+}
+
+// UpdateActionItemParams only changes the fields which are set
+type UpdateActionItemParams struct {
+	Title   *string
+	OwnerId *int
+	DueDate *string
+	Done    *bool
+}
+
+type ListActionItemsParams struct {
+	OwnerId int  // only the action items of this user
+	Open    bool // only the action items which are not done
+}
+
+// dateLayout is the format of due dates
+const dateLayout = "2006-01-02"
+
+// CreatePostmortem generates the draft of a postmortem from the history of an incident
+//
+//encore:api auth method=POST path=/incidents/:id/postmortem
+func CreatePostmortem(ctx context.Context, id int) (*Postmortem, error) {
+	eb := errs.B().Meta("incidentId", id)
+	if err := requireResponder(ctx, id, "write the postmortem of"); err != nil {
+		return nil, err
+	}
+	incident, err := getIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	draft, err := draftPostmortem(ctx, incident)
+	if err != nil {
+		return nil, err
+	}
+	postmortem, err := RowToPostmortem(sqldb.QueryRow(ctx, `
+		INSERT INTO postmortems (incident_id, body, created_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (incident_id) DO NOTHING
+		RETURNING id, incident_id, body, created_at, updated_at
+	`, id, renderPostmortem(draft), auth.Actor()))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.AlreadyExists).Msg("the incident already has a postmortem").Err()
+	}
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert postmortem").Err()
+	}
+
+	audit.Log(ctx, "postmortem.create", "postmortem", postmortem.Id, nil, postmortem)
+	return postmortem, nil
+}
+
+//encore:api auth method=GET path=/incidents/:id/postmortem
+func GetPostmortem(ctx context.Context, id int) (*Postmortem, error) {
+	if err := requireRole(ctx, id, authz.RoleViewer, "view the postmortem of"); err != nil {
+		return nil, err
+	}
+	return getPostmortem(ctx, id)
+}
+
+// UpdatePostmortem replaces the Markdown of a postmortem
+//
+//encore:api auth method=PUT path=/incidents/:id/postmortem
+func UpdatePostmortem(ctx context.Context, id int, params *UpdatePostmortemParams) (*Postmortem, error) {
+	eb := errs.B().Meta("incidentId", id)
+	if err := requireResponder(ctx, id, "edit the postmortem of"); err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(params.Body)) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("body is empty").Err()
+	}
+	before, err := getPostmortem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	postmortem, err := RowToPostmortem(sqldb.QueryRow(ctx, `
+		UPDATE postmortems
+		SET body = $1, updated_by = $2, updated_at = NOW()
+		WHERE incident_id = $3
+		RETURNING id, incident_id, body, created_at, updated_at
+	`, params.Body, auth.Actor(), id))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update postmortem").Err()
+	}
+	postmortem.ActionItems = before.ActionItems
+
+	audit.Log(ctx, "postmortem.update", "postmortem", postmortem.Id, before, postmortem)
+	return postmortem, nil
+}
+
+//encore:api auth method=POST path=/incidents/:id/postmortem/action-items
+func AddActionItem(ctx context.Context, id int, params *ActionItemParams) (*ActionItem, error) {
+	eb := errs.B().Meta("incidentId", id, "params", params)
+	if err := requireResponder(ctx, id, "add action items to the postmortem of"); err != nil {
+		return nil, err
+	}
+	postmortem, err := getPostmortem(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyActionItem(ctx, params.Title, params.OwnerId, params.DueDate); err != nil {
+		return nil, err
+	}
+
+	var itemId int
+	err = sqldb.QueryRow(ctx, `
+		INSERT INTO action_items (postmortem_id, title, owner_id, due_date, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, postmortem.Id, params.Title, params.OwnerId, params.DueDate, auth.Actor()).Scan(&itemId)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert action item").Err()
+	}
+	item, err := getActionItem(ctx, id, itemId)
+	if err != nil {
+		return nil, err
+	}
+
+	audit.Log(ctx, "action_item.create", "action_item", item.Id, nil, item)
+	return item, nil
+}
+
+//encore:api auth method=PATCH path=/incidents/:id/postmortem/action-items/:itemId
+func UpdateActionItem(ctx context.Context, id int, itemId int, params *UpdateActionItemParams) (*ActionItem, error) {
+	eb := errs.B().Meta("incidentId", id, "itemId", itemId, "params", params)
+	if err := requireResponder(ctx, id, "update action items of the postmortem of"); err != nil {
+		return nil, err
+	}
+	before, err := getActionItem(ctx, id, itemId)
+	if err != nil {
+		return nil, err
+	}
+
+	title, ownerId, dueDate, done := before.Title, before.Owner.Id, before.DueDate, before.Done
+	if params.Title != nil {
+		title = *params.Title
+	}
+	if params.OwnerId != nil {
+		ownerId = *params.OwnerId
+	}
+	if params.DueDate != nil {
+		dueDate = *params.DueDate
+	}
+	if params.Done != nil {
+		done = *params.Done
+	}
+	if params.OwnerId != nil || params.DueDate != nil || params.Title != nil {
+		if err := verifyActionItem(ctx, title, ownerId, dueDate); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = sqldb.Exec(ctx, `
+		UPDATE action_items
+		SET title = $1, owner_id = $2, due_date = $3, updated_by = $4,
+		    done_at = CASE WHEN $5 THEN COALESCE(done_at, NOW()) END
+		WHERE id = $6
+	`, title, ownerId, dueDate, auth.Actor(), done, itemId)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update action item").Err()
+	}
+	item, err := getActionItem(ctx, id, itemId)
+	if err != nil {
+		return nil, err
+	}
+
+	audit.Log(ctx, "action_item.update", "action_item", item.Id, before, item)
+	return item, nil
+}
+
+// ListActionItems returns the action items of all postmortems, the ones due first
+//
+//encore:api auth method=GET path=/action-items
+func ListActionItems(ctx context.Context, params *ListActionItemsParams) (*ActionItems, error) {
+	if err := authz.RequireTeamRole(authz.RoleViewer, nil, "view action items"); err != nil {
+		return nil, err
+	}
+	return listActionItems(ctx, `
+		WHERE ($1 = 0 OR a.owner_id = $1)
+		  AND (NOT $2 OR a.done_at IS NULL)
+		ORDER BY a.due_date ASC, a.id ASC
+	`, params.OwnerId, params.Open)
+}
+
+var _ = cron.NewJob("overdue-action-items", cron.JobConfig{
+	Title:    "Remind owners of overdue postmortem action items",
+	Every:    24 * cron.Hour,
+	Endpoint: RemindOverdueActionItems,
+})
+
+//encore:api private
+func RemindOverdueActionItems(ctx context.Context) error {
+	overdue, err := listActionItems(ctx, `
+		WHERE a.done_at IS NULL
+		  AND a.due_date < CURRENT_DATE
+		ORDER BY a.due_date ASC, a.id ASC
+	`)
+	if err != nil {
+		return err
+	}
+	if len(overdue.Items) == 0 {
+		return nil
+	}
+
+	lines := []string{"These postmortem action items are overdue:"}
+	for _, item := range overdue.Items {
+		lines = append(lines, fmt.Sprintf("- %s (incident #%d), due %s, owned by %s", item.Title, item.IncidentId, item.DueDate, users.Mention(ctx, &item.Owner)))
+	}
+	return slack.Notify(ctx, &slack.NotifyParams{Text: strings.Join(lines, "\n")})
+}
+
+func getPostmortem(ctx context.Context, incidentId int) (*Postmortem, error) {
+	postmortem, err := RowToPostmortem(sqldb.QueryRow(ctx, `
+		SELECT id, incident_id, body, created_at, updated_at
+		FROM postmortems
+		WHERE incident_id = $1
+	`, incidentId))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Meta("incidentId", incidentId).Code(errs.NotFound).Msg("the incident has no postmortem yet").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := listActionItems(ctx, `
+		WHERE a.postmortem_id = $1
+		ORDER BY a.due_date ASC, a.id ASC
+	`, postmortem.Id)
+	if err != nil {
+		return nil, err
+	}
+	postmortem.ActionItems = items.Items
+	return postmortem, nil
+}
+
+func getActionItem(ctx context.Context, incidentId int, itemId int) (*ActionItem, error) {
+	items, err := listActionItems(ctx, `
+		WHERE p.incident_id = $1
+		  AND a.id = $2
+	`, incidentId, itemId)
+	if err != nil {
+		return nil, err
+	}
+	if len(items.Items) == 0 {
+		return nil, errs.B().Meta("incidentId", incidentId, "itemId", itemId).Code(errs.NotFound).Msg("no action item found").Err()
+	}
+	return &items.Items[0], nil
+}
+
+// listActionItems Helper function returning the action items matching the WHERE clause, which
+// can refer to the action items as a and their postmortems as p
+func listActionItems(ctx context.Context, where string, args ...interface{}) (*ActionItems, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT a.id, a.postmortem_id, p.incident_id, a.title, a.owner_id, a.due_date, a.done_at
+		FROM action_items a
+		JOIN postmortems p ON p.id = a.postmortem_id
+	`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	items := &ActionItems{}
+	for rows.Next() {
+		var item ActionItem
+		var ownerId int
+		var dueDate time.Time
+		if err := rows.Scan(&item.Id, &item.PostmortemId, &item.IncidentId, &item.Title, &ownerId, &dueDate, &item.DoneAt); err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		owner, err := users.Get(ctx, ownerId)
+		if err != nil {
+			return nil, err
+		}
+		item.Owner = *owner
+		item.DueDate = dueDate.Format(dateLayout)
+		item.Done = item.DoneAt != nil
+		items.Items = append(items.Items, item)
+	}
+	return items, nil
+}
+
+// verifyActionItem Helper function for making sure an action item has a title, an owner who can
+// still do it and a due date
+func verifyActionItem(ctx context.Context, title string, ownerId int, dueDate string) error {
+	eb := errs.B()
+	if len(strings.TrimSpace(title)) == 0 {
+		return eb.Code(errs.InvalidArgument).Msg("title is empty").Err()
+	}
+	if _, err := time.Parse(dateLayout, dueDate); err != nil {
+		return eb.Code(errs.InvalidArgument).Msgf("due date is not a date like %s", dateLayout).Err()
+	}
+	if _, err := users.GetAssignable(ctx, ownerId); err != nil {
+		return err
+	}
+	return nil
+}
+
+// postmortemDraft is what the draft of a postmortem is rendered from
+type postmortemDraft struct {
+	Incident   Incident
+	Service    *services.Service
+	Timeline   []timelineEntry
+	Responders []string
+}
+
+type timelineEntry struct {
+	At   time.Time
+	Text string
+}
+
+// draftPostmortem Helper function gathering the timeline and responders of an incident from its
+// audit events and notes
+func draftPostmortem(ctx context.Context, incident *Incident) (*postmortemDraft, error) {
+	draft := &postmortemDraft{Incident: *incident}
+	if incident.ServiceId != nil {
+		service, err := services.Get(ctx, *incident.ServiceId)
+		if err != nil {
+			rlog.Error("FAIL to get service of incident", "incident", incident.Id, "err", err)
+		} else {
+			draft.Service = service
+		}
+	}
+
+	// long incidents have more events than one page of the history
+	var events []audit.Event
+	history := &audit.HistoryParams{EntityType: "incident", EntityId: strconv.Itoa(incident.Id)}
+	for {
+		page, err := audit.History(ctx, history)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, page.Items...)
+		if page.NextCursor == 0 {
+			break
+		}
+		history.Cursor = page.NextCursor
+	}
+	notes, err := listNotes(ctx, incident.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]string{}
+	name := func(actor *string) string {
+		if actor == nil {
+			return "the system"
+		}
+		if _, ok := names[*actor]; !ok {
+			names[*actor] = describeActor(ctx, *actor)
+		}
+		return names[*actor]
+	}
+	// responders in the order they joined, with the roles they held
+	var responders []string
+	roles := map[string][]string{}
+	addResponder := func(name string, role string) {
+		held, ok := roles[name]
+		if !ok {
+			responders = append(responders, name)
+		}
+		for _, r := range held {
+			if r == role {
+				return
+			}
+		}
+		if role != "" {
+			held = append(held, role)
+		}
+		roles[name] = held
+	}
+
+	for _, event := range events {
+		if event.Action == "incident.note" {
+			continue // notes are added from the notes below, including those from before they were audited
+		}
+		var after Incident
+		if len(event.After) > 0 {
+			if err := json.Unmarshal(event.After, &after); err != nil {
+				return nil, err
+			}
+		}
+		if after.Assignee != nil {
+			addResponder(fullName(after.Assignee), "")
+		}
+		for _, assignment := range after.Roles {
+			addResponder(fullName(&assignment.User), describeRole(assignment.Role))
+		}
+		for _, responder := range after.Responders {
+			if responder.Status == ResponderAccepted {
+				addResponder(fullName(&responder.User), "")
+			}
+		}
+		actor := name(event.Actor)
+		if event.Actor != nil && strings.HasPrefix(*event.Actor, "user:") {
+			addResponder(actor, "")
+		}
+		draft.Timeline = append(draft.Timeline, timelineEntry{At: event.CreatedAt, Text: describeEvent(event.Action, actor, &after)})
+	}
+	for _, note := range notes.Items {
+		author := name(note.Author)
+		if note.Author != nil && strings.HasPrefix(*note.Author, "user:") {
+			addResponder(author, "")
+		}
+		draft.Timeline = append(draft.Timeline, timelineEntry{At: note.CreatedAt, Text: fmt.Sprintf("Note by %s: %s", author, note.Text)})
+	}
+	for _, responder := range responders {
+		if len(roles[responder]) > 0 {
+			responder = fmt.Sprintf("%s (%s)", responder, strings.Join(roles[responder], ", "))
+		}
+		draft.Responders = append(draft.Responders, responder)
+	}
+
+	// notes and events are interleaved in the order they happened
+	sort.SliceStable(draft.Timeline, func(i, j int) bool {
+		return draft.Timeline[i].At.Before(draft.Timeline[j].At)
+	})
+	return draft, nil
+}
+
+func describeEvent(action string, actor string, after *Incident) string {
+	switch action {
+	case "incident.create":
+		switch {
+		case after.Suppressed:
+			return fmt.Sprintf("Incident created by %s and suppressed", actor)
+		case after.Assignee != nil:
+			return fmt.Sprintf("Incident created by %s and assigned to %s", actor, fullName(after.Assignee))
+		}
+		return fmt.Sprintf("Incident created by %s, nobody was on-call", actor)
+	case "incident.assign":
+		if after.Assignee != nil {
+			return fmt.Sprintf("Assigned to %s by %s", fullName(after.Assignee), actor)
+		}
+	case "incident.acknowledge":
+		return fmt.Sprintf("Acknowledged by %s", actor)
+	case "incident.resolve":
+		return fmt.Sprintf("Resolved automatically by %s", actor)
+	case "incident.snooze":
+		if after.SnoozedUntil != nil {
+			return fmt.Sprintf("Snoozed until %s by %s", after.SnoozedUntil.UTC().Format("15:04"), actor)
+		}
+	case "incident.wake":
+		return "Snooze expired"
+	case "incident.responders":
+		return fmt.Sprintf("Responders paged by %s: %s", actor, describeResponders(after.Responders))
+	case "incident.respond":
+		return fmt.Sprintf("%s responded to the page: %s", actor, describeResponders(after.Responders))
+	case "incident.merge":
+		if after.ParentId != nil {
+			return fmt.Sprintf("Merged into incident #%d by %s", *after.ParentId, actor)
+		}
+	case "incident.merge_into":
+		return fmt.Sprintf("Incidents %s merged into this one by %s", describeIds(after.ChildIds), actor)
+	case "incident.link", "incident.unlink":
+		if len(after.RelatedIds) == 0 {
+			return fmt.Sprintf("Related incidents unlinked by %s", actor)
+		}
+		return fmt.Sprintf("Related incidents are now %s, linked by %s", describeIds(after.RelatedIds), actor)
+	case "incident.escalate":
+		return fmt.Sprintf("Escalated to %s by a more severe incident of the alert storm", after.Severity)
+	case "incident.roles":
+		if roles := describeRoles(after.Roles); roles != "" {
+			return fmt.Sprintf("Roles assigned by %s: %s", actor, roles)
+		}
+		return fmt.Sprintf("Roles unassigned by %s", actor)
+	case "incident.remove_responder":
+		return fmt.Sprintf("Responder who no longer exists removed by %s", actor)
+	case "incident.remove_role":
+		return fmt.Sprintf("Role of a user who no longer exists unassigned by %s", actor)
+	}
+	return fmt.Sprintf("%s by %s", action, actor)
+}
+
+// describeActor Helper function naming whoever an auth UID belongs to
+func describeActor(ctx context.Context, actor string) string {
+	kind, id, _ := strings.Cut(actor, ":")
+	switch kind {
+	case "user":
+		if userId, err := strconv.Atoi(id); err == nil {
+			if user, err := users.Get(ctx, userId); err == nil {
+				return fullName(user)
+			}
+		}
+	case "apikey":
+		return "API key #" + id
+	case "system":
+		return id
+	}
+	return actor
+}
+
+func describeIds(ids []int) string {
+	var parts []string
+	for _, id := range ids {
+		parts = append(parts, fmt.Sprintf("#%d", id))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func fullName(user *users.User) string {
+	return user.FirstName + " " + user.LastName
+}
+
+// renderPostmortem renders the Markdown draft of a postmortem, with placeholders for what the
+// responders have to fill in
+func renderPostmortem(draft *postmortemDraft) string {
+	incident := draft.Incident
+	title, _, _ := strings.Cut(strings.TrimSpace(incident.Body), "\n")
+	if runes := []rune(title); len(runes) > 80 {
+		title = string(runes[:77]) + "..."
+	}
+
+	var md strings.Builder
+	fmt.Fprintf(&md, "# Postmortem: %s\n\n", title)
+	fmt.Fprintf(&md, "Incident #%d, %s\n\n", incident.Id, incident.Severity)
+
+	md.WriteString("## Summary\n\n")
+	fmt.Fprintf(&md, "> %s\n\n", strings.ReplaceAll(strings.TrimSpace(incident.Body), "\n", "\n> "))
+	md.WriteString("_What happened and why, in a few sentences._\n\n")
+
+	md.WriteString("## Impact\n\n")
+	if draft.Service != nil {
+		fmt.Fprintf(&md, "- Service: %s\n", draft.Service.Name)
+	}
+	fmt.Fprintf(&md, "- Start: %s\n", incident.CreatedAt.UTC().Format("2006-01-02 15:04 MST"))
+	if incident.AcknowledgedAt != nil {
+		fmt.Fprintf(&md, "- End: %s\n", incident.AcknowledgedAt.UTC().Format("2006-01-02 15:04 MST"))
+		fmt.Fprintf(&md, "- Duration: %s\n", incident.AcknowledgedAt.Sub(incident.CreatedAt).Round(time.Minute))
+	} else {
+		md.WriteString("- End: ongoing\n")
+	}
+	md.WriteString("\n_Who was affected and how._\n\n")
+
+	md.WriteString("## Timeline\n\nAll times are UTC.\n\n")
+	for _, entry := range draft.Timeline {
+		fmt.Fprintf(&md, "- %s %s\n", entry.At.UTC().Format("2006-01-02 15:04"), entry.Text)
+	}
+	if len(draft.Timeline) == 0 {
+		md.WriteString("_Nothing was recorded._\n")
+	}
+	md.WriteString("\n")
+
+	md.WriteString("## Responders\n\n")
+	for _, responder := range draft.Responders {
+		fmt.Fprintf(&md, "- %s\n", responder)
+	}
+	if len(draft.Responders) == 0 {
+		md.WriteString("_Nobody was assigned._\n")
+	}
+	md.WriteString("\n")
+
+	md.WriteString("## Root cause\n\n_Why it happened, and why it wasn't caught earlier._\n\n")
+	md.WriteString("## Action items\n\n_Follow-ups are tracked as action items of this postmortem, each with an owner and a due date._\n")
+	return md.String()
+}
+
+// RowToPostmortem Helper function from Row to Postmortem, without its action items
+func RowToPostmortem(row interface {
+	Scan(dest ...interface{}) error
+}) (*Postmortem, error) {
+	var postmortem = &Postmortem{}
+	err := row.Scan(&postmortem.Id, &postmortem.IncidentId, &postmortem.Body, &postmortem.CreatedAt, &postmortem.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return postmortem, nil
+}
@@ -0,0 +1,154 @@
+package incidents
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"encore.app/audit"
+	"encore.app/services"
+	"encore.app/users"
+)
+
+func TestRenderPostmortem(t *testing.T) {
+	created := time.Date(2030, 1, 7, 22, 0, 0, 0, time.UTC)
+	acknowledged := created.Add(72 * time.Minute)
+	jane := &users.User{Id: 2, FirstName: "Jane", LastName: "Doe"}
+
+	markdown := renderPostmortem(&postmortemDraft{
+		Incident: Incident{
+			Id:             12,
+			Body:           "Checkout is failing\nPayments time out",
+			Severity:       "SEV1",
+			CreatedAt:      created,
+			AcknowledgedAt: &acknowledged,
+		},
+		Service: &services.Service{Name: "checkout"},
+		Timeline: []timelineEntry{
+			{At: created, Text: describeEvent("incident.create", "API key #1", &Incident{Assignee: jane})},
+			{At: created.Add(5 * time.Minute), Text: "Note by Jane Doe: the payment provider is down"},
+			{At: acknowledged, Text: describeEvent("incident.acknowledge", "Jane Doe", &Incident{})},
+		},
+		Responders: []string{"Jane Doe"},
+	})
+
+	for _, expected := range []string{
+		"# Postmortem: Checkout is failing\n",
+		"Incident #12, SEV1\n",
+		"> Checkout is failing\n> Payments time out\n",
+		"- Service: checkout\n",
+		"- Start: 2030-01-07 22:00 UTC\n",
+		"- End: 2030-01-07 23:12 UTC\n",
+		"- Duration: 1h12m0s\n",
+		"- 2030-01-07 22:00 Incident created by API key #1 and assigned to Jane Doe\n",
+		"- 2030-01-07 22:05 Note by Jane Doe: the payment provider is down\n",
+		"- 2030-01-07 23:12 Acknowledged by Jane Doe\n",
+		"## Responders\n\n- Jane Doe\n",
+		"## Action items\n",
+	} {
+		if !strings.Contains(markdown, expected) {
+			t.Errorf("expected postmortem to contain %q, got\n%s", expected, markdown)
+		}
+	}
+}
+
+func TestRenderPostmortemOfOngoingIncident(t *testing.T) {
+	markdown := renderPostmortem(&postmortemDraft{Incident: Incident{Id: 1, Body: "Disk full", Severity: "SEV3"}})
+	for _, expected := range []string{"- End: ongoing\n", "_Nothing was recorded._", "_Nobody was assigned._"} {
+		if !strings.Contains(markdown, expected) {
+			t.Errorf("expected postmortem to contain %q, got\n%s", expected, markdown)
+		}
+	}
+}
+
+func TestRenderPostmortemTruncatesLongTitleByCharacters(t *testing.T) {
+	body := strings.Repeat("ü", 100)
+	markdown := renderPostmortem(&postmortemDraft{Incident: Incident{Id: 1, Body: body, Severity: "SEV3"}})
+	title, _, _ := strings.Cut(markdown, "\n")
+	if expected := "# Postmortem: " + strings.Repeat("ü", 77) + "..."; title != expected {
+		t.Errorf("expected title %q, got %q", expected, title)
+	}
+	if !utf8.ValidString(markdown) {
+		t.Error("expected the postmortem to be valid UTF-8")
+	}
+}
+
+func TestDescribeRoles(t *testing.T) {
+	incident := &Incident{Id: 12, Roles: []RoleAssignment{
+		{Role: RoleCommander, User: users.User{FirstName: "Jane", LastName: "Doe"}},
+		{Role: RoleCommunicationsLead, User: users.User{FirstName: "Bil", LastName: "Hameed"}},
+	}}
+
+	if text := withRoles("Incident #12 is snoozed", incident); text != "Incident #12 is snoozed\nRoles: commander: Jane Doe, communications lead: Bil Hameed" {
+		t.Errorf("unexpected Slack message %q", text)
+	}
+	if text := withRoles("Incident #13 is snoozed", &Incident{Id: 13}); text != "Incident #13 is snoozed" {
+		t.Errorf("expected no roles in Slack message, got %q", text)
+	}
+	if text := describeEvent("incident.roles", "Jane Doe", incident); text != "Roles assigned by Jane Doe: commander: Jane Doe, communications lead: Bil Hameed" {
+		t.Errorf("unexpected timeline entry %q", text)
+	}
+}
+
+func TestDescribeResponders(t *testing.T) {
+	incident := &Incident{Responders: []Responder{
+		{User: users.User{FirstName: "Jane", LastName: "Doe"}, Status: ResponderAccepted},
+		{User: users.User{FirstName: "Bil", LastName: "Hameed"}, Status: ResponderRequested},
+	}}
+	if text := describeEvent("incident.responders", "API key #1", incident); text != "Responders paged by API key #1: Jane Doe (accepted), Bil Hameed (requested)" {
+		t.Errorf("unexpected timeline entry %q", text)
+	}
+}
+
+func TestDescribeMerge(t *testing.T) {
+	parentId := 1
+	if text := describeEvent("incident.merge", "Jane Doe", &Incident{ParentId: &parentId}); text != "Merged into incident #1 by Jane Doe" {
+		t.Errorf("unexpected timeline entry %q", text)
+	}
+	if text := describeEvent("incident.merge_into", "Jane Doe", &Incident{ChildIds: []int{2, 3}}); text != "Incidents #2, #3 merged into this one by Jane Doe" {
+		t.Errorf("unexpected timeline entry %q", text)
+	}
+}
+
+func TestPostmortemTimelineHasEveryEventAndNote(t *testing.T) {
+	ctx := authenticated()
+	incident := createIncident(t, "Queue is backing up")
+	if _, err := AddNote(ctx, incident.Id, &AddNoteParams{Text: "consumers are stuck"}); err != nil {
+		t.Fatal(err)
+	}
+	history, err := audit.History(ctx, &audit.HistoryParams{EntityType: "incident", EntityId: strconv.Itoa(incident.Id)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := len(history.Items); actions == 0 || history.Items[actions-1].Action != "incident.note" {
+		t.Errorf("expected adding the note to be audited, got %+v", history.Items)
+	}
+
+	// more events than one page of the history
+	for i := 0; i < 500; i++ {
+		err := audit.Record(ctx, &audit.RecordParams{Action: "incident.acknowledge", EntityType: "incident", EntityId: strconv.Itoa(incident.Id)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	draft, err := draftPostmortem(ctx, incident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes := 0
+	for _, entry := range draft.Timeline {
+		if strings.HasPrefix(entry.Text, "Note by") {
+			notes++
+		}
+	}
+	if notes != 1 {
+		t.Errorf("expected the note once, got %d times", notes)
+	}
+	// the audited note is in the timeline once, from the notes
+	if expected := len(history.Items) + 500; len(draft.Timeline) != expected {
+		t.Errorf("expected %d timeline entries, got %d", expected, len(draft.Timeline))
+	}
+}
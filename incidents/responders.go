@@ -0,0 +1,296 @@
+package incidents
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/email"
+	"encore.app/schedules"
+	"encore.app/slack"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Statuses of responders
+const (
+	ResponderRequested = "requested"
+	ResponderAccepted  = "accepted"
+	ResponderDeclined  = "declined"
+)
+
+// Responder is someone paged into an incident to help, besides the assignee
+type Responder struct {
+	User        users.User
+	Status      string // requested, accepted or declined
+	Message     string // what help is needed
+	RequestedAt time.Time
+	RespondedAt *time.Time
+}
+
+// AddRespondersParams targets either a user, the responders of a team or whoever is on-call in
+// a schedule layer
+type AddRespondersParams struct {
+	UserId  *int
+	TeamId  *int
+	Layer   string // e.g. secondary
+	Message string // what help is needed, e.g. "the database is out of connections"
+}
+
+type RespondParams struct {
+	Status string // accepted or declined
+}
+
+// AddResponders pages more people into an incident, without changing who it is assigned to. They
+// are mentioned on Slack and emailed, and can accept or decline to help.
+//
+//encore:api auth method=POST path=/incidents/:id/responders
+func AddResponders(ctx context.Context, id int, params *AddRespondersParams) (*Incident, error) {
+	eb := errs.B().Meta("incidentId", id, "params", params)
+	if err := requireResponder(ctx, id, "page responders into"); err != nil {
+		return nil, err
+	}
+	before, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := resolveResponders(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	var paged []users.User
+	for _, user := range targets {
+		if before.Assignee != nil && before.Assignee.Id == user.Id {
+			continue // already working on it
+		}
+		paged = append(paged, user)
+	}
+	if len(paged) == 0 {
+		return nil, eb.Code(errs.FailedPrecondition).Msg("nobody to page besides the assignee").Err()
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	for _, user := range paged {
+		// paging someone again asks them again, even if they declined before
+		_, err := sqldb.ExecTx(tx, ctx, `
+			INSERT INTO responders (incident_id, user_id, message, requested_by)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (incident_id, user_id) DO UPDATE
+			SET status = 'requested', message = EXCLUDED.message, requested_by = EXCLUDED.requested_by,
+			    requested_at = NOW(), responded_at = NULL
+		`, id, user.Id, params.Message, auth.Actor())
+		if err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert responder").Err()
+		}
+	}
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("commit responders").Err()
+	}
+
+	incident, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "incident.responders", "incident", id, before, incident)
+	notifyResponders(ctx, incident, paged, params.Message)
+	return incident, nil
+}
+
+// Respond accepts or declines to help with an incident someone was paged into
+//
+//encore:api auth method=PUT path=/incidents/:id/responders/:userId
+func Respond(ctx context.Context, id int, userId int, params *RespondParams) (*Incident, error) {
+	eb := errs.B().Meta("incidentId", id, "userId", userId, "params", params)
+	if actor := auth.Actor(); actor == nil || *actor != string(auth.UserUID(userId)) {
+		return nil, eb.Code(errs.PermissionDenied).Msg("only the responder can accept or decline to help").Err()
+	}
+	if params.Status != ResponderAccepted && params.Status != ResponderDeclined {
+		return nil, eb.Code(errs.InvalidArgument).Msgf("status is neither %s nor %s", ResponderAccepted, ResponderDeclined).Err()
+	}
+	before, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var user users.User
+	for _, responder := range before.Responders {
+		if responder.User.Id == userId {
+			user = responder.User
+		}
+	}
+	if user.Id == 0 {
+		return nil, eb.Code(errs.NotFound).Msg("you have not been paged into the incident").Err()
+	}
+
+	_, err = sqldb.Exec(ctx, `
+		UPDATE responders
+		SET status = $1, responded_at = NOW()
+		WHERE incident_id = $2
+		  AND user_id = $3
+	`, params.Status, id, userId)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update responder").Err()
+	}
+
+	incident, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "incident.respond", "incident", id, before, incident)
+	_ = slack.Notify(ctx, &slack.NotifyParams{
+		Text: withRoles(fmt.Sprintf("%s %s to help with incident #%d\n%s", fullName(&user), params.Status, incident.Id, incident.Body), incident),
+	})
+	return incident, nil
+}
+
+// resolveResponders Helper function returning the users targeted by AddRespondersParams, who
+// have to be assignable
+func resolveResponders(ctx context.Context, params *AddRespondersParams) ([]users.User, error) {
+	eb := errs.B().Meta("params", params)
+	targets := 0
+	for _, set := range []bool{params.UserId != nil, params.TeamId != nil, params.Layer != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("target either a user, a team or a schedule layer").Err()
+	}
+
+	switch {
+	case params.UserId != nil:
+		user, err := users.GetAssignable(ctx, *params.UserId)
+		if err != nil {
+			return nil, err
+		}
+		return []users.User{*user}, nil
+	case params.TeamId != nil:
+		team, err := users.GetTeam(ctx, *params.TeamId)
+		if err != nil {
+			return nil, err
+		}
+		var members []users.User
+		for _, member := range team.Members {
+			if member.Role.Includes(authz.RoleResponder) && member.User.DeactivatedAt == nil {
+				members = append(members, member.User)
+			}
+		}
+		if len(members) == 0 {
+			return nil, eb.Code(errs.FailedPrecondition).Msgf("team %s has no responders", team.Name).Err()
+		}
+		return members, nil
+	}
+
+	schedule, err := schedules.ScheduledNow(ctx, &schedules.ScheduledParams{Layer: params.Layer})
+	if err != nil {
+		return nil, err
+	}
+	return []users.User{schedule.User}, nil
+}
+
+// notifyResponders Helper function paging responders through their contact methods: a mention on
+// Slack, and an email if we know their address
+func notifyResponders(ctx context.Context, incident *Incident, paged []users.User, message string) {
+	var mentions []string
+	for _, user := range paged {
+		mentions = append(mentions, users.Mention(ctx, &user))
+	}
+	text := fmt.Sprintf("%s: you are paged to help with incident #%d [%s]", strings.Join(mentions, " "), incident.Id, incident.Severity)
+	if message != "" {
+		text = fmt.Sprintf("%s: %s", text, message)
+	}
+	_ = slack.Notify(ctx, &slack.NotifyParams{Text: withRoles(fmt.Sprintf("%s\n%s", text, incident.Body), incident)})
+
+	for _, user := range paged {
+		if user.Email == "" {
+			continue
+		}
+		body := fmt.Sprintf("You are paged to help with incident #%d [%s].\n\n%s\n\n%s\n\nAccept or decline with PUT /incidents/%d/responders/%d.", incident.Id, incident.Severity, message, incident.Body, incident.Id, user.Id)
+		err := email.Send(ctx, &email.SendParams{
+			To:      user.Email,
+			Subject: fmt.Sprintf("[%s] You are paged to help with incident #%d", incident.Severity, incident.Id),
+			Body:    body,
+		})
+		if err != nil {
+			rlog.Error("FAIL to email responder", "incident", incident.Id, "user", user.Id, "err", err)
+		}
+	}
+}
+
+// isAcceptedResponder reports whether the caller accepted to help with an incident, so they can
+// work on it even if they are not a responder in one of its teams
+func isAcceptedResponder(incident *Incident) bool {
+	actor := auth.Actor()
+	if actor == nil {
+		return false
+	}
+	for _, responder := range incident.Responders {
+		if responder.Status == ResponderAccepted && string(auth.UserUID(responder.User.Id)) == *actor {
+			return true
+		}
+	}
+	return false
+}
+
+func describeResponders(responders []Responder) string {
+	var parts []string
+	for _, responder := range responders {
+		parts = append(parts, fmt.Sprintf("%s (%s)", fullName(&responder.User), responder.Status))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// loadResponders Helper function adding the responders to incidents, in the order they were paged
+func loadResponders(ctx context.Context, incidents []Incident) error {
+	if len(incidents) == 0 {
+		return nil
+	}
+	byId := map[int]*Incident{}
+	var ids []string
+	for i := range incidents {
+		byId[incidents[i].Id] = &incidents[i]
+		ids = append(ids, fmt.Sprint(incidents[i].Id))
+	}
+
+	rows, err := sqldb.Query(ctx, `
+		SELECT incident_id, user_id, status, message, requested_at, responded_at
+		FROM responders
+		WHERE incident_id = ANY(STRING_TO_ARRAY($1, ',')::BIGINT[])
+		ORDER BY requested_at ASC, user_id ASC
+	`, strings.Join(ids, ","))
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var incidentId, userId int
+		var responder Responder
+		if err := rows.Scan(&incidentId, &userId, &responder.Status, &responder.Message, &responder.RequestedAt, &responder.RespondedAt); err != nil {
+			return err
+		}
+		user, err := users.Get(ctx, userId)
+		if err != nil {
+			rlog.Error("FAIL to get responder", "incident", incidentId, "user", userId, "err", err)
+			continue
+		}
+		responder.User = *user
+		if incident, ok := byId[incidentId]; ok {
+			incident.Responders = append(incident.Responders, responder)
+		}
+	}
+	return nil
+}
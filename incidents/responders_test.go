@@ -0,0 +1,108 @@
+package incidents
+
+import (
+	"context"
+	"testing"
+
+	"encore.app/auth"
+	"encore.app/users"
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+// authenticatedAs is the context of a request made by a user with their own token
+func authenticatedAs(user *users.User) context.Context {
+	return encoreauth.WithContext(context.Background(), auth.UserUID(user.Id), &auth.Data{User: user, Name: fullName(user)})
+}
+
+func TestAddRespondersTwicePagesOnce(t *testing.T) {
+	user := createUser(t)
+	incident := createIncident(t, "Database is out of connections")
+
+	if _, err := AddResponders(authenticated(), incident.Id, &AddRespondersParams{UserId: &user.Id, Message: "help"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Respond(authenticatedAs(user), incident.Id, user.Id, &RespondParams{Status: ResponderDeclined}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := AddResponders(authenticated(), incident.Id, &AddRespondersParams{UserId: &user.Id, Message: "please help"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// paging someone again asks them again
+	if len(updated.Responders) != 1 {
+		t.Fatalf("expected one responder, got %+v", updated.Responders)
+	}
+	responder := updated.Responders[0]
+	if responder.User.Id != user.Id || responder.Status != ResponderRequested || responder.Message != "please help" || responder.RespondedAt != nil {
+		t.Errorf("expected user #%d to be asked again, got %+v", user.Id, responder)
+	}
+}
+
+func TestAddRespondersRejectsDeactivatedUser(t *testing.T) {
+	user := createUser(t)
+	if _, err := users.Deactivate(authenticated(), user.Id); err != nil {
+		t.Fatal(err)
+	}
+	incident := createIncident(t, "Database is out of connections")
+
+	_, err := AddResponders(authenticated(), incident.Id, &AddRespondersParams{UserId: &user.Id})
+	if errs.Code(err) != errs.FailedPrecondition {
+		t.Errorf("expected a deactivated user to be rejected, got %v", err)
+	}
+}
+
+func TestAddRespondersRejectsUnknownUser(t *testing.T) {
+	incident := createIncident(t, "Database is out of connections")
+	unknownId := 2147483000
+
+	_, err := AddResponders(authenticated(), incident.Id, &AddRespondersParams{UserId: &unknownId})
+	if err == nil {
+		t.Error("expected a user who doesn't exist to be rejected")
+	}
+}
+
+func TestRespondTwice(t *testing.T) {
+	user := createUser(t)
+	incident := createIncident(t, "Database is out of connections")
+	if _, err := AddResponders(authenticated(), incident.Id, &AddRespondersParams{UserId: &user.Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Respond(authenticatedAs(user), incident.Id, user.Id, &RespondParams{Status: ResponderAccepted}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := Respond(authenticatedAs(user), incident.Id, user.Id, &RespondParams{Status: ResponderDeclined})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last answer counts
+	if len(updated.Responders) != 1 || updated.Responders[0].Status != ResponderDeclined || updated.Responders[0].RespondedAt == nil {
+		t.Errorf("expected user #%d to have declined, got %+v", user.Id, updated.Responders)
+	}
+}
+
+func TestRespondForSomebodyElseIsDenied(t *testing.T) {
+	user, other := createUser(t), createUser(t)
+	incident := createIncident(t, "Database is out of connections")
+	if _, err := AddResponders(authenticated(), incident.Id, &AddRespondersParams{UserId: &user.Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Respond(authenticatedAs(other), incident.Id, user.Id, &RespondParams{Status: ResponderAccepted})
+	if errs.Code(err) != errs.PermissionDenied {
+		t.Errorf("expected answering for somebody else to be denied, got %v", err)
+	}
+}
+
+func TestRespondWithoutBeingPagedIsNotFound(t *testing.T) {
+	user := createUser(t)
+	incident := createIncident(t, "Database is out of connections")
+
+	_, err := Respond(authenticatedAs(user), incident.Id, user.Id, &RespondParams{Status: ResponderAccepted})
+	if errs.Code(err) != errs.NotFound {
+		t.Errorf("expected answering without being paged to be not found, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package incidents
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/slack"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Incident roles for major incidents, held by people besides the assignee
+const (
+	RoleCommander          = "commander"           // coordinates the response and makes the decisions
+	RoleCommunicationsLead = "communications_lead" // keeps stakeholders and the status page up to date
+	RoleScribe             = "scribe"              // keeps notes for the timeline of the postmortem
+)
+
+var Roles = []string{RoleCommander, RoleCommunicationsLead, RoleScribe}
+
+// RoleAssignment is a user holding a role in an incident
+type RoleAssignment struct {
+	Role string
+	User users.User
+}
+
+type SetRolesParams struct {
+	Roles map[string]int // the user holding each role, e.g. {"commander":2}, roles which are left out are unassigned
+}
+
+// SetRoles replaces who holds the roles of an incident. Users who get a role are paged on Slack,
+// the assignee stays the same.
+//
+//encore:api auth method=PUT path=/incidents/:id/roles
+func SetRoles(ctx context.Context, id int, params *SetRolesParams) (*Incident, error) {
+	eb := errs.B().Meta("incidentId", id, "params", params)
+	if err := requireResponder(ctx, id, "assign roles of"); err != nil {
+		return nil, err
+	}
+	for role, userId := range params.Roles {
+		if err := VerifyRole(role); err != nil {
+			return nil, err
+		}
+		if _, err := users.GetAssignable(ctx, userId); err != nil {
+			return nil, err
+		}
+	}
+	before, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	var kept []string
+	for role := range params.Roles {
+		kept = append(kept, role)
+	}
+	_, err = sqldb.ExecTx(tx, ctx, `
+		DELETE FROM roles
+		WHERE incident_id = $1
+		  AND NOT role = ANY(STRING_TO_ARRAY($2, ','))
+	`, id, strings.Join(kept, ","))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("unassign roles").Err()
+	}
+	for role, userId := range params.Roles {
+		// a role held by the same user as before is left as it is
+		_, err := sqldb.ExecTx(tx, ctx, `
+			INSERT INTO roles (incident_id, role, user_id, assigned_by)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (incident_id, role) DO UPDATE
+			SET user_id = EXCLUDED.user_id, assigned_by = EXCLUDED.assigned_by, assigned_at = NOW()
+			WHERE roles.user_id <> EXCLUDED.user_id
+		`, id, role, userId, auth.Actor())
+		if err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msg("assign role").Err()
+		}
+	}
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("commit roles").Err()
+	}
+
+	incident, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "incident.roles", "incident", id, before, incident)
+
+	// page whoever got a role they didn't hold before
+	var paged []string
+	for _, assignment := range incident.Roles {
+		if !holdsRole(before.Roles, assignment) {
+			paged = append(paged, fmt.Sprintf("%s %s", describeRole(assignment.Role), users.Mention(ctx, &assignment.User)))
+		}
+	}
+	if len(paged) > 0 {
+		_ = slack.Notify(ctx, &slack.NotifyParams{
+			Text: fmt.Sprintf("Incident #%d needs you: %s\n%s", incident.Id, strings.Join(paged, ", "), incident.Body),
+		})
+	}
+	return incident, nil
+}
+
+// VerifyRole Helper function for making sure an incident role is one we know about
+func VerifyRole(role string) error {
+	for _, known := range Roles {
+		if role == known {
+			return nil
+		}
+	}
+	return errs.B().Meta("role", role).Code(errs.InvalidArgument).Msgf("unknown role %q, expected one of %v", role, Roles).Err()
+}
+
+func holdsRole(roles []RoleAssignment, assignment RoleAssignment) bool {
+	for _, held := range roles {
+		if held.Role == assignment.Role && held.User.Id == assignment.User.Id {
+			return true
+		}
+	}
+	return false
+}
+
+func describeRole(role string) string {
+	return strings.ReplaceAll(role, "_", " ")
+}
+
+// describeRoles Helper function listing who holds the roles of an incident, e.g. for Slack
+// messages, or an empty string if nobody does
+func describeRoles(roles []RoleAssignment) string {
+	var parts []string
+	for _, assignment := range roles {
+		parts = append(parts, fmt.Sprintf("%s: %s", describeRole(assignment.Role), fullName(&assignment.User)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// withRoles Helper function adding who holds the roles of an incident to a Slack message
+func withRoles(text string, incident *Incident) string {
+	if roles := describeRoles(incident.Roles); roles != "" {
+		return fmt.Sprintf("%s\nRoles: %s", text, roles)
+	}
+	return text
+}
+
+// loadRoles Helper function adding the roles to incidents, in the order of Roles
+func loadRoles(ctx context.Context, incidents []Incident) error {
+	if len(incidents) == 0 {
+		return nil
+	}
+	byId := map[int]*Incident{}
+	var ids []string
+	for i := range incidents {
+		byId[incidents[i].Id] = &incidents[i]
+		ids = append(ids, fmt.Sprint(incidents[i].Id))
+	}
+
+	rows, err := sqldb.Query(ctx, `
+		SELECT incident_id, role, user_id
+		FROM roles
+		WHERE incident_id = ANY(STRING_TO_ARRAY($1, ',')::BIGINT[])
+		ORDER BY ARRAY_POSITION(STRING_TO_ARRAY($2, ','), role::TEXT)
+	`, strings.Join(ids, ","), strings.Join(Roles, ","))
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var incidentId, userId int
+		var role string
+		if err := rows.Scan(&incidentId, &role, &userId); err != nil {
+			return err
+		}
+		user, err := users.Get(ctx, userId)
+		if err != nil {
+			rlog.Error("FAIL to get user holding a role", "incident", incidentId, "user", userId, "err", err)
+			continue
+		}
+		if incident, ok := byId[incidentId]; ok {
+			incident.Roles = append(incident.Roles, RoleAssignment{Role: role, User: *user})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package incidents
+
+import (
+	"testing"
+
+	"encore.app/users"
+	"encore.dev/beta/errs"
+)
+
+func TestSetRolesReplacesRoles(t *testing.T) {
+	commander, scribe, successor := createUser(t), createUser(t), createUser(t)
+	incident := createIncident(t, "Checkout is down")
+
+	_, err := SetRoles(authenticated(), incident.Id, &SetRolesParams{Roles: map[string]int{RoleCommander: commander.Id, RoleScribe: scribe.Id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated, err := SetRoles(authenticated(), incident.Id, &SetRolesParams{Roles: map[string]int{RoleCommander: successor.Id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the scribe was left out, so it is unassigned
+	if len(updated.Roles) != 1 || updated.Roles[0].Role != RoleCommander || updated.Roles[0].User.Id != successor.Id {
+		t.Errorf("expected only user #%d to be commander, got %+v", successor.Id, updated.Roles)
+	}
+}
+
+func TestSetRolesRejectsUnknownRole(t *testing.T) {
+	user := createUser(t)
+	incident := createIncident(t, "Checkout is down")
+
+	_, err := SetRoles(authenticated(), incident.Id, &SetRolesParams{Roles: map[string]int{"hero": user.Id}})
+	if errs.Code(err) != errs.InvalidArgument {
+		t.Errorf("expected an unknown role to be rejected, got %v", err)
+	}
+	assertNoRoles(t, incident.Id)
+}
+
+func TestSetRolesRejectsUnknownUser(t *testing.T) {
+	incident := createIncident(t, "Checkout is down")
+
+	_, err := SetRoles(authenticated(), incident.Id, &SetRolesParams{Roles: map[string]int{RoleCommander: 2147483000}})
+	if err == nil {
+		t.Error("expected a user who doesn't exist to be rejected")
+	}
+	assertNoRoles(t, incident.Id)
+}
+
+func TestSetRolesRejectsDeactivatedUser(t *testing.T) {
+	user := createUser(t)
+	if _, err := users.Deactivate(authenticated(), user.Id); err != nil {
+		t.Fatal(err)
+	}
+	incident := createIncident(t, "Checkout is down")
+
+	_, err := SetRoles(authenticated(), incident.Id, &SetRolesParams{Roles: map[string]int{RoleCommander: user.Id}})
+	if errs.Code(err) != errs.FailedPrecondition {
+		t.Errorf("expected a deactivated user to be rejected, got %v", err)
+	}
+	assertNoRoles(t, incident.Id)
+}
+
+func assertNoRoles(t *testing.T, incidentId int) {
+	incident, err := GetById(authenticated(), incidentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incident.Roles) != 0 {
+		t.Errorf("expected nobody to hold a role, got %+v", incident.Roles)
+	}
+}
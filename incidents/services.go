@@ -0,0 +1,91 @@
+package incidents
+
+import (
+	"context"
+
+	"encore.app/services"
+	"encore.dev/storage/sqldb"
+)
+
+// ServiceIncidents are the open incidents of a service
+type ServiceIncidents struct {
+	Service services.Service
+	Open    int
+	Items   []Incident
+}
+
+type ServiceCounts struct {
+	Items []ServiceCount
+}
+
+type ServiceCount struct {
+	Service services.Service
+	Open    int
+}
+
+// ListByService returns the open incidents of a service, e.g. to see whether checkout is broken
+//
+//encore:api public method=GET path=/services/:id/incidents
+func ListByService(ctx context.Context, id int) (*ServiceIncidents, error) {
+	service, err := services.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+		FROM incidents
+		WHERE acknowledged_at IS NULL
+		  AND NOT suppressed
+		  AND service_id = $1
+		ORDER BY created_at ASC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	incidents, err := RowsToIncidents(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	for i := range incidents.Items {
+		incidents.Items[i].redact()
+	}
+	return &ServiceIncidents{Service: *service, Open: len(incidents.Items), Items: incidents.Items}, nil
+}
+
+// CountByService returns how many incidents are open for every service in the catalogue
+//
+//encore:api public method=GET path=/incident-counts
+func CountByService(ctx context.Context) (*ServiceCounts, error) {
+	catalogue, err := services.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sqldb.Query(ctx, `
+		SELECT service_id, COUNT(*)
+		FROM incidents
+		WHERE acknowledged_at IS NULL
+		  AND NOT suppressed
+		  AND service_id IS NOT NULL
+		GROUP BY service_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	open := map[int]int{}
+	for rows.Next() {
+		var serviceId, count int
+		if err := rows.Scan(&serviceId, &count); err != nil {
+			return nil, err
+		}
+		open[serviceId] = count
+	}
+
+	counts := &ServiceCounts{}
+	for _, service := range catalogue.Items {
+		counts.Items = append(counts.Items, ServiceCount{Service: service, Open: open[service.Id]})
+	}
+	return counts, nil
+}
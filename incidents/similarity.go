@@ -0,0 +1,243 @@
+package incidents
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"encore.dev/storage/sqldb"
+)
+
+// Alerts about the same problem often differ only in hostnames, ids and timestamps. Incidents are
+// compared by a MinHash fingerprint of their body with those masked, which estimates how many of
+// the word triples of two bodies they have in common.
+const (
+	// new incidents at least this similar to an open incident are attached to it instead of paging,
+	// unless they are more severe
+	attachSimilarity = 0.9
+	// open incidents at least this similar are suggested for merging
+	suggestSimilarity = 0.5
+	// how far apart open incidents are created to be compared
+	similarityWindow = 6 * time.Hour
+	shingleSize      = 3
+	minHashes        = 64
+)
+
+var (
+	uuidPattern      = regexp.MustCompile(`\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	timestampPattern = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}([t ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(z|[+-]\d{2}:?\d{2})?)?\b|\b\d{1,2}:\d{2}:\d{2}(\.\d+)?\b`)
+	ipv6Pattern      = regexp.MustCompile(`\b([0-9a-f]{1,4}:){3,7}[0-9a-f]{1,4}\b`)
+	ipv4Pattern      = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`)
+	hexPattern       = regexp.MustCompile(`\b(0x[0-9a-f]+|[0-9a-f]{6,})\b`)
+	digitPattern     = regexp.MustCompile(`\d`)
+	hexLetterPattern = regexp.MustCompile(`[a-f]`)
+	numberPattern    = regexp.MustCompile(`\d+(\.\d+)?`)
+	tokenPattern     = regexp.MustCompile(`[\p{L}\p{N}_<>]+`)
+)
+
+// minHashSeeds are the seeds of the hash functions of fingerprints, they must never change as
+// fingerprints are stored
+var minHashSeeds = func() []uint64 {
+	seeds := make([]uint64, minHashes)
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range seeds {
+		state += 0x9e3779b97f4a7c15
+		seeds[i] = mix(state)
+	}
+	return seeds
+}()
+
+type SimilarIncidents struct {
+	Items []SimilarIncident
+}
+
+type SimilarIncident struct {
+	IncidentId int
+	Similarity float64 // between 0 and 1
+	Severity   string
+}
+
+// Similar lists the open incidents which look like duplicates of an incident, most similar first,
+// e.g. to merge them
+//
+//encore:api public method=GET path=/incidents/:id/similar
+func Similar(ctx context.Context, id int) (*SimilarIncidents, error) {
+	incident, err := getIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var stored []byte
+	if err := sqldb.QueryRow(ctx, `SELECT fingerprint FROM incidents WHERE id = $1`, id).Scan(&stored); err != nil {
+		return nil, err
+	}
+	signature := decodeFingerprint(stored)
+	if signature == nil {
+		signature = fingerprint(incident.Body)
+	}
+	similar, err := findSimilar(ctx, signature, incident.ServiceId, incident.CreatedAt, id)
+	if err != nil {
+		return nil, err
+	}
+	return &SimilarIncidents{Items: similar}, nil
+}
+
+// findSimilar Helper function returning the open incidents of the same service created within the
+// similarity window around a time which are at least suggestSimilarity similar, most similar first
+func findSimilar(ctx context.Context, signature []uint64, serviceId *int, around time.Time, excludeId int) ([]SimilarIncident, error) {
+	if signature == nil {
+		return nil, nil
+	}
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, body, severity, fingerprint
+		FROM incidents
+		WHERE acknowledged_at IS NULL
+		  AND NOT suppressed
+		  AND storm_scope IS NULL
+		  AND service_id IS NOT DISTINCT FROM $1
+		  AND created_at BETWEEN $2 AND $3
+		  AND id <> $4
+		ORDER BY created_at DESC
+		LIMIT 500
+	`, serviceId, around.Add(-similarityWindow), around.Add(similarityWindow), excludeId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var similar []SimilarIncident
+	for rows.Next() {
+		var id int
+		var body, severity string
+		var stored []byte
+		if err := rows.Scan(&id, &body, &severity, &stored); err != nil {
+			return nil, err
+		}
+		other := decodeFingerprint(stored)
+		if other == nil {
+			other = fingerprint(body) // created before fingerprints were stored
+		}
+		if score := similarity(signature, other); score >= suggestSimilarity {
+			similar = append(similar, SimilarIncident{IncidentId: id, Similarity: score, Severity: severity})
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Similarity > similar[j].Similarity
+	})
+	return similar, nil
+}
+
+// normalize Helper function masking the parts of an alert which differ between alerts about the
+// same problem, e.g. "Disk 93% full on 10.0.0.7" becomes "disk <num>% full on <ip>"
+func normalize(body string) string {
+	text := strings.ToLower(body)
+	text = uuidPattern.ReplaceAllString(text, "<uuid>")
+	text = timestampPattern.ReplaceAllString(text, "<time>")
+	text = ipv6Pattern.ReplaceAllString(text, "<ip>")
+	text = ipv4Pattern.ReplaceAllString(text, "<ip>")
+	text = hexPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if strings.HasPrefix(match, "0x") || (digitPattern.MatchString(match) && hexLetterPattern.MatchString(match)) {
+			return "<hex>"
+		}
+		return match // a word such as "deadbeef", or a number which is masked next
+	})
+	return numberPattern.ReplaceAllString(text, "<num>")
+}
+
+// shingles Helper function returning the overlapping word triples of a normalized text, or the
+// whole text if it is shorter
+func shingles(text string) []string {
+	tokens := tokenPattern.FindAllString(text, -1)
+	if len(tokens) == 0 {
+		return nil
+	}
+	if len(tokens) <= shingleSize {
+		return []string{strings.Join(tokens, " ")}
+	}
+	var result []string
+	for i := 0; i+shingleSize <= len(tokens); i++ {
+		result = append(result, strings.Join(tokens[i:i+shingleSize], " "))
+	}
+	return result
+}
+
+// fingerprint Helper function returning the MinHash signature of an incident body, nil if it
+// has no words
+func fingerprint(body string) []uint64 {
+	shingles := shingles(normalize(body))
+	if len(shingles) == 0 {
+		return nil
+	}
+	signature := make([]uint64, minHashes)
+	for i := range signature {
+		signature[i] = math.MaxUint64
+	}
+	for _, shingle := range shingles {
+		h := fnv.New64a()
+		h.Write([]byte(shingle))
+		sum := h.Sum64()
+		for i, seed := range minHashSeeds {
+			if value := mix(sum ^ seed); value < signature[i] {
+				signature[i] = value
+			}
+		}
+	}
+	return signature
+}
+
+// similarity Helper function estimating the share of word triples two bodies have in common
+// from their fingerprints
+func similarity(a []uint64, b []uint64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	equal := 0
+	for i := range a {
+		if a[i] == b[i] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(a))
+}
+
+// moreSevere reports whether a severity is worse than another one, SEV1 being the worst
+func moreSevere(severity string, than string) bool {
+	return severity < than
+}
+
+// mix is the finalizer of splitmix64, turning one hash into many independent ones
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func encodeFingerprint(signature []uint64) []byte {
+	if signature == nil {
+		return nil
+	}
+	raw := make([]byte, 8*len(signature))
+	for i, value := range signature {
+		binary.BigEndian.PutUint64(raw[8*i:], value)
+	}
+	return raw
+}
+
+func decodeFingerprint(raw []byte) []uint64 {
+	if len(raw) != 8*minHashes {
+		return nil
+	}
+	signature := make([]uint64, minHashes)
+	for i := range signature {
+		signature[i] = binary.BigEndian.Uint64(raw[8*i:])
+	}
+	return signature
+}
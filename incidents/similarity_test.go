@@ -0,0 +1,90 @@
+package incidents
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := map[string]string{
+		"Disk 93% full on 10.0.0.7": "disk <num>% full on <ip>",
+		"Job 3f2b8c1e-9a4d-4e6f-8b1a-2c3d4e5f6a7b failed at 2024-03-01T12:00:00Z": "job <uuid> failed at <time>",
+		"Segfault at 0x7ffe3b2a in worker deadbeef, commit a1b2c3d":               "segfault at <hex> in worker deadbeef, commit <hex>",
+		"web-01.prod responded 503 after 1.5s from fe80:0:0:0:202:b3ff:fe1e:8329": "web-<num>.prod responded <num> after <num>s from <ip>",
+	}
+	for body, expected := range cases {
+		if normalized := normalize(body); normalized != expected {
+			t.Errorf("expected %q to normalize to %q, got %q", body, expected, normalized)
+		}
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	a := fingerprint("CRITICAL: database connection pool exhausted on db-07.prod (10.1.4.7), 512/512 connections in use since 2024-03-01 04:13:22")
+	b := fingerprint("CRITICAL: database connection pool exhausted on db-12.prod (10.1.4.12), 498/512 connections in use since 2024-03-01 04:15:09")
+	if score := similarity(a, b); score < attachSimilarity {
+		t.Fatalf("expected alerts differing in hosts, counts and timestamps to be attached, got %v", score)
+	}
+
+	c := fingerprint("WARNING: certificate for api.example.com expires in 14 days")
+	if score := similarity(a, c); score >= suggestSimilarity {
+		t.Fatalf("expected unrelated alerts not to be suggested, got %v", score)
+	}
+
+	d := fingerprint("CRITICAL: database connection pool exhausted on db-07.prod (10.1.4.7), 512/512 connections in use, writes are being rejected")
+	if score := similarity(a, d); score < suggestSimilarity || score >= attachSimilarity {
+		t.Fatalf("expected partly overlapping alerts to be suggested only, got %v", score)
+	}
+
+	if fingerprint("  !! ") != nil {
+		t.Fatal("expected no fingerprint of a body without words")
+	}
+	if score := similarity(nil, a); score != 0 {
+		t.Fatalf("expected nothing to be similar to a missing fingerprint, got %v", score)
+	}
+}
+
+func TestEncodeFingerprint(t *testing.T) {
+	signature := fingerprint("Disk 93% full on 10.0.0.7")
+	if decoded := decodeFingerprint(encodeFingerprint(signature)); !reflect.DeepEqual(decoded, signature) {
+		t.Fatalf("expected the fingerprint to survive encoding, got %v", decoded)
+	}
+	if decodeFingerprint(nil) != nil {
+		t.Fatal("expected no fingerprint for NULL")
+	}
+}
+
+func TestMoreSevere(t *testing.T) {
+	if !moreSevere("SEV1", "SEV3") {
+		t.Error("expected SEV1 to be more severe than SEV3")
+	}
+	if moreSevere("SEV3", "SEV3") || moreSevere("SEV4", "SEV2") {
+		t.Error("expected the same or a milder severity not to be more severe")
+	}
+}
+
+func TestMoreSevereDuplicateIsNotAttached(t *testing.T) {
+	ctx := authenticated()
+	body := "Replication slot on the warehouse replica is lagging behind the primary by 812 MB"
+	original, err := Create(ctx, &CreateParams{Body: body, Severity: "SEV3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worse, err := Create(ctx, &CreateParams{Body: body, Severity: "SEV1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if worse.ParentId != nil {
+		t.Errorf("expected the more severe duplicate to page on its own, got attached to #%d", *worse.ParentId)
+	}
+
+	// the SEV1 is the most similar incident now, the SEV3 is attached to either of them
+	duplicate, err := Create(ctx, &CreateParams{Body: body, Severity: "SEV3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicate.ParentId == nil || (*duplicate.ParentId != original.Id && *duplicate.ParentId != worse.Id) {
+		t.Errorf("expected the duplicate to be attached, got parent %v", duplicate.ParentId)
+	}
+}
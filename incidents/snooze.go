@@ -0,0 +1,154 @@
+package incidents
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/slack"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// maxSnooze is the longest an incident can be snoozed, so it isn't forgotten
+const maxSnooze = 7 * 24 * time.Hour
+
+type SnoozeParams struct {
+	Duration string // e.g. 8h or 30m
+}
+
+// Snooze pauses reminders and escalation of an incident which can't be acted on yet, e.g. until the
+// morning. When the snooze expires, the incident is assigned to whoever is on-call at that time.
+//
+//encore:api auth method=PUT path=/incidents/:id/snooze
+func Snooze(ctx context.Context, id int, params *SnoozeParams) (*Incident, error) {
+	eb := errs.B().Meta("incidentId", id, "params", params)
+	if err := requireResponder(ctx, id, "snooze"); err != nil {
+		return nil, err
+	}
+	duration, err := time.ParseDuration(params.Duration)
+	if err != nil || duration <= 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("duration is not a positive duration, e.g. 8h or 30m").Err()
+	}
+	if duration > maxSnooze {
+		return nil, eb.Code(errs.InvalidArgument).Msgf("incidents can be snoozed for at most %s", maxSnooze).Err()
+	}
+
+	before, err := getOpenIncident(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if before.Suppressed {
+		return nil, eb.Code(errs.FailedPrecondition).Msg("suppressed incidents are not paged anyway").Err()
+	}
+
+	rows, err := sqldb.Query(ctx, `
+		UPDATE incidents
+		SET snoozed_until = $1, snoozed_by = $2
+		WHERE acknowledged_at IS NULL
+		  AND id = $3
+		RETURNING id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+	`, time.Now().Add(duration), auth.Actor(), id)
+	if err != nil {
+		return nil, err
+	}
+	incidents, err := RowsToIncidents(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	if incidents.Items == nil {
+		return nil, eb.Code(errs.NotFound).Msg("no incident found").Err()
+	}
+
+	incident := &incidents.Items[0]
+	audit.Log(ctx, "incident.snooze", "incident", incident.Id, before, incident)
+	_ = slack.Notify(ctx, &slack.NotifyParams{
+		Text: withRoles(fmt.Sprintf("Incident #%d is snoozed until %s\n%s", incident.Id, incident.SnoozedUntil.Format(time.RFC1123), incident.Body), incident),
+	})
+
+	return incident, nil
+}
+
+var _ = cron.NewJob("wake-snoozed-incidents", cron.JobConfig{
+	Title:    "Re-notify incidents whose snooze expired",
+	Every:    cron.Minute,
+	Endpoint: WakeSnoozedIncidents,
+})
+
+// WakeSnoozedIncidents pages the incidents whose snooze expired. The snooze of an incident is only
+// cleared once it was paged, so incidents which fail are retried the next minute rather than
+// staying silent.
+//
+//encore:api private
+func WakeSnoozedIncidents(ctx context.Context) error {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+		FROM incidents
+		WHERE snoozed_until <= NOW()
+		  AND acknowledged_at IS NULL
+		ORDER BY snoozed_until ASC
+	`)
+	if err != nil {
+		return err
+	}
+	incidents, err := RowsToIncidents(ctx, rows)
+	if err != nil {
+		return err
+	}
+	if len(incidents.Items) == 0 {
+		return nil
+	}
+
+	failed := 0
+	for _, incident := range incidents.Items {
+		// whoever was on-call when it was snoozed may not be anymore
+		assigneeId := onCallFor(ctx, incident.TeamId, incident.ServiceId)
+		if err := wake(ctx, &incident, assigneeId); err != nil {
+			rlog.Error("FAIL to wake snoozed incident", "incident", incident.Id, "err", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d snoozed incidents could not be woken", failed, len(incidents.Items))
+	}
+	return nil
+}
+
+// wake Helper function paging a snoozed incident whose snooze expired and then clearing its
+// snooze, unless it was snoozed again in the meantime. Without an assignee, because nobody is
+// on-call, the incident is assigned once someone is.
+func wake(ctx context.Context, incident *Incident, assigneeId *int) error {
+	if assigneeId == nil {
+		err := slack.Notify(ctx, &slack.NotifyParams{
+			Text: fmt.Sprintf("Snooze of incident #%d expired, nobody is on-call to assign it to\n%s", incident.Id, incident.Body),
+		})
+		if err != nil {
+			return err
+		}
+	} else if _, err := assign(ctx, incident.Id, *assigneeId); err != nil { // assign notifies whoever it is assigned to
+		return err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+		UPDATE incidents
+		SET snoozed_until = NULL
+		WHERE id = $1
+		  AND snoozed_until <= NOW()
+		RETURNING id, assigned_user_id, body, created_at, acknowledged_at, source, severity, labels, team_id, tags, suppressed, snoozed_until, service_id
+	`, incident.Id)
+	if err != nil {
+		return err
+	}
+	woken, err := RowsToIncidents(ctx, rows)
+	if err != nil {
+		return err
+	}
+	if len(woken.Items) > 0 {
+		audit.Log(ctx, "incident.wake", "incident", incident.Id, incident, woken.Items[0])
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package incidents
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"encore.app/audit"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+func TestSnoozeRejectsInvalidDurations(t *testing.T) {
+	incident := createIncident(t, "Snooze test: invalid durations")
+	for _, duration := range []string{"", "tomorrow", "-1h", "0s", "169h"} {
+		_, err := Snooze(authenticated(), incident.Id, &SnoozeParams{Duration: duration})
+		if errs.Code(err) != errs.InvalidArgument {
+			t.Errorf("expected %q to be InvalidArgument, got %v", duration, err)
+		}
+	}
+}
+
+func TestSnoozedIncidentsAreNotAssigned(t *testing.T) {
+	incident := createIncident(t, "Snooze test: not assigned while snoozed")
+	if _, err := sqldb.Exec(context.Background(), `UPDATE incidents SET assigned_user_id = NULL WHERE id = $1`, incident.Id); err != nil {
+		t.Fatal(err)
+	}
+	snoozed, err := Snooze(authenticated(), incident.Id, &SnoozeParams{Duration: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snoozed.SnoozedUntil == nil || time.Until(*snoozed.SnoozedUntil) < 59*time.Minute {
+		t.Fatalf("expected the incident to be snoozed for an hour, got %v", snoozed.SnoozedUntil)
+	}
+
+	if err := AssignUnassignedIncidents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetById(context.Background(), incident.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Assignee != nil {
+		t.Errorf("expected the snoozed incident to stay unassigned, got %v", got.Assignee)
+	}
+}
+
+func TestWakeSnoozedIncidents(t *testing.T) {
+	ctx := context.Background()
+	expired := createIncident(t, "Snooze test: expired")
+	pending := createIncident(t, "Snooze test: still snoozed")
+	if _, err := sqldb.Exec(ctx, `UPDATE incidents SET snoozed_until = NOW() - INTERVAL '1 minute' WHERE id = $1`, expired.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Snooze(authenticated(), pending.Id, &SnoozeParams{Duration: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WakeSnoozedIncidents(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	woken, err := GetById(ctx, expired.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if woken.SnoozedUntil != nil {
+		t.Errorf("expected the snooze of incident #%d to be cleared, got %v", expired.Id, woken.SnoozedUntil)
+	}
+	still, err := GetById(ctx, pending.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if still.SnoozedUntil == nil {
+		t.Errorf("expected incident #%d to stay snoozed", pending.Id)
+	}
+
+	history, err := audit.History(ctx, &audit.HistoryParams{EntityType: "incident", EntityId: strconv.Itoa(expired.Id)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Items) == 0 || history.Items[len(history.Items)-1].Action != "incident.wake" {
+		t.Errorf("expected waking to be audited last, got %v", history.Items)
+	}
+}
+
+func TestWakeKeepsSnoozeOfIncidentSnoozedAgain(t *testing.T) {
+	ctx := context.Background()
+	incident := createIncident(t, "Snooze test: snoozed again")
+	if _, err := sqldb.Exec(ctx, `UPDATE incidents SET snoozed_until = NOW() - INTERVAL '1 minute' WHERE id = $1`, incident.Id); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := GetById(ctx, incident.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// someone snoozes it again after the cron job loaded it
+	if _, err := Snooze(authenticated(), incident.Id, &SnoozeParams{Duration: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wake(ctx, expired, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetById(ctx, incident.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SnoozedUntil == nil {
+		t.Error("expected the new snooze to be kept")
+	}
+}
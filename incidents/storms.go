@@ -0,0 +1,523 @@
+package incidents
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/rules"
+	"encore.app/services"
+	"encore.app/slack"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// defaultStormThreshold applies to the service, or else the team, of incidents when no threshold
+// is configured for them. Storms of all incidents are only detected once a threshold without team
+// and service is configured, as unrelated incidents would otherwise be grouped together.
+var defaultStormThreshold = StormThreshold{MaxIncidents: 10, Window: time.Minute.String()}
+
+// maxStormSources is how many sources the counts of an alert storm list before summing up the rest
+const maxStormSources = 5
+
+type StormThresholds struct {
+	Items []StormThreshold
+}
+
+// StormThreshold is the rate of new incidents which makes an alert storm. The incidents of a storm
+// are grouped into one umbrella incident instead of each paging on its own.
+type StormThreshold struct {
+	Id           int
+	TeamId       *int   // counts the incidents routed to the team
+	ServiceId    *int   // counts the incidents of the service, without either it counts every incident
+	MaxIncidents int    // more incidents than this within the window are a storm
+	Window       string // e.g. 1m or 5m
+}
+
+type StormThresholdParams struct {
+	TeamId       *int
+	ServiceId    *int
+	MaxIncidents int
+	Window       string
+}
+
+// stormScope is what the incidents of an alert storm have in common
+type stormScope struct {
+	Kind string // service, team or all
+	Id   int
+}
+
+type sourceCount struct {
+	Source string
+	Count  int
+}
+
+// SetStormThreshold configures when incidents of a service or team, or all incidents, are an alert
+// storm. Schedulers configure it for the services and teams they schedule, admins for everything.
+//
+//encore:api auth method=PUT path=/storm-thresholds
+func SetStormThreshold(ctx context.Context, params *StormThresholdParams) (*StormThreshold, error) {
+	eb := errs.B().Meta("params", params)
+	if params.TeamId != nil && params.ServiceId != nil {
+		return nil, eb.Code(errs.InvalidArgument).Msg("a threshold is either for a team or for a service").Err()
+	}
+	if err := requireStormScheduler(ctx, params.TeamId, params.ServiceId); err != nil {
+		return nil, err
+	}
+	if params.MaxIncidents <= 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("max incidents is not positive").Err()
+	}
+	window, err := time.ParseDuration(params.Window)
+	if err != nil || window < time.Second {
+		return nil, eb.Code(errs.InvalidArgument).Msg("window is not a duration of at least a second, e.g. 1m or 5m").Err()
+	}
+
+	threshold, err := RowToStormThreshold(sqldb.QueryRow(ctx, `
+		INSERT INTO storm_thresholds (team_id, service_id, max_incidents, window_seconds, created_by)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (COALESCE(team_id, 0), COALESCE(service_id, 0)) DO UPDATE
+		SET max_incidents = EXCLUDED.max_incidents, window_seconds = EXCLUDED.window_seconds, updated_by = EXCLUDED.created_by
+		RETURNING id, team_id, service_id, max_incidents, window_seconds
+	`, params.TeamId, params.ServiceId, params.MaxIncidents, int(window.Seconds()), auth.Actor()))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("upsert storm threshold").Err()
+	}
+
+	audit.Log(ctx, "storm_threshold.set", "storm_threshold", threshold.Id, nil, threshold)
+	return threshold, nil
+}
+
+//encore:api public method=GET path=/storm-thresholds
+func ListStormThresholds(ctx context.Context) (*StormThresholds, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, team_id, service_id, max_incidents, window_seconds
+		FROM storm_thresholds
+		ORDER BY id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var thresholds []StormThreshold
+	for rows.Next() {
+		threshold, err := RowToStormThreshold(rows)
+		if err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		thresholds = append(thresholds, *threshold)
+	}
+	return &StormThresholds{Items: thresholds}, nil
+}
+
+// DeleteStormThreshold goes back to the default threshold for the service or team
+//
+//encore:api auth method=DELETE path=/storm-thresholds/:id
+func DeleteStormThreshold(ctx context.Context, id int) (*StormThreshold, error) {
+	eb := errs.B().Meta("thresholdId", id)
+	threshold, err := RowToStormThreshold(sqldb.QueryRow(ctx, `
+		SELECT id, team_id, service_id, max_incidents, window_seconds
+		FROM storm_thresholds
+		WHERE id = $1
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no storm threshold found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := requireStormScheduler(ctx, threshold.TeamId, threshold.ServiceId); err != nil {
+		return nil, err
+	}
+	if _, err := sqldb.Exec(ctx, `DELETE FROM storm_thresholds WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+
+	audit.Log(ctx, "storm_threshold.delete", "storm_threshold", id, threshold, nil)
+	return threshold, nil
+}
+
+// joinStorm Helper function returning the umbrella incident a new incident is grouped into when
+// it is part of an alert storm, and whether the incident opened it. The umbrella is opened by the
+// first incident above the threshold, and takes over the open incidents of the storm which were
+// paged before.
+func joinStorm(ctx context.Context, routing *rules.Result, service *services.Service) (*int, bool, error) {
+	var serviceId *int
+	if service != nil {
+		serviceId = &service.Id
+	}
+	threshold, err := RowToStormThreshold(sqldb.QueryRow(ctx, `
+		SELECT id, team_id, service_id, max_incidents, window_seconds
+		FROM storm_thresholds
+		WHERE service_id = $1
+		   OR (service_id IS NULL AND team_id = $2)
+		   OR (service_id IS NULL AND team_id IS NULL)
+		ORDER BY service_id IS NULL, team_id IS NULL
+		LIMIT 1
+	`, serviceId, routing.TeamId))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		if serviceId == nil && routing.TeamId == nil {
+			return nil, false, nil
+		}
+		threshold, err = &defaultStormThreshold, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	window, err := time.ParseDuration(threshold.Window)
+	if err != nil {
+		return nil, false, err
+	}
+	scope := scopeFor(threshold, serviceId, routing.TeamId)
+
+	var recent int
+	err = sqldb.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM incidents
+		WHERE created_at > NOW() - $1 * INTERVAL '1 second'
+		  AND NOT suppressed
+		  AND storm_scope IS NULL
+		  AND ($2 = 'all' OR ($2 = 'service' AND service_id = $3) OR ($2 = 'team' AND team_id = $3))
+	`, int(window.Seconds()), scope.Kind, scope.Id).Scan(&recent)
+	if err != nil {
+		return nil, false, err
+	}
+	if recent < threshold.MaxIncidents {
+		return nil, false, nil
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	// the incidents of a storm arrive concurrently, only one of them may open the umbrella
+	if _, err := sqldb.ExecTx(tx, ctx, `SELECT pg_advisory_xact_lock(HASHTEXT($1))`, scope.key()); err != nil {
+		return nil, false, err
+	}
+	var umbrellaId int
+	err = sqldb.QueryRowTx(tx, ctx, `
+		SELECT id
+		FROM incidents
+		WHERE storm_scope = $1
+		  AND acknowledged_at IS NULL
+		ORDER BY id DESC
+		LIMIT 1
+	`, scope.key()).Scan(&umbrellaId)
+	if err == nil {
+		return &umbrellaId, false, sqldb.Commit(tx)
+	}
+	if !errors.Is(err, sqldb.ErrNoRows) {
+		return nil, false, err
+	}
+
+	labels := map[string]string{}
+	teamId := routing.TeamId
+	if scope.Kind == "service" {
+		labels[serviceLabel] = service.Name
+		teamId = &service.TeamId
+	} else if scope.Kind == "team" {
+		teamId = &scope.Id
+	}
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return nil, false, err
+	}
+	body := fmt.Sprintf("Alert storm: more than %d incidents %s within %s, new incidents are grouped into this one", threshold.MaxIncidents, describeScope(ctx, scope, service), window)
+	err = sqldb.QueryRowTx(tx, ctx, `
+		INSERT INTO incidents (assigned_user_id, body, source, severity, labels, team_id, service_id, storm_scope, created_by)
+		VALUES ($1, $2, 'storm', $3, $4::JSONB, $5, $6, $7, $8)
+		RETURNING id
+	`, assigneeFor(ctx, routing, service), body, routing.Severity, string(labelsJSON), teamId, serviceId, scope.key(), auth.Actor()).Scan(&umbrellaId)
+	if err != nil {
+		return nil, false, err
+	}
+	rows, err := sqldb.QueryTx(tx, ctx, `
+		UPDATE incidents
+		SET merged_into_id = $1, acknowledged_at = NOW(), snoozed_until = NULL
+		WHERE acknowledged_at IS NULL
+		  AND NOT suppressed
+		  AND storm_scope IS NULL
+		  AND created_at > NOW() - $2 * INTERVAL '1 second'
+		  AND ($3 = 'all' OR ($3 = 'service' AND service_id = $4) OR ($3 = 'team' AND team_id = $4))
+		RETURNING id
+	`, umbrellaId, int(window.Seconds()), scope.Kind, scope.Id)
+	if err != nil {
+		return nil, false, err
+	}
+	var absorbedIds []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, false, err
+		}
+		absorbedIds = append(absorbedIds, id)
+	}
+	rows.Close()
+	// the counts posted every minute start after the incident opening the umbrella, which is as
+	// severe as the worst incident it took over
+	_, err = sqldb.ExecTx(tx, ctx, `
+		UPDATE incidents
+		SET storm_notified_count = $1,
+		    severity = LEAST(severity, (SELECT MIN(severity) FROM incidents WHERE merged_into_id = $2))
+		WHERE id = $2
+	`, len(absorbedIds)+1, umbrellaId)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, false, err
+	}
+
+	umbrella, err := getIncident(ctx, umbrellaId)
+	if err != nil {
+		return nil, false, err
+	}
+	audit.Log(ctx, "incident.create", "incident", umbrella.Id, nil, umbrella)
+	for _, id := range absorbedIds {
+		if absorbed, err := getIncident(ctx, id); err == nil {
+			audit.Log(ctx, "incident.merge", "incident", id, nil, absorbed)
+		}
+	}
+	return &umbrella.Id, true, nil
+}
+
+// announceStorm Helper function posting a single message when an alert storm starts, once the
+// incident opening the umbrella was grouped into it too
+func announceStorm(ctx context.Context, umbrellaId int) {
+	umbrella, err := getIncident(ctx, umbrellaId)
+	if err != nil {
+		rlog.Error("FAIL to announce alert storm", "incident", umbrellaId, "err", err)
+		return
+	}
+	text := fmt.Sprintf("Alert storm: incident #%d [%s] opened and unassigned", umbrella.Id, umbrella.Severity)
+	if umbrella.Assignee != nil {
+		text = fmt.Sprintf("Alert storm: incident #%d [%s] opened and assigned to %s %s %s", umbrella.Id, umbrella.Severity, umbrella.Assignee.FirstName, umbrella.Assignee.LastName, users.Mention(ctx, umbrella.Assignee))
+	}
+	text = fmt.Sprintf("%s\n%s\nIncidents so far: %s", text, umbrella.Body, describeCounts(stormCounts(ctx, umbrella.Id)))
+	_ = slack.Notify(ctx, &slack.NotifyParams{Text: text})
+}
+
+// escalateStorm Helper function raising the severity of an umbrella to that of a more severe
+// incident grouped into it, and paging about it once more, as the storm is at least as bad
+func escalateStorm(ctx context.Context, umbrellaId int, incident *Incident) {
+	before, err := getIncident(ctx, umbrellaId)
+	if err != nil {
+		rlog.Error("FAIL to escalate alert storm", "incident", umbrellaId, "err", err)
+		return
+	}
+	result, err := sqldb.Exec(ctx, `
+		UPDATE incidents
+		SET severity = $1
+		WHERE id = $2
+		  AND severity > $1
+	`, incident.Severity, umbrellaId)
+	if err != nil {
+		rlog.Error("FAIL to escalate alert storm", "incident", umbrellaId, "err", err)
+		return
+	}
+	if result.RowsAffected() == 0 {
+		return
+	}
+
+	umbrella, err := getIncident(ctx, umbrellaId)
+	if err != nil {
+		rlog.Error("FAIL to escalate alert storm", "incident", umbrellaId, "err", err)
+		return
+	}
+	audit.Log(ctx, "incident.escalate", "incident", umbrella.Id, before, umbrella)
+	text := fmt.Sprintf("Alert storm #%d escalated from %s to %s by incident #%d", umbrella.Id, before.Severity, umbrella.Severity, incident.Id)
+	if umbrella.Assignee != nil {
+		text = fmt.Sprintf("%s, assigned to %s %s %s", text, umbrella.Assignee.FirstName, umbrella.Assignee.LastName, users.Mention(ctx, umbrella.Assignee))
+	}
+	_ = slack.Notify(ctx, &slack.NotifyParams{Text: withRoles(fmt.Sprintf("%s\n%s", text, incident.Body), umbrella)})
+}
+
+var _ = cron.NewJob("summarize-alert-storms", cron.JobConfig{
+	Title:    "Post counts of the incidents grouped into alert storms",
+	Every:    cron.Minute,
+	Endpoint: SummarizeStorms,
+})
+
+// SummarizeStorms posts one message per alert storm with the incidents grouped into it since the
+// last summary, instead of a message per incident
+//
+//encore:api private
+func SummarizeStorms(ctx context.Context) error {
+	rows, err := sqldb.Query(ctx, `
+		WITH counts AS (
+			SELECT u.id, u.storm_notified_count AS notified, COUNT(c.id) AS total
+			FROM incidents u
+			JOIN incidents c ON c.merged_into_id = u.id
+			WHERE u.storm_scope IS NOT NULL
+			  AND u.acknowledged_at IS NULL
+			GROUP BY u.id, u.storm_notified_count
+		)
+		UPDATE incidents i
+		SET storm_notified_count = counts.total
+		FROM counts
+		WHERE i.id = counts.id
+		  AND counts.total > counts.notified
+		RETURNING i.id, i.severity, counts.total, counts.total - counts.notified
+	`)
+	if err != nil {
+		return err
+	}
+	type summary struct {
+		id       int
+		severity string
+		total    int
+		grouped  int
+	}
+	var summaries []summary
+	for rows.Next() {
+		var s summary
+		if err := rows.Scan(&s.id, &s.severity, &s.total, &s.grouped); err != nil {
+			rows.Close()
+			return err
+		}
+		summaries = append(summaries, s)
+	}
+	rows.Close()
+
+	for _, s := range summaries {
+		text := fmt.Sprintf("Alert storm #%d [%s]: %d more incidents grouped in the last minute, %d in total: %s", s.id, s.severity, s.grouped, s.total, describeCounts(stormCounts(ctx, s.id)))
+		if err := slack.Notify(ctx, &slack.NotifyParams{Text: text}); err != nil {
+			rlog.Error("FAIL to summarize alert storm", "incident", s.id, "err", err)
+		}
+	}
+	return nil
+}
+
+// requireStormScheduler Helper function making sure the caller can configure alert storms of a
+// service or team, or of everything if there is neither
+func requireStormScheduler(ctx context.Context, teamId *int, serviceId *int) error {
+	if serviceId != nil {
+		service, err := services.Get(ctx, *serviceId)
+		if err != nil {
+			return err
+		}
+		return authz.RequireTeamRole(authz.RoleScheduler, []int{service.TeamId}, "configure alert storms")
+	}
+	if teamId != nil {
+		if _, err := users.GetTeam(ctx, *teamId); err != nil {
+			return err
+		}
+		return authz.RequireTeamRole(authz.RoleScheduler, []int{*teamId}, "configure alert storms")
+	}
+	return authz.RequireAdmin("configure alert storms for every incident")
+}
+
+// scopeFor Helper function deciding which incidents count towards a storm: those the threshold is
+// configured for, or else those of the same service, team or all of them
+func scopeFor(threshold *StormThreshold, serviceId *int, teamId *int) stormScope {
+	if threshold.Id != 0 {
+		serviceId, teamId = threshold.ServiceId, threshold.TeamId
+	}
+	if serviceId != nil {
+		return stormScope{Kind: "service", Id: *serviceId}
+	}
+	if teamId != nil {
+		return stormScope{Kind: "team", Id: *teamId}
+	}
+	return stormScope{Kind: "all"}
+}
+
+func (s stormScope) key() string {
+	if s.Kind == "all" {
+		return s.Kind
+	}
+	return fmt.Sprintf("%s:%d", s.Kind, s.Id)
+}
+
+func describeScope(ctx context.Context, scope stormScope, service *services.Service) string {
+	switch scope.Kind {
+	case "service":
+		return fmt.Sprintf("of service %s", service.Name)
+	case "team":
+		if team, err := users.GetTeam(ctx, scope.Id); err == nil {
+			return fmt.Sprintf("of team %s", team.Name)
+		}
+		return fmt.Sprintf("of team #%d", scope.Id)
+	}
+	return "in total"
+}
+
+// stormCounts Helper function counting the incidents grouped into an umbrella by their source
+func stormCounts(ctx context.Context, umbrellaId int) []sourceCount {
+	rows, err := sqldb.Query(ctx, `
+		SELECT source, COUNT(*)
+		FROM incidents
+		WHERE merged_into_id = $1
+		GROUP BY source
+		ORDER BY COUNT(*) DESC, source ASC
+	`, umbrellaId)
+	if err != nil {
+		rlog.Error("FAIL to count alert storm", "incident", umbrellaId, "err", err)
+		return nil
+	}
+
+	defer rows.Close()
+
+	var counts []sourceCount
+	for rows.Next() {
+		var count sourceCount
+		if err := rows.Scan(&count.Source, &count.Count); err != nil {
+			rlog.Error("FAIL to count alert storm", "incident", umbrellaId, "err", err)
+			return nil
+		}
+		counts = append(counts, count)
+	}
+	return counts
+}
+
+// describeCounts Helper function listing the counts by source, largest first, e.g. "120 from
+// datadog, 30 from pingdom"
+func describeCounts(counts []sourceCount) string {
+	var parts []string
+	var rest int
+	for i, count := range counts {
+		if i >= maxStormSources {
+			rest += count.Count
+			continue
+		}
+		source := count.Source
+		if source == "" {
+			source = "an unknown source"
+		}
+		parts = append(parts, fmt.Sprintf("%d from %s", count.Count, source))
+	}
+	if rest > 0 {
+		parts = append(parts, fmt.Sprintf("%d from other sources", rest))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// RowToStormThreshold Helper function from Row to StormThreshold
+func RowToStormThreshold(row interface {
+	Scan(dest ...interface{}) error
+}) (*StormThreshold, error) {
+	var threshold = &StormThreshold{}
+	var windowSeconds int
+	err := row.Scan(&threshold.Id, &threshold.TeamId, &threshold.ServiceId, &threshold.MaxIncidents, &windowSeconds)
+	if err != nil {
+		return nil, err
+	}
+	threshold.Window = (time.Duration(windowSeconds) * time.Second).String()
+	return threshold, nil
+}
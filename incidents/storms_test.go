@@ -0,0 +1,95 @@
+package incidents
+
+import (
+	"testing"
+	"time"
+
+	"encore.app/services"
+	"encore.app/users"
+)
+
+func TestScopeFor(t *testing.T) {
+	serviceId, teamId := 3, 2
+	if scope := scopeFor(&defaultStormThreshold, &serviceId, &teamId); scope.key() != "service:3" {
+		t.Fatalf("expected the default to count the service, got %v", scope.key())
+	}
+	if scope := scopeFor(&defaultStormThreshold, nil, &teamId); scope.key() != "team:2" {
+		t.Fatalf("expected the default to count the team, got %v", scope.key())
+	}
+	if scope := scopeFor(&defaultStormThreshold, nil, nil); scope.key() != "all" {
+		t.Fatalf("expected the default to count everything, got %v", scope.key())
+	}
+	teamThreshold := &StormThreshold{Id: 1, TeamId: &teamId, MaxIncidents: 50, Window: "1m0s"}
+	if scope := scopeFor(teamThreshold, &serviceId, &teamId); scope.key() != "team:2" {
+		t.Fatalf("expected the team threshold to count the team, got %v", scope.key())
+	}
+	globalThreshold := &StormThreshold{Id: 2, MaxIncidents: 200, Window: "1m0s"}
+	if scope := scopeFor(globalThreshold, &serviceId, &teamId); scope.key() != "all" {
+		t.Fatalf("expected the global threshold to count everything, got %v", scope.key())
+	}
+}
+
+func TestDescribeCounts(t *testing.T) {
+	counts := []sourceCount{
+		{Source: "datadog", Count: 120},
+		{Source: "pingdom", Count: 30},
+		{Source: "", Count: 7},
+		{Source: "sentry", Count: 5},
+		{Source: "grafana", Count: 3},
+		{Source: "cloudwatch", Count: 2},
+		{Source: "statuscake", Count: 1},
+	}
+	expected := "120 from datadog, 30 from pingdom, 7 from an unknown source, 5 from sentry, 3 from grafana, 3 from other sources"
+	if text := describeCounts(counts); text != expected {
+		t.Fatalf("expected %q, got %q", expected, text)
+	}
+	if text := describeCounts(nil); text != "none" {
+		t.Fatalf("expected none, got %q", text)
+	}
+}
+
+func TestStormTakesSeverityOfWorstIncident(t *testing.T) {
+	ctx := authenticated()
+	team, err := users.CreateTeam(ctx, &users.CreateTeamParams{Name: "storm " + time.Now().Format(time.RFC3339Nano)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := services.Create(ctx, &services.ServiceParams{Name: "queue " + time.Now().Format(time.RFC3339Nano), TeamId: team.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetStormThreshold(ctx, &StormThresholdParams{ServiceId: &service.Id, MaxIncidents: 1, Window: "1m"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := Create(ctx, &CreateParams{Body: "Consumer lag above limit", Severity: "SEV2", ServiceId: &service.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// opens the umbrella and takes over the first incident
+	second, err := Create(ctx, &CreateParams{Body: "Dead letter queue growing", Severity: "SEV3", ServiceId: &service.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ParentId == nil {
+		t.Fatalf("expected incident #%d to open an alert storm", second.Id)
+	}
+	umbrella, err := GetById(ctx, *second.ParentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if umbrella.Severity != "SEV2" {
+		t.Errorf("expected the umbrella to be as severe as incident #%d, got %s", first.Id, umbrella.Severity)
+	}
+
+	if _, err := Create(ctx, &CreateParams{Body: "Broker disk full", Severity: "SEV1", ServiceId: &service.Id}); err != nil {
+		t.Fatal(err)
+	}
+	escalated, err := GetById(ctx, umbrella.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if escalated.Severity != "SEV1" {
+		t.Errorf("expected the umbrella to be escalated to SEV1, got %s", escalated.Severity)
+	}
+}
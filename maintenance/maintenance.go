@@ -0,0 +1,322 @@
+// Package maintenance suppresses paging during planned maintenance. Incidents matching the scope
+// of an active maintenance window are stored, but nobody is assigned or notified.
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/slack"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+type Windows struct {
+	Items []Window
+}
+
+type Window struct {
+	Id    int
+	Name  string
+	Start time.Time
+	End   time.Time
+	Scope Scope
+}
+
+// Scope is what a maintenance window applies to. Incidents have to match all of it, so an empty
+// scope matches every incident.
+type Scope struct {
+	TeamId  *int              // the team the rules routed the incident to
+	Service string            // the service label of the incident
+	Labels  map[string]string // each label has to have exactly this value
+}
+
+type CreateParams struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+	Scope Scope
+}
+
+// MatchParams is an incident about to be created
+type MatchParams struct {
+	TeamId *int
+	Labels map[string]string
+	At     time.Time // defaults to now
+}
+
+// serviceLabel is the label of incidents naming the service they are about
+const serviceLabel = "service"
+
+// Create schedules a maintenance window. Schedulers can create them for their teams, admins for everything.
+//
+//encore:api auth method=POST path=/maintenance-windows
+func Create(ctx context.Context, params *CreateParams) (*Window, error) {
+	eb := errs.B().Meta("params", params)
+	if err := requireScheduler(params.Scope.TeamId); err != nil {
+		return nil, err
+	}
+	if len(params.Name) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("name is empty").Err()
+	}
+	if !params.Start.Before(params.End) {
+		return nil, eb.Code(errs.InvalidArgument).Msg("start timestamp is not before end timestamp").Err()
+	}
+	if !params.End.After(time.Now()) {
+		return nil, eb.Code(errs.InvalidArgument).Msg("end timestamp in the past").Err()
+	}
+	if params.Scope.TeamId != nil {
+		if _, err := users.GetTeam(ctx, *params.Scope.TeamId); err != nil {
+			return nil, err
+		}
+	}
+
+	labels, err := json.Marshal(params.Scope.Labels)
+	if err != nil {
+		return nil, err
+	}
+	window, err := RowToWindow(sqldb.QueryRow(ctx, `
+		INSERT INTO windows (name, start_time, end_time, team_id, service, labels, created_by)
+		VALUES ($1, $2, $3, $4, $5, COALESCE(NULLIF($6, 'null')::JSONB, '{}'), $7)
+		RETURNING id, name, start_time, end_time, team_id, service, labels
+	`, params.Name, params.Start, params.End, params.Scope.TeamId, params.Scope.Service, string(labels), auth.Actor()))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert maintenance window").Err()
+	}
+
+	audit.Log(ctx, "maintenance_window.create", "maintenance_window", window.Id, nil, window)
+	return window, nil
+}
+
+// List returns the maintenance windows which haven't ended yet
+//
+//encore:api public method=GET path=/maintenance-windows
+func List(ctx context.Context) (*Windows, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, name, start_time, end_time, team_id, service, labels
+		FROM windows
+		WHERE end_time > NOW()
+		ORDER BY start_time ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return rowsToWindows(rows)
+}
+
+//encore:api public method=GET path=/maintenance-windows/:id
+func Get(ctx context.Context, id int) (*Window, error) {
+	eb := errs.B().Meta("windowId", id)
+	window, err := RowToWindow(sqldb.QueryRow(ctx, `
+		SELECT id, name, start_time, end_time, team_id, service, labels
+		FROM windows
+		WHERE id = $1
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no maintenance window found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return window, nil
+}
+
+// End ends a maintenance window early, e.g. because the maintenance is done. A window which
+// hasn't started yet is cancelled.
+//
+//encore:api auth method=POST path=/maintenance-windows/:id/end
+func End(ctx context.Context, id int) (*Window, error) {
+	eb := errs.B().Meta("windowId", id)
+	before, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireScheduler(before.Scope.TeamId); err != nil {
+		return nil, err
+	}
+
+	window, err := RowToWindow(sqldb.QueryRow(ctx, `
+		UPDATE windows
+		SET end_time = GREATEST(start_time, NOW()), ended_by = $1,
+		    -- nothing to announce about a window which is cancelled before it started
+		    start_announced_at = COALESCE(start_announced_at, CASE WHEN start_time > NOW() THEN NOW() END),
+		    end_announced_at = CASE WHEN start_time > NOW() THEN NOW() END
+		WHERE id = $2
+		  AND end_time > NOW()
+		RETURNING id, name, start_time, end_time, team_id, service, labels
+	`, auth.Actor(), id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.FailedPrecondition).Msg("maintenance window has already ended").Err()
+	}
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("end maintenance window").Err()
+	}
+
+	audit.Log(ctx, "maintenance_window.end", "maintenance_window", id, before, window)
+	return window, nil
+}
+
+// Matching returns the active maintenance windows an incident falls into
+//
+//encore:api private
+func Matching(ctx context.Context, params *MatchParams) (*Windows, error) {
+	at := params.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, name, start_time, end_time, team_id, service, labels
+		FROM windows
+		WHERE start_time <= $1
+		  AND end_time > $1
+		ORDER BY start_time ASC
+	`, at)
+	if err != nil {
+		return nil, err
+	}
+	active, err := rowsToWindows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	matching := &Windows{}
+	for _, window := range active.Items {
+		if window.Scope.matches(params.TeamId, params.Labels) {
+			matching.Items = append(matching.Items, window)
+		}
+	}
+	return matching, nil
+}
+
+var _ = cron.NewJob("announce-maintenance-windows", cron.JobConfig{
+	Title:    "Announce on Slack when maintenance windows start and end",
+	Every:    cron.Minute,
+	Endpoint: AnnounceWindows,
+})
+
+//encore:api private
+func AnnounceWindows(ctx context.Context) error {
+	started, err := claimAnnouncements(ctx, `
+		UPDATE windows
+		SET start_announced_at = NOW()
+		WHERE start_announced_at IS NULL
+		  AND start_time <= NOW()
+		RETURNING id, name, start_time, end_time, team_id, service, labels
+	`)
+	if err != nil {
+		return err
+	}
+	for _, window := range started.Items {
+		announce(ctx, &window, fmt.Sprintf("Maintenance window #%d %q has started, incidents %s are not paged until %s", window.Id, window.Name, window.Scope.describe(), window.End.Format(time.RFC1123)))
+	}
+
+	ended, err := claimAnnouncements(ctx, `
+		UPDATE windows
+		SET end_announced_at = NOW()
+		WHERE end_announced_at IS NULL
+		  AND end_time <= NOW()
+		RETURNING id, name, start_time, end_time, team_id, service, labels
+	`)
+	if err != nil {
+		return err
+	}
+	for _, window := range ended.Items {
+		announce(ctx, &window, fmt.Sprintf("Maintenance window #%d %q has ended, incidents %s are paged again", window.Id, window.Name, window.Scope.describe()))
+	}
+	return nil
+}
+
+// claimAnnouncements Helper function marking windows as announced, so they are announced only once
+func claimAnnouncements(ctx context.Context, query string) (*Windows, error) {
+	rows, err := sqldb.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return rowsToWindows(rows)
+}
+
+func announce(ctx context.Context, window *Window, text string) {
+	if err := slack.Notify(ctx, &slack.NotifyParams{Text: text}); err != nil {
+		rlog.Error("FAIL to announce maintenance window", "window", window.Id, "err", err)
+	}
+}
+
+// requireScheduler Helper function making sure the caller can manage maintenance windows of a
+// team, or of everything if there is no team
+func requireScheduler(teamId *int) error {
+	if teamId == nil {
+		return authz.RequireAdmin("manage maintenance windows for every team")
+	}
+	return authz.RequireTeamRole(authz.RoleScheduler, []int{*teamId}, "manage maintenance windows")
+}
+
+func (s *Scope) matches(teamId *int, labels map[string]string) bool {
+	if s.TeamId != nil && (teamId == nil || *teamId != *s.TeamId) {
+		return false
+	}
+	if s.Service != "" && labels[serviceLabel] != s.Service {
+		return false
+	}
+	for name, value := range s.Labels {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Scope) describe() string {
+	var parts []string
+	if s.TeamId != nil {
+		parts = append(parts, fmt.Sprintf("team #%d", *s.TeamId))
+	}
+	if s.Service != "" {
+		parts = append(parts, fmt.Sprintf("service %s", s.Service))
+	}
+	for name, value := range s.Labels {
+		parts = append(parts, fmt.Sprintf("%s=%s", name, value))
+	}
+	if len(parts) == 0 {
+		return "of everything"
+	}
+	return fmt.Sprintf("of %v", parts)
+}
+
+func rowsToWindows(rows *sqldb.Rows) (*Windows, error) {
+	defer rows.Close()
+
+	var windows []Window
+	for rows.Next() {
+		window, err := RowToWindow(rows)
+		if err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		windows = append(windows, *window)
+	}
+	return &Windows{Items: windows}, nil
+}
+
+// RowToWindow Helper function from Row to Window
+func RowToWindow(row interface {
+	Scan(dest ...interface{}) error
+}) (*Window, error) {
+	var window = &Window{}
+	var labels []byte
+	err := row.Scan(&window.Id, &window.Name, &window.Start, &window.End, &window.Scope.TeamId, &window.Scope.Service, &labels)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(labels, &window.Scope.Labels); err != nil {
+		return nil, err
+	}
+	return window, nil
+}
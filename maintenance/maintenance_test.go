@@ -0,0 +1,27 @@
+package maintenance
+
+import "testing"
+
+func TestScopeMatches(t *testing.T) {
+	payments, search := 1, 2
+	labels := map[string]string{"service": "checkout", "region": "eu"}
+	for _, test := range []struct {
+		scope    Scope
+		teamId   *int
+		expected bool
+	}{
+		{Scope{}, nil, true},
+		{Scope{TeamId: &payments}, &payments, true},
+		{Scope{TeamId: &payments}, &search, false},
+		{Scope{TeamId: &payments}, nil, false},
+		{Scope{Service: "checkout"}, nil, true},
+		{Scope{Service: "search"}, nil, false},
+		{Scope{Labels: map[string]string{"region": "eu"}}, nil, true},
+		{Scope{Labels: map[string]string{"region": "us"}}, nil, false},
+		{Scope{TeamId: &payments, Service: "checkout", Labels: map[string]string{"region": "eu"}}, &payments, true},
+	} {
+		if matched := test.scope.matches(test.teamId, labels); matched != test.expected {
+			t.Errorf("expected %+v to match %v, got %v", test.scope, test.expected, matched)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+CREATE TABLE windows
+(
+    id                   BIGSERIAL PRIMARY KEY,
+    name                 VARCHAR(255) NOT NULL,
+    start_time           TIMESTAMPTZ  NOT NULL,
+    end_time             TIMESTAMPTZ  NOT NULL,
+    -- the scope, incidents have to match all of it, an empty scope matches every incident
+    team_id              BIGINT,
+    service              VARCHAR(255) NOT NULL DEFAULT '',
+    labels               JSONB        NOT NULL DEFAULT '{}',
+    -- set once the start and end have been announced on Slack
+    start_announced_at   TIMESTAMPTZ,
+    end_announced_at     TIMESTAMPTZ,
+    created_by           VARCHAR(255),
+    ended_by             VARCHAR(255),
+    created_at           TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    CHECK (start_time <= end_time) -- equal when cancelled before it started
+);
+
+CREATE INDEX windows_end_time_index ON windows (end_time);
@@ -0,0 +1,200 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Severities from the most to the least severe
+var Severities = []string{"SEV1", "SEV2", "SEV3", "SEV4"}
+
+// DefaultSeverity is given to incidents without a severity which no rule sets one for
+const DefaultSeverity = "SEV3"
+
+// Event is what rules are evaluated against, i.e. an incident about to be created
+type Event struct {
+	Body     string
+	Source   string            // e.g. the monitoring system or environment, such as staging
+	Severity string            // empty when the source didn't set one
+	Labels   map[string]string // e.g. {"service":"payments"}
+	Time     time.Time         // defaults to now
+}
+
+// Conditions all have to match for a rule to match. Empty conditions match everything.
+type Conditions struct {
+	BodyRegex string            // e.g. (?i)payments
+	Labels    map[string]string // each label has to have exactly this value
+	Source    string
+	Severity  string
+	TimeOfDay *TimeOfDay
+}
+
+// TimeOfDay matches between two wall-clock times, e.g. 18:00 to 09:00 for outside office hours
+type TimeOfDay struct {
+	Start    string // e.g. 09:00, inclusive
+	End      string // e.g. 17:00, exclusive, before Start to wrap around midnight, never equal to Start
+	TimeZone string // defaults to UTC
+}
+
+// Actions are applied when a rule matches, later rules overriding earlier ones
+type Actions struct {
+	TeamId     *int
+	Severity   string
+	AssigneeId *int
+	Suppress   bool     // store the incident, but don't assign or notify anyone
+	Tags       []string // added to the tags of earlier rules
+}
+
+// Result is what matching rules decided for an event
+type Result struct {
+	MatchedRuleIds []int
+	TeamId         *int
+	Severity       string
+	AssigneeId     *int
+	Suppressed     bool
+	SuppressedBy   *int // the rule which suppressed the event
+	Tags           []string
+}
+
+// evaluate Helper function applying the actions of the rules which match the event, in order.
+// Evaluation stops at the first matching rule, unless it has Continue set, or when it suppresses.
+func evaluate(rules []Rule, event *Event) (*Result, error) {
+	result := &Result{Severity: event.Severity}
+	for _, rule := range rules {
+		matched, err := rule.Conditions.matches(event)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d: %w", rule.Id, err)
+		}
+		if !matched {
+			continue
+		}
+
+		result.MatchedRuleIds = append(result.MatchedRuleIds, rule.Id)
+		actions := rule.Actions
+		if actions.TeamId != nil {
+			result.TeamId = actions.TeamId
+		}
+		if actions.Severity != "" {
+			result.Severity = actions.Severity
+		}
+		if actions.AssigneeId != nil {
+			result.AssigneeId = actions.AssigneeId
+		}
+		result.Tags = appendUnique(result.Tags, actions.Tags...)
+		if actions.Suppress {
+			result.Suppressed = true
+			id := rule.Id
+			result.SuppressedBy = &id
+			break
+		}
+		if !rule.Continue {
+			break
+		}
+	}
+	if result.Severity == "" {
+		result.Severity = DefaultSeverity
+	}
+	return result, nil
+}
+
+func (c *Conditions) matches(event *Event) (bool, error) {
+	if c.Source != "" && c.Source != event.Source {
+		return false, nil
+	}
+	if c.Severity != "" && c.Severity != event.Severity {
+		return false, nil
+	}
+	for name, value := range c.Labels {
+		if event.Labels[name] != value {
+			return false, nil
+		}
+	}
+	if c.BodyRegex != "" {
+		re, err := compileRegex(c.BodyRegex)
+		if err != nil {
+			return false, fmt.Errorf("invalid body regex: %w", err)
+		}
+		if !re.MatchString(event.Body) {
+			return false, nil
+		}
+	}
+	if c.TimeOfDay != nil {
+		return c.TimeOfDay.matches(event.Time)
+	}
+	return true, nil
+}
+
+// compiledRegexes caches the body regexes of rules, as every incident is evaluated against all rules
+var compiledRegexes = struct {
+	sync.Mutex
+	byPattern map[string]*regexp.Regexp
+}{byPattern: make(map[string]*regexp.Regexp)}
+
+// maxCompiledRegexes bounds the cache, which keeps the regexes of changed and deleted rules
+const maxCompiledRegexes = 1000
+
+// compileRegex Helper function compiling a regex only the first time it is used
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	compiledRegexes.Lock()
+	defer compiledRegexes.Unlock()
+	if re, ok := compiledRegexes.byPattern[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(compiledRegexes.byPattern) >= maxCompiledRegexes {
+		compiledRegexes.byPattern = make(map[string]*regexp.Regexp)
+	}
+	compiledRegexes.byPattern[pattern] = re
+	return re, nil
+}
+
+func (t *TimeOfDay) matches(at time.Time) (bool, error) {
+	location, err := time.LoadLocation(t.TimeZone)
+	if err != nil {
+		return false, fmt.Errorf("invalid time zone %q", t.TimeZone)
+	}
+	start, err := minuteOfDay(t.Start)
+	if err != nil {
+		return false, err
+	}
+	end, err := minuteOfDay(t.End)
+	if err != nil {
+		return false, err
+	}
+
+	local := at.In(location)
+	minute := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return minute >= start && minute < end, nil
+	}
+	return minute >= start || minute < end, nil // wraps around midnight
+}
+
+func minuteOfDay(clock string) (int, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("time of day %q is not in the format 15:04", clock)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func appendUnique(values []string, more ...string) []string {
+	for _, value := range more {
+		exists := false
+		for _, existing := range values {
+			if existing == value {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,14 @@
+CREATE TABLE rules
+(
+    id         BIGSERIAL PRIMARY KEY,
+    position   INTEGER      NOT NULL, -- rules are evaluated in ascending order
+    name       VARCHAR(255) NOT NULL,
+    conditions JSONB        NOT NULL,
+    actions    JSONB        NOT NULL,
+    continue   BOOLEAN      NOT NULL DEFAULT FALSE,
+    created_by VARCHAR(255),
+    updated_by VARCHAR(255),
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX rules_position_index ON rules (position, id);
@@ -0,0 +1,275 @@
+// Package rules routes incidents based on their content, e.g. "if the body matches payments,
+// route it to the payments team with SEV2" or "if the source is staging, suppress it".
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type Rules struct {
+	Items []Rule
+}
+
+type Rule struct {
+	Id         int
+	Position   int // rules are evaluated in ascending order
+	Name       string
+	Conditions Conditions
+	Actions    Actions
+	Continue   bool // keep evaluating the following rules after this one matched
+}
+
+type RuleParams struct {
+	Name       string
+	Position   int // defaults to after the last rule
+	Conditions Conditions
+	Actions    Actions
+	Continue   bool
+}
+
+type TestParams struct {
+	Event Event
+}
+
+//encore:api auth method=POST path=/rules
+func Create(ctx context.Context, params *RuleParams) (*Rule, error) {
+	eb := errs.B().Meta("params", params)
+	if err := authz.RequireAdmin("manage rules"); err != nil {
+		return nil, err
+	}
+	if err := VerifyRule(ctx, params); err != nil {
+		return nil, err
+	}
+
+	conditions, actions, err := marshalRule(params)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := RowToRule(sqldb.QueryRow(ctx, `
+		INSERT INTO rules (position, name, conditions, actions, continue, created_by)
+		VALUES (CASE WHEN $1 > 0 THEN $1 ELSE (SELECT COALESCE(MAX(position), 0) + 1 FROM rules) END, $2, $3, $4, $5, $6)
+		RETURNING id, position, name, conditions, actions, continue
+	`, params.Position, params.Name, conditions, actions, params.Continue, auth.Actor()))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert rule").Err()
+	}
+
+	audit.Log(ctx, "rule.create", "rule", rule.Id, nil, rule)
+	return rule, nil
+}
+
+//encore:api public method=GET path=/rules
+func List(ctx context.Context) (*Rules, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, position, name, conditions, actions, continue
+		FROM rules
+		ORDER BY position ASC, id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		rule, err := RowToRule(rows)
+		if err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		rules = append(rules, *rule)
+	}
+
+	return &Rules{Items: rules}, nil
+}
+
+//encore:api public method=GET path=/rules/:id
+func Get(ctx context.Context, id int) (*Rule, error) {
+	eb := errs.B().Meta("ruleId", id)
+	rule, err := RowToRule(sqldb.QueryRow(ctx, `
+		SELECT id, position, name, conditions, actions, continue
+		FROM rules
+		WHERE id = $1
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no rule found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+//encore:api auth method=PUT path=/rules/:id
+func Update(ctx context.Context, id int, params *RuleParams) (*Rule, error) {
+	eb := errs.B().Meta("ruleId", id, "params", params)
+	if err := authz.RequireAdmin("manage rules"); err != nil {
+		return nil, err
+	}
+	before, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyRule(ctx, params); err != nil {
+		return nil, err
+	}
+
+	conditions, actions, err := marshalRule(params)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := RowToRule(sqldb.QueryRow(ctx, `
+		UPDATE rules
+		SET position = CASE WHEN $1 > 0 THEN $1 ELSE position END, name = $2, conditions = $3, actions = $4, continue = $5, updated_by = $6
+		WHERE id = $7
+		RETURNING id, position, name, conditions, actions, continue
+	`, params.Position, params.Name, conditions, actions, params.Continue, auth.Actor(), id))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update rule").Err()
+	}
+
+	audit.Log(ctx, "rule.update", "rule", id, before, rule)
+	return rule, nil
+}
+
+//encore:api auth method=DELETE path=/rules/:id
+func Delete(ctx context.Context, id int) (*Rule, error) {
+	if err := authz.RequireAdmin("manage rules"); err != nil {
+		return nil, err
+	}
+	rule, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sqldb.Exec(ctx, `DELETE FROM rules WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+
+	audit.Log(ctx, "rule.delete", "rule", id, rule, nil)
+	return rule, nil
+}
+
+// Test is a dry-run of the rules against an event, to see what would happen to such an incident
+//
+//encore:api public method=POST path=/rules/test
+func Test(ctx context.Context, params *TestParams) (*Result, error) {
+	return Evaluate(ctx, &params.Event)
+}
+
+// Evaluate is called by the incidents service for every new incident, before it is assigned
+//
+//encore:api private
+func Evaluate(ctx context.Context, event *Event) (*Result, error) {
+	eb := errs.B()
+	rules, err := List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	result, err := evaluate(rules.Items, event)
+	if err != nil {
+		return nil, eb.Code(errs.Internal).Cause(err).Msg(err.Error()).Err()
+	}
+	return result, nil
+}
+
+// VerifyRule Helper function for making sure a rule can be evaluated and its actions refer to
+// a team and user who exist
+func VerifyRule(ctx context.Context, params *RuleParams) error {
+	eb := errs.B().Meta("name", params.Name)
+	if len(params.Name) == 0 {
+		return eb.Code(errs.InvalidArgument).Msg("name is empty").Err()
+	}
+
+	conditions := params.Conditions
+	if conditions.BodyRegex != "" {
+		if _, err := regexp.Compile(conditions.BodyRegex); err != nil {
+			return eb.Code(errs.InvalidArgument).Msgf("invalid body regex: %v", err).Err()
+		}
+	}
+	if conditions.Severity != "" {
+		if err := VerifySeverity(conditions.Severity); err != nil {
+			return err
+		}
+	}
+	if conditions.TimeOfDay != nil {
+		if _, err := conditions.TimeOfDay.matches(time.Now()); err != nil {
+			return eb.Code(errs.InvalidArgument).Msg(err.Error()).Err()
+		}
+		// it would never match, as End is exclusive
+		start, _ := minuteOfDay(conditions.TimeOfDay.Start)
+		if end, _ := minuteOfDay(conditions.TimeOfDay.End); start == end {
+			return eb.Code(errs.InvalidArgument).Msg("time of day starts when it ends, leave it out to match all day").Err()
+		}
+	}
+
+	actions := params.Actions
+	if actions.Severity != "" {
+		if err := VerifySeverity(actions.Severity); err != nil {
+			return err
+		}
+	}
+	if actions.TeamId != nil {
+		if _, err := users.GetTeam(ctx, *actions.TeamId); err != nil {
+			return err
+		}
+	}
+	if actions.AssigneeId != nil {
+		if _, err := users.GetAssignable(ctx, *actions.AssigneeId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifySeverity Helper function for making sure a severity is one we know about
+func VerifySeverity(severity string) error {
+	for _, known := range Severities {
+		if severity == known {
+			return nil
+		}
+	}
+	return errs.B().Meta("severity", severity).Code(errs.InvalidArgument).Msgf("unknown severity %q, expected one of %v", severity, Severities).Err()
+}
+
+func marshalRule(params *RuleParams) (conditions []byte, actions []byte, err error) {
+	if conditions, err = json.Marshal(params.Conditions); err != nil {
+		return nil, nil, err
+	}
+	if actions, err = json.Marshal(params.Actions); err != nil {
+		return nil, nil, err
+	}
+	return conditions, actions, nil
+}
+
+// RowToRule Helper function from Row to Rule
+func RowToRule(row interface {
+	Scan(dest ...interface{}) error
+}) (*Rule, error) {
+	var rule = &Rule{}
+	var conditions, actions []byte
+	err := row.Scan(&rule.Id, &rule.Position, &rule.Name, &conditions, &actions, &rule.Continue)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(conditions, &rule.Conditions); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(actions, &rule.Actions); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
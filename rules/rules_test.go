@@ -0,0 +1,96 @@
+package rules
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+func TestEvaluate(t *testing.T) {
+	payments, oncall := 1, 7
+	rules := []Rule{
+		{Id: 1, Conditions: Conditions{Source: "staging"}, Actions: Actions{Suppress: true}},
+		{Id: 2, Conditions: Conditions{BodyRegex: "(?i)payments"}, Actions: Actions{TeamId: &payments, Severity: "SEV2", Tags: []string{"payments"}}, Continue: true},
+		{Id: 3, Conditions: Conditions{Labels: map[string]string{"region": "eu"}}, Actions: Actions{AssigneeId: &oncall, Tags: []string{"eu", "payments"}}},
+		{Id: 4, Actions: Actions{Severity: "SEV4"}},
+	}
+
+	result, err := evaluate(rules, &Event{Body: "Payments are failing", Labels: map[string]string{"region": "eu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Result{MatchedRuleIds: []int{2, 3}, TeamId: &payments, Severity: "SEV2", AssigneeId: &oncall, Tags: []string{"payments", "eu"}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected %+v, got %+v", expected, result)
+	}
+
+	result, err = evaluate(rules, &Event{Body: "Payments are failing", Source: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Suppressed || *result.SuppressedBy != 1 || len(result.MatchedRuleIds) != 1 {
+		t.Errorf("expected staging to be suppressed by rule 1, got %+v", result)
+	}
+
+	result, err = evaluate(rules, &Event{Body: "Disk is full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Severity != "SEV4" || !reflect.DeepEqual(result.MatchedRuleIds, []int{4}) {
+		t.Errorf("expected the catch-all rule to match, got %+v", result)
+	}
+
+	result, err = evaluate(nil, &Event{Body: "Disk is full"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Severity != DefaultSeverity {
+		t.Errorf("expected the default severity, got %v", result.Severity)
+	}
+}
+
+func TestTimeOfDay(t *testing.T) {
+	nights := TimeOfDay{Start: "18:00", End: "09:00", TimeZone: "Europe/Berlin"}
+	for at, expected := range map[string]bool{
+		"2030-01-07T17:30:00Z": true,  // 18:30 in Berlin
+		"2030-01-07T07:59:00Z": true,  // 08:59 in Berlin
+		"2030-01-07T08:00:00Z": false, // 09:00 in Berlin
+		"2030-01-07T12:00:00Z": false,
+	} {
+		parsed, _ := time.Parse(time.RFC3339, at)
+		matched, err := nights.matches(parsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != expected {
+			t.Errorf("expected %v to match %v, got %v", at, expected, matched)
+		}
+	}
+}
+
+func TestVerifyRule_TimeOfDayStartingWhenItEnds(t *testing.T) {
+	params := &RuleParams{Name: "never", Conditions: Conditions{TimeOfDay: &TimeOfDay{Start: "09:00", End: "9:00"}}}
+	if err := VerifyRule(context.Background(), params); errs.Code(err) != errs.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestCompileRegex(t *testing.T) {
+	first, err := compileRegex("(?i)payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := compileRegex("(?i)payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected the regex to be compiled once")
+	}
+	if _, err := compileRegex("(unclosed"); err == nil {
+		t.Error("expected an invalid regex to fail")
+	}
+}
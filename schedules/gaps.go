@@ -0,0 +1,142 @@
+package schedules
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/slack"
+	"encore.app/users"
+	"encore.dev/cron"
+	"encore.dev/storage/sqldb"
+)
+
+type Gaps struct {
+	Items []TimeRange
+}
+
+// coverageLookahead is how far ahead the daily coverage check looks for gaps
+const coverageLookahead = 14 * 24 * time.Hour
+
+type ListGapsParams struct {
+	Start  time.Time
+	End    time.Time
+	TeamId int // the on-call of this team, defaults to the global on-call
+}
+
+// ListGaps returns the periods nobody is on-call. For the global on-call only its primary layer
+// counts, as that is who incidents get assigned to. A team is covered by its own shifts in any
+// layer, or else by a member of the team in the global on-call, the same as TeamOnCall.
+//
+//encore:api public method=GET path=/schedules/gaps
+func ListGaps(ctx context.Context, params *ListGapsParams) (*Gaps, error) {
+	timeRange := TimeRange{Start: params.Start, End: params.End}
+	err := VerifyTimeRange(timeRange)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[int]bool)
+	if params.TeamId != 0 {
+		team, err := users.GetTeam(ctx, params.TeamId)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range team.Members {
+			if member.User.DeactivatedAt == nil {
+				members[member.User.Id] = true
+			}
+		}
+	}
+
+	// unlike ListByTimeRange we need every schedule touching the window, not just those inside it
+	rows, err := sqldb.Query(ctx, `
+		SELECT user_id, layer, team_id, start_time, end_time
+		FROM schedules
+		WHERE start_time < $2
+		  AND end_time > $1
+		  AND (team_id IS NULL OR team_id = $3)
+		ORDER BY start_time ASC
+	`, timeRange.Start.UTC(), timeRange.End.UTC(), params.TeamId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var covered []TimeRange
+	for rows.Next() {
+		var userId int
+		var layer string
+		var teamId *int
+		var tr TimeRange
+		if err := rows.Scan(&userId, &layer, &teamId, &tr.Start, &tr.End); err != nil {
+			return nil, err
+		}
+		switch {
+		case params.TeamId == 0 && (teamId != nil || layer != LayerPrimary):
+			continue
+		case params.TeamId != 0 && teamId == nil && !members[userId]:
+			continue
+		}
+		covered = append(covered, tr)
+	}
+
+	return &Gaps{Items: FindGaps(timeRange, covered)}, nil
+}
+
+// FindGaps Helper function returning the parts of window which are not covered by any of the
+// given time ranges, which must be sorted by start time.
+func FindGaps(window TimeRange, covered []TimeRange) []TimeRange {
+	var gaps []TimeRange
+	cursor := window.Start
+	for _, tr := range covered {
+		if !tr.End.After(cursor) {
+			continue
+		}
+		if tr.Start.After(cursor) {
+			gaps = append(gaps, TimeRange{Start: cursor, End: minTime(tr.Start, window.End)})
+		}
+		cursor = tr.End
+		if !cursor.Before(window.End) {
+			return gaps
+		}
+	}
+	if cursor.Before(window.End) {
+		gaps = append(gaps, TimeRange{Start: cursor, End: window.End})
+	}
+	return gaps
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+var _ = cron.NewJob("schedule-coverage-gaps", cron.JobConfig{
+	Title:    "Warn on Slack about upcoming periods where nobody is on-call",
+	Every:    24 * cron.Hour,
+	Endpoint: NotifyCoverageGaps,
+})
+
+//encore:api private
+func NotifyCoverageGaps(ctx context.Context) error {
+	now := time.Now().UTC()
+	gaps, err := ListGaps(ctx, &ListGapsParams{Start: now, End: now.Add(coverageLookahead)})
+	if err != nil {
+		return err
+	}
+	if len(gaps.Items) == 0 {
+		return nil
+	}
+
+	var items = []string{"Nobody is on-call during these periods in the next 14 days, incidents created then will be unassigned:"}
+	for _, gap := range gaps.Items {
+		items = append(items, fmt.Sprintf("%s to %s", gap.Start.Format(time.RFC1123), gap.End.Format(time.RFC1123)))
+	}
+
+	return slack.Notify(ctx, &slack.NotifyParams{Text: strings.Join(items, "\n")})
+}
@@ -0,0 +1,75 @@
+package schedules
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"encore.app/authz"
+	"encore.app/users"
+)
+
+func TestFindGaps(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2030, 1, 7, hour, 0, 0, 0, time.UTC)
+	}
+	window := TimeRange{Start: at(0), End: at(24)}
+
+	tests := []struct {
+		name    string
+		covered []TimeRange
+		want    []TimeRange
+	}{
+		{"nothing scheduled", nil, []TimeRange{window}},
+		{"fully covered", []TimeRange{{at(0), at(12)}, {at(12), at(24)}}, nil},
+		{"covered beyond the window", []TimeRange{{at(0).Add(-time.Hour), at(24).Add(time.Hour)}}, nil},
+		{"gap between shifts", []TimeRange{{at(0), at(8)}, {at(10), at(24)}}, []TimeRange{{at(8), at(10)}}},
+		{"gaps at both ends", []TimeRange{{at(6), at(18)}}, []TimeRange{{at(0), at(6)}, {at(18), at(24)}}},
+		{"shift inside another", []TimeRange{{at(0), at(20)}, {at(2), at(4)}}, []TimeRange{{at(20), at(24)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FindGaps(window, tt.covered); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListGapsOfTeam(t *testing.T) {
+	team, err := users.CreateTeam(authenticated(), &users.CreateTeamParams{Name: "gaps " + time.Now().Format(time.RFC3339Nano)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, outsider := createUser(t), createUser(t)
+	if _, err := users.AddMember(authenticated(), team.Id, &users.AddMemberParams{UserId: member.Id, Role: authz.RoleResponder}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the member in the global on-call, then a shift of the team itself, then somebody else
+	slot := freeSlot(14)
+	createSchedule(t, member, slot)
+	own := TimeRange{Start: slot.End, End: slot.End.Add(time.Hour)}
+	if _, err := Create(authenticated(), member.Id, &CreateParams{Start: own.Start, End: own.End, Layer: LayerSecondary, TeamId: &team.Id}); err != nil {
+		t.Fatal(err)
+	}
+	other := TimeRange{Start: own.End, End: own.End.Add(time.Hour)}
+	createSchedule(t, outsider, other)
+
+	gaps, err := ListGaps(authenticated(), &ListGapsParams{Start: slot.Start, End: other.End, TeamId: team.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps.Items) != 1 || !gaps.Items[0].Start.Equal(other.Start) || !gaps.Items[0].End.Equal(other.End) {
+		t.Errorf("expected only the shift of somebody outside the team to be a gap, got %v", gaps.Items)
+	}
+
+	// the global on-call doesn't count the team's shift
+	gaps, err = ListGaps(authenticated(), &ListGapsParams{Start: slot.Start, End: other.End})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps.Items) != 1 || !gaps.Items[0].Start.Equal(own.Start) || !gaps.Items[0].End.Equal(own.End) {
+		t.Errorf("expected the shift of the team to be a gap of the global on-call, got %v", gaps.Items)
+	}
+}
@@ -0,0 +1,206 @@
+package schedules
+
+import (
+	"context"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type ReassignParams struct {
+	ToUserId int
+}
+
+// ListUpcomingByUser returns the current and future shifts of a user, oldest first
+//
+//encore:api public method=GET path=/users/:userId/schedules
+func ListUpcomingByUser(ctx context.Context, userId int) (*Schedules, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, user_id, layer, start_time, end_time, team_id
+		FROM schedules
+		WHERE user_id = $1
+		  AND end_time > NOW()
+		ORDER BY start_time ASC
+	`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		schedule, err := RowToSchedule(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, *schedule)
+	}
+
+	redactUsers(schedules)
+	return &Schedules{Items: schedules}, nil
+}
+
+// ReassignUser hands the current and future shifts and the rotations of a user over to another
+// user, e.g. before they are deactivated. A shift which already started is split, so the history
+// of who was on call stays correct. Returns the shifts of the other user.
+//
+//encore:api private
+func ReassignUser(ctx context.Context, userId int, params *ReassignParams) (*Schedules, error) {
+	eb := errs.B().Meta("userId", userId, "params", params)
+	if userId == params.ToUserId {
+		return nil, eb.Code(errs.InvalidArgument).Msg("cannot reassign shifts to the same user").Err()
+	}
+	to, err := users.GetAssignable(ctx, params.ToUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	upcoming, err := ListUpcomingByUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	// shifts of a team's own on-call can only be handed to its members, the same as creating them
+	checked := make(map[int]bool)
+	for _, schedule := range upcoming.Items {
+		if schedule.TeamId == nil || checked[*schedule.TeamId] {
+			continue
+		}
+		if err := requireTeamMember(ctx, *schedule.TeamId, to.Id); err != nil {
+			return nil, err
+		}
+		checked[*schedule.TeamId] = true
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	type change struct {
+		before, after Schedule
+	}
+	var changes []change
+	now := time.Now()
+	for _, before := range upcoming.Items {
+		after := before
+		after.User = *to
+		if before.Time.Start.Before(now) {
+			// end the ongoing shift now and continue it with the other user
+			after.Time.Start = now
+			_, err = sqldb.ExecTx(tx, ctx, `
+				UPDATE schedules SET end_time = $1, updated_by = $2 WHERE id = $3
+			`, after.Time.Start, auth.Actor(), before.Id)
+			if err != nil {
+				return nil, eb.Code(errs.Unavailable).Cause(err).Msg("end ongoing schedule").Err()
+			}
+			err = sqldb.QueryRowTx(tx, ctx, `
+				INSERT INTO schedules (user_id, layer, start_time, end_time, team_id, created_by)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id
+			`, to.Id, after.Layer, after.Time.Start, after.Time.End, after.TeamId, auth.Actor()).Scan(&after.Id)
+		} else {
+			_, err = sqldb.ExecTx(tx, ctx, `
+				UPDATE schedules SET user_id = $1, updated_by = $2 WHERE id = $3
+			`, to.Id, auth.Actor(), before.Id)
+		}
+		if err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msg("reassign schedule").Err()
+		}
+		changes = append(changes, change{before: before, after: after})
+	}
+
+	_, err = sqldb.ExecTx(tx, ctx, `UPDATE rotations SET user_id = $1 WHERE user_id = $2`, to.Id, userId)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("reassign rotations").Err()
+	}
+
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("commit reassignment").Err()
+	}
+
+	reassigned := &Schedules{}
+	for _, c := range changes {
+		if c.before.Id == c.after.Id {
+			audit.Log(ctx, "schedule.update", "schedule", c.after.Id, c.before, c.after)
+		} else {
+			ended := c.before
+			ended.Time.End = c.after.Time.Start
+			audit.Log(ctx, "schedule.update", "schedule", ended.Id, c.before, ended)
+			audit.Log(ctx, "schedule.create", "schedule", c.after.Id, nil, c.after)
+		}
+		reassigned.Items = append(reassigned.Items, c.after)
+	}
+	return reassigned, nil
+}
+
+// ReleaseUser removes the current and future shifts and the rotations of a user when nobody was
+// chosen to take them over, e.g. when their identity provider deprovisions them. A shift which
+// already started ends now. Returns the shifts as they were, so someone can be found for them.
+//
+//encore:api private
+func ReleaseUser(ctx context.Context, userId int) (*Schedules, error) {
+	eb := errs.B().Meta("userId", userId)
+	upcoming, err := ListUpcomingByUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	now := time.Now()
+	for _, schedule := range upcoming.Items {
+		if schedule.Time.Start.Before(now) {
+			_, err = sqldb.ExecTx(tx, ctx, `
+				UPDATE schedules SET end_time = $1, updated_by = $2 WHERE id = $3
+			`, now, auth.Actor(), schedule.Id)
+		} else {
+			_, err = sqldb.ExecTx(tx, ctx, `DELETE FROM schedules WHERE id = $1`, schedule.Id)
+		}
+		if err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msg("release schedule").Err()
+		}
+	}
+
+	rows, err := sqldb.QueryTx(tx, ctx, `DELETE FROM rotations WHERE user_id = $1 RETURNING id`, userId)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("release rotations").Err()
+	}
+	var rotationIds []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, eb.Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		rotationIds = append(rotationIds, id)
+	}
+	rows.Close()
+
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("commit release").Err()
+	}
+
+	for _, schedule := range upcoming.Items {
+		if schedule.Time.Start.Before(now) {
+			ended := schedule
+			ended.Time.End = now
+			audit.Log(ctx, "schedule.update", "schedule", schedule.Id, schedule, ended)
+		} else {
+			audit.Log(ctx, "schedule.delete", "schedule", schedule.Id, schedule, nil)
+		}
+	}
+	for _, id := range rotationIds {
+		audit.Log(ctx, "rotation.delete", "rotation", id, UserReference{Table: "rotations", Id: id, UserId: userId}, nil)
+	}
+	return upcoming, nil
+}
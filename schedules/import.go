@@ -0,0 +1,340 @@
+package schedules
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	ImportFormatCSV = "csv"
+	ImportFormatICS = "ics"
+)
+
+type ImportParams struct {
+	Format string // either "csv" or "ics"
+	Data   string // the raw contents of the file being imported
+	DryRun bool   // only validate the import, nothing will be stored
+}
+
+type ImportResult struct {
+	DryRun    bool
+	Schedules []Schedule
+	Conflicts []ImportConflict
+}
+
+type ImportConflict struct {
+	Line    int
+	User    string
+	Layer   string
+	Time    TimeRange
+	Message string
+}
+
+// importRow is a single shift read from an import file, before it has been validated
+type importRow struct {
+	Line     int
+	User     string
+	Layer    string
+	Time     TimeRange
+	Conflict string // found while parsing, e.g. a recurring event, reported with the other conflicts
+}
+
+//encore:api auth method=POST path=/schedules/import
+func Import(ctx context.Context, params *ImportParams) (*ImportResult, error) {
+	eb := errs.B().Meta("format", params.Format, "dryRun", params.DryRun)
+
+	var rows []importRow
+	var err error
+	switch strings.ToLower(params.Format) {
+	case ImportFormatCSV:
+		rows, err = parseCSV(params.Data)
+	case ImportFormatICS:
+		rows, err = parseICS(params.Data)
+	default:
+		return nil, eb.Code(errs.InvalidArgument).Msgf("unsupported format %q, expected %q or %q", params.Format, ImportFormatCSV, ImportFormatICS).Err()
+	}
+	if err != nil {
+		return nil, eb.Code(errs.InvalidArgument).Cause(err).Msg("could not parse import").Err()
+	}
+	if len(rows) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("import contains no schedules").Err()
+	}
+
+	everyone, err := users.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{DryRun: params.DryRun}
+	for i, row := range rows {
+		conflict := func(msg string) {
+			result.Conflicts = append(result.Conflicts, ImportConflict{Line: row.Line, User: row.User, Layer: row.Layer, Time: row.Time, Message: msg})
+		}
+
+		if row.Conflict != "" {
+			conflict(row.Conflict)
+			continue
+		}
+		user := findImportUser(everyone.Items, row.User)
+		if user == nil {
+			conflict("user not found")
+			continue
+		}
+		if user.DeactivatedAt != nil {
+			conflict("user is deactivated")
+			continue
+		}
+		if err := RequireScheduler(ctx, user.Id); err != nil {
+			conflict(errorMessage(err))
+			continue
+		}
+		if err := VerifyNewSchedule(ctx, row.Time, row.Layer, nil); err != nil {
+			conflict(errorMessage(err))
+			continue
+		}
+		if other := overlappingRow(rows[:i], row); other != nil {
+			conflict(fmt.Sprintf("overlaps with line %d of the import", other.Line))
+			continue
+		}
+		result.Schedules = append(result.Schedules, Schedule{User: *user, Layer: row.Layer, Time: row.Time})
+	}
+
+	if params.DryRun {
+		return result, nil
+	}
+	if len(result.Conflicts) > 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msgf("import has %d conflicting rows and nothing was imported, use DryRun to list them", len(result.Conflicts)).Err()
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	for i := range result.Schedules {
+		schedule := &result.Schedules[i]
+		err := sqldb.QueryRowTx(tx, ctx, `
+			INSERT INTO schedules (user_id, layer, start_time, end_time, created_by)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, start_time, end_time
+		`, schedule.User.Id, schedule.Layer, schedule.Time.Start, schedule.Time.End, auth.Actor()).Scan(&schedule.Id, &schedule.Time.Start, &schedule.Time.End)
+		if isExclusionViolation(err) {
+			return nil, overlapError(ctx, schedule.Time, schedule.Layer, nil, 0, err)
+		}
+		if err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert schedule").Err()
+		}
+	}
+
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("commit import").Err()
+	}
+	for _, schedule := range result.Schedules {
+		audit.Log(ctx, "schedule.create", "schedule", schedule.Id, nil, schedule)
+	}
+
+	return result, nil
+}
+
+// findImportUser Helper function to match the user column of an import against the slack handle
+// or email of a known user
+func findImportUser(candidates []users.User, identifier string) *users.User {
+	identifier = strings.TrimPrefix(strings.TrimSpace(identifier), "@")
+	for i := range candidates {
+		if strings.EqualFold(candidates[i].SlackHandle, identifier) || (candidates[i].Email != "" && strings.EqualFold(candidates[i].Email, identifier)) {
+			return &candidates[i]
+		}
+	}
+	return nil
+}
+
+// errorMessage Helper function to get the message of an error without its code
+func errorMessage(err error) string {
+	var e *errs.Error
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	return err.Error()
+}
+
+// overlappingRow Helper function to find an earlier row in the same import and layer which overlaps with row
+func overlappingRow(previous []importRow, row importRow) *importRow {
+	for i := range previous {
+		if previous[i].Conflict == "" && previous[i].Layer == row.Layer && previous[i].Time.Start.Before(row.Time.End) && row.Time.Start.Before(previous[i].Time.End) {
+			return &previous[i]
+		}
+	}
+	return nil
+}
+
+// parseCSV Helper function for reading "user,start,end[,layer]" rows with RFC3339 timestamps.
+// A leading header row is skipped.
+func parseCSV(data string) ([]importRow, error) {
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) != 3 && len(record) != 4 {
+			return nil, fmt.Errorf("line %d: expected 3 or 4 fields, got %d", line, len(record))
+		}
+		if len(rows) == 0 && line == 1 && strings.EqualFold(record[0], "user") {
+			continue // header
+		}
+
+		start, err := time.Parse(time.RFC3339, record[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: start is not a RFC3339 timestamp: %w", line, err)
+		}
+		end, err := time.Parse(time.RFC3339, record[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: end is not a RFC3339 timestamp: %w", line, err)
+		}
+
+		layer := LayerPrimary
+		if len(record) == 4 && strings.TrimSpace(record[3]) != "" {
+			layer = strings.ToLower(strings.TrimSpace(record[3])) // like the categories of ics events
+		}
+
+		rows = append(rows, importRow{Line: line, User: record[0], Layer: layer, Time: TimeRange{Start: start, End: end}})
+	}
+
+	return rows, nil
+}
+
+// parseICS Helper function for reading the VEVENTs of an iCalendar file. The user is taken from the
+// ATTENDEE of each event, falling back to its SUMMARY, and the layer from its CATEGORIES.
+func parseICS(data string) ([]importRow, error) {
+	var rows []importRow
+	var event *importRow
+	var attendee, summary string
+
+	lines, err := unfoldICS(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		name, params, value := splitICSLine(line.text)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			event = &importRow{Line: line.number, Layer: LayerPrimary}
+			attendee, summary = "", ""
+		case event == nil:
+			continue // not inside an event
+		case name == "END" && value == "VEVENT":
+			event.User = attendee
+			if event.User == "" {
+				event.User = summary
+			}
+			if event.User == "" {
+				return nil, fmt.Errorf("line %d: event has no ATTENDEE or SUMMARY", event.Line)
+			}
+			if event.Time.Start.IsZero() || event.Time.End.IsZero() {
+				return nil, fmt.Errorf("line %d: event must have both DTSTART and DTEND", event.Line)
+			}
+			rows = append(rows, *event)
+			event = nil
+		case name == "DTSTART" || name == "DTEND":
+			parsed, err := parseICSTime(params["TZID"], value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s: %w", line.number, name, err)
+			}
+			if name == "DTSTART" {
+				event.Time.Start = parsed
+			} else {
+				event.Time.End = parsed
+			}
+		case name == "RRULE" || name == "RDATE":
+			// only the first occurrence would be imported, which silently drops the others
+			event.Conflict = "recurring events are not supported, export the occurrences as single events"
+		case name == "ATTENDEE":
+			attendee = strings.TrimPrefix(strings.TrimPrefix(value, "mailto:"), "MAILTO:")
+		case name == "SUMMARY":
+			summary = value
+		case name == "CATEGORIES":
+			event.Layer = strings.ToLower(value)
+		}
+	}
+	if event != nil {
+		return nil, fmt.Errorf("line %d: event is never closed", event.Line)
+	}
+
+	return rows, nil
+}
+
+type icsLine struct {
+	number int
+	text   string
+}
+
+// unfoldICS joins continuation lines (starting with a space or tab) onto the line before them
+func unfoldICS(data string) ([]icsLine, error) {
+	var lines []icsLine
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")) {
+			lines[len(lines)-1].text += text[1:]
+			continue
+		}
+		if text != "" {
+			lines = append(lines, icsLine{number: number, text: text})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("line %d: %w", number+1, err)
+	}
+	return lines, nil
+}
+
+// splitICSLine splits "NAME;PARAM=x:value" into its name, parameters and value
+func splitICSLine(line string) (string, map[string]string, string) {
+	head, value, _ := strings.Cut(line, ":")
+	parts := strings.Split(head, ";")
+	params := map[string]string{}
+	for _, param := range parts[1:] {
+		if key, val, ok := strings.Cut(param, "="); ok {
+			params[strings.ToUpper(key)] = strings.Trim(val, `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, value
+}
+
+func parseICSTime(tzid string, value string) (time.Time, error) {
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse("20060102T150405Z", value)
+	}
+	location := time.UTC
+	if tzid != "" {
+		var err error
+		if location, err = time.LoadLocation(tzid); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.ParseInLocation("20060102T150405", value, location)
+}
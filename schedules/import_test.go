@@ -0,0 +1,144 @@
+package schedules
+
+import (
+	"bufio"
+	_ "embed"
+	"strings"
+	"testing"
+	"time"
+
+	"encore.app/users"
+)
+
+//go:embed testdata/import.ics
+var icsFixture string
+
+func TestParseCSV(t *testing.T) {
+	rows, err := parseCSV("user,start,end\nbil,2030-01-07T09:00:00Z,2030-01-08T09:00:00Z\n@bil, 2030-01-08T09:00:00+01:00, 2030-01-09T09:00:00+01:00\n")
+	if err != nil {
+		t.Fatal("failed to parse csv", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+	if rows[1].Line != 3 || rows[1].User != "@bil" {
+		t.Errorf("unexpected second row: %+v", rows[1])
+	}
+	if !rows[1].Time.Start.Equal(time.Date(2030, 1, 8, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected start time: %v", rows[1].Time.Start)
+	}
+}
+
+func TestParseCSV_Layer(t *testing.T) {
+	rows, err := parseCSV("bil,2030-01-07T09:00:00Z,2030-01-08T09:00:00Z,secondary\nbil,2030-01-08T09:00:00Z,2030-01-09T09:00:00Z\n")
+	if err != nil {
+		t.Fatal("failed to parse csv", err)
+	}
+	if rows[0].Layer != LayerSecondary || rows[1].Layer != LayerPrimary {
+		t.Errorf("unexpected layers: %q, %q", rows[0].Layer, rows[1].Layer)
+	}
+}
+
+func TestParseCSV_LayerIsCaseInsensitive(t *testing.T) {
+	rows, err := parseCSV("bil,2030-01-07T09:00:00Z,2030-01-08T09:00:00Z, Primary\nbil,2030-01-08T09:00:00Z,2030-01-09T09:00:00Z,SECONDARY\n")
+	if err != nil {
+		t.Fatal("failed to parse csv", err)
+	}
+	if rows[0].Layer != LayerPrimary || rows[1].Layer != LayerSecondary {
+		t.Errorf("unexpected layers: %q, %q", rows[0].Layer, rows[1].Layer)
+	}
+}
+
+func TestParseCSV_InvalidTimestamp(t *testing.T) {
+	if _, err := parseCSV("bil,tomorrow,2030-01-08T09:00:00Z\n"); err == nil {
+		t.Fatal("should have failed")
+	}
+}
+
+func TestParseICS(t *testing.T) {
+	rows, err := parseICS(icsFixture)
+	if err != nil {
+		t.Fatal("failed to parse ics", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+	if rows[0].User != "bil" || !rows[0].Time.Start.Equal(time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected first row: %+v", rows[0])
+	}
+	// the attendee is folded over two lines and takes precedence over the summary
+	if rows[1].User != "bil@example.com" {
+		t.Errorf("expected attendee to be used as user, got %q", rows[1].User)
+	}
+	if !rows[1].Time.Start.Equal(time.Date(2030, 1, 8, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected TZID to be applied, got %v", rows[1].Time.Start)
+	}
+}
+
+func TestParseICS_RecurringEventIsAConflict(t *testing.T) {
+	rows, err := parseICS("BEGIN:VCALENDAR\nBEGIN:VEVENT\nSUMMARY:bil\nDTSTART:20300107T090000Z\nDTEND:20300108T090000Z\nRRULE:FREQ=WEEKLY;COUNT=4\nEND:VEVENT\nEND:VCALENDAR\n")
+	if err != nil {
+		t.Fatal("failed to parse ics", err)
+	}
+	if len(rows) != 1 || rows[0].Conflict == "" {
+		t.Fatalf("expected the recurring event to be a conflict, got %+v", rows)
+	}
+	if other := overlappingRow(rows, importRow{Layer: LayerPrimary, Time: rows[0].Time}); other != nil {
+		t.Errorf("expected the recurring event not to be compared with other rows, got line %d", other.Line)
+	}
+}
+
+func TestParseICS_LineTooLong(t *testing.T) {
+	data := "BEGIN:VCALENDAR\nBEGIN:VEVENT\nSUMMARY:" + strings.Repeat("x", bufio.MaxScanTokenSize) + "\nEND:VEVENT\nEND:VCALENDAR\n"
+	if _, err := parseICS(data); err == nil {
+		t.Fatal("expected a line the scanner can't read to fail the import")
+	}
+}
+
+func TestOverlappingRow(t *testing.T) {
+	day := time.Date(2030, 1, 7, 0, 0, 0, 0, time.UTC)
+	rows := []importRow{
+		{Line: 1, Layer: LayerPrimary, Time: TimeRange{Start: day, End: day.Add(24 * time.Hour)}},
+		{Line: 2, Layer: LayerPrimary, Time: TimeRange{Start: day.Add(24 * time.Hour), End: day.Add(48 * time.Hour)}},
+		{Line: 3, Layer: LayerPrimary, Time: TimeRange{Start: day.Add(-time.Hour), End: day.Add(72 * time.Hour)}},
+		{Line: 4, Layer: LayerSecondary, Time: TimeRange{Start: day, End: day.Add(24 * time.Hour)}},
+	}
+	if other := overlappingRow(rows[:1], rows[1]); other != nil {
+		t.Errorf("back to back shifts should not overlap, got line %d", other.Line)
+	}
+	if other := overlappingRow(rows[:2], rows[2]); other == nil || other.Line != 1 {
+		t.Errorf("expected enclosing shift to overlap with line 1, got %+v", other)
+	}
+	if other := overlappingRow(rows[:3], rows[3]); other != nil {
+		t.Errorf("shifts on different layers should not overlap, got line %d", other.Line)
+	}
+}
+
+func TestFindImportUser(t *testing.T) {
+	candidates := []users.User{
+		{Id: 1, SlackHandle: "bil", Email: "bil@example.com"},
+		{Id: 2, SlackHandle: "jane"},
+	}
+	for identifier, expected := range map[string]int{"bil": 1, "@Bil": 1, "BIL@example.com": 1, "jane": 2} {
+		user := findImportUser(candidates, identifier)
+		if user == nil || user.Id != expected {
+			t.Errorf("expected %q to match user %d, got %v", identifier, expected, user)
+		}
+	}
+	if user := findImportUser(candidates, "nobody@example.com"); user != nil {
+		t.Errorf("expected no match, got %v", user)
+	}
+}
+
+func TestParseICS_MatchesAttendeeByEmail(t *testing.T) {
+	rows, err := parseICS(icsFixture)
+	if err != nil {
+		t.Fatal("failed to parse ics", err)
+	}
+	candidates := []users.User{{Id: 1, SlackHandle: "bil", Email: "Bil@example.com"}}
+	for _, row := range rows {
+		if user := findImportUser(candidates, row.User); user == nil || user.Id != 1 {
+			t.Errorf("expected line %d with user %q to match by slack handle or email, got %v", row.Line, row.User, user)
+		}
+	}
+}
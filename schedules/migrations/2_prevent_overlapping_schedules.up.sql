@@ -0,0 +1,25 @@
+-- Existing shifts may already overlap, which would fail adding the constraint. The earlier shift
+-- wins: a later one starts once every shift before it ended, or is removed if that leaves nothing.
+WITH ordered AS (
+    SELECT id, MAX(end_time) OVER (ORDER BY start_time, id ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING) AS covered_until
+    FROM schedules
+)
+DELETE FROM schedules
+USING ordered
+WHERE schedules.id = ordered.id
+  AND ordered.covered_until >= schedules.end_time;
+
+WITH ordered AS (
+    SELECT id, MAX(end_time) OVER (ORDER BY start_time, id ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING) AS covered_until
+    FROM schedules
+)
+UPDATE schedules
+SET start_time = ordered.covered_until
+FROM ordered
+WHERE schedules.id = ordered.id
+  AND ordered.covered_until > schedules.start_time;
+
+-- start_time and end_time are stored without time zone, hence tsrange rather than tstzrange.
+-- Ranges are half-open so back-to-back shifts (one ending as the next starts) are allowed.
+ALTER TABLE schedules
+    ADD CONSTRAINT schedules_no_overlap EXCLUDE USING gist (tsrange(start_time, end_time, '[)') WITH &&);
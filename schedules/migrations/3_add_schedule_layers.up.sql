@@ -0,0 +1,10 @@
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+ALTER TABLE schedules
+    ADD COLUMN layer VARCHAR(255) NOT NULL DEFAULT 'primary';
+
+-- schedules may now overlap, as long as they are on different layers
+ALTER TABLE schedules
+    DROP CONSTRAINT schedules_no_overlap;
+ALTER TABLE schedules
+    ADD CONSTRAINT schedules_no_overlap EXCLUDE USING gist (layer WITH =, tsrange(start_time, end_time, '[)') WITH &&);
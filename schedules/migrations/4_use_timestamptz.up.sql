@@ -0,0 +1,27 @@
+-- existing timestamps were written in UTC
+ALTER TABLE schedules
+    DROP CONSTRAINT schedules_no_overlap;
+ALTER TABLE schedules
+    ALTER COLUMN start_time TYPE TIMESTAMPTZ USING start_time AT TIME ZONE 'UTC',
+    ALTER COLUMN end_time TYPE TIMESTAMPTZ USING end_time AT TIME ZONE 'UTC';
+ALTER TABLE schedules
+    ADD CONSTRAINT schedules_no_overlap EXCLUDE USING gist (layer WITH =, tstzrange(start_time, end_time, '[)') WITH &&);
+
+-- a rotation is a weekly shift starting at a wall-clock time in its time zone,
+-- which is materialized into schedules ahead of time
+CREATE TABLE rotations
+(
+    id         BIGSERIAL PRIMARY KEY,
+    user_id    INTEGER      NOT NULL,
+    layer      VARCHAR(255) NOT NULL DEFAULT 'primary',
+    weekday    SMALLINT     NOT NULL,
+    start_time VARCHAR(5)   NOT NULL,
+    hours      INTEGER      NOT NULL,
+    time_zone  VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE schedules
+    ADD COLUMN rotation_id BIGINT REFERENCES rotations (id) ON DELETE SET NULL;
+
+CREATE UNIQUE INDEX schedules_rotation_start_index ON schedules (rotation_id, start_time);
@@ -0,0 +1,7 @@
+-- the auth UID of whoever made the change, NULL when it was made by the system itself
+ALTER TABLE schedules
+    ADD COLUMN created_by VARCHAR(255),
+    ADD COLUMN updated_by VARCHAR(255);
+
+ALTER TABLE rotations
+    ADD COLUMN created_by VARCHAR(255);
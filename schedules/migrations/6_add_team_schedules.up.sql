@@ -0,0 +1,9 @@
+-- a shift can belong to a team, which then has an on-call of its own. Shifts without a team are
+-- the global on-call as before, so the layers only have to be free within the same team.
+ALTER TABLE schedules
+    ADD COLUMN team_id INTEGER;
+
+ALTER TABLE schedules
+    DROP CONSTRAINT schedules_no_overlap;
+ALTER TABLE schedules
+    ADD CONSTRAINT schedules_no_overlap EXCLUDE USING gist (COALESCE(team_id, 0) WITH =, layer WITH =, tstzrange(start_time, end_time, '[)') WITH &&);
@@ -0,0 +1,96 @@
+package schedules
+
+import (
+	"context"
+
+	"encore.app/audit"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// UserReference is a row pointing at a user of the users service, which the database can't enforce
+type UserReference struct {
+	Table  string // schedules or rotations
+	Id     int
+	UserId int
+}
+
+type UserReferences struct {
+	Items []UserReference
+}
+
+type RemoveUserReferencesParams struct {
+	UserIds []int
+}
+
+// ListUserReferences returns every schedule and rotation with the user it belongs to, without
+// loading the users, so it also works when a user doesn't exist anymore
+//
+//encore:api private
+func ListUserReferences(ctx context.Context) (*UserReferences, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT 'schedules', id, user_id FROM schedules
+		UNION ALL
+		SELECT 'rotations', id, user_id FROM rotations
+		ORDER BY 1, 2
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	references := &UserReferences{}
+	for rows.Next() {
+		var reference UserReference
+		if err := rows.Scan(&reference.Table, &reference.Id, &reference.UserId); err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		references.Items = append(references.Items, reference)
+	}
+
+	return references, nil
+}
+
+// RemoveUserReferences deletes the schedules and rotations of users who don't exist, which would
+// otherwise fail every request loading them
+//
+//encore:api private
+func RemoveUserReferences(ctx context.Context, params *RemoveUserReferencesParams) (*UserReferences, error) {
+	eb := errs.B().Meta("userIds", params.UserIds)
+	removed := &UserReferences{}
+	for _, userId := range params.UserIds {
+		rows, err := sqldb.Query(ctx, `
+			WITH deleted_schedules AS (
+				DELETE FROM schedules WHERE user_id = $1 RETURNING id
+			), deleted_rotations AS (
+				DELETE FROM rotations WHERE user_id = $1 RETURNING id
+			)
+			SELECT 'schedules', id FROM deleted_schedules
+			UNION ALL
+			SELECT 'rotations', id FROM deleted_rotations
+		`, userId)
+		if err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msg("remove user references").Err()
+		}
+
+		for rows.Next() {
+			reference := UserReference{UserId: userId}
+			if err := rows.Scan(&reference.Table, &reference.Id); err != nil {
+				rows.Close()
+				return nil, eb.Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+			}
+			removed.Items = append(removed.Items, reference)
+		}
+		rows.Close()
+	}
+
+	for _, reference := range removed.Items {
+		entityType := "schedule"
+		if reference.Table == "rotations" {
+			entityType = "rotation"
+		}
+		audit.Log(ctx, entityType+".delete", entityType, reference.Id, reference, nil)
+	}
+	return removed, nil
+}
@@ -0,0 +1,75 @@
+package schedules
+
+import (
+	"context"
+	"testing"
+
+	"encore.dev/storage/sqldb"
+)
+
+// missingUserId is never handed out by the users service
+const missingUserId = 2147483000
+
+func TestUserReferencesOfMissingUsersAreRemoved(t *testing.T) {
+	ctx := context.Background()
+	kept := createSchedule(t, createUser(t), freeSlot(30))
+
+	slot := freeSlot(31)
+	var scheduleId, rotationId int
+	err := sqldb.QueryRow(ctx, `
+		INSERT INTO schedules (user_id, layer, start_time, end_time) VALUES ($1, 'primary', $2, $3) RETURNING id
+	`, missingUserId, slot.Start, slot.End).Scan(&scheduleId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqldb.QueryRow(ctx, `
+		INSERT INTO rotations (user_id, weekday, start_time, hours, time_zone) VALUES ($1, 1, '09:00', 8, 'UTC') RETURNING id
+	`, missingUserId).Scan(&rotationId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	references, err := ListUserReferences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []UserReference{
+		{Table: "schedules", Id: scheduleId, UserId: missingUserId},
+		{Table: "rotations", Id: rotationId, UserId: missingUserId},
+		{Table: "schedules", Id: kept.Id, UserId: kept.User.Id},
+	} {
+		if !containsReference(references.Items, expected) {
+			t.Errorf("expected %v to be listed, got %v", expected, references.Items)
+		}
+	}
+
+	removed, err := RemoveUserReferences(ctx, &RemoveUserReferencesParams{UserIds: []int{missingUserId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed.Items) != 2 {
+		t.Fatalf("expected the schedule and the rotation to be removed, got %v", removed.Items)
+	}
+
+	references, err = ListUserReferences(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, reference := range references.Items {
+		if reference.UserId == missingUserId {
+			t.Errorf("expected %v to be removed", reference)
+		}
+	}
+	if _, err := Get(ctx, kept.Id); err != nil {
+		t.Errorf("expected the schedule of an existing user to be kept, got %v", err)
+	}
+}
+
+func containsReference(references []UserReference, expected UserReference) bool {
+	for _, reference := range references {
+		if reference == expected {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+package schedules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Rotation is a weekly shift, e.g. "09:00 Europe/Berlin every Monday for 24 hours". Its start is
+// a wall-clock time in its time zone, so it stays at 09:00 across daylight saving time transitions.
+type Rotation struct {
+	Id        int
+	User      users.User
+	Layer     string
+	Weekday   string // e.g. monday
+	StartTime string // wall-clock time of day, e.g. 09:00
+	Hours     int
+	TimeZone  string
+}
+
+type CreateRotationParams struct {
+	Weekday   string
+	StartTime string
+	Hours     int
+	TimeZone  string // defaults to the user's time zone
+	Layer     string // defaults to primary
+}
+
+// rotationLookahead is how far ahead the schedules of a rotation are created
+const rotationLookahead = 4 * 7 * 24 * time.Hour
+
+//encore:api auth method=POST path=/users/:userId/rotations
+func CreateRotation(ctx context.Context, userId int, params *CreateRotationParams) (*Rotation, error) {
+	eb := errs.B().Meta("userId", userId, "params", params)
+
+	user, err := users.GetAssignable(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := RequireScheduler(ctx, userId); err != nil {
+		return nil, err
+	}
+
+	rotation := &Rotation{
+		User:      *user,
+		Layer:     params.Layer,
+		Weekday:   strings.ToLower(params.Weekday),
+		StartTime: params.StartTime,
+		Hours:     params.Hours,
+		TimeZone:  params.TimeZone,
+	}
+	if rotation.Layer == "" {
+		rotation.Layer = LayerPrimary
+	}
+	if rotation.TimeZone == "" {
+		rotation.TimeZone = user.TimeZone
+	}
+	if err := VerifyLayer(rotation.Layer); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	occurrences, err := rotation.Occurrences(now, now.Add(rotationLookahead))
+	if err != nil {
+		return nil, eb.Code(errs.InvalidArgument).Msg(err.Error()).Err()
+	}
+	for _, occurrence := range occurrences {
+		if err := VerifyNewSchedule(ctx, occurrence, rotation.Layer, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	weekday, _ := parseWeekday(rotation.Weekday)
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	err = sqldb.QueryRowTx(tx, ctx, `
+		INSERT INTO rotations (user_id, layer, weekday, start_time, hours, time_zone, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, userId, rotation.Layer, int(weekday), rotation.StartTime, rotation.Hours, rotation.TimeZone, auth.Actor()).Scan(&rotation.Id)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert rotation").Err()
+	}
+
+	for _, occurrence := range occurrences {
+		_, err := sqldb.ExecTx(tx, ctx, `
+			INSERT INTO schedules (user_id, layer, start_time, end_time, rotation_id, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, userId, rotation.Layer, occurrence.Start, occurrence.End, rotation.Id, auth.Actor())
+		if err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert schedule").Err()
+		}
+	}
+
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("commit rotation").Err()
+	}
+	audit.Log(ctx, "rotation.create", "rotation", rotation.Id, nil, rotation)
+
+	return rotation, nil
+}
+
+//encore:api public method=GET path=/rotations/:id
+func GetRotation(ctx context.Context, id int) (*Rotation, error) {
+	eb := errs.B().Meta("rotationId", id)
+	rotation, err := RowToRotation(ctx, sqldb.QueryRow(ctx, `
+		SELECT id, user_id, layer, weekday, start_time, hours, time_zone
+		FROM rotations
+		WHERE id = $1
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no rotation found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	users.Redact(&rotation.User)
+	return rotation, nil
+}
+
+var _ = cron.NewJob("extend-rotations", cron.JobConfig{
+	Title:    "Create upcoming schedules for weekly rotations",
+	Every:    24 * cron.Hour,
+	Endpoint: ExtendRotations,
+})
+
+//encore:api private
+func ExtendRotations(ctx context.Context) error {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, user_id, layer, weekday, start_time, hours, time_zone
+		FROM rotations
+	`)
+	if err != nil {
+		return err
+	}
+
+	var rotations []Rotation
+	for rows.Next() {
+		rotation, err := RowToRotation(ctx, rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		rotations = append(rotations, *rotation)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, rotation := range rotations {
+		if rotation.User.DeactivatedAt != nil {
+			continue // should have been handed over, don't put anyone on call who has left
+		}
+		occurrences, err := rotation.Occurrences(now, now.Add(rotationLookahead))
+		if err != nil {
+			return err
+		}
+
+		for _, occurrence := range occurrences {
+			var exists bool
+			err := sqldb.QueryRow(ctx, `
+				SELECT EXISTS(SELECT 1 FROM schedules WHERE rotation_id = $1 AND start_time = $2)
+			`, rotation.Id, occurrence.Start).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+
+			if err := VerifyNewSchedule(ctx, occurrence, rotation.Layer, nil); err != nil {
+				rlog.Error("FAIL to extend rotation", "rotation", rotation.Id, "start", occurrence.Start, "err", err)
+				continue // someone else has taken over this shift
+			}
+
+			schedule := Schedule{User: rotation.User, Layer: rotation.Layer, Time: occurrence}
+			err = sqldb.QueryRow(ctx, `
+				INSERT INTO schedules (user_id, layer, start_time, end_time, rotation_id)
+				VALUES ($1, $2, $3, $4, $5)
+				RETURNING id
+			`, rotation.User.Id, rotation.Layer, occurrence.Start, occurrence.End, rotation.Id).Scan(&schedule.Id)
+			if err != nil {
+				return err
+			}
+			audit.Log(ctx, "schedule.create", "schedule", schedule.Id, nil, schedule)
+		}
+	}
+
+	return nil
+}
+
+// Occurrences Helper function returning the shifts of the rotation starting within from and until.
+// Each start and end is computed as a wall-clock time in the rotation's time zone, so the UTC offset
+// follows daylight saving time.
+func (r *Rotation) Occurrences(from, until time.Time) ([]TimeRange, error) {
+	weekday, err := parseWeekday(r.Weekday)
+	if err != nil {
+		return nil, err
+	}
+	location, err := time.LoadLocation(r.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", r.TimeZone, err)
+	}
+	clock, err := time.Parse("15:04", r.StartTime)
+	if err != nil {
+		return nil, fmt.Errorf("start time %q is not in the format 15:04", r.StartTime)
+	}
+	if r.Hours <= 0 || r.Hours > 7*24 {
+		return nil, fmt.Errorf("hours must be between 1 and %d", 7*24)
+	}
+
+	local := from.In(location)
+	day := local.Day() + (int(weekday)-int(local.Weekday())+7)%7
+
+	var occurrences []TimeRange
+	for ; ; day += 7 {
+		start := time.Date(local.Year(), local.Month(), day, clock.Hour(), clock.Minute(), 0, 0, location)
+		if start.Before(from) {
+			continue // earlier today
+		}
+		if !start.Before(until) {
+			return occurrences, nil
+		}
+		// the end is a wall-clock time too, so a weekly shift ends when the next one starts even if
+		// daylight saving time changed in between
+		end := time.Date(local.Year(), local.Month(), day, clock.Hour()+r.Hours, clock.Minute(), 0, 0, location)
+		occurrences = append(occurrences, TimeRange{Start: start, End: end})
+	}
+}
+
+func parseWeekday(value string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), value) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", value)
+}
+
+// RowToRotation Helper function from Row to Rotation
+func RowToRotation(ctx context.Context, row interface {
+	Scan(dest ...interface{}) error
+}) (*Rotation, error) {
+	var rotation = &Rotation{}
+	var userId, weekday int
+	err := row.Scan(&rotation.Id, &userId, &rotation.Layer, &weekday, &rotation.StartTime, &rotation.Hours, &rotation.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	rotation.Weekday = strings.ToLower(time.Weekday(weekday).String())
+	user, err := users.Get(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	rotation.User = *user
+	return rotation, nil
+}
@@ -2,8 +2,14 @@ package schedules
 
 import (
 	"context"
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
 	"encore.app/users"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"encore.dev/beta/errs"
@@ -15,80 +21,221 @@ type Schedules struct {
 }
 
 type Schedule struct {
-	Id   int
-	User users.User
-	Time TimeRange
+	Id     int
+	User   users.User
+	Layer  string
+	Time   TimeRange
+	TeamId *int // the team whose on-call this is, nil for the global on-call
 }
 
+// Layers allow more than one person to be on-call at the same time, e.g. a secondary to
+// escalate to when the primary does not respond. Incidents are assigned to the primary.
+const (
+	LayerPrimary   = "primary"
+	LayerSecondary = "secondary"
+	LayerManager   = "manager"
+)
+
+var Layers = []string{LayerPrimary, LayerSecondary, LayerManager}
+
 type TimeRange struct {
 	Start time.Time
 	End   time.Time
 }
 
-//encore:api public method=POST path=/users/:userId/schedules
-func Create(ctx context.Context, userId int, timeRange TimeRange) (*Schedule, error) {
-	eb := errs.B().Meta("userID", userId, "start", timeRange.Start.String(), "end", timeRange.End.String())
-	if timeRange.Start.Before(time.Now()) {
-		return nil, eb.Code(errs.InvalidArgument).Msg("start timestamp in the past").Err()
+//encore:api auth method=POST path=/users/:userId/schedules
+func Create(ctx context.Context, userId int, params *CreateParams) (*Schedule, error) {
+	eb := errs.B().Meta("userID", userId, "params", params)
+	layer := params.Layer
+	if layer == "" {
+		layer = LayerPrimary
 	}
 
-	err := VerifyTimeRange(timeRange)
+	// check for user
+	user, err := users.GetAssignable(ctx, userId)
 	if err != nil {
-		return nil, eb.Code(errs.InvalidArgument).Cause(err).Msg("invalid time range").Err()
-	}
-
-	// check for existing schedules. we only support 1 at a timestamp right now.
-	if schedule, err := ScheduledAt(ctx, timeRange.Start.Format(time.RFC3339)); schedule != nil && err == nil {
-		return nil, eb.Code(errs.InvalidArgument).Cause(err).Msg("schedule already exists within this start timestamp").Err()
+		return nil, err
 	}
-
-	if schedule, err := ScheduledAt(ctx, timeRange.End.Format(time.RFC3339)); schedule != nil && err == nil {
-		return nil, eb.Code(errs.InvalidArgument).Cause(err).Msg("schedule already exists within this end timestamp").Err()
+	if err := RequireScheduler(ctx, userId); err != nil {
+		return nil, err
 	}
 
-	// check for user
-	user, err := users.Get(ctx, userId)
+	timeRange, err := params.timeRange(user.TimeZone)
 	if err != nil {
-		return nil, eb.Code(errs.NotFound).Msg("user not found").Err()
+		return nil, eb.Code(errs.InvalidArgument).Msg(err.Error()).Err()
+	}
+	if params.TeamId != nil {
+		if err := requireTeamMember(ctx, *params.TeamId, userId); err != nil {
+			return nil, err
+		}
+	}
+	if err := VerifyNewSchedule(ctx, timeRange, layer, params.TeamId); err != nil {
+		return nil, err
 	}
 
-	schedule := Schedule{User: *user, Time: TimeRange{}}
+	schedule := Schedule{User: *user, Layer: layer, Time: TimeRange{}, TeamId: params.TeamId}
 	err = sqldb.QueryRow(ctx, `
-		INSERT INTO schedules (user_id, start_time, end_time)
-		VALUES ($1, $2, $3)
+		INSERT INTO schedules (user_id, layer, start_time, end_time, team_id, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6)
 		RETURNING id, start_time, end_time
-	`, userId, timeRange.Start, timeRange.End).Scan(&schedule.Id, &schedule.Time.Start, &schedule.Time.End)
+	`, userId, layer, timeRange.Start, timeRange.End, params.TeamId, auth.Actor()).Scan(&schedule.Id, &schedule.Time.Start, &schedule.Time.End)
+	if isExclusionViolation(err) {
+		return nil, overlapError(ctx, timeRange, layer, params.TeamId, 0, err)
+	}
 	if err != nil {
 		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert schedule").Err()
 	}
 
+	audit.Log(ctx, "schedule.create", "schedule", schedule.Id, nil, schedule)
 	return &schedule, nil
 }
 
+type CreateParams struct {
+	Start time.Time
+	End   time.Time
+	// LocalStart and LocalEnd are wall-clock times (2006-01-02T15:04) which can be given instead
+	// of Start and End. They are read in TimeZone, or the user's time zone when it's empty.
+	LocalStart string
+	LocalEnd   string
+	TimeZone   string
+	Layer      string // defaults to primary
+	TeamId     *int   // makes it a shift of the team's own on-call, the user has to be a member
+}
+
+func (p *CreateParams) timeRange(userTimeZone string) (TimeRange, error) {
+	if p.LocalStart == "" && p.LocalEnd == "" {
+		return TimeRange{Start: p.Start, End: p.End}, nil
+	}
+	if p.LocalStart == "" || p.LocalEnd == "" {
+		return TimeRange{}, errors.New("both local start and local end are required")
+	}
+
+	timeZone := p.TimeZone
+	if timeZone == "" {
+		timeZone = userTimeZone
+	}
+	start, err := ParseLocalTime(p.LocalStart, timeZone)
+	if err != nil {
+		return TimeRange{}, err
+	}
+	end, err := ParseLocalTime(p.LocalEnd, timeZone)
+	if err != nil {
+		return TimeRange{}, err
+	}
+	return TimeRange{Start: start, End: end}, nil
+}
+
+type ScheduledParams struct {
+	Layer    string // defaults to primary
+	TimeZone string // allows the timestamp to be a wall-clock time (2006-01-02T15:04) in this time zone
+}
+
+func (p *ScheduledParams) layer() string {
+	if p == nil || p.Layer == "" {
+		return LayerPrimary
+	}
+	return p.Layer
+}
+
 //encore:api public method=GET path=/scheduled
-func ScheduledNow(ctx context.Context) (*Schedule, error) {
-	return Scheduled(ctx, time.Now())
+func ScheduledNow(ctx context.Context, params *ScheduledParams) (*Schedule, error) {
+	schedule, err := Scheduled(ctx, time.Now(), params.layer())
+	if err != nil {
+		return nil, err
+	}
+	users.Redact(&schedule.User)
+	return schedule, nil
 }
 
 //encore:api public method=GET path=/scheduled/:timestamp
-func ScheduledAt(ctx context.Context, timestamp string) (*Schedule, error) {
+func ScheduledAt(ctx context.Context, timestamp string, params *ScheduledParams) (*Schedule, error) {
 	eb := errs.B().Meta("timestamp", timestamp)
 	parsedtime, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil && params != nil && params.TimeZone != "" {
+		parsedtime, err = ParseLocalTime(timestamp, params.TimeZone)
+	}
 	if err != nil {
 		return nil, eb.Code(errs.InvalidArgument).Msg("timestamp is not in a valid format").Err()
 	}
 
-	return Scheduled(ctx, parsedtime)
+	schedule, err := Scheduled(ctx, parsedtime, params.layer())
+	if err != nil {
+		return nil, err
+	}
+	users.Redact(&schedule.User)
+	return schedule, nil
 }
 
-func Scheduled(ctx context.Context, timestamp time.Time) (*Schedule, error) {
-	eb := errs.B().Meta("timestamp", timestamp.String())
+//encore:api public method=GET path=/scheduled/:timestamp/layers
+func ScheduledLayersAt(ctx context.Context, timestamp string) (*Schedules, error) {
+	eb := errs.B().Meta("timestamp", timestamp)
+	parsedtime, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return nil, eb.Code(errs.InvalidArgument).Msg("timestamp is not in a valid format").Err()
+	}
+	schedules, err := scheduledLayers(ctx, parsedtime, nil)
+	if err != nil {
+		return nil, err
+	}
+	redactUsers(schedules.Items)
+	return schedules, nil
+}
+
+// scheduledLayers Helper function returning the shifts of every layer at a time of a team's own
+// on-call, or of the global on-call when teamId is nil, in the order of escalation
+func scheduledLayers(ctx context.Context, timestamp time.Time, teamId *int) (*Schedules, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, user_id, layer, start_time, end_time, team_id
+		FROM schedules
+		WHERE start_time <= $1
+		  AND end_time > $1
+		  AND team_id IS NOT DISTINCT FROM $2
+	`, timestamp.UTC(), teamId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		schedule, err := RowToSchedule(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, *schedule)
+	}
+
+	// order by escalation rather than alphabetically
+	sort.SliceStable(schedules, func(i, j int) bool {
+		return layerRank(schedules[i].Layer) < layerRank(schedules[j].Layer)
+	})
+
+	return &Schedules{Items: schedules}, nil
+}
+
+// redactUsers Helper function hiding the contact details of the users of shifts from callers who
+// aren't authenticated
+func redactUsers(schedules []Schedule) {
+	for i := range schedules {
+		users.Redact(&schedules[i].User)
+	}
+}
+
+func Scheduled(ctx context.Context, timestamp time.Time, layer string) (*Schedule, error) {
+	eb := errs.B().Meta("timestamp", timestamp.String(), "layer", layer)
+	if err := VerifyLayer(layer); err != nil {
+		return nil, err
+	}
+
 	schedule, err := RowToSchedule(ctx, sqldb.QueryRow(ctx, `
-		SELECT id, user_id, start_time, end_time
+		SELECT id, user_id, layer, start_time, end_time, team_id
 		FROM schedules
 		WHERE start_time <= $1
-		  AND end_time >= $1
-	`, timestamp.UTC()))
+		  AND end_time > $1
+		  AND layer = $2
+		  AND team_id IS NULL
+	`, timestamp.UTC(), layer))
 	if errors.Is(err, sqldb.ErrNoRows) {
 		return nil, eb.Code(errs.NotFound).Msg("no schedule found").Err()
 	}
@@ -98,6 +245,61 @@ func Scheduled(ctx context.Context, timestamp time.Time) (*Schedule, error) {
 	return schedule, nil
 }
 
+type TeamOnCallParams struct {
+	Layers []string // tried in order, defaults to all layers in the order of escalation
+}
+
+// TeamOnCall returns who of a team is paged right now: the team's own shift in the first layer
+// that has one, or else the shift of a member of the team in the global on-call
+//
+//encore:api public method=GET path=/teams/:id/oncall
+func TeamOnCall(ctx context.Context, id int, params *TeamOnCallParams) (*Schedule, error) {
+	eb := errs.B().Meta("teamId", id, "params", params)
+	layers := Layers
+	if params != nil && len(params.Layers) > 0 {
+		layers = params.Layers
+	}
+	for _, layer := range layers {
+		if err := VerifyLayer(layer); err != nil {
+			return nil, err
+		}
+	}
+	team, err := users.GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	own, err := scheduledLayers(ctx, now, &id)
+	if err != nil {
+		return nil, err
+	}
+	global, err := scheduledLayers(ctx, now, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range layers {
+		for _, schedule := range own.Items {
+			if schedule.Layer == layer && schedule.User.DeactivatedAt == nil {
+				users.Redact(&schedule.User)
+				return &schedule, nil
+			}
+		}
+		for _, schedule := range global.Items {
+			if schedule.Layer != layer {
+				continue
+			}
+			for _, member := range team.Members {
+				if member.User.Id == schedule.User.Id && member.User.DeactivatedAt == nil {
+					users.Redact(&schedule.User)
+					return &schedule, nil
+				}
+			}
+		}
+	}
+	return nil, eb.Code(errs.NotFound).Msgf("nobody of team %s is on-call", team.Name).Err()
+}
+
 //encore:api public method=GET path=/schedules
 func ListByTimeRange(ctx context.Context, timeRange TimeRange) (*Schedules, error) {
 	var rows *sqldb.Rows
@@ -109,7 +311,7 @@ func ListByTimeRange(ctx context.Context, timeRange TimeRange) (*Schedules, erro
 	}
 
 	rows, err = sqldb.Query(ctx, `
-		SELECT id, user_id, start_time, end_time
+		SELECT id, user_id, layer, start_time, end_time, team_id
 		FROM schedules
 		WHERE start_time >= $1
 		  AND end_time <= $2
@@ -130,11 +332,16 @@ func ListByTimeRange(ctx context.Context, timeRange TimeRange) (*Schedules, erro
 		schedules = append(schedules, *schedule)
 	}
 
+	redactUsers(schedules)
 	return &Schedules{Items: schedules}, nil
 }
 
-//encore:api public method=DELETE path=/schedules
+//encore:api auth method=DELETE path=/schedules
 func DeleteByTimeRange(ctx context.Context, timeRange TimeRange) (*Schedules, error) {
+	if err := authz.RequireAdmin("delete schedules by time range"); err != nil {
+		return nil, err
+	}
+
 	schedules, err := ListByTimeRange(ctx, timeRange)
 	if err != nil {
 		return nil, err
@@ -144,17 +351,169 @@ func DeleteByTimeRange(ctx context.Context, timeRange TimeRange) (*Schedules, er
 	if err != nil {
 		return nil, err
 	}
+	for _, schedule := range schedules.Items {
+		audit.Log(ctx, "schedule.delete", "schedule", schedule.Id, schedule, nil)
+	}
 
 	return schedules, err
 }
 
+//encore:api public method=GET path=/schedules/:id
+func Get(ctx context.Context, id int) (*Schedule, error) {
+	eb := errs.B().Meta("scheduleId", id)
+	schedule, err := RowToSchedule(ctx, sqldb.QueryRow(ctx, `
+		SELECT id, user_id, layer, start_time, end_time, team_id
+		FROM schedules
+		WHERE id = $1
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no schedule found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	users.Redact(&schedule.User)
+	return schedule, nil
+}
+
+//encore:api auth method=PATCH path=/schedules/:id
+func Update(ctx context.Context, id int, params *UpdateParams) (*Schedule, error) {
+	eb := errs.B().Meta("scheduleId", id, "params", params)
+	schedule, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := RequireScheduler(ctx, schedule.User.Id); err != nil {
+		return nil, err
+	}
+
+	timeRange := schedule.Time
+	if params.Start != nil {
+		if params.Start.Before(time.Now()) && !params.Start.Equal(schedule.Time.Start) {
+			return nil, eb.Code(errs.InvalidArgument).Msg("start timestamp in the past").Err()
+		}
+		timeRange.Start = *params.Start
+	}
+	if params.End != nil {
+		timeRange.End = *params.End
+	}
+	layer := schedule.Layer
+	if params.Layer != nil {
+		layer = *params.Layer
+	}
+	if err := VerifyAvailable(ctx, timeRange, layer, schedule.TeamId, id); err != nil {
+		return nil, err
+	}
+
+	userId := schedule.User.Id
+	if params.UserId != nil {
+		if _, err := users.GetAssignable(ctx, *params.UserId); err != nil {
+			return nil, err
+		}
+		if err := RequireScheduler(ctx, *params.UserId); err != nil {
+			return nil, err
+		}
+		if schedule.TeamId != nil {
+			if err := requireTeamMember(ctx, *schedule.TeamId, *params.UserId); err != nil {
+				return nil, err
+			}
+		}
+		userId = *params.UserId
+	}
+
+	before := schedule
+	schedule, err = RowToSchedule(ctx, sqldb.QueryRow(ctx, `
+		UPDATE schedules
+		SET user_id = $1, layer = $2, start_time = $3, end_time = $4, updated_by = $5
+		WHERE id = $6
+		RETURNING id, user_id, layer, start_time, end_time, team_id
+	`, userId, layer, timeRange.Start, timeRange.End, auth.Actor(), id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no schedule found").Err()
+	}
+	if isExclusionViolation(err) {
+		return nil, overlapError(ctx, timeRange, layer, before.TeamId, id, err)
+	}
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update schedule").Err()
+	}
+	audit.Log(ctx, "schedule.update", "schedule", id, before, schedule)
+	return schedule, nil
+}
+
+// UpdateParams only changes the fields which are set
+type UpdateParams struct {
+	UserId *int
+	Layer  *string
+	Start  *time.Time
+	End    *time.Time
+}
+
+//encore:api auth method=DELETE path=/schedules/:id
+func Delete(ctx context.Context, id int) (*Schedule, error) {
+	eb := errs.B().Meta("scheduleId", id)
+	existing, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := RequireScheduler(ctx, existing.User.Id); err != nil {
+		return nil, err
+	}
+
+	schedule, err := RowToSchedule(ctx, sqldb.QueryRow(ctx, `
+		DELETE FROM schedules
+		WHERE id = $1
+		RETURNING id, user_id, layer, start_time, end_time, team_id
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no schedule found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "schedule.delete", "schedule", id, existing, nil)
+	return schedule, nil
+}
+
+// RequireScheduler Helper function making sure the caller is a scheduler in one of the user's teams.
+// Only admins can edit the schedules of users who are not in any team.
+func RequireScheduler(ctx context.Context, userId int) error {
+	teamIds, err := users.TeamIds(ctx, userId)
+	if err != nil {
+		return err
+	}
+	action := fmt.Sprintf("edit the schedules of user #%d", userId)
+	if len(teamIds) == 0 {
+		return authz.RequireAdmin(action + ", who is not in any team")
+	}
+	return authz.RequireTeamRole(authz.RoleScheduler, teamIds, action)
+}
+
+// requireTeamMember Helper function making sure the caller schedules the team and the user is one of
+// its members, for shifts of the team's own on-call
+func requireTeamMember(ctx context.Context, teamId int, userId int) error {
+	team, err := users.GetTeam(ctx, teamId)
+	if err != nil {
+		return err
+	}
+	if err := authz.RequireTeamRole(authz.RoleScheduler, []int{teamId}, fmt.Sprintf("edit the schedules of team %s", team.Name)); err != nil {
+		return err
+	}
+	for _, member := range team.Members {
+		if member.User.Id == userId {
+			return nil
+		}
+	}
+	return errs.B().Meta("teamId", teamId, "userId", userId).Code(errs.InvalidArgument).Msgf("user #%d is not a member of team %s", userId, team.Name).Err()
+}
+
 // RowToSchedule Helper function from Row to Schedule
 func RowToSchedule(ctx context.Context, row interface {
 	Scan(dest ...interface{}) error
 }) (*Schedule, error) {
 	var schedule = &Schedule{Time: TimeRange{}}
 	var userId int
-	err := row.Scan(&schedule.Id, &userId, &schedule.Time.Start, &schedule.Time.End)
+	err := row.Scan(&schedule.Id, &userId, &schedule.Layer, &schedule.Time.Start, &schedule.Time.End, &schedule.TeamId)
 	if err != nil {
 		return nil, err
 	}
@@ -166,6 +525,91 @@ func RowToSchedule(ctx context.Context, row interface {
 	return schedule, nil
 }
 
+// VerifyNewSchedule Helper function for making sure a new schedule can be created within a time range
+func VerifyNewSchedule(ctx context.Context, timeRange TimeRange, layer string, teamId *int) error {
+	eb := errs.B().Meta("start", timeRange.Start.String(), "end", timeRange.End.String())
+	if timeRange.Start.Before(time.Now()) {
+		return eb.Code(errs.InvalidArgument).Msg("start timestamp in the past").Err()
+	}
+
+	return VerifyAvailable(ctx, timeRange, layer, teamId, 0)
+}
+
+// VerifyAvailable Helper function for making sure a schedule can occupy a time range within a layer
+// of a team's on-call, or the global on-call when teamId is nil. The schedule with excludeId is
+// ignored, so an existing schedule can be moved within its own time.
+func VerifyAvailable(ctx context.Context, timeRange TimeRange, layer string, teamId *int, excludeId int) error {
+	eb := errs.B().Meta("start", timeRange.Start.String(), "end", timeRange.End.String(), "layer", layer, "excludeId", excludeId)
+	if err := VerifyLayer(layer); err != nil {
+		return err
+	}
+
+	err := VerifyTimeRange(timeRange)
+	if err != nil {
+		return eb.Code(errs.InvalidArgument).Cause(err).Msg("invalid time range").Err()
+	}
+
+	// check for existing schedules. we only support 1 per layer at a timestamp.
+	overlapping, err := Overlapping(ctx, timeRange, layer, teamId, excludeId)
+	if err != nil {
+		return err
+	}
+	if overlapping != nil {
+		return eb.Code(errs.InvalidArgument).Meta("scheduleId", overlapping.Id).Msgf("schedule overlaps with existing schedule #%d", overlapping.Id).Err()
+	}
+
+	return nil
+}
+
+// Overlapping Helper function to find an existing schedule in the layer of the same on-call sharing
+// any time with the time range. Schedules are half-open, so one ending exactly when the other
+// starts does not overlap.
+func Overlapping(ctx context.Context, timeRange TimeRange, layer string, teamId *int, excludeId int) (*Schedule, error) {
+	schedule, err := RowToSchedule(ctx, sqldb.QueryRow(ctx, `
+		SELECT id, user_id, layer, start_time, end_time, team_id
+		FROM schedules
+		WHERE start_time < $2
+		  AND end_time > $1
+		  AND layer = $3
+		  AND team_id IS NOT DISTINCT FROM $4
+		  AND id <> $5
+		ORDER BY start_time ASC
+		LIMIT 1
+	`, timeRange.Start.UTC(), timeRange.End.UTC(), layer, teamId, excludeId))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, nil
+	}
+	return schedule, err
+}
+
+// exclusionViolation is the SQLSTATE of a violated exclusion constraint, i.e. schedules_no_overlap
+const exclusionViolation = "23P01"
+
+// isExclusionViolation Helper function telling whether the database rejected a schedule because it
+// overlaps another one in its layer, e.g. one which was created concurrently after VerifyAvailable
+func isExclusionViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return pgErr.SQLState() == exclusionViolation
+	}
+	return strings.Contains(err.Error(), "SQLSTATE "+exclusionViolation)
+}
+
+// overlapError Helper function for the error of a schedule rejected by schedules_no_overlap, naming
+// the shift it overlaps with
+func overlapError(ctx context.Context, timeRange TimeRange, layer string, teamId *int, excludeId int, cause error) error {
+	eb := errs.B().Meta("start", timeRange.Start.String(), "end", timeRange.End.String(), "layer", layer).Code(errs.InvalidArgument).Cause(cause)
+	overlapping, err := Overlapping(ctx, timeRange, layer, teamId, excludeId)
+	if err != nil || overlapping == nil {
+		return eb.Msgf("schedule overlaps with an existing %s schedule", layer).Err()
+	}
+	return eb.Meta("scheduleId", overlapping.Id).Msgf("schedule overlaps with existing %s schedule #%d of %s %s from %s to %s", layer, overlapping.Id,
+		overlapping.User.FirstName, overlapping.User.LastName, overlapping.Time.Start.Format(time.RFC3339), overlapping.Time.End.Format(time.RFC3339)).Err()
+}
+
 // VerifyTimeRange Helper function for making sure start and end times are valid
 func VerifyTimeRange(timeRange TimeRange) error {
 	eb := errs.B().Meta("start", timeRange.Start.String(), "end", timeRange.End.String())
@@ -179,3 +623,21 @@ func VerifyTimeRange(timeRange TimeRange) error {
 
 	return nil
 }
+
+// VerifyLayer Helper function for making sure a layer is one we know about
+func VerifyLayer(layer string) error {
+	if layerRank(layer) == len(Layers) {
+		return errs.B().Meta("layer", layer).Code(errs.InvalidArgument).Msgf("unknown layer %q, expected one of %s", layer, strings.Join(Layers, ", ")).Err()
+	}
+	return nil
+}
+
+// layerRank is the position of the layer in the escalation order, or len(Layers) if it's unknown
+func layerRank(layer string) int {
+	for i, l := range Layers {
+		if l == layer {
+			return i
+		}
+	}
+	return len(Layers)
+}
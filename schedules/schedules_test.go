@@ -0,0 +1,194 @@
+package schedules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/users"
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+type sqlStateError struct {
+	code string
+}
+
+func (e *sqlStateError) Error() string    { return "ERROR: database error (SQLSTATE " + e.code + ")" }
+func (e *sqlStateError) SQLState() string { return e.code }
+
+func TestIsExclusionViolation(t *testing.T) {
+	if !isExclusionViolation(fmt.Errorf("insert: %w", &sqlStateError{code: exclusionViolation})) {
+		t.Error("expected a wrapped exclusion violation to be detected")
+	}
+	if isExclusionViolation(&sqlStateError{code: "23505"}) {
+		t.Error("expected a unique violation not to be an exclusion violation")
+	}
+	if !isExclusionViolation(errors.New(`ERROR: conflicting key value violates exclusion constraint "schedules_no_overlap" (SQLSTATE 23P01)`)) {
+		t.Error("expected an exclusion violation to be detected by its message")
+	}
+	if isExclusionViolation(nil) {
+		t.Error("expected no error not to be an exclusion violation")
+	}
+}
+
+// authenticated is the context of a request made with an admin API key, as mutating endpoints require auth
+func authenticated() context.Context {
+	apiKeyId := 1
+	return encoreauth.WithContext(context.Background(), "apikey:1", &auth.Data{APIKeyId: &apiKeyId, Name: "test", Admin: true})
+}
+
+func createUser(t *testing.T) *users.User {
+	user, err := users.Create(authenticated(), users.CreateParams{
+		FirstName:   "Bilawal",
+		LastName:    "Hameed",
+		SlackHandle: "bil",
+	})
+	if err != nil {
+		t.Fatal("failed to create user", err)
+	}
+	return user
+}
+
+// freeSlot returns an hour far enough in the future not to overlap the schedules of other tests
+func freeSlot(yearsAhead int) TimeRange {
+	start := time.Now().UTC().AddDate(yearsAhead, 0, 0).Truncate(time.Hour)
+	return TimeRange{Start: start, End: start.Add(time.Hour)}
+}
+
+func createSchedule(t *testing.T, user *users.User, timeRange TimeRange) *Schedule {
+	schedule, err := Create(authenticated(), user.Id, &CreateParams{Start: timeRange.Start, End: timeRange.End})
+	if err != nil {
+		t.Fatal("failed to create schedule", err)
+	}
+	return schedule
+}
+
+func TestGetUnknownScheduleIsNotFound(t *testing.T) {
+	if _, err := Get(context.Background(), -1); errs.Code(err) != errs.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+	if _, err := Update(authenticated(), -1, &UpdateParams{}); errs.Code(err) != errs.NotFound {
+		t.Fatalf("expected NotFound when updating, got %v", err)
+	}
+	if _, err := Delete(authenticated(), -1); errs.Code(err) != errs.NotFound {
+		t.Fatalf("expected NotFound when deleting, got %v", err)
+	}
+}
+
+func TestUpdateSchedule(t *testing.T) {
+	user := createUser(t)
+	other := createUser(t)
+	schedule := createSchedule(t, user, freeSlot(10))
+
+	end := schedule.Time.End.Add(30 * time.Minute)
+	updated, err := Update(authenticated(), schedule.Id, &UpdateParams{UserId: &other.Id, End: &end})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.User.Id != other.Id {
+		t.Errorf("expected the schedule to be handed to user #%d, got #%d", other.Id, updated.User.Id)
+	}
+	if !updated.Time.Start.Equal(schedule.Time.Start) || !updated.Time.End.Equal(end) {
+		t.Errorf("expected only the end to change, got %v", updated.Time)
+	}
+
+	got, err := Get(context.Background(), schedule.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, updated) {
+		t.Errorf("expected %v to be stored, got %v", updated, got)
+	}
+}
+
+func TestUpdateScheduleOverlappingAnotherIsRejected(t *testing.T) {
+	user := createUser(t)
+	first := createSchedule(t, user, freeSlot(11))
+	second := createSchedule(t, user, TimeRange{Start: first.Time.End, End: first.Time.End.Add(time.Hour)})
+
+	start := first.Time.Start.Add(30 * time.Minute)
+	_, err := Update(authenticated(), second.Id, &UpdateParams{Start: &start})
+	if errs.Code(err) != errs.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+
+	got, err := Get(context.Background(), second.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Time.Start.Equal(second.Time.Start) {
+		t.Errorf("expected the rejected update not to be stored, got %v", got.Time)
+	}
+
+	// another layer may overlap
+	secondary := LayerSecondary
+	if _, err := Update(authenticated(), second.Id, &UpdateParams{Start: &start, Layer: &secondary}); err != nil {
+		t.Fatalf("expected the secondary layer to overlap the primary, got %v", err)
+	}
+}
+
+func TestDeleteSchedule(t *testing.T) {
+	user := createUser(t)
+	schedule := createSchedule(t, user, freeSlot(12))
+
+	deleted, err := Delete(authenticated(), schedule.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.Id != schedule.Id {
+		t.Errorf("expected schedule #%d to be deleted, got #%d", schedule.Id, deleted.Id)
+	}
+	if _, err := Get(context.Background(), schedule.Id); errs.Code(err) != errs.NotFound {
+		t.Fatalf("expected the deleted schedule to be NotFound, got %v", err)
+	}
+}
+
+func TestScheduleChangesAreAudited(t *testing.T) {
+	user := createUser(t)
+	schedule := createSchedule(t, user, freeSlot(13))
+	end := schedule.Time.End.Add(time.Hour)
+	if _, err := Update(authenticated(), schedule.Id, &UpdateParams{End: &end}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Delete(authenticated(), schedule.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := audit.History(context.Background(), &audit.HistoryParams{EntityType: "schedule", EntityId: strconv.Itoa(schedule.Id)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, event := range history.Items {
+		actions = append(actions, event.Action)
+	}
+	expected := []string{"schedule.create", "schedule.update", "schedule.delete"}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("expected events %v, got %v", expected, actions)
+	}
+
+	var before, after Schedule
+	if err := json.Unmarshal(history.Items[1].Before, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(history.Items[1].After, &after); err != nil {
+		t.Fatal(err)
+	}
+	if !before.Time.End.Equal(schedule.Time.End) || !after.Time.End.Equal(end) {
+		t.Errorf("expected the update to record the end moving from %v to %v, got %v to %v", schedule.Time.End, end, before.Time.End, after.Time.End)
+	}
+	if history.Items[2].Actor == nil || *history.Items[2].Actor != "apikey:1" {
+		t.Errorf("expected the deletion to be attributed to the API key, got %v", history.Items[2].Actor)
+	}
+	if string(history.Items[2].After) != "null" && len(history.Items[2].After) != 0 {
+		t.Errorf("expected nothing after the deletion, got %s", history.Items[2].After)
+	}
+}
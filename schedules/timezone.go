@@ -0,0 +1,30 @@
+package schedules
+
+import (
+	"fmt"
+	"time"
+)
+
+// LocalTimeLayout is the format of wall-clock times given together with an IANA time zone
+const LocalTimeLayout = "2006-01-02T15:04"
+
+// ParseLocalTime Helper function for reading a wall-clock time in an IANA time zone.
+// Wall-clock times which are skipped when clocks move forward for daylight saving time do
+// not exist and are rejected, while ambiguous ones when clocks move back resolve to the first.
+func ParseLocalTime(value string, timeZone string) (time.Time, error) {
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time zone %q: %w", timeZone, err)
+	}
+
+	parsed, err := time.ParseInLocation(LocalTimeLayout, value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("local time %q is not in the format %s", value, LocalTimeLayout)
+	}
+
+	if parsed.Format(LocalTimeLayout) != value {
+		return time.Time{}, fmt.Errorf("local time %s does not exist in %s because of a daylight saving time transition", value, timeZone)
+	}
+
+	return parsed, nil
+}
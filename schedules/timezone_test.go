@@ -0,0 +1,109 @@
+package schedules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLocalTime(t *testing.T) {
+	parsed, err := ParseLocalTime("2030-07-01T09:00", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2030, 7, 1, 7, 0, 0, 0, time.UTC); !parsed.Equal(want) {
+		t.Errorf("got %v, want %v", parsed.UTC(), want)
+	}
+}
+
+func TestParseLocalTime_SkippedByDST(t *testing.T) {
+	// clocks in Berlin jump from 02:00 to 03:00 on the last Sunday of March
+	if _, err := ParseLocalTime("2030-03-31T02:30", "Europe/Berlin"); err == nil {
+		t.Fatal("should have failed for a wall-clock time which does not exist")
+	}
+}
+
+func TestParseLocalTime_InvalidTimeZone(t *testing.T) {
+	if _, err := ParseLocalTime("2030-03-31T09:00", "Europe/Nowhere"); err == nil {
+		t.Fatal("should have failed")
+	}
+}
+
+func TestRotationOccurrences_AcrossDST(t *testing.T) {
+	rotation := Rotation{Weekday: "monday", StartTime: "09:00", Hours: 24, TimeZone: "Europe/Berlin"}
+	from := time.Date(2030, 3, 20, 0, 0, 0, 0, time.UTC)  // a Wednesday
+	until := time.Date(2030, 4, 10, 0, 0, 0, 0, time.UTC) // three Mondays later
+
+	occurrences, err := rotation.Occurrences(from, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 09:00 CET is 08:00 UTC, 09:00 CEST is 07:00 UTC
+	want := []time.Time{
+		time.Date(2030, 3, 25, 8, 0, 0, 0, time.UTC),
+		time.Date(2030, 4, 1, 7, 0, 0, 0, time.UTC),
+		time.Date(2030, 4, 8, 7, 0, 0, 0, time.UTC),
+	}
+	if len(occurrences) != len(want) {
+		t.Fatalf("expected %d occurrences, got %v", len(want), occurrences)
+	}
+	for i, occurrence := range occurrences {
+		if !occurrence.Start.Equal(want[i]) {
+			t.Errorf("occurrence %d starts at %v, want %v", i, occurrence.Start.UTC(), want[i])
+		}
+		if occurrence.End.Sub(occurrence.Start) != 24*time.Hour {
+			t.Errorf("occurrence %d lasts %v, want 24h", i, occurrence.End.Sub(occurrence.Start))
+		}
+	}
+}
+
+func TestRotationOccurrences_WeeklyAcrossDST(t *testing.T) {
+	rotation := Rotation{Weekday: "monday", StartTime: "09:00", Hours: 168, TimeZone: "Europe/Berlin"}
+	for _, change := range []struct {
+		name   string
+		from   time.Time
+		lasted time.Duration // the shift across the change
+	}{
+		{"spring", time.Date(2030, 3, 25, 0, 0, 0, 0, time.UTC), 167 * time.Hour},
+		{"autumn", time.Date(2030, 10, 21, 0, 0, 0, 0, time.UTC), 169 * time.Hour},
+	} {
+		occurrences, err := rotation.Occurrences(change.from, change.from.Add(14*24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(occurrences) != 2 {
+			t.Fatalf("%s: expected 2 occurrences, got %v", change.name, occurrences)
+		}
+		// nobody is on-call twice and nobody is missing when the clocks change
+		if !occurrences[0].End.Equal(occurrences[1].Start) {
+			t.Errorf("%s: first shift ends at %v, but the next starts at %v", change.name, occurrences[0].End.UTC(), occurrences[1].Start.UTC())
+		}
+		if lasted := occurrences[0].End.Sub(occurrences[0].Start); lasted != change.lasted {
+			t.Errorf("%s: shift across the change lasts %v, want %v", change.name, lasted, change.lasted)
+		}
+		if end := occurrences[1].End.In(occurrences[1].Start.Location()); end.Hour() != 9 || end.Weekday() != time.Monday {
+			t.Errorf("%s: second shift ends at %v, want Monday 09:00", change.name, end)
+		}
+	}
+}
+
+func TestRotationOccurrences_SameDay(t *testing.T) {
+	rotation := Rotation{Weekday: "Monday", StartTime: "09:00", Hours: 8, TimeZone: "UTC"}
+	monday := time.Date(2030, 1, 7, 0, 0, 0, 0, time.UTC)
+
+	occurrences, err := rotation.Occurrences(monday.Add(8*time.Hour), monday.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(occurrences) != 1 || !occurrences[0].Start.Equal(monday.Add(9*time.Hour)) {
+		t.Errorf("expected the shift later today, got %v", occurrences)
+	}
+
+	occurrences, err = rotation.Occurrences(monday.Add(10*time.Hour), monday.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(occurrences) != 0 {
+		t.Errorf("expected no shift once today's has started, got %v", occurrences)
+	}
+}
@@ -0,0 +1,389 @@
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"encore.app/authz"
+	"encore.app/users"
+	encore "encore.dev"
+	"encore.dev/beta/errs"
+)
+
+// defaultRole is given to members added by the identity provider, which doesn't know about our
+// roles. Admins can change it afterwards, and it is kept when the group is provisioned again.
+const defaultRole = authz.RoleResponder
+
+type Group struct {
+	Schemas     []string `json:"schemas"`
+	Id          string   `json:"id,omitempty"`
+	ExternalId  string   `json:"externalId,omitempty"`
+	DisplayName string   `json:"displayName"`
+	Members     []Member `json:"members"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+type Member struct {
+	Value   string `json:"value"` // the id of the user
+	Display string `json:"display,omitempty"`
+}
+
+var memberFilterPattern = regexp.MustCompile(`^(?i:members)\[\s*(?i:value)\s+(?i:eq)\s+"([^"]*)"\s*\]$`)
+
+//encore:api auth raw method=POST path=/scim/v2/Groups
+func CreateGroup(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	ctx := req.Context()
+	var group Group
+	if err := readJSON(req, &group); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	team, err := users.CreateTeam(ctx, &users.CreateTeamParams{Name: group.DisplayName})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	created, err := replaceGroup(ctx, team.Id, &group)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", created.Meta.Location)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// ListGroups supports filtering by displayName and externalId
+//
+//encore:api auth raw method=GET path=/scim/v2/Groups
+func ListGroups(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	ctx := req.Context()
+	filter, err := parseFilter(req.URL.Query().Get("filter"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Error{Schemas: []string{schemaError}, Status: "400", ScimType: "invalidFilter", Detail: err.Error()})
+		return
+	}
+
+	teams, err := users.ListTeams(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	externalIds, err := externalIds(ctx, resourceGroup)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Azure AD asks for groups without their members when it only wants to know they exist
+	excludeMembers := strings.EqualFold(req.URL.Query().Get("excludedAttributes"), "members")
+
+	var resources []interface{}
+	for _, team := range teams.Items {
+		group := toGroup(&team, externalIds[team.Id])
+		if filter != nil && !group.matches(filter) {
+			continue
+		}
+		if excludeMembers {
+			group.Members = nil
+		}
+		resources = append(resources, group)
+	}
+	writeJSON(w, http.StatusOK, page(req, resources))
+}
+
+//encore:api auth raw method=GET path=/scim/v2/Groups/:id
+func GetGroup(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	id, err := pathId(encore.CurrentRequest().PathParams.Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	group, err := getGroup(req.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+//encore:api auth raw method=PUT path=/scim/v2/Groups/:id
+func ReplaceGroup(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	id, err := pathId(encore.CurrentRequest().PathParams.Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var desired Group
+	if err := readJSON(req, &desired); err != nil {
+		writeError(w, err)
+		return
+	}
+	group, err := replaceGroup(req.Context(), id, &desired)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+// PatchGroup is how both Okta and Azure AD add and remove members
+//
+//encore:api auth raw method=PATCH path=/scim/v2/Groups/:id
+func PatchGroup(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	ctx := req.Context()
+	id, err := pathId(encore.CurrentRequest().PathParams.Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var patch PatchRequest
+	if err := readJSON(req, &patch); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	group, err := getGroup(ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := group.apply(patch.Operations); err != nil {
+		writeError(w, errs.B().Code(errs.InvalidArgument).Msg(err.Error()).Err())
+		return
+	}
+	group, err = replaceGroup(ctx, id, group)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, group)
+}
+
+//encore:api auth raw method=DELETE path=/scim/v2/Groups/:id
+func DeleteGroup(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	ctx := req.Context()
+	id, err := pathId(encore.CurrentRequest().PathParams.Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := users.DeleteTeam(ctx, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := storeExternalId(ctx, resourceGroup, id, ""); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getGroup(ctx context.Context, id int) (*Group, error) {
+	team, err := users.GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	external, err := externalId(ctx, resourceGroup, id)
+	if err != nil {
+		return nil, err
+	}
+	return toGroup(team, external), nil
+}
+
+// replaceGroup Helper function changing a team to match the SCIM group. New members get the
+// defaultRole, existing members keep theirs.
+func replaceGroup(ctx context.Context, id int, desired *Group) (*Group, error) {
+	eb := errs.B().Meta("teamId", id)
+	team, err := users.GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if desired.DisplayName != team.Name {
+		if _, err := users.UpdateTeam(ctx, id, &users.UpdateTeamParams{Name: desired.DisplayName}); err != nil {
+			return nil, err
+		}
+	}
+
+	wanted := make(map[int]bool)
+	for _, member := range desired.Members {
+		userId, err := strconv.Atoi(member.Value)
+		if err != nil {
+			return nil, eb.Code(errs.InvalidArgument).Msgf("member %q is not the id of a user", member.Value).Err()
+		}
+		wanted[userId] = true
+	}
+	for _, member := range team.Members {
+		if wanted[member.User.Id] {
+			delete(wanted, member.User.Id) // already a member
+			continue
+		}
+		if _, err := users.RemoveMember(ctx, id, member.User.Id); err != nil {
+			return nil, err
+		}
+	}
+	for userId := range wanted {
+		if _, err := users.AddMember(ctx, id, &users.AddMemberParams{UserId: userId, Role: defaultRole}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := storeExternalId(ctx, resourceGroup, id, desired.ExternalId); err != nil {
+		return nil, err
+	}
+	return getGroup(ctx, id)
+}
+
+// toGroup Helper function from Team of the users service to a SCIM group
+func toGroup(team *users.Team, external string) *Group {
+	group := &Group{
+		Schemas:     []string{schemaGroup},
+		Id:          strconv.Itoa(team.Id),
+		ExternalId:  external,
+		DisplayName: team.Name,
+		Members:     []Member{},
+		Meta:        &Meta{ResourceType: resourceGroup, Location: fmt.Sprintf("%s/Groups/%d", basePath, team.Id)},
+	}
+	for _, member := range team.Members {
+		group.Members = append(group.Members, Member{
+			Value:   strconv.Itoa(member.User.Id),
+			Display: member.User.FirstName + " " + member.User.LastName,
+		})
+	}
+	return group
+}
+
+func (g *Group) matches(filter *Filter) bool {
+	switch strings.ToLower(filter.Attribute) {
+	case "displayname":
+		return strings.EqualFold(g.DisplayName, filter.Value)
+	case "externalid":
+		return g.ExternalId == filter.Value
+	}
+	return false
+}
+
+// apply Helper function applying patch operations to a SCIM group
+func (g *Group) apply(operations []PatchOperation) error {
+	for _, operation := range operations {
+		name, err := operationName(operation)
+		if err != nil {
+			return err
+		}
+		if operation.Path != "" {
+			if err := g.set(name, operation.Path, operation.Value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// without a path the value holds the attributes to change, e.g. {"displayName":"payments"}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(operation.Value, &values); err != nil {
+			return fmt.Errorf("%s operation without path needs an object value", operation.Op)
+		}
+		for path, value := range values {
+			if err := g.set(name, path, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// set Helper function applying one operation to an attribute of a SCIM group
+func (g *Group) set(operation string, path string, value json.RawMessage) error {
+	if match := memberFilterPattern.FindStringSubmatch(path); match != nil {
+		if operation != "remove" {
+			return fmt.Errorf("only remove is supported for %s", path)
+		}
+		g.removeMembers([]Member{{Value: match[1]}})
+		return nil
+	}
+
+	switch strings.ToLower(path) {
+	case "displayname":
+		if operation == "remove" {
+			return fmt.Errorf("displayName is required")
+		}
+		return unmarshalOptional(value, &g.DisplayName)
+	case "externalid":
+		if operation == "remove" {
+			value = nil
+		}
+		return unmarshalOptional(value, &g.ExternalId)
+	case "members":
+		var members []Member
+		if operation != "remove" || len(value) > 0 {
+			if err := unmarshalOptional(value, &members); err != nil {
+				return err
+			}
+		}
+		switch {
+		case operation == "add":
+			g.addMembers(members)
+		case operation == "replace":
+			g.Members = members
+		case len(members) == 0:
+			g.Members = nil // remove without a value removes everyone
+		default:
+			g.removeMembers(members)
+		}
+		return nil
+	}
+	return nil
+}
+
+func (g *Group) addMembers(members []Member) {
+	for _, member := range members {
+		if !g.hasMember(member.Value) {
+			g.Members = append(g.Members, member)
+		}
+	}
+}
+
+func (g *Group) removeMembers(members []Member) {
+	remove := make(map[string]bool)
+	for _, member := range members {
+		remove[member.Value] = true
+	}
+	var kept []Member
+	for _, member := range g.Members {
+		if !remove[member.Value] {
+			kept = append(kept, member)
+		}
+	}
+	g.Members = kept
+}
+
+func (g *Group) hasMember(value string) bool {
+	for _, member := range g.Members {
+		if member.Value == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+-- the id the identity provider uses for a user or group, which it sends back as externalId
+CREATE TABLE external_ids
+(
+    resource_type VARCHAR(16)  NOT NULL, -- User or Group
+    resource_id   BIGINT       NOT NULL,
+    external_id   VARCHAR(255) NOT NULL,
+    PRIMARY KEY (resource_type, resource_id)
+);
@@ -0,0 +1,230 @@
+// Package scim lets an identity provider such as Okta or Azure AD own the list of users and teams
+// using SCIM 2.0 (RFC 7643 and 7644). Users map onto the users service and groups onto its teams.
+//
+// The endpoints are raw, because SCIM needs its own JSON attribute names, status codes and errors.
+// Identity providers authenticate with an admin API key.
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"encore.app/authz"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	schemaUser         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	schemaGroup        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	schemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	schemaPatchOp      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	schemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	resourceUser  = "User"
+	resourceGroup = "Group"
+
+	basePath = "/scim/v2"
+)
+
+type Meta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+type PatchOperation struct {
+	Op    string          `json:"op"` // add, replace or remove, Azure AD capitalizes them
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// Filter is the only kind of filter identity providers use to find a resource, e.g. userName eq "jane@example.com"
+type Filter struct {
+	Attribute string
+	Value     string
+}
+
+var filterPattern = regexp.MustCompile(`^\s*([A-Za-z.]+)\s+(?i:eq)\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// parseFilter Helper function for filters of the form `attribute eq "value"`, which is all we support
+func parseFilter(filter string) (*Filter, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+	match := filterPattern.FindStringSubmatch(filter)
+	if match == nil {
+		return nil, fmt.Errorf("unsupported filter %q, only `attribute eq \"value\"` is supported", filter)
+	}
+	value, err := strconv.Unquote(`"` + match[2] + `"`)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter value %q", match[2])
+	}
+	return &Filter{Attribute: match[1], Value: value}, nil
+}
+
+// page Helper function applying the 1-based startIndex and count query parameters to a list
+func page(req *http.Request, resources []interface{}) *ListResponse {
+	startIndex, err := strconv.Atoi(req.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(req.URL.Query().Get("count"))
+	if err != nil || count < 0 {
+		count = len(resources)
+	}
+
+	list := &ListResponse{Schemas: []string{schemaListResponse}, TotalResults: len(resources), StartIndex: startIndex, Resources: []interface{}{}}
+	if startIndex <= len(resources) {
+		end := startIndex - 1 + count
+		if end > len(resources) {
+			end = len(resources)
+		}
+		list.Resources = resources[startIndex-1 : end]
+	}
+	list.ItemsPerPage = len(list.Resources)
+	return list
+}
+
+// requireAdmin Helper function for making sure only the identity provider, using an admin API key,
+// provisions users. Writes an error and returns false otherwise.
+func requireAdmin(w http.ResponseWriter) bool {
+	if err := authz.RequireAdmin("provision users and groups"); err != nil {
+		writeError(w, err)
+		return false
+	}
+	return true
+}
+
+func readJSON(req *http.Request, v interface{}) error {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		return errs.B().Code(errs.InvalidArgument).Cause(err).Msgf("invalid request body: %v", err).Err()
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError Helper function writing an error of our services in the format of SCIM
+func writeError(w http.ResponseWriter, err error) {
+	code := errs.Code(err)
+	status := code.HTTPStatus()
+	scimError := Error{Schemas: []string{schemaError}, Status: strconv.Itoa(status), Detail: errorMessage(err)}
+	switch code {
+	case errs.AlreadyExists:
+		status = http.StatusConflict
+		scimError.Status, scimError.ScimType = strconv.Itoa(status), "uniqueness"
+	case errs.FailedPrecondition:
+		// e.g. a user who is already deactivated
+		status = http.StatusConflict
+		scimError.Status = strconv.Itoa(status)
+	case errs.InvalidArgument:
+		scimError.ScimType = "invalidValue"
+	}
+	writeJSON(w, status, scimError)
+}
+
+// errorMessage Helper function to get the message of an error without its code
+func errorMessage(err error) string {
+	var e *errs.Error
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	return err.Error()
+}
+
+// pathId Helper function for the numeric id of the resource in the request path
+func pathId(idParam string) (int, error) {
+	id, err := strconv.Atoi(idParam)
+	if err != nil {
+		return 0, errs.B().Code(errs.NotFound).Msgf("no resource with id %q", idParam).Err()
+	}
+	return id, nil
+}
+
+// externalId Helper function returning the id the identity provider knows a resource by
+func externalId(ctx context.Context, resourceType string, id int) (string, error) {
+	var external string
+	err := sqldb.QueryRow(ctx, `
+		SELECT external_id FROM external_ids WHERE resource_type = $1 AND resource_id = $2
+	`, resourceType, id).Scan(&external)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return "", nil
+	}
+	return external, err
+}
+
+// externalIds Helper function returning the ids the identity provider knows the resources of a type by
+func externalIds(ctx context.Context, resourceType string) (map[int]string, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT resource_id, external_id FROM external_ids WHERE resource_type = $1
+	`, resourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ids := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var external string
+		if err := rows.Scan(&id, &external); err != nil {
+			return nil, err
+		}
+		ids[id] = external
+	}
+	return ids, nil
+}
+
+// storeExternalId Helper function remembering the id the identity provider knows a resource by
+func storeExternalId(ctx context.Context, resourceType string, id int, external string) error {
+	if external == "" {
+		_, err := sqldb.Exec(ctx, `DELETE FROM external_ids WHERE resource_type = $1 AND resource_id = $2`, resourceType, id)
+		return err
+	}
+	_, err := sqldb.Exec(ctx, `
+		INSERT INTO external_ids (resource_type, resource_id, external_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (resource_type, resource_id) DO UPDATE SET external_id = excluded.external_id
+	`, resourceType, id, external)
+	return err
+}
+
+// operationName Helper function normalizing the op of a patch operation
+func operationName(op PatchOperation) (string, error) {
+	name := strings.ToLower(op.Op)
+	if name != "add" && name != "replace" && name != "remove" {
+		return "", fmt.Errorf("unsupported patch operation %q", op.Op)
+	}
+	return name, nil
+}
@@ -0,0 +1,143 @@
+package scim
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func readFixture(t *testing.T, name string, v interface{}) {
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal("failed to read fixture", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal("failed to parse fixture", err)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	filter, err := parseFilter(`userName eq "jane.doe@example.com"`)
+	if err != nil {
+		t.Fatal("failed to parse filter", err)
+	}
+	if filter.Attribute != "userName" || filter.Value != "jane.doe@example.com" {
+		t.Errorf("unexpected filter %v", filter)
+	}
+
+	filter, err = parseFilter(`displayName EQ "say \"hi\""`)
+	if err != nil {
+		t.Fatal("failed to parse filter", err)
+	}
+	if filter.Value != `say "hi"` {
+		t.Errorf("unexpected value %q", filter.Value)
+	}
+
+	if _, err := parseFilter(`userName sw "jane"`); err == nil {
+		t.Error("should have failed for unsupported operator")
+	}
+	if filter, err := parseFilter(""); filter != nil || err != nil {
+		t.Errorf("expected no filter, got %v %v", filter, err)
+	}
+}
+
+func TestUserAttributes_Okta(t *testing.T) {
+	var user User
+	readFixture(t, "okta_create_user.json", &user)
+	attributes, err := user.attributes()
+	if err != nil {
+		t.Fatal("failed to map user", err)
+	}
+	expected := userAttributes{FirstName: "Jane", LastName: "Doe", SlackHandle: "jane.doe", Email: "jane.doe@example.com", TimeZone: "UTC", Active: true}
+	if *attributes != expected {
+		t.Errorf("expected %v, got %v", expected, *attributes)
+	}
+	if user.ExternalId != "00ujl29u0le5T6Aj10h7" {
+		t.Errorf("unexpected externalId %q", user.ExternalId)
+	}
+}
+
+func TestUserAttributes_Azure(t *testing.T) {
+	var user User
+	readFixture(t, "azure_create_user.json", &user)
+	attributes, err := user.attributes()
+	if err != nil {
+		t.Fatal("failed to map user", err)
+	}
+	if attributes.Email != "Test_User_fd0ea19b-0777-472c-9f96-4f70d2226f2e@contoso.com" {
+		t.Errorf("expected the primary email, got %q", attributes.Email)
+	}
+	if attributes.Phone != "+14255550123" {
+		t.Errorf("unexpected phone %q", attributes.Phone)
+	}
+	if attributes.SlackHandle != "Test_User_ab6490ee-1e48-479e-a20b-2d77186b5dd1" {
+		t.Errorf("unexpected slack handle %q", attributes.SlackHandle)
+	}
+}
+
+func TestUserAttributes_InvalidTimezone(t *testing.T) {
+	user := User{UserName: "jane.doe@example.com", Name: Name{GivenName: "Jane", FamilyName: "Doe"}, Timezone: "Mars/Olympus"}
+	if _, err := user.attributes(); err == nil {
+		t.Fatal("expected an unknown time zone to be rejected before anything is written")
+	}
+}
+
+func TestUserApply_OktaDeactivate(t *testing.T) {
+	var user User
+	var patch PatchRequest
+	readFixture(t, "okta_create_user.json", &user)
+	readFixture(t, "okta_deactivate_user.json", &patch)
+	if err := user.apply(patch.Operations); err != nil {
+		t.Fatal("failed to apply patch", err)
+	}
+	if user.Active == nil || *user.Active {
+		t.Errorf("expected user to be inactive, got %v", user.Active)
+	}
+}
+
+func TestUserApply_Azure(t *testing.T) {
+	var user User
+	var patch PatchRequest
+	readFixture(t, "azure_create_user.json", &user)
+	readFixture(t, "azure_patch_user.json", &patch)
+	if err := user.apply(patch.Operations); err != nil {
+		t.Fatal("failed to apply patch", err)
+	}
+	attributes, err := user.attributes()
+	if err != nil {
+		t.Fatal("failed to map user", err)
+	}
+	if attributes.Email != "updatedEmail@microsoft.com" || attributes.LastName != "updatedFamilyName" || attributes.Active {
+		t.Errorf("patch was not applied: %v", *attributes)
+	}
+}
+
+func TestGroupApply_Okta(t *testing.T) {
+	group := Group{DisplayName: "payments", Members: []Member{{Value: "1"}, {Value: "2"}}}
+	var patch PatchRequest
+	readFixture(t, "okta_patch_group.json", &patch)
+	if err := group.apply(patch.Operations); err != nil {
+		t.Fatal("failed to apply patch", err)
+	}
+	if group.DisplayName != "payments-oncall" {
+		t.Errorf("expected group to be renamed, got %q", group.DisplayName)
+	}
+	expected := []Member{{Value: "1"}, {Value: "3", Display: "jane.doe@example.com"}}
+	if !reflect.DeepEqual(group.Members, expected) {
+		t.Errorf("expected members %v, got %v", expected, group.Members)
+	}
+}
+
+func TestGroupApply_Azure(t *testing.T) {
+	group := Group{DisplayName: "payments", Members: []Member{{Value: "1"}, {Value: "2"}}}
+	var patch PatchRequest
+	readFixture(t, "azure_patch_group.json", &patch)
+	if err := group.apply(patch.Operations); err != nil {
+		t.Fatal("failed to apply patch", err)
+	}
+	expected := []Member{{Value: "2"}, {Value: "3"}}
+	if !reflect.DeepEqual(group.Members, expected) {
+		t.Errorf("expected members %v, got %v", expected, group.Members)
+	}
+}
@@ -0,0 +1,522 @@
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.app/incidents"
+	"encore.app/users"
+	encore "encore.dev"
+	"encore.dev/beta/errs"
+)
+
+type User struct {
+	Schemas      []string     `json:"schemas"`
+	Id           string       `json:"id,omitempty"`
+	ExternalId   string       `json:"externalId,omitempty"`
+	UserName     string       `json:"userName"`
+	Name         Name         `json:"name"`
+	DisplayName  string       `json:"displayName,omitempty"`
+	NickName     string       `json:"nickName,omitempty"` // the Slack handle
+	Emails       []MultiValue `json:"emails,omitempty"`
+	PhoneNumbers []MultiValue `json:"phoneNumbers,omitempty"`
+	Timezone     string       `json:"timezone,omitempty"`
+	Active       *bool        `json:"active,omitempty"` // missing means active
+	Meta         *Meta        `json:"meta,omitempty"`
+}
+
+type Name struct {
+	GivenName  string `json:"givenName"`
+	FamilyName string `json:"familyName"`
+}
+
+type MultiValue struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// userAttributes are the attributes of a SCIM user we store in the users service
+type userAttributes struct {
+	FirstName   string
+	LastName    string
+	SlackHandle string
+	Email       string
+	Phone       string
+	TimeZone    string
+	Active      bool
+}
+
+//encore:api auth raw method=POST path=/scim/v2/Users
+func CreateUser(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	ctx := req.Context()
+	var scimUser User
+	if err := readJSON(req, &scimUser); err != nil {
+		writeError(w, err)
+		return
+	}
+	attributes, err := scimUser.attributes()
+	if err != nil {
+		writeError(w, errs.B().Code(errs.InvalidArgument).Msg(err.Error()).Err())
+		return
+	}
+
+	user, err := users.Create(ctx, users.CreateParams{
+		FirstName:   attributes.FirstName,
+		LastName:    attributes.LastName,
+		SlackHandle: attributes.SlackHandle,
+		TimeZone:    attributes.TimeZone,
+		Email:       attributes.Email,
+		Phone:       attributes.Phone,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// the user and their external id live in different databases. If the id can't be stored, the
+	// user is deactivated again, so the identity provider's retry finds them by their userName
+	// and reactivates them along with storing the id.
+	stored := storeExternalId(ctx, resourceUser, user.Id, scimUser.ExternalId)
+	if stored != nil || !attributes.Active {
+		// a new user has no shifts or incidents to hand over
+		if _, err := incidents.DeactivateUser(ctx, user.Id, &incidents.DeactivateUserParams{}); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if stored != nil {
+		writeError(w, stored)
+		return
+	}
+
+	created, err := getUser(ctx, user.Id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", created.Meta.Location)
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// ListUsers supports filtering by userName, externalId and emails.value, which identity
+// providers use to find out whether a user already exists
+//
+//encore:api auth raw method=GET path=/scim/v2/Users
+func ListUsers(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	ctx := req.Context()
+	filter, err := parseFilter(req.URL.Query().Get("filter"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, Error{Schemas: []string{schemaError}, Status: "400", ScimType: "invalidFilter", Detail: err.Error()})
+		return
+	}
+
+	everyone, err := users.List(ctx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	externalIds, err := externalIds(ctx, resourceUser)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var resources []interface{}
+	for _, user := range everyone.Items {
+		scimUser := toUser(&user, externalIds[user.Id])
+		if filter != nil && !scimUser.matches(filter) {
+			continue
+		}
+		resources = append(resources, scimUser)
+	}
+	writeJSON(w, http.StatusOK, page(req, resources))
+}
+
+//encore:api auth raw method=GET path=/scim/v2/Users/:id
+func GetUser(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	id, err := pathId(encore.CurrentRequest().PathParams.Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	user, err := getUser(req.Context(), id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// ReplaceUser is how Okta updates users
+//
+//encore:api auth raw method=PUT path=/scim/v2/Users/:id
+func ReplaceUser(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	id, err := pathId(encore.CurrentRequest().PathParams.Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var desired User
+	if err := readJSON(req, &desired); err != nil {
+		writeError(w, err)
+		return
+	}
+	user, err := replaceUser(req.Context(), id, &desired)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// PatchUser is how Azure AD updates users, and how Okta deactivates them
+//
+//encore:api auth raw method=PATCH path=/scim/v2/Users/:id
+func PatchUser(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	ctx := req.Context()
+	id, err := pathId(encore.CurrentRequest().PathParams.Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var patch PatchRequest
+	if err := readJSON(req, &patch); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	user, err := getUser(ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := user.apply(patch.Operations); err != nil {
+		writeError(w, errs.B().Code(errs.InvalidArgument).Msg(err.Error()).Err())
+		return
+	}
+	user, err = replaceUser(ctx, id, user)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// DeleteUser deactivates the user, who keeps their history like any other deactivated user
+//
+//encore:api auth raw method=DELETE path=/scim/v2/Users/:id
+func DeleteUser(w http.ResponseWriter, req *http.Request) {
+	if !requireAdmin(w) {
+		return
+	}
+	ctx := req.Context()
+	id, err := pathId(encore.CurrentRequest().PathParams.Get("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	user, err := users.Get(ctx, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if user.DeactivatedAt == nil {
+		if _, err := deprovision(ctx, id); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getUser(ctx context.Context, id int) (*User, error) {
+	user, err := users.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	external, err := externalId(ctx, resourceUser, id)
+	if err != nil {
+		return nil, err
+	}
+	return toUser(user, external), nil
+}
+
+// replaceUser Helper function changing a user to match the SCIM user, including (re)activating them
+func replaceUser(ctx context.Context, id int, desired *User) (*User, error) {
+	attributes, err := desired.attributes()
+	if err != nil {
+		return nil, errs.B().Code(errs.InvalidArgument).Msg(err.Error()).Err()
+	}
+	current, err := users.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	active := current.DeactivatedAt == nil
+	if !attributes.Active && active {
+		// deactivated first, as deactivated users can't be changed and keep their details from
+		// when they left
+		if _, err := deprovision(ctx, id); err != nil {
+			return nil, err
+		}
+		active = false
+	}
+	if attributes.Active && !active {
+		if _, err := users.Reactivate(ctx, id); err != nil {
+			return nil, err
+		}
+		active = true
+	}
+	if active {
+		_, err := users.Update(ctx, id, &users.UpdateParams{
+			FirstName:   &attributes.FirstName,
+			LastName:    &attributes.LastName,
+			SlackHandle: &attributes.SlackHandle,
+			TimeZone:    &attributes.TimeZone,
+			Email:       &attributes.Email,
+			Phone:       &attributes.Phone,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := storeExternalId(ctx, resourceUser, id, desired.ExternalId); err != nil {
+		return nil, err
+	}
+	return getUser(ctx, id)
+}
+
+// deprovision Helper function deactivating a user the identity provider removed. It can't wait
+// for someone to take over their shifts and incidents, so they are released and Slack is asked to
+// cover them.
+func deprovision(ctx context.Context, id int) (*incidents.DeactivatedUser, error) {
+	return incidents.DeactivateUser(ctx, id, &incidents.DeactivateUserParams{Release: true})
+}
+
+// toUser Helper function from User of the users service to a SCIM user
+func toUser(user *users.User, external string) *User {
+	active := user.DeactivatedAt == nil
+	scimUser := &User{
+		Schemas:     []string{schemaUser},
+		Id:          strconv.Itoa(user.Id),
+		ExternalId:  external,
+		UserName:    user.Email,
+		Name:        Name{GivenName: user.FirstName, FamilyName: user.LastName},
+		DisplayName: user.FirstName + " " + user.LastName,
+		NickName:    user.SlackHandle,
+		Timezone:    user.TimeZone,
+		Active:      &active,
+		Meta:        &Meta{ResourceType: resourceUser, Location: fmt.Sprintf("%s/Users/%d", basePath, user.Id)},
+	}
+	if scimUser.UserName == "" {
+		scimUser.UserName = user.SlackHandle
+	}
+	if user.Email != "" {
+		scimUser.Emails = []MultiValue{{Value: user.Email, Type: "work", Primary: true}}
+	}
+	if user.Phone != "" {
+		scimUser.PhoneNumbers = []MultiValue{{Value: user.Phone, Type: "work", Primary: true}}
+	}
+	return scimUser
+}
+
+// attributes Helper function mapping a SCIM user onto the attributes we store. The email defaults
+// to the userName, which identity providers usually set to it, and the Slack handle to the part of
+// the email before the @.
+func (u *User) attributes() (*userAttributes, error) {
+	attributes := &userAttributes{
+		FirstName:   u.Name.GivenName,
+		LastName:    u.Name.FamilyName,
+		SlackHandle: u.NickName,
+		Email:       primaryValue(u.Emails),
+		Phone:       primaryValue(u.PhoneNumbers),
+		TimeZone:    u.Timezone,
+		Active:      u.Active == nil || *u.Active,
+	}
+	if u.UserName == "" {
+		return nil, fmt.Errorf("userName is required")
+	}
+	if attributes.Email == "" && strings.Contains(u.UserName, "@") {
+		attributes.Email = u.UserName
+	}
+	if attributes.SlackHandle == "" {
+		attributes.SlackHandle = strings.SplitN(u.UserName, "@", 2)[0]
+	}
+	if attributes.TimeZone == "" {
+		attributes.TimeZone = "UTC"
+	}
+	// checked before anything is written, so a user isn't reactivated and then fails to update
+	if _, err := time.LoadLocation(attributes.TimeZone); err != nil {
+		return nil, fmt.Errorf("timezone %q is not a valid IANA time zone", attributes.TimeZone)
+	}
+	if attributes.FirstName == "" || attributes.LastName == "" {
+		return nil, fmt.Errorf("name.givenName and name.familyName are required")
+	}
+	return attributes, nil
+}
+
+func (u *User) matches(filter *Filter) bool {
+	switch strings.ToLower(filter.Attribute) {
+	case "username":
+		return strings.EqualFold(u.UserName, filter.Value)
+	case "externalid":
+		return u.ExternalId == filter.Value
+	case "emails", "emails.value":
+		for _, email := range u.Emails {
+			if strings.EqualFold(email.Value, filter.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply Helper function applying patch operations to a SCIM user
+func (u *User) apply(operations []PatchOperation) error {
+	for _, operation := range operations {
+		name, err := operationName(operation)
+		if err != nil {
+			return err
+		}
+		if operation.Path != "" {
+			if err := u.set(operation.Path, operation.Value, name == "remove"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// without a path the value holds the attributes to change, e.g. {"active":false}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(operation.Value, &values); err != nil {
+			return fmt.Errorf("%s operation without path needs an object value", operation.Op)
+		}
+		for path, value := range values {
+			if err := u.set(path, value, name == "remove"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// set Helper function changing a single attribute of a SCIM user. Attributes we don't store, such
+// as those of the enterprise extension, are ignored.
+func (u *User) set(path string, value json.RawMessage, remove bool) error {
+	if remove {
+		value = nil
+	}
+	lower := strings.ToLower(path)
+	switch {
+	case lower == "active":
+		active, err := parseBool(value)
+		if err != nil {
+			return err
+		}
+		u.Active = &active
+		return nil
+	case lower == "username":
+		return unmarshalOptional(value, &u.UserName)
+	case lower == "externalid":
+		return unmarshalOptional(value, &u.ExternalId)
+	case lower == "displayname":
+		return unmarshalOptional(value, &u.DisplayName)
+	case lower == "nickname":
+		return unmarshalOptional(value, &u.NickName)
+	case lower == "timezone":
+		return unmarshalOptional(value, &u.Timezone)
+	case lower == "name":
+		return unmarshalOptional(value, &u.Name)
+	case lower == "name.givenname":
+		return unmarshalOptional(value, &u.Name.GivenName)
+	case lower == "name.familyname":
+		return unmarshalOptional(value, &u.Name.FamilyName)
+	case lower == "emails":
+		return unmarshalOptional(value, &u.Emails)
+	case lower == "phonenumbers":
+		return unmarshalOptional(value, &u.PhoneNumbers)
+	case strings.HasPrefix(lower, "emails[") && strings.HasSuffix(lower, "].value"):
+		return setPrimaryValue(&u.Emails, value)
+	case strings.HasPrefix(lower, "phonenumbers[") && strings.HasSuffix(lower, "].value"):
+		return setPrimaryValue(&u.PhoneNumbers, value)
+	}
+	return nil
+}
+
+// primaryValue Helper function returning the primary value of a multi-valued attribute, or else the first
+func primaryValue(values []MultiValue) string {
+	for _, value := range values {
+		if value.Primary {
+			return value.Value
+		}
+	}
+	if len(values) > 0 {
+		return values[0].Value
+	}
+	return ""
+}
+
+// setPrimaryValue Helper function for paths like emails[type eq "work"].value. We only store one
+// email and phone number, so it's the one being changed, whatever the filter.
+func setPrimaryValue(values *[]MultiValue, value json.RawMessage) error {
+	var s string
+	if err := unmarshalOptional(value, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*values = nil
+		return nil
+	}
+	*values = []MultiValue{{Value: s, Type: "work", Primary: true}}
+	return nil
+}
+
+// parseBool Helper function for booleans, which Azure AD sends as strings such as "False"
+func parseBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b, nil
+		}
+	}
+	return false, fmt.Errorf("expected a boolean, got %s", value)
+}
+
+// unmarshalOptional Helper function resetting v to its zero value when there is no value
+func unmarshalOptional(value json.RawMessage, v interface{}) error {
+	if len(value) == 0 || string(value) == "null" {
+		// unmarshalling null leaves v as it is
+		target := reflect.ValueOf(v).Elem()
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return fmt.Errorf("invalid value %s: %v", value, err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+CREATE TABLE services
+(
+    id                BIGSERIAL PRIMARY KEY,
+    name              VARCHAR(255) NOT NULL,
+    team_id           BIGINT       NOT NULL, -- the owning team
+    -- the schedule layers paged in order, the first one with a member of the team on-call is assigned
+    escalation_policy JSONB        NOT NULL DEFAULT '["primary", "secondary", "manager"]',
+    runbook_url       VARCHAR(2048) NOT NULL DEFAULT '',
+    depends_on        JSONB        NOT NULL DEFAULT '[]', -- ids of the services this one depends on
+    created_by        VARCHAR(255),
+    updated_by        VARCHAR(255),
+    created_at        TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+-- the name is the service label of incidents, so it has to be unique
+CREATE UNIQUE INDEX services_name_index ON services (LOWER(name));
@@ -0,0 +1,3 @@
+-- public services are the components shown on the status page
+ALTER TABLE services
+    ADD COLUMN public BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,314 @@
+// Package services is the catalogue of the services we run, e.g. checkout or search, which
+// incidents are attached to. Each service is owned by a team whose on-call is paged for it.
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/schedules"
+	"encore.app/users"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type Services struct {
+	Items []Service
+}
+
+type Service struct {
+	Id               int
+	Name             string
+	TeamId           int      // the owning team, whose on-call incidents of the service are assigned to
+	EscalationPolicy []string // schedule layers to page in order, e.g. ["primary", "manager"]
+	RunbookURL       string
+	DependsOn        []int // ids of the services this one depends on
+	Public           bool  // customers know it, so it is a component of the status page
+}
+
+type ServiceParams struct {
+	Name             string
+	TeamId           int
+	EscalationPolicy []string // defaults to every layer in escalation order
+	RunbookURL       string
+	DependsOn        []int
+	Public           bool
+}
+
+// Create adds a service to the catalogue. Schedulers can manage the services of their teams.
+//
+//encore:api auth method=POST path=/services
+func Create(ctx context.Context, params *ServiceParams) (*Service, error) {
+	eb := errs.B().Meta("params", params)
+	if err := authz.RequireTeamRole(authz.RoleScheduler, []int{params.TeamId}, "manage services"); err != nil {
+		return nil, err
+	}
+	if err := VerifyService(ctx, 0, params); err != nil {
+		return nil, err
+	}
+
+	policy, dependsOn, err := marshalService(params)
+	if err != nil {
+		return nil, err
+	}
+	service, err := RowToService(sqldb.QueryRow(ctx, `
+		INSERT INTO services (name, team_id, escalation_policy, runbook_url, depends_on, public, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, name, team_id, escalation_policy, runbook_url, depends_on, public
+	`, params.Name, params.TeamId, policy, params.RunbookURL, dependsOn, params.Public, auth.Actor()))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert service").Err()
+	}
+
+	audit.Log(ctx, "service.create", "service", service.Id, nil, service)
+	return service, nil
+}
+
+//encore:api public method=GET path=/services
+func List(ctx context.Context) (*Services, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, name, team_id, escalation_policy, runbook_url, depends_on, public
+		FROM services
+		ORDER BY name ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var services []Service
+	for rows.Next() {
+		service, err := RowToService(rows)
+		if err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		services = append(services, *service)
+	}
+
+	return &Services{Items: services}, nil
+}
+
+//encore:api public method=GET path=/services/:id
+func Get(ctx context.Context, id int) (*Service, error) {
+	eb := errs.B().Meta("serviceId", id)
+	service, err := RowToService(sqldb.QueryRow(ctx, `
+		SELECT id, name, team_id, escalation_policy, runbook_url, depends_on, public
+		FROM services
+		WHERE id = $1
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no service found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// Update replaces a service. Handing it over to another team needs the scheduler role in both.
+//
+//encore:api auth method=PUT path=/services/:id
+func Update(ctx context.Context, id int, params *ServiceParams) (*Service, error) {
+	eb := errs.B().Meta("serviceId", id, "params", params)
+	before, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authz.RequireTeamRole(authz.RoleScheduler, []int{before.TeamId}, "manage services"); err != nil {
+		return nil, err
+	}
+	if err := authz.RequireTeamRole(authz.RoleScheduler, []int{params.TeamId}, "hand services over to a team"); err != nil {
+		return nil, err
+	}
+	if err := VerifyService(ctx, id, params); err != nil {
+		return nil, err
+	}
+
+	policy, dependsOn, err := marshalService(params)
+	if err != nil {
+		return nil, err
+	}
+	service, err := RowToService(sqldb.QueryRow(ctx, `
+		UPDATE services
+		SET name = $1, team_id = $2, escalation_policy = $3, runbook_url = $4, depends_on = $5, public = $6, updated_by = $7
+		WHERE id = $8
+		RETURNING id, name, team_id, escalation_policy, runbook_url, depends_on, public
+	`, params.Name, params.TeamId, policy, params.RunbookURL, dependsOn, params.Public, auth.Actor(), id))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update service").Err()
+	}
+
+	audit.Log(ctx, "service.update", "service", id, before, service)
+	return service, nil
+}
+
+//encore:api auth method=DELETE path=/services/:id
+func Delete(ctx context.Context, id int) (*Service, error) {
+	eb := errs.B().Meta("serviceId", id)
+	service, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authz.RequireTeamRole(authz.RoleScheduler, []int{service.TeamId}, "manage services"); err != nil {
+		return nil, err
+	}
+
+	all, err := List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range all.Items {
+		for _, dependency := range other.DependsOn {
+			if dependency == id {
+				return nil, eb.Code(errs.FailedPrecondition).Msgf("service %s depends on it", other.Name).Err()
+			}
+		}
+	}
+
+	if _, err := sqldb.Exec(ctx, `DELETE FROM services WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+
+	audit.Log(ctx, "service.delete", "service", id, service, nil)
+	return service, nil
+}
+
+// OnCall returns who is paged for a service: the first layer of its escalation policy in which the
+// owning team has someone on-call, either in the team's own shifts or a member in the global ones
+//
+//encore:api public method=GET path=/services/:id/oncall
+func OnCall(ctx context.Context, id int) (*schedules.Schedule, error) {
+	eb := errs.B().Meta("serviceId", id)
+	service, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := schedules.TeamOnCall(ctx, service.TeamId, &schedules.TeamOnCallParams{Layers: service.EscalationPolicy})
+	if errs.Code(err) == errs.NotFound {
+		return nil, eb.Code(errs.NotFound).Cause(err).Msgf("nobody of the team owning %s is on-call", service.Name).Err()
+	}
+	return schedule, err
+}
+
+// VerifyService Helper function for making sure a service refers to a team, layers and services
+// which exist, without depending on itself
+func VerifyService(ctx context.Context, id int, params *ServiceParams) error {
+	eb := errs.B().Meta("name", params.Name)
+	if len(strings.TrimSpace(params.Name)) == 0 {
+		return eb.Code(errs.InvalidArgument).Msg("name is empty").Err()
+	}
+	if _, err := users.GetTeam(ctx, params.TeamId); err != nil {
+		return err
+	}
+	for _, layer := range params.EscalationPolicy {
+		if err := schedules.VerifyLayer(layer); err != nil {
+			return err
+		}
+	}
+	if params.RunbookURL != "" {
+		runbook, err := url.Parse(params.RunbookURL)
+		if err != nil || (runbook.Scheme != "http" && runbook.Scheme != "https") || runbook.Host == "" {
+			return eb.Code(errs.InvalidArgument).Msg("runbook URL is not an http(s) URL").Err()
+		}
+	}
+
+	all, err := List(ctx)
+	if err != nil {
+		return err
+	}
+	dependencies := map[int][]int{}
+	for _, service := range all.Items {
+		if service.Id != id && strings.EqualFold(service.Name, params.Name) {
+			return eb.Code(errs.AlreadyExists).Msgf("service %s already exists", service.Name).Err()
+		}
+		dependencies[service.Id] = service.DependsOn
+	}
+	for _, dependency := range params.DependsOn {
+		if _, ok := dependencies[dependency]; !ok || dependency == id {
+			return eb.Code(errs.InvalidArgument).Msgf("service #%d it depends on does not exist", dependency).Err()
+		}
+	}
+	if id != 0 {
+		dependencies[id] = params.DependsOn
+		if cycle := findCycle(dependencies, id); cycle != nil {
+			return eb.Code(errs.InvalidArgument).Msgf("dependencies are circular: %s", describeCycle(cycle)).Err()
+		}
+	}
+	return nil
+}
+
+// findCycle returns the services on a dependency path from a service back to itself, if there is one
+func findCycle(dependencies map[int][]int, id int) []int {
+	visited := map[int]bool{}
+	var visit func(path []int) []int
+	visit = func(path []int) []int {
+		for _, dependency := range dependencies[path[len(path)-1]] {
+			if dependency == id {
+				return append(path, id)
+			}
+			if visited[dependency] {
+				continue
+			}
+			visited[dependency] = true
+			if cycle := visit(append(path, dependency)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return visit([]int{id})
+}
+
+func describeCycle(cycle []int) string {
+	var ids []string
+	for _, id := range cycle {
+		ids = append(ids, fmt.Sprintf("#%d", id))
+	}
+	return strings.Join(ids, " -> ")
+}
+
+func marshalService(params *ServiceParams) (policy []byte, dependsOn []byte, err error) {
+	layers := params.EscalationPolicy
+	if len(layers) == 0 {
+		layers = schedules.Layers
+	}
+	if policy, err = json.Marshal(layers); err != nil {
+		return nil, nil, err
+	}
+	ids := params.DependsOn
+	if ids == nil {
+		ids = []int{}
+	}
+	if dependsOn, err = json.Marshal(ids); err != nil {
+		return nil, nil, err
+	}
+	return policy, dependsOn, nil
+}
+
+// RowToService Helper function from Row to Service
+func RowToService(row interface {
+	Scan(dest ...interface{}) error
+}) (*Service, error) {
+	var service = &Service{}
+	var policy, dependsOn []byte
+	err := row.Scan(&service.Id, &service.Name, &service.TeamId, &policy, &service.RunbookURL, &dependsOn, &service.Public)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(policy, &service.EscalationPolicy); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(dependsOn, &service.DependsOn); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
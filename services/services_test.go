@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/schedules"
+	"encore.app/users"
+	encoreauth "encore.dev/beta/auth"
+	"encore.dev/beta/errs"
+)
+
+func TestFindCycle(t *testing.T) {
+	// checkout -> payments -> database, search -> database
+	dependencies := map[int][]int{1: {2}, 2: {3}, 3: nil, 4: {3}}
+	if cycle := findCycle(dependencies, 1); cycle != nil {
+		t.Errorf("expected no cycle, got %v", cycle)
+	}
+
+	dependencies[3] = []int{4, 1}
+	if cycle := findCycle(dependencies, 1); !reflect.DeepEqual(cycle, []int{1, 2, 3, 1}) {
+		t.Errorf("expected cycle through every service, got %v", cycle)
+	}
+	if cycle := findCycle(dependencies, 4); !reflect.DeepEqual(cycle, []int{4, 3, 4}) {
+		t.Errorf("expected cycle between search and database, got %v", cycle)
+	}
+}
+
+// authenticated is the context of a request made with an admin API key, as mutating endpoints require auth
+func authenticated() context.Context {
+	apiKeyId := 1
+	return encoreauth.WithContext(context.Background(), "apikey:1", &auth.Data{APIKeyId: &apiKeyId, Name: "test", Admin: true})
+}
+
+// createTeam Helper function creating a team with one member, who is on-call in the team's own
+// shifts of the given layers for the next minute
+func createTeam(t *testing.T, name string, layers ...string) (*users.Team, *users.User) {
+	member, err := users.Create(authenticated(), users.CreateParams{FirstName: "Jane", LastName: "Doe", SlackHandle: "jane"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	team, err := users.CreateTeam(authenticated(), &users.CreateTeamParams{Name: name + " " + time.Now().Format(time.RFC3339Nano)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.AddMember(authenticated(), team.Id, &users.AddMemberParams{UserId: member.Id, Role: authz.RoleResponder}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(100 * time.Millisecond)
+	for _, layer := range layers {
+		_, err := schedules.Create(authenticated(), member.Id, &schedules.CreateParams{Start: start, End: start.Add(time.Minute), Layer: layer, TeamId: &team.Id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Until(start))
+	return team, member
+}
+
+func TestOnCallIsTheOwningTeamsOnCall(t *testing.T) {
+	team, member := createTeam(t, "Payments", schedules.LayerSecondary)
+	service, err := Create(authenticated(), &ServiceParams{Name: "payments " + time.Now().Format(time.RFC3339Nano), TeamId: team.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schedule, err := OnCall(context.Background(), service.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schedule.User.Id != member.Id || schedule.TeamId == nil || *schedule.TeamId != team.Id {
+		t.Errorf("expected the team's shift of user #%d, got %+v", member.Id, schedule)
+	}
+}
+
+func TestOnCallFollowsEscalationPolicy(t *testing.T) {
+	team, _ := createTeam(t, "Search", schedules.LayerSecondary)
+	service, err := Create(authenticated(), &ServiceParams{Name: "search " + time.Now().Format(time.RFC3339Nano), TeamId: team.Id, EscalationPolicy: []string{schedules.LayerPrimary}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the team's secondary isn't paged for this service
+	if _, err := OnCall(context.Background(), service.Id); errs.Code(err) != errs.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+}
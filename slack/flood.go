@@ -0,0 +1,173 @@
+package slack
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev/rlog"
+)
+
+// Incoming webhooks accept about one message per second and answer 429 beyond short bursts. Rather
+// than losing notifications during an alert storm, messages above the rate are queued and sent
+// coalesced into one message once Slack accepts messages again. The queue is in the memory of each
+// instance, so queued messages are lost when it stops, and instances don't share the rate.
+const (
+	floodInterval = time.Second
+	floodBurst    = 5
+	// Slack truncates messages longer than 40000 characters
+	maxCoalescedLength = 35000
+	// how long to back off when Slack rate limits without a Retry-After header
+	defaultRetryAfter = 30 * time.Second
+)
+
+// floodGuard is a rate limiter for the messages of this instance, letting floodBurst messages
+// through at once and one per interval after that
+type floodGuard struct {
+	sync.Mutex
+	interval     time.Duration
+	burst        int
+	next         time.Time // when the rate allows a message again if no burst was left
+	blockedUntil time.Time // set by Slack answering 429
+	pending      []string
+	flushing     bool
+}
+
+var flood = &floodGuard{interval: floodInterval, burst: floodBurst}
+
+// admit returns whether the text can be sent now. Otherwise it is queued, and startFlush reports
+// whether the caller has to start flushing the queue.
+func (g *floodGuard) admit(text string, now time.Time) (sendNow bool, startFlush bool) {
+	g.Lock()
+	defer g.Unlock()
+	if len(g.pending) == 0 && g.wait(now) == 0 {
+		g.take(now)
+		return true, false
+	}
+	g.pending = append(g.pending, text)
+	if g.flushing {
+		return false, false
+	}
+	g.flushing = true
+	return false, true
+}
+
+// flush returns the queued messages coalesced into one once the rate allows it, or how long to wait
+// for that. Messages which don't fit into one Slack message stay queued. Once the queue is empty,
+// it returns done and flushing stops.
+func (g *floodGuard) flush(now time.Time) (text string, wait time.Duration, done bool) {
+	g.Lock()
+	defer g.Unlock()
+	if len(g.pending) == 0 {
+		g.flushing = false
+		return "", 0, true
+	}
+	if wait := g.wait(now); wait > 0 {
+		return "", wait, false
+	}
+	g.take(now)
+	text, n := coalesce(g.pending)
+	g.pending = g.pending[n:]
+	return text, 0, false
+}
+
+// block stops messages until Slack accepts them again, queueing the text which was rejected
+func (g *floodGuard) block(text string, until time.Time) (startFlush bool) {
+	g.Lock()
+	defer g.Unlock()
+	if until.After(g.blockedUntil) {
+		g.blockedUntil = until
+	}
+	g.pending = append([]string{text}, g.pending...)
+	if g.flushing {
+		return false
+	}
+	g.flushing = true
+	return true
+}
+
+// stopFlushing lets the next queued message start flushing again
+func (g *floodGuard) stopFlushing() {
+	g.Lock()
+	defer g.Unlock()
+	g.flushing = false
+}
+
+func (g *floodGuard) wait(now time.Time) time.Duration {
+	if now.Before(g.blockedUntil) {
+		return g.blockedUntil.Sub(now)
+	}
+	if !g.next.After(now) {
+		return 0
+	}
+	// the burst is used up when next is more than burst-1 intervals ahead
+	if ahead := g.next.Sub(now) - time.Duration(g.burst-1)*g.interval; ahead > 0 {
+		return ahead
+	}
+	return 0
+}
+
+func (g *floodGuard) take(now time.Time) {
+	if g.next.Before(now) {
+		g.next = now
+	}
+	g.next = g.next.Add(g.interval)
+}
+
+// coalesce Helper function joining as many of the messages as fit into one Slack message,
+// returning the text and how many messages it contains
+func coalesce(messages []string) (string, int) {
+	if len(messages) == 1 {
+		return messages[0], 1
+	}
+	var b strings.Builder
+	n := 0
+	for _, message := range messages {
+		if n > 0 && b.Len()+len(message) > maxCoalescedLength {
+			break
+		}
+		b.WriteString("\n\n")
+		b.WriteString(message)
+		n++
+	}
+	if n == 1 {
+		return messages[0], 1
+	}
+	return fmt.Sprintf("%d notifications were held back by Slack's rate limit:%s", n, b.String()), n
+}
+
+// flushQueue sends the queued messages until the queue is empty. It runs in the background, as the
+// requests which queued the messages shouldn't wait for Slack.
+func flushQueue(webhookURL string) {
+	defer func() {
+		// flushing stops by itself once the queue is empty, a panic must not hold the queue back forever
+		if r := recover(); r != nil {
+			flood.stopFlushing()
+			rlog.Error("FAIL to flush slack notifications", "panic", r)
+		}
+	}()
+	ctx := context.Background()
+	for {
+		text, wait, done := flood.flush(time.Now())
+		if done {
+			return
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+		if text == "" {
+			continue // Slack rejects empty messages, the rest of the queue still has to go out
+		}
+		retryAfter, err := post(ctx, webhookURL, &NotifyParams{Text: text})
+		if retryAfter > 0 {
+			flood.block(text, time.Now().Add(retryAfter))
+			continue
+		}
+		if err != nil {
+			rlog.Error("FAIL to send coalesced slack notification", "err", err)
+		}
+	}
+}
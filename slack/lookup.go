@@ -0,0 +1,105 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"encore.dev/beta/errs"
+)
+
+const slackAPIURL = "https://slack.com/api"
+
+type LookupUserParams struct {
+	Email string
+}
+
+// SlackUser is a member of the Slack workspace. Mentions need their Id, e.g. <@U012AB3CD>.
+type SlackUser struct {
+	Id string
+}
+
+// lookupCacheTTL is how long lookups are remembered, including emails without a Slack member,
+// so notifications don't run into Slack's rate limits
+const lookupCacheTTL = time.Hour
+
+type cachedLookup struct {
+	user      *SlackUser
+	err       error
+	expiresAt time.Time
+}
+
+var lookupCache = struct {
+	sync.Mutex
+	items map[string]cachedLookup
+}{items: make(map[string]cachedLookup)}
+
+// LookupUserByEmail finds the Slack member with an email address using users.lookupByEmail
+//
+//encore:api private
+func LookupUserByEmail(ctx context.Context, params *LookupUserParams) (*SlackUser, error) {
+	email := strings.ToLower(strings.TrimSpace(params.Email))
+
+	lookupCache.Lock()
+	cached, ok := lookupCache.items[email]
+	lookupCache.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.user, cached.err
+	}
+
+	user, err := LookupUserByEmailRaw(ctx, slackAPIURL, secrets.SlackBotToken, email)
+	if err != nil && errs.Code(err) != errs.NotFound {
+		return nil, err // don't remember errors which may go away
+	}
+
+	lookupCache.Lock()
+	lookupCache.items[email] = cachedLookup{user: user, err: err, expiresAt: time.Now().Add(lookupCacheTTL)}
+	lookupCache.Unlock()
+	return user, err
+}
+
+func LookupUserByEmailRaw(ctx context.Context, apiURL string, token string, email string) (*SlackUser, error) {
+	eb := errs.B().Meta("email", email)
+	if token == "" {
+		return nil, eb.Code(errs.FailedPrecondition).Msg("SlackBotToken is not set").Err()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL+"/users.lookupByEmail?email="+url.QueryEscape(email), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, eb.Code(errs.Unavailable).Msgf("lookup slack user: %s", resp.Status).Err()
+	}
+
+	// the Web API responds with 200 OK and ok=false for errors
+	var body struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error"`
+		User  struct {
+			Id string `json:"id"`
+		} `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("decode slack response").Err()
+	}
+	if body.Error == "users_not_found" {
+		return nil, eb.Code(errs.NotFound).Msg("no slack user with this email").Err()
+	}
+	if !body.Ok {
+		return nil, eb.Code(errs.Unavailable).Msgf("lookup slack user: %s", body.Error).Err()
+	}
+	return &SlackUser{Id: body.User.Id}, nil
+}
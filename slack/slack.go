@@ -7,41 +7,77 @@ import (
 	"encore.dev/beta/errs"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
+// client gives up on Slack rather than holding up requests, and the flushing of the queue, forever
+var client = &http.Client{Timeout: 10 * time.Second}
+
 type NotifyParams struct {
 	Text string `json:"text"`
 }
 
+// Notify posts a message to the Slack channel. Messages above Slack's rate limit are queued and
+// posted coalesced shortly after, so it returns before they are delivered.
+//
 //encore:api private
 func Notify(ctx context.Context, p *NotifyParams) error {
-	return NotifyRaw(ctx, secrets.SlackWebhookURL, p)
+	sendNow, startFlush := flood.admit(p.Text, time.Now())
+	if !sendNow {
+		if startFlush {
+			go flushQueue(secrets.SlackWebhookURL)
+		}
+		return nil
+	}
+	retryAfter, err := post(ctx, secrets.SlackWebhookURL, p)
+	if retryAfter > 0 {
+		if flood.block(p.Text, time.Now().Add(retryAfter)) {
+			go flushQueue(secrets.SlackWebhookURL)
+		}
+		return nil
+	}
+	return err
 }
 
 func NotifyRaw(ctx context.Context, slackWebhookURL string, p *NotifyParams) error {
+	_, err := post(ctx, slackWebhookURL, p)
+	return err
+}
+
+// post Helper function sending a message to a webhook, returning how long to wait if Slack rate limited it
+func post(ctx context.Context, slackWebhookURL string, p *NotifyParams) (time.Duration, error) {
 	eb := errs.B()
 	reqBody, err := json.Marshal(p)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	req, err := http.NewRequestWithContext(ctx, "POST", slackWebhookURL, bytes.NewReader(reqBody))
 	if err != nil {
-		return err
+		return 0, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter := defaultRetryAfter
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return retryAfter, eb.Code(errs.ResourceExhausted).Msgf("notify slack: rate limited for %s", retryAfter).Err()
+	}
 	if resp.StatusCode >= 400 {
 		body, _ := io.ReadAll(resp.Body)
-		return eb.Code(errs.Unavailable).Msgf("notify slack: %s: %s", resp.Status, body).Err()
+		return 0, eb.Code(errs.Unavailable).Msgf("notify slack: %s: %s", resp.Status, body).Err()
 	}
-	return nil
+	return 0, nil
 }
 
 var secrets struct {
 	SlackWebhookURL string
+	SlackBotToken   string // needs the users:read.email scope to resolve member IDs
 }
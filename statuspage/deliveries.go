@@ -0,0 +1,218 @@
+package statuspage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"encore.app/email"
+	"encore.dev/beta/errs"
+	"encore.dev/cron"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+const (
+	// maxAttempts is how often a notification is tried before giving up on it
+	maxAttempts = 10
+	// maxBackoff is the longest we wait before retrying a notification
+	maxBackoff = 6 * time.Hour
+	// deliveryBatch is how many notifications are sent per run of the cron job
+	deliveryBatch = 100
+)
+
+// webhookPayload is posted to webhook subscribers as JSON
+type webhookPayload struct {
+	Type  string // subscription.confirm or incident.update
+	Post  *Post  `json:",omitempty"`
+	Links links
+}
+
+type delivery struct {
+	id       int
+	kind     string
+	address  string
+	subject  string
+	body     string
+	payload  string
+	attempts int
+}
+
+// enqueue Helper function queueing a notification, rendered both as an email and a webhook payload
+func enqueue(ctx context.Context, subscriberId int, subject string, body string, payload webhookPayload) error {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = sqldb.Exec(ctx, `
+		INSERT INTO deliveries (subscriber_id, subject, body, payload)
+		VALUES ($1, $2, $3, $4)
+	`, subscriberId, subject, body, string(payloadJSON))
+	if err != nil {
+		return errs.B().Code(errs.Unavailable).Cause(err).Msg("queue notification").Err()
+	}
+	return nil
+}
+
+var _ = cron.NewJob("deliver-status-notifications", cron.JobConfig{
+	Title:    "Notify status page subscribers",
+	Every:    cron.Minute,
+	Endpoint: DeliverNotifications,
+})
+
+//encore:api private
+func DeliverNotifications(ctx context.Context) error {
+	// the next attempt is pushed back while sending, so a concurrent run doesn't send them again
+	rows, err := sqldb.Query(ctx, `
+		UPDATE deliveries d
+		SET attempts = d.attempts + 1, next_attempt_at = NOW() + INTERVAL '10 minutes'
+		FROM subscribers s
+		WHERE s.id = d.subscriber_id
+		  AND d.id IN (
+			SELECT id
+			FROM deliveries
+			WHERE delivered_at IS NULL
+			  AND failed_at IS NULL
+			  AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at ASC
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		  )
+		RETURNING d.id, s.kind, s.address, d.subject, d.body, d.payload, d.attempts
+	`, deliveryBatch)
+	if err != nil {
+		return err
+	}
+	var due []delivery
+	for rows.Next() {
+		var d delivery
+		if err := rows.Scan(&d.id, &d.kind, &d.address, &d.subject, &d.body, &d.payload, &d.attempts); err != nil {
+			rows.Close()
+			return errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+
+	for _, d := range due {
+		var err error
+		if d.kind == SubscriberWebhook {
+			err = sendWebhook(ctx, d.address, []byte(d.payload))
+		} else {
+			err = email.Send(ctx, &email.SendParams{To: d.address, Subject: d.subject, Body: d.body})
+		}
+		if err == nil {
+			_, err = sqldb.Exec(ctx, `UPDATE deliveries SET delivered_at = NOW(), last_error = '' WHERE id = $1`, d.id)
+		} else if d.attempts >= maxAttempts || errors.Is(err, errBlockedAddress) {
+			rlog.Error("FAIL to notify subscriber, giving up", "delivery", d.id, "attempts", d.attempts, "err", err)
+			_, err = sqldb.Exec(ctx, `UPDATE deliveries SET failed_at = NOW(), last_error = $1 WHERE id = $2`, err.Error(), d.id)
+		} else {
+			rlog.Info("FAIL to notify subscriber, retrying", "delivery", d.id, "attempts", d.attempts, "err", err)
+			_, err = sqldb.Exec(ctx, `UPDATE deliveries SET next_attempt_at = $1, last_error = $2 WHERE id = $3`, time.Now().Add(backoff(d.attempts)), err.Error(), d.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backoff is how long to wait after a failed attempt, doubling from a minute
+func backoff(attempts int) time.Duration {
+	wait := time.Minute
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
+
+// errBlockedAddress fails webhooks to addresses of our own network. Anyone can subscribe a webhook,
+// who could otherwise make us send requests to internal services or the cloud metadata endpoint.
+var errBlockedAddress = errors.New("webhook address is not public")
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy:               nil, // a proxy would connect to the address instead of us
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: dialPublicOnly}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+func sendWebhook(ctx context.Context, webhookURL string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook responded %s: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// dialPublicOnly checks the address a webhook actually connects to, also when following redirects.
+// The host was checked when subscribing, but DNS may resolve it to another address since.
+func dialPublicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", errBlockedAddress, host)
+	}
+	return nil
+}
+
+// verifyWebhookHost Helper function making sure every address the host of a webhook URL resolves
+// to is public
+func verifyWebhookHost(ctx context.Context, webhookURL string) error {
+	webhook, err := url.Parse(webhookURL)
+	if err != nil {
+		return err
+	}
+	host := webhook.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return fmt.Errorf("%w: %s", errBlockedAddress, host)
+		}
+		return nil
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addresses) == 0 {
+		return fmt.Errorf("webhook host %s can't be resolved", host)
+	}
+	for _, address := range addresses {
+		if !isPublicIP(address.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", errBlockedAddress, host, address.IP)
+		}
+	}
+	return nil
+}
+
+// isPublicIP reports whether an address is outside of loopback, private, link-local and unspecified
+// ranges, including IPv4 addresses mapped to IPv6
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
@@ -0,0 +1,27 @@
+-- posts are what customers are told about an incident, separate from the internal incident itself
+CREATE TABLE posts
+(
+    id          BIGSERIAL PRIMARY KEY,
+    title       VARCHAR(255) NOT NULL,
+    status      VARCHAR(32)  NOT NULL, -- the status of the latest update
+    service_ids JSONB        NOT NULL DEFAULT '[]', -- the affected public services
+    incident_id BIGINT, -- the internal incident, never shown to customers
+    created_by  VARCHAR(255),
+    created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    updated_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE INDEX posts_created_at_index ON posts (created_at);
+
+CREATE TABLE updates
+(
+    id         BIGSERIAL PRIMARY KEY,
+    post_id    BIGINT       NOT NULL REFERENCES posts (id) ON DELETE CASCADE,
+    status     VARCHAR(32)  NOT NULL,
+    message    TEXT         NOT NULL,
+    created_by VARCHAR(255),
+    created_at TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX updates_post_id_index ON updates (post_id, created_at);
@@ -0,0 +1,30 @@
+CREATE TABLE subscribers
+(
+    id           BIGSERIAL PRIMARY KEY,
+    kind         VARCHAR(16)   NOT NULL, -- email or webhook
+    address      VARCHAR(2048) NOT NULL, -- the email address or webhook URL
+    service_ids  JSONB         NOT NULL DEFAULT '[]', -- the components subscribed to, empty for all of them
+    -- in the links to confirm and unsubscribe, so only the owner of the address can use them
+    token        VARCHAR(64)   NOT NULL UNIQUE,
+    confirmed_at TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ   NOT NULL DEFAULT NOW(),
+    UNIQUE (kind, address)
+);
+
+-- deliveries are a queue of notifications to subscribers, retried with a backoff until they succeed
+CREATE TABLE deliveries
+(
+    id              BIGSERIAL PRIMARY KEY,
+    subscriber_id   BIGINT      NOT NULL REFERENCES subscribers (id) ON DELETE CASCADE,
+    subject         TEXT        NOT NULL, -- of emails
+    body            TEXT        NOT NULL, -- of emails
+    payload         TEXT        NOT NULL, -- JSON posted to webhooks
+    attempts        INTEGER     NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_error      TEXT        NOT NULL DEFAULT '',
+    delivered_at    TIMESTAMPTZ,
+    failed_at       TIMESTAMPTZ, -- given up after too many attempts
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX deliveries_pending_index ON deliveries (next_attempt_at) WHERE delivered_at IS NULL AND failed_at IS NULL;
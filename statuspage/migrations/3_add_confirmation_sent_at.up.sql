@@ -0,0 +1,3 @@
+-- when the last confirmation was queued, so subscribing again can't be used to flood an address
+ALTER TABLE subscribers
+    ADD COLUMN confirmation_sent_at TIMESTAMPTZ;
@@ -0,0 +1,339 @@
+package statuspage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"encore.app/audit"
+	"encore.app/auth"
+	"encore.app/authz"
+	"encore.app/services"
+	"encore.app/slack"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+// Statuses of posts, in the order an incident usually goes through them
+const (
+	PostInvestigating = "investigating"
+	PostIdentified    = "identified"
+	PostMonitoring    = "monitoring"
+	PostResolved      = "resolved"
+)
+
+var PostStatuses = []string{PostInvestigating, PostIdentified, PostMonitoring, PostResolved}
+
+type Posts struct {
+	Items []Post
+}
+
+// Post is what customers are told about an incident
+type Post struct {
+	Id         int
+	Title      string
+	Status     string // of the latest update
+	ServiceIds []int  // the affected public services
+	IncidentId *int   `json:"-"` // the internal incident it is about, never shown to customers
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	ResolvedAt *time.Time
+	Updates    []Update // newest first
+}
+
+type Update struct {
+	Id        int
+	Status    string
+	Message   string
+	CreatedAt time.Time
+}
+
+type PublishParams struct {
+	Title      string
+	Status     string // defaults to investigating
+	Message    string
+	ServiceIds []int
+	IncidentId *int
+}
+
+type UpdateParams struct {
+	Status  string // defaults to the current status
+	Message string
+}
+
+// Publish tells customers about an incident. Responders of the teams owning the affected services
+// can publish posts.
+//
+//encore:api auth method=POST path=/status/incidents
+func Publish(ctx context.Context, params *PublishParams) (*Post, error) {
+	eb := errs.B().Meta("params", params)
+	if err := requireResponder(ctx, params.ServiceIds); err != nil {
+		return nil, err
+	}
+	if len(params.Title) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("title is empty").Err()
+	}
+	if len(params.Message) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("message is empty").Err()
+	}
+	status := params.Status
+	if status == "" {
+		status = PostInvestigating
+	}
+	if err := VerifyPostStatus(status); err != nil {
+		return nil, err
+	}
+	serviceIds := params.ServiceIds
+	if serviceIds == nil {
+		serviceIds = []int{}
+	}
+	serviceIdsJSON, err := json.Marshal(serviceIds)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	var id int
+	err = sqldb.QueryRowTx(tx, ctx, `
+		INSERT INTO posts (title, status, service_ids, incident_id, created_by, resolved_at)
+		VALUES ($1, $2, $3, $4, $5, CASE WHEN $2 = 'resolved' THEN NOW() END)
+		RETURNING id
+	`, params.Title, status, string(serviceIdsJSON), params.IncidentId, auth.Actor()).Scan(&id)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert post").Err()
+	}
+	_, err = sqldb.ExecTx(tx, ctx, `
+		INSERT INTO updates (post_id, status, message, created_by)
+		VALUES ($1, $2, $3, $4)
+	`, id, status, params.Message, auth.Actor())
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert update").Err()
+	}
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("commit post").Err()
+	}
+
+	post, err := GetPost(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "status_post.publish", "status_post", id, nil, post)
+	notifySubscribers(ctx, post)
+	_ = slack.Notify(ctx, &slack.NotifyParams{
+		Text: fmt.Sprintf("Published on the status page: %s [%s]\n%s", post.Title, post.Status, params.Message),
+	})
+	return post, nil
+}
+
+// AddUpdate tells customers how an incident is progressing, resolving the post with the status resolved
+//
+//encore:api auth method=POST path=/status/incidents/:id/updates
+func AddUpdate(ctx context.Context, id int, params *UpdateParams) (*Post, error) {
+	eb := errs.B().Meta("postId", id, "params", params)
+	before, err := GetPost(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireResponder(ctx, before.ServiceIds); err != nil {
+		return nil, err
+	}
+	if len(params.Message) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("message is empty").Err()
+	}
+	status := params.Status
+	if status == "" {
+		status = before.Status
+	}
+	if err := VerifyPostStatus(status); err != nil {
+		return nil, err
+	}
+
+	tx, err := sqldb.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sqldb.Rollback(tx) // no-op once committed
+
+	_, err = sqldb.ExecTx(tx, ctx, `
+		UPDATE posts
+		SET status = $1, updated_at = NOW(),
+		    resolved_at = CASE WHEN $1 = 'resolved' THEN COALESCE(resolved_at, NOW()) END
+		WHERE id = $2
+	`, status, id)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update post").Err()
+	}
+	_, err = sqldb.ExecTx(tx, ctx, `
+		INSERT INTO updates (post_id, status, message, created_by)
+		VALUES ($1, $2, $3, $4)
+	`, id, status, params.Message, auth.Actor())
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert update").Err()
+	}
+	if err := sqldb.Commit(tx); err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("commit update").Err()
+	}
+
+	post, err := GetPost(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "status_post.update", "status_post", id, before, post)
+	notifySubscribers(ctx, post)
+	_ = slack.Notify(ctx, &slack.NotifyParams{
+		Text: fmt.Sprintf("Updated on the status page: %s [%s]\n%s", post.Title, post.Status, params.Message),
+	})
+	return post, nil
+}
+
+// ListPosts returns the history of posts, newest first
+//
+//encore:api public method=GET path=/status/incidents
+func ListPosts(ctx context.Context) (*Posts, error) {
+	return listPosts(ctx, false)
+}
+
+//encore:api public method=GET path=/status/incidents/:id
+func GetPost(ctx context.Context, id int) (*Post, error) {
+	eb := errs.B().Meta("postId", id)
+	post, err := RowToPost(sqldb.QueryRow(ctx, `
+		SELECT id, title, status, service_ids, incident_id, created_at, updated_at, resolved_at
+		FROM posts
+		WHERE id = $1
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no post found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := loadUpdates(ctx, []*Post{post}); err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+// VerifyPostStatus Helper function for making sure a status of a post is one we know about
+func VerifyPostStatus(status string) error {
+	for _, known := range PostStatuses {
+		if status == known {
+			return nil
+		}
+	}
+	return errs.B().Meta("status", status).Code(errs.InvalidArgument).Msgf("unknown status %q, expected one of %v", status, PostStatuses).Err()
+}
+
+// historyLimit is how many posts the status page shows
+const historyLimit = 50
+
+func listPosts(ctx context.Context, unresolved bool) (*Posts, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, title, status, service_ids, incident_id, created_at, updated_at, resolved_at
+		FROM posts
+		WHERE NOT $1 OR resolved_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, unresolved, historyLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var posts []*Post
+	for rows.Next() {
+		post, err := RowToPost(rows)
+		if err != nil {
+			return nil, errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		posts = append(posts, post)
+	}
+	rows.Close()
+
+	if err := loadUpdates(ctx, posts); err != nil {
+		return nil, err
+	}
+	result := &Posts{}
+	for _, post := range posts {
+		result.Items = append(result.Items, *post)
+	}
+	return result, nil
+}
+
+// loadUpdates Helper function adding the updates to posts, newest first
+func loadUpdates(ctx context.Context, posts []*Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	byId := map[int]*Post{}
+	var ids []string
+	for _, post := range posts {
+		byId[post.Id] = post
+		ids = append(ids, fmt.Sprint(post.Id))
+	}
+
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, post_id, status, message, created_at
+		FROM updates
+		WHERE post_id = ANY(STRING_TO_ARRAY($1, ',')::BIGINT[])
+		ORDER BY created_at DESC, id DESC
+	`, strings.Join(ids, ","))
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var update Update
+		var postId int
+		if err := rows.Scan(&update.Id, &postId, &update.Status, &update.Message, &update.CreatedAt); err != nil {
+			return errs.B().Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		if post, ok := byId[postId]; ok {
+			post.Updates = append(post.Updates, update)
+		}
+	}
+	return nil
+}
+
+// requireResponder Helper function making sure the caller is a responder in a team owning one of
+// the services. Any responder may publish posts which don't affect a particular service.
+func requireResponder(ctx context.Context, serviceIds []int) error {
+	var teamIds []int
+	for _, id := range serviceIds {
+		service, err := services.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !service.Public {
+			return errs.B().Meta("serviceId", id).Code(errs.InvalidArgument).Msgf("service %s is not public", service.Name).Err()
+		}
+		teamIds = append(teamIds, service.TeamId)
+	}
+	return authz.RequireTeamRole(authz.RoleResponder, teamIds, "publish on the status page")
+}
+
+// RowToPost Helper function from Row to Post, without its updates
+func RowToPost(row interface {
+	Scan(dest ...interface{}) error
+}) (*Post, error) {
+	var post = &Post{}
+	var serviceIds []byte
+	err := row.Scan(&post.Id, &post.Title, &post.Status, &serviceIds, &post.IncidentId, &post.CreatedAt, &post.UpdatedAt, &post.ResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(serviceIds, &post.ServiceIds); err != nil {
+		return nil, err
+	}
+	return post, nil
+}
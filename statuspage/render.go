@@ -0,0 +1,233 @@
+package statuspage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+)
+
+// title of the status page and its feeds
+const title = "Status"
+
+var page = template.Must(template.New("status").Funcs(template.FuncMap{
+	"label": func(status string) string {
+		return strings.ReplaceAll(status, "_", " ")
+	},
+	"time": func(t time.Time) string {
+		return t.UTC().Format("Jan 2, 15:04 MST")
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<link rel="alternate" type="application/atom+xml" title="{{.Title}}" href="/status/feed.atom">
+<link rel="alternate" type="application/rss+xml" title="{{.Title}}" href="/status/feed.rss">
+<style>
+body { font-family: sans-serif; max-width: 48em; margin: 2em auto; padding: 0 1em; color: #222; }
+.status { padding: 1em; border-radius: 4px; color: #fff; background: #c0392b; }
+.operational { background: #27ae60; }
+.under_maintenance { background: #2980b9; }
+.degraded_performance { background: #f39c12; }
+.partial_outage { background: #e67e22; }
+.components li { display: flex; justify-content: space-between; padding: .5em 0; border-bottom: 1px solid #eee; }
+.components { list-style: none; padding: 0; }
+time, .muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="status {{.Summary.Status}}">{{if eq .Summary.Status "operational"}}All systems operational{{else}}Current status: {{label .Summary.Status}}{{end}}</p>
+<ul class="components">
+{{range .Summary.Components}}<li><span>{{.Name}}</span><span>{{label .Status}}</span></li>
+{{end}}</ul>
+<h2>Incidents</h2>
+{{range .History}}<article id="incident-{{.Id}}">
+<h3>{{.Title}} <span class="muted">{{label .Status}}</span></h3>
+{{range .Updates}}<p><strong>{{label .Status}}</strong> - {{.Message}}<br><time>{{time .CreatedAt}}</time></p>
+{{end}}</article>
+{{else}}<p class="muted">No incidents reported.</p>
+{{end}}<p class="muted">Updated {{time .Summary.UpdatedAt}}</p>
+</body>
+</html>
+`))
+
+// Page renders the status page as HTML
+//
+//encore:api public raw method=GET path=/status
+func Page(w http.ResponseWriter, req *http.Request) {
+	summary, err := Summarize(req.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	history, err := ListPosts(req.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = page.Execute(w, struct {
+		Title   string
+		Summary *Summary
+		History []Post
+	}{title, summary, history.Items})
+	if err != nil {
+		rlog.Error("FAIL to render status page", "err", err)
+	}
+}
+
+// AtomFeed is the history of posts as an Atom feed
+//
+//encore:api public raw method=GET path=/status/feed.atom
+func AtomFeed(w http.ResponseWriter, req *http.Request) {
+	history, err := ListPosts(req.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeXML(w, "application/atom+xml", renderAtom(history.Items, baseURL(req), time.Now()))
+}
+
+// RSSFeed is the history of posts as an RSS feed
+//
+//encore:api public raw method=GET path=/status/feed.rss
+func RSSFeed(w http.ResponseWriter, req *http.Request) {
+	history, err := ListPosts(req.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeXML(w, "application/rss+xml", renderRSS(history.Items, baseURL(req), time.Now()))
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Guid        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description"`
+}
+
+func renderAtom(posts []Post, base string, now time.Time) interface{} {
+	feed := atomFeed{
+		Title:   title,
+		Id:      base + "/status",
+		Updated: now.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Href: base + "/status"}, {Href: base + "/status/feed.atom", Rel: "self"}},
+	}
+	for _, post := range posts {
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   fmt.Sprintf("%s [%s]", post.Title, post.Status),
+			Id:      postURL(base, post.Id),
+			Updated: post.UpdatedAt.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: postURL(base, post.Id)},
+			Content: atomContent{Type: "text", Body: describeUpdates(post.Updates)},
+		})
+	}
+	return feed
+}
+
+func renderRSS(posts []Post, base string, now time.Time) interface{} {
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:         title,
+		Link:          base + "/status",
+		Description:   "Incidents and their updates",
+		LastBuildDate: now.UTC().Format(time.RFC1123Z),
+	}}
+	for _, post := range posts {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       fmt.Sprintf("%s [%s]", post.Title, post.Status),
+			Link:        postURL(base, post.Id),
+			Guid:        postURL(base, post.Id),
+			PubDate:     post.CreatedAt.UTC().Format(time.RFC1123Z),
+			Description: describeUpdates(post.Updates),
+		})
+	}
+	return feed
+}
+
+func describeUpdates(updates []Update) string {
+	var lines []string
+	for _, update := range updates {
+		lines = append(lines, fmt.Sprintf("%s - %s: %s", update.CreatedAt.UTC().Format(time.RFC1123), update.Status, update.Message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func postURL(base string, id int) string {
+	return fmt.Sprintf("%s/status#incident-%d", base, id)
+}
+
+// baseURL Helper function returning the URL the status page was requested on, for links in the feeds
+func baseURL(req *http.Request) string {
+	scheme := "https"
+	if forwarded := req.Header.Get("X-Forwarded-Proto"); forwarded != "" {
+		scheme = forwarded
+	} else if req.TLS == nil {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s", scheme, req.Host)
+}
+
+func writeXML(w http.ResponseWriter, contentType string, v interface{}) {
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		rlog.Error("FAIL to render feed", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	rlog.Error("FAIL to render status page", "err", err)
+	http.Error(w, "status is unavailable", errs.Code(err).HTTPStatus())
+}
@@ -0,0 +1,129 @@
+// Package statuspage tells customers whether we are down. The status of each public service is
+// derived from its open incidents, while what customers read about an incident is published by
+// responders as posts, so internal incident details are never shown.
+package statuspage
+
+import (
+	"context"
+	"time"
+
+	"encore.app/incidents"
+	"encore.app/maintenance"
+	"encore.app/services"
+)
+
+// Statuses of components, from best to worst
+const (
+	StatusOperational   = "operational"
+	StatusMaintenance   = "under_maintenance"
+	StatusDegraded      = "degraded_performance"
+	StatusPartialOutage = "partial_outage"
+	StatusMajorOutage   = "major_outage"
+)
+
+var Statuses = []string{StatusOperational, StatusMaintenance, StatusDegraded, StatusPartialOutage, StatusMajorOutage}
+
+// Component is a public service as customers see it
+type Component struct {
+	Id     int
+	Name   string
+	Status string
+}
+
+type Summary struct {
+	Status     string // the worst status of the components
+	UpdatedAt  time.Time
+	Components []Component
+	Incidents  []Post // the unresolved ones
+}
+
+// Summarize is the status page as JSON
+//
+//encore:api public method=GET path=/status.json
+func Summarize(ctx context.Context) (*Summary, error) {
+	unresolved, err := listPosts(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	catalogue, err := services.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{Status: StatusOperational, UpdatedAt: time.Now(), Incidents: unresolved.Items}
+	for _, service := range catalogue.Items {
+		if !service.Public {
+			continue
+		}
+		open, err := incidents.ListByService(ctx, service.Id)
+		if err != nil {
+			return nil, err
+		}
+		var severities []string
+		for _, incident := range open.Items {
+			severities = append(severities, incident.Severity)
+		}
+		windows, err := maintenance.Matching(ctx, &maintenance.MatchParams{
+			TeamId: &service.TeamId,
+			Labels: map[string]string{"service": service.Name},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		status := componentStatus(severities, len(windows.Items) > 0, affects(unresolved.Items, service.Id))
+		summary.Components = append(summary.Components, Component{Id: service.Id, Name: service.Name, Status: status})
+		summary.Status = worstStatus(summary.Status, status)
+	}
+	return summary, nil
+}
+
+// componentStatus derives the status of a component from the severities of its open incidents.
+// Acknowledged incidents aren't open anymore, so a post which isn't resolved yet keeps it degraded.
+func componentStatus(severities []string, inMaintenance bool, posted bool) string {
+	status := StatusOperational
+	if inMaintenance {
+		status = StatusMaintenance
+	}
+	if posted {
+		status = worstStatus(status, StatusDegraded)
+	}
+	for _, severity := range severities {
+		switch severity {
+		case "SEV1":
+			status = worstStatus(status, StatusMajorOutage)
+		case "SEV2":
+			status = worstStatus(status, StatusPartialOutage)
+		default:
+			status = worstStatus(status, StatusDegraded)
+		}
+	}
+	return status
+}
+
+func worstStatus(a, b string) string {
+	if statusRank(b) > statusRank(a) {
+		return b
+	}
+	return a
+}
+
+func statusRank(status string) int {
+	for i, known := range Statuses {
+		if status == known {
+			return i
+		}
+	}
+	return 0
+}
+
+func affects(posts []Post, serviceId int) bool {
+	for _, post := range posts {
+		for _, id := range post.ServiceIds {
+			if id == serviceId {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package statuspage
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComponentStatus(t *testing.T) {
+	for _, test := range []struct {
+		severities    []string
+		inMaintenance bool
+		posted        bool
+		expected      string
+	}{
+		{nil, false, false, StatusOperational},
+		{nil, true, false, StatusMaintenance},
+		{nil, false, true, StatusDegraded},
+		{[]string{"SEV4"}, false, false, StatusDegraded},
+		{[]string{"SEV3", "SEV2"}, false, false, StatusPartialOutage},
+		{[]string{"SEV2", "SEV1", "SEV3"}, true, true, StatusMajorOutage},
+	} {
+		if status := componentStatus(test.severities, test.inMaintenance, test.posted); status != test.expected {
+			t.Errorf("expected %v (maintenance %v, posted %v) to be %s, got %s", test.severities, test.inMaintenance, test.posted, test.expected, status)
+		}
+	}
+}
+
+func TestRenderFeeds(t *testing.T) {
+	created := time.Date(2030, 1, 7, 22, 0, 0, 0, time.UTC)
+	posts := []Post{{
+		Id:        3,
+		Title:     "Checkout is failing",
+		Status:    PostMonitoring,
+		CreatedAt: created,
+		UpdatedAt: created.Add(time.Hour),
+		Updates: []Update{
+			{Status: PostMonitoring, Message: "A fix is rolled out", CreatedAt: created.Add(time.Hour)},
+			{Status: PostInvestigating, Message: "Payments <fail>", CreatedAt: created},
+		},
+	}}
+
+	atom, err := xml.Marshal(renderAtom(posts, "https://example.com", created))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<feed xmlns="http://www.w3.org/2005/Atom">`,
+		`<title>Checkout is failing [monitoring]</title>`,
+		`<id>https://example.com/status#incident-3</id>`,
+		`<updated>2030-01-07T23:00:00Z</updated>`,
+		`investigating: Payments &lt;fail&gt;`,
+	} {
+		if !strings.Contains(string(atom), expected) {
+			t.Errorf("expected Atom feed to contain %s, got %s", expected, atom)
+		}
+	}
+
+	rss, err := xml.Marshal(renderRSS(posts, "https://example.com", created))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<rss version="2.0">`,
+		`<guid>https://example.com/status#incident-3</guid>`,
+		`<pubDate>Mon, 07 Jan 2030 22:00:00 +0000</pubDate>`,
+	} {
+		if !strings.Contains(string(rss), expected) {
+			t.Errorf("expected RSS feed to contain %s, got %s", expected, rss)
+		}
+	}
+}
+
+func TestPostHidesIncident(t *testing.T) {
+	incidentId := 7
+	raw, err := json.Marshal(Post{Id: 1, Title: "Checkout is slow", IncidentId: &incidentId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "IncidentId") {
+		t.Errorf("expected the internal incident not to be published, got %s", raw)
+	}
+}
@@ -0,0 +1,284 @@
+package statuspage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"encore.app/services"
+	"encore.dev"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+// Kinds of subscribers
+const (
+	SubscriberEmail   = "email"
+	SubscriberWebhook = "webhook"
+)
+
+// confirmationCooldown is how long subscribing an unconfirmed address again doesn't send another
+// confirmation
+const confirmationCooldown = time.Hour
+
+// Subscriber is notified about posts affecting the components they subscribed to
+type Subscriber struct {
+	Id         int
+	Kind       string
+	Address    string // the email address or webhook URL
+	ServiceIds []int  // empty for all components
+	Confirmed  bool
+}
+
+type SubscribeParams struct {
+	Email      string // either an email address
+	WebhookURL string // or a URL to post JSON to
+	ServiceIds []int  // the public services to be notified about, defaults to all of them
+}
+
+// Subscribe signs up for notifications by email or webhook. Nothing but the confirmation is sent
+// until the link in it has been opened, so nobody can be subscribed against their will. Webhooks
+// have to be on public addresses.
+//
+//encore:api public method=POST path=/status/subscribers
+func Subscribe(ctx context.Context, params *SubscribeParams) (*Subscriber, error) {
+	eb := errs.B().Meta("params", params)
+	kind, address, err := subscriberAddress(params)
+	if err != nil {
+		return nil, err
+	}
+	if kind == SubscriberWebhook {
+		if err := verifyWebhookHost(ctx, address); err != nil {
+			return nil, eb.Code(errs.InvalidArgument).Msg(err.Error()).Err()
+		}
+	}
+	for _, id := range params.ServiceIds {
+		service, err := services.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if !service.Public {
+			return nil, eb.Code(errs.InvalidArgument).Msgf("service #%d is not public", id).Err()
+		}
+	}
+	serviceIds := params.ServiceIds
+	if serviceIds == nil {
+		serviceIds = []int{}
+	}
+	serviceIdsJSON, err := json.Marshal(serviceIds)
+	if err != nil {
+		return nil, err
+	}
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// subscribing again resends the confirmation, but only the owner can change a confirmed subscription
+	var subscriber Subscriber
+	var storedIds []byte
+	err = sqldb.QueryRow(ctx, `
+		INSERT INTO subscribers (kind, address, service_ids, token)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (kind, address) DO UPDATE
+		SET service_ids = CASE WHEN subscribers.confirmed_at IS NULL THEN EXCLUDED.service_ids ELSE subscribers.service_ids END
+		RETURNING id, kind, address, service_ids, confirmed_at IS NOT NULL, token
+	`, kind, address, string(serviceIdsJSON), token).Scan(&subscriber.Id, &subscriber.Kind, &subscriber.Address, &storedIds, &subscriber.Confirmed, &token)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("insert subscriber").Err()
+	}
+	if err := json.Unmarshal(storedIds, &subscriber.ServiceIds); err != nil {
+		return nil, err
+	}
+
+	if !subscriber.Confirmed {
+		// anyone can subscribe any address, so the confirmation is only sent again after a while
+		var due bool
+		err := sqldb.QueryRow(ctx, `
+			UPDATE subscribers
+			SET confirmation_sent_at = NOW()
+			WHERE id = $1
+			  AND (confirmation_sent_at IS NULL OR confirmation_sent_at <= $2)
+			RETURNING TRUE
+		`, subscriber.Id, time.Now().Add(-confirmationCooldown)).Scan(&due)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return &subscriber, nil
+		}
+		if err != nil {
+			return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update subscriber").Err()
+		}
+
+		links := linksFor(token)
+		subject := "Confirm your subscription to status updates"
+		body := fmt.Sprintf("Please confirm you want to be notified about incidents by opening\n%s\n\nIf you didn't subscribe, ignore this email.", links.ConfirmURL)
+		if err := enqueue(ctx, subscriber.Id, subject, body, webhookPayload{Type: "subscription.confirm", Links: links}); err != nil {
+			return nil, err
+		}
+	}
+	return &subscriber, nil
+}
+
+//encore:api public method=GET path=/status/subscribers/confirm/:token
+func Confirm(ctx context.Context, token string) (*Subscriber, error) {
+	subscriber, err := RowToSubscriber(sqldb.QueryRow(ctx, `
+		UPDATE subscribers
+		SET confirmed_at = COALESCE(confirmed_at, NOW())
+		WHERE token = $1
+		RETURNING id, kind, address, service_ids, confirmed_at IS NOT NULL
+	`, token))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Code(errs.NotFound).Msg("no subscription found, it may have been cancelled").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return subscriber, nil
+}
+
+//encore:api public method=GET path=/status/subscribers/unsubscribe/:token
+func Unsubscribe(ctx context.Context, token string) (*Subscriber, error) {
+	subscriber, err := RowToSubscriber(sqldb.QueryRow(ctx, `
+		DELETE FROM subscribers
+		WHERE token = $1
+		RETURNING id, kind, address, service_ids, confirmed_at IS NOT NULL
+	`, token))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, errs.B().Code(errs.NotFound).Msg("no subscription found, it may have been cancelled already").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return subscriber, nil
+}
+
+// notifySubscribers Helper function queueing a notification about a post to the confirmed
+// subscribers of the components it affects
+func notifySubscribers(ctx context.Context, post *Post) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id, kind, address, service_ids, confirmed_at IS NOT NULL, token
+		FROM subscribers
+		WHERE confirmed_at IS NOT NULL
+	`)
+	if err != nil {
+		rlog.Error("FAIL to list subscribers", "post", post.Id, "err", err)
+		return
+	}
+
+	type recipient struct {
+		subscriber Subscriber
+		token      string
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		var serviceIds []byte
+		if err := rows.Scan(&r.subscriber.Id, &r.subscriber.Kind, &r.subscriber.Address, &serviceIds, &r.subscriber.Confirmed, &r.token); err != nil {
+			rlog.Error("FAIL to scan subscriber", "err", err)
+			continue
+		}
+		if err := json.Unmarshal(serviceIds, &r.subscriber.ServiceIds); err != nil {
+			rlog.Error("FAIL to parse services of subscriber", "subscriber", r.subscriber.Id, "err", err)
+			continue
+		}
+		if subscribedTo(r.subscriber.ServiceIds, post.ServiceIds) {
+			recipients = append(recipients, r)
+		}
+	}
+	rows.Close()
+
+	subject := fmt.Sprintf("%s [%s]", post.Title, post.Status)
+	for _, r := range recipients {
+		links := linksFor(r.token)
+		links.ConfirmURL = "" // already confirmed
+		body := fmt.Sprintf("%s\n\n%s\n\nStatus page: %s\nUnsubscribe: %s", subject, describeUpdates(post.Updates), links.StatusURL, links.UnsubscribeURL)
+		if err := enqueue(ctx, r.subscriber.Id, subject, body, webhookPayload{Type: "incident.update", Post: post, Links: links}); err != nil {
+			rlog.Error("FAIL to queue notification", "post", post.Id, "subscriber", r.subscriber.Id, "err", err)
+		}
+	}
+}
+
+// subscribedTo reports whether a subscriber of the services is notified about a post affecting
+// the others. Posts which don't affect a particular service are about everything.
+func subscribedTo(subscribed []int, affected []int) bool {
+	if len(subscribed) == 0 || len(affected) == 0 {
+		return true
+	}
+	for _, a := range subscribed {
+		for _, b := range affected {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// subscriberAddress Helper function returning the kind and normalised address of a new subscriber
+func subscriberAddress(params *SubscribeParams) (string, string, error) {
+	eb := errs.B()
+	switch {
+	case params.Email != "" && params.WebhookURL != "":
+		return "", "", eb.Code(errs.InvalidArgument).Msg("subscribe either an email address or a webhook URL").Err()
+	case params.Email != "":
+		address, err := mail.ParseAddress(params.Email)
+		if err != nil || address.Name != "" {
+			return "", "", eb.Code(errs.InvalidArgument).Msg("email is not a valid email address").Err()
+		}
+		return SubscriberEmail, strings.ToLower(address.Address), nil
+	case params.WebhookURL != "":
+		webhook, err := url.Parse(params.WebhookURL)
+		if err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+			return "", "", eb.Code(errs.InvalidArgument).Msg("webhook URL is not an http(s) URL").Err()
+		}
+		return SubscriberWebhook, webhook.String(), nil
+	}
+	return "", "", eb.Code(errs.InvalidArgument).Msg("email or webhook URL is empty").Err()
+}
+
+// links are the URLs in notifications
+type links struct {
+	StatusURL      string
+	ConfirmURL     string `json:",omitempty"`
+	UnsubscribeURL string
+}
+
+func linksFor(token string) links {
+	base := encore.Meta().APIBaseURL
+	return links{
+		StatusURL:      base.JoinPath("status").String(),
+		ConfirmURL:     base.JoinPath("status", "subscribers", "confirm", token).String(),
+		UnsubscribeURL: base.JoinPath("status", "subscribers", "unsubscribe", token).String(),
+	}
+}
+
+func generateToken() (string, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// RowToSubscriber Helper function from Row to Subscriber
+func RowToSubscriber(row interface {
+	Scan(dest ...interface{}) error
+}) (*Subscriber, error) {
+	var subscriber = &Subscriber{}
+	var serviceIds []byte
+	err := row.Scan(&subscriber.Id, &subscriber.Kind, &subscriber.Address, &serviceIds, &subscriber.Confirmed)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(serviceIds, &subscriber.ServiceIds); err != nil {
+		return nil, err
+	}
+	return subscriber, nil
+}
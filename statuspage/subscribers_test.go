@@ -0,0 +1,168 @@
+package statuspage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"encore.dev/storage/sqldb"
+)
+
+func TestSubscribedTo(t *testing.T) {
+	for _, test := range []struct {
+		subscribed, affected []int
+		expected             bool
+	}{
+		{nil, []int{1}, true},
+		{[]int{1}, nil, true},
+		{[]int{1, 2}, []int{2, 3}, true},
+		{[]int{1}, []int{2}, false},
+	} {
+		if subscribed := subscribedTo(test.subscribed, test.affected); subscribed != test.expected {
+			t.Errorf("expected subscriber of %v to be notified about %v: %v, got %v", test.subscribed, test.affected, test.expected, subscribed)
+		}
+	}
+}
+
+func TestSubscriberAddress(t *testing.T) {
+	kind, address, err := subscriberAddress(&SubscribeParams{Email: "Jane@Example.com"})
+	if err != nil || kind != SubscriberEmail || address != "jane@example.com" {
+		t.Errorf("expected email jane@example.com, got %s %s %v", kind, address, err)
+	}
+	kind, address, err = subscriberAddress(&SubscribeParams{WebhookURL: "https://example.com/hooks/status"})
+	if err != nil || kind != SubscriberWebhook || address != "https://example.com/hooks/status" {
+		t.Errorf("expected webhook, got %s %s %v", kind, address, err)
+	}
+	for _, params := range []SubscribeParams{
+		{},
+		{Email: "jane"},
+		{Email: "Jane <jane@example.com>"},
+		{WebhookURL: "ftp://example.com"},
+		{Email: "jane@example.com", WebhookURL: "https://example.com"},
+	} {
+		if _, _, err := subscriberAddress(&params); err == nil {
+			t.Errorf("expected %+v to be invalid", params)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		5:  16 * time.Minute,
+		9:  256 * time.Minute,
+		10: maxBackoff,
+		20: maxBackoff,
+	} {
+		if wait := backoff(attempts); wait != expected {
+			t.Errorf("expected to wait %s after %d attempts, got %s", expected, attempts, wait)
+		}
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer server.Close()
+	// the test server listens on loopback, which webhooks are otherwise never sent to
+	defer func(client *http.Client) { webhookClient = client }(webhookClient)
+	webhookClient = server.Client()
+
+	if err := sendWebhook(context.Background(), server.URL+"/hook", []byte(`{"Type":"incident.update"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if received != `{"Type":"incident.update"}` {
+		t.Errorf("expected payload to be posted, got %s", received)
+	}
+	if err := sendWebhook(context.Background(), server.URL+"/gone", []byte(`{}`)); err == nil {
+		t.Error("expected an error response to fail the delivery")
+	}
+}
+
+func TestSendWebhookToInternalAddressIsBlocked(t *testing.T) {
+	called := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	err := sendWebhook(context.Background(), server.URL+"/hook", []byte(`{}`))
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("expected a webhook to loopback to be blocked, got %v", err)
+	}
+	if called {
+		t.Error("expected the blocked webhook not to reach the server")
+	}
+}
+
+func TestVerifyWebhookHost(t *testing.T) {
+	for _, webhook := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"http://10.0.0.7/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://0.0.0.0/hook",
+		"http://[::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+		"http://[fe80::1]/hook",
+	} {
+		if err := verifyWebhookHost(context.Background(), webhook); err == nil {
+			t.Errorf("expected %s to be rejected", webhook)
+		}
+	}
+	if err := verifyWebhookHost(context.Background(), "https://93.184.216.34/hook"); err != nil {
+		t.Errorf("expected a public address to be accepted, got %v", err)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	cases := map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"172.16.0.1":      false,
+		"169.254.169.254": false,
+		"fd00::1":         false,
+		"224.0.0.1":       false,
+		"::":              false,
+	}
+	for address, expected := range cases {
+		if public := isPublicIP(net.ParseIP(address)); public != expected {
+			t.Errorf("expected %s to be public %t, got %t", address, expected, public)
+		}
+	}
+}
+
+func TestSubscribingAgainDoesNotResendConfirmation(t *testing.T) {
+	ctx := context.Background()
+	params := &SubscribeParams{Email: fmt.Sprintf("cooldown-%d@example.com", time.Now().UnixNano())}
+	subscriber, err := Subscribe(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Subscribe(ctx, params); err != nil {
+		t.Fatal(err)
+	}
+
+	var queued int
+	if err := sqldb.QueryRow(ctx, `SELECT COUNT(*) FROM deliveries WHERE subscriber_id = $1`, subscriber.Id).Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != 1 {
+		t.Errorf("expected one confirmation to be queued, got %d", queued)
+	}
+}
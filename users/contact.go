@@ -0,0 +1,96 @@
+package users
+
+import (
+	"context"
+	"net/mail"
+	"regexp"
+
+	"encore.app/slack"
+	"encore.dev/beta/errs"
+	"encore.dev/rlog"
+	"encore.dev/storage/sqldb"
+)
+
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// verifyContactDetails Helper function for making sure an email and phone number are valid if set,
+// and nobody else (except the user with id) already has the email
+func verifyContactDetails(ctx context.Context, id int, email string, phone string) error {
+	eb := errs.B().Meta("email", email, "phone", phone)
+	if email != "" {
+		address, err := mail.ParseAddress(email)
+		if err != nil || address.Address != email {
+			return eb.Code(errs.InvalidArgument).Msg("email is not a valid address, e.g. jane@example.com").Err()
+		}
+
+		var taken bool
+		err = sqldb.QueryRow(ctx, `
+			SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1) AND id <> $2)
+		`, email, id).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return eb.Code(errs.AlreadyExists).Msg("another user already has this email").Err()
+		}
+	}
+	if phone != "" && !phonePattern.MatchString(phone) {
+		return eb.Code(errs.InvalidArgument).Msg("phone is not in the E.164 format, e.g. +4915123456789").Err()
+	}
+	return nil
+}
+
+// lookupSlackUserId Helper function resolving the Slack member ID of an email. Users are still
+// created when Slack doesn't know them (yet), so it returns an empty string instead of failing.
+func lookupSlackUserId(ctx context.Context, email string) string {
+	if email == "" {
+		return ""
+	}
+	slackUser, err := slack.LookupUserByEmail(ctx, &slack.LookupUserParams{Email: email})
+	if err != nil {
+		rlog.Info("could not resolve slack user", "email", email, "err", err)
+		return ""
+	}
+	return slackUser.Id
+}
+
+// ResolveSlackUserId looks up the Slack member ID of a user who doesn't have one yet, e.g. because
+// they joined the Slack workspace after they were created, and stores it
+//
+//encore:api private
+func ResolveSlackUserId(ctx context.Context, id int) (*User, error) {
+	user, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if user.SlackUserId != "" || user.Email == "" {
+		return user, nil
+	}
+
+	user.SlackUserId = lookupSlackUserId(ctx, user.Email)
+	if user.SlackUserId == "" {
+		return user, nil
+	}
+	_, err = sqldb.Exec(ctx, `UPDATE users SET slack_user_id = $1 WHERE id = $2`, user.SlackUserId, id)
+	if err != nil {
+		return nil, errs.B().Meta("userId", id).Code(errs.Unavailable).Cause(err).Msg("store slack user id").Err()
+	}
+	return user, nil
+}
+
+// Mention Helper function for mentioning a user in a Slack message. Only mentions with a member ID
+// ping the user, so it falls back to plain text when Slack doesn't know them.
+func Mention(ctx context.Context, user *User) string {
+	if user.SlackUserId == "" && user.Email != "" {
+		resolved, err := ResolveSlackUserId(ctx, user.Id)
+		if err != nil {
+			rlog.Info("could not resolve slack user", "userId", user.Id, "err", err)
+		} else {
+			user.SlackUserId = resolved.SlackUserId
+		}
+	}
+	if user.SlackUserId != "" {
+		return "<@" + user.SlackUserId + ">"
+	}
+	return "@" + user.SlackHandle
+}
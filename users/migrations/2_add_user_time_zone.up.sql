@@ -0,0 +1,2 @@
+ALTER TABLE users
+    ADD COLUMN time_zone VARCHAR(255) NOT NULL DEFAULT 'UTC';
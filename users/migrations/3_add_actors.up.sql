@@ -0,0 +1,3 @@
+-- the auth UID of whoever made the change, NULL when it was made by the system itself
+ALTER TABLE users
+    ADD COLUMN created_by VARCHAR(255);
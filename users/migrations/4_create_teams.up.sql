@@ -0,0 +1,16 @@
+ALTER TABLE users
+    ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE teams
+(
+    id   BIGSERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL UNIQUE
+);
+
+CREATE TABLE team_members
+(
+    team_id BIGINT       NOT NULL REFERENCES teams (id) ON DELETE CASCADE,
+    user_id BIGINT       NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role    VARCHAR(255) NOT NULL,
+    PRIMARY KEY (team_id, user_id)
+);
@@ -0,0 +1,5 @@
+-- deactivated users are kept so incidents and schedules can still point at them
+ALTER TABLE users
+    ADD COLUMN updated_by     VARCHAR(255),
+    ADD COLUMN deactivated_at TIMESTAMPTZ,
+    ADD COLUMN deactivated_by VARCHAR(255);
@@ -0,0 +1,7 @@
+ALTER TABLE users
+    ADD COLUMN email         VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN phone         VARCHAR(32)  NOT NULL DEFAULT '',
+    -- the Slack member ID resolved from the email, which mentions need to actually ping someone
+    ADD COLUMN slack_user_id VARCHAR(32)  NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX users_email_index ON users (LOWER(email)) WHERE email <> '';
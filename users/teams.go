@@ -0,0 +1,301 @@
+package users
+
+import (
+	"context"
+	"errors"
+
+	"encore.app/audit"
+	"encore.app/authz"
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+)
+
+type Teams struct {
+	Items []Team
+}
+
+type Team struct {
+	Id      int
+	Name    string
+	Members []Member
+}
+
+type Member struct {
+	User User
+	Role authz.Role
+}
+
+// Membership is a team a user belongs to and their role in it
+type Membership struct {
+	TeamId   int
+	TeamName string
+	Role     authz.Role
+}
+
+type Memberships struct {
+	Items []Membership
+}
+
+type CreateTeamParams struct {
+	Name string
+}
+
+type UpdateTeamParams struct {
+	Name string
+}
+
+type AddMemberParams struct {
+	UserId int
+	Role   authz.Role
+}
+
+//encore:api auth method=POST path=/teams
+func CreateTeam(ctx context.Context, params *CreateTeamParams) (*Team, error) {
+	eb := errs.B().Meta("params", params)
+	if err := authz.RequireAdmin("manage teams"); err != nil {
+		return nil, err
+	}
+	if len(params.Name) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("name is empty").Err()
+	}
+
+	team := &Team{}
+	err := sqldb.QueryRow(ctx, `
+		INSERT INTO teams (name)
+		VALUES ($1)
+		RETURNING id, name
+	`, params.Name).Scan(&team.Id, &team.Name)
+	if err != nil {
+		return nil, eb.Code(errs.AlreadyExists).Cause(err).Msg("team already exists").Err()
+	}
+
+	audit.Log(ctx, "team.create", "team", team.Id, nil, team)
+	return team, nil
+}
+
+//encore:api auth method=PATCH path=/teams/:id
+func UpdateTeam(ctx context.Context, id int, params *UpdateTeamParams) (*Team, error) {
+	eb := errs.B().Meta("teamId", id, "params", params)
+	if err := authz.RequireAdmin("manage teams"); err != nil {
+		return nil, err
+	}
+	if len(params.Name) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("name is empty").Err()
+	}
+	before, err := GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sqldb.Exec(ctx, `UPDATE teams SET name = $1 WHERE id = $2`, params.Name, id)
+	if err != nil {
+		return nil, eb.Code(errs.AlreadyExists).Cause(err).Msg("team already exists").Err()
+	}
+
+	after, err := GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "team.update", "team", id, before, after)
+	return after, nil
+}
+
+// DeleteTeam removes a team and its memberships. Its members keep their schedules and incidents.
+//
+//encore:api auth method=DELETE path=/teams/:id
+func DeleteTeam(ctx context.Context, id int) (*Team, error) {
+	if err := authz.RequireAdmin("manage teams"); err != nil {
+		return nil, err
+	}
+	team, err := GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// memberships are deleted by the foreign key
+	if _, err := sqldb.Exec(ctx, `DELETE FROM teams WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+
+	audit.Log(ctx, "team.delete", "team", id, team, nil)
+	return team, nil
+}
+
+//encore:api public method=GET path=/teams
+func ListTeams(ctx context.Context) (*Teams, error) {
+	rows, err := sqldb.Query(ctx, `
+		SELECT id
+		FROM teams
+		ORDER BY name ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	var teams []Team
+	for _, id := range ids {
+		team, err := GetTeam(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, *team)
+	}
+
+	return &Teams{Items: teams}, nil
+}
+
+// GetTeam returns a team and its members, whose contact details only authenticated callers see
+//
+//encore:api public method=GET path=/teams/:id
+func GetTeam(ctx context.Context, id int) (*Team, error) {
+	eb := errs.B().Meta("teamId", id)
+	team := &Team{}
+	err := sqldb.QueryRow(ctx, `SELECT id, name FROM teams WHERE id = $1`, id).Scan(&team.Id, &team.Name)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no team found").Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sqldb.Query(ctx, `
+		SELECT u.id, u.first_name, u.last_name, u.slack_handle, u.time_zone, u.is_admin, u.deactivated_at, u.email, u.phone, u.slack_user_id, m.role
+		FROM team_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.team_id = $1
+		ORDER BY u.id ASC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var member Member
+		err := rows.Scan(&member.User.Id, &member.User.FirstName, &member.User.LastName, &member.User.SlackHandle, &member.User.TimeZone, &member.User.Admin, &member.User.DeactivatedAt, &member.User.Email, &member.User.Phone, &member.User.SlackUserId, &member.Role)
+		if err != nil {
+			return nil, eb.Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		Redact(&member.User)
+		team.Members = append(team.Members, member)
+	}
+
+	return team, nil
+}
+
+// AddMember adds a user to a team, or changes their role if they already are a member
+//
+//encore:api auth method=PUT path=/teams/:id/members
+func AddMember(ctx context.Context, id int, params *AddMemberParams) (*Team, error) {
+	eb := errs.B().Meta("teamId", id, "params", params)
+	if err := authz.RequireAdmin("manage teams"); err != nil {
+		return nil, err
+	}
+	if err := authz.VerifyRole(params.Role); err != nil {
+		return nil, err
+	}
+	if _, err := GetAssignable(ctx, params.UserId); err != nil {
+		return nil, err
+	}
+	before, err := GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = sqldb.Exec(ctx, `
+		INSERT INTO team_members (team_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (team_id, user_id) DO UPDATE SET role = excluded.role
+	`, id, params.UserId, params.Role)
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("add team member").Err()
+	}
+
+	after, err := GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "team.member.add", "team", id, before, after)
+	return after, nil
+}
+
+//encore:api auth method=DELETE path=/teams/:id/members/:userId
+func RemoveMember(ctx context.Context, id int, userId int) (*Team, error) {
+	eb := errs.B().Meta("teamId", id, "userId", userId)
+	if err := authz.RequireAdmin("manage teams"); err != nil {
+		return nil, err
+	}
+
+	before, err := GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := sqldb.Exec(ctx, `DELETE FROM team_members WHERE team_id = $1 AND user_id = $2`, id, userId)
+	if err != nil {
+		return nil, err
+	}
+	if result.RowsAffected() == 0 {
+		return nil, eb.Code(errs.NotFound).Msg("user is not a member of this team").Err()
+	}
+
+	after, err := GetTeam(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	audit.Log(ctx, "team.member.remove", "team", id, before, after)
+	return after, nil
+}
+
+//encore:api public method=GET path=/users/:id/teams
+func ListMemberships(ctx context.Context, id int) (*Memberships, error) {
+	eb := errs.B().Meta("userId", id)
+	rows, err := sqldb.Query(ctx, `
+		SELECT t.id, t.name, m.role
+		FROM team_members m
+		JOIN teams t ON t.id = m.team_id
+		WHERE m.user_id = $1
+		ORDER BY t.name ASC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var memberships []Membership
+	for rows.Next() {
+		var membership Membership
+		if err := rows.Scan(&membership.TeamId, &membership.TeamName, &membership.Role); err != nil {
+			return nil, eb.Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
+		}
+		memberships = append(memberships, membership)
+	}
+
+	return &Memberships{Items: memberships}, nil
+}
+
+// TeamIds Helper function returning the ids of the teams a user belongs to
+func TeamIds(ctx context.Context, userId int) ([]int, error) {
+	memberships, err := ListMemberships(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, membership := range memberships.Items {
+		ids = append(ids, membership.TeamId)
+	}
+	return ids, nil
+}
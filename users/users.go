@@ -2,9 +2,14 @@ package users
 
 import (
 	"context"
+	"encore.app/audit"
+	"encore.app/authz"
+	"encore.dev/beta/auth"
 	"encore.dev/beta/errs"
 	"encore.dev/storage/sqldb"
 	"errors"
+	"fmt"
+	"time"
 )
 
 type Users struct {
@@ -16,11 +21,21 @@ type User struct {
 	FirstName   string
 	LastName    string
 	SlackHandle string
+	TimeZone    string // IANA time zone, e.g. Europe/Berlin
+	Admin       bool
+	Email       string
+	Phone       string // E.164, e.g. +4915123456789
+	SlackUserId string // Slack member ID resolved from Email, e.g. U012AB3CD
+	// DeactivatedAt is set once the user has left. They keep their history but can't be assigned anymore.
+	DeactivatedAt *time.Time
 }
 
-//encore:api public method=POST path=/users
+//encore:api auth method=POST path=/users
 func Create(ctx context.Context, params CreateParams) (*User, error) {
 	eb := errs.B().Meta("params", params)
+	if err := authz.RequireAdmin("manage users"); err != nil {
+		return nil, err
+	}
 
 	if len(params.FirstName) == 0 {
 		return nil, eb.Code(errs.InvalidArgument).Msg("first name is empty").Err()
@@ -34,52 +49,251 @@ func Create(ctx context.Context, params CreateParams) (*User, error) {
 		return nil, eb.Code(errs.InvalidArgument).Msg("slack handle is empty").Err()
 	}
 
-	user := User{}
-	err := sqldb.QueryRow(ctx, `
-		INSERT INTO users (first_name, last_name, slack_handle)
-		VALUES ($1, $2, $3)
-		RETURNING id, first_name, last_name, slack_handle
-	`, params.FirstName, params.LastName, params.SlackHandle).Scan(&user.Id, &user.FirstName, &user.LastName, &user.SlackHandle)
+	timeZone := params.TimeZone
+	if len(timeZone) == 0 {
+		timeZone = "UTC"
+	}
+	if _, err := time.LoadLocation(timeZone); err != nil {
+		return nil, eb.Code(errs.InvalidArgument).Msg("time zone is not a valid IANA time zone").Err()
+	}
+
+	if err := verifyContactDetails(ctx, 0, params.Email, params.Phone); err != nil {
+		return nil, err
+	}
+
+	// the auth service depends on users, so we record the actor's UID directly
+	actor, _ := auth.UserID()
+
+	user, err := RowToUser(sqldb.QueryRow(ctx, `
+		INSERT INTO users (first_name, last_name, slack_handle, time_zone, is_admin, email, phone, slack_user_id, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''))
+		RETURNING id, first_name, last_name, slack_handle, time_zone, is_admin, deactivated_at, email, phone, slack_user_id
+	`, params.FirstName, params.LastName, params.SlackHandle, timeZone, params.Admin, params.Email, params.Phone, lookupSlackUserId(ctx, params.Email), string(actor)))
 	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	audit.Log(ctx, "user.create", "user", user.Id, nil, user)
+	return user, nil
 }
 
 type CreateParams struct {
 	FirstName   string
 	LastName    string
 	SlackHandle string
+	TimeZone    string // defaults to UTC
+	Admin       bool
+	Email       string // used to find the user on Slack
+	Phone       string
 }
 
+// GetUser returns a user, with their contact details only to authenticated callers
+//
 //encore:api public method=GET path=/users/:id
+func GetUser(ctx context.Context, id int) (*User, error) {
+	user, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	Redact(user)
+	return user, nil
+}
+
+// Get returns a user with their contact details, for other services to page them
+//
+//encore:api private
 func Get(ctx context.Context, id int) (*User, error) {
 	eb := errs.B().Meta("userId", id)
 
-	user := User{}
-	err := sqldb.QueryRow(ctx, `
-		SELECT id, first_name, last_name, slack_handle
+	user, err := RowToUser(sqldb.QueryRow(ctx, `
+		SELECT id, first_name, last_name, slack_handle, time_zone, is_admin, deactivated_at, email, phone, slack_user_id
 		FROM users
 		WHERE id = $1
-	`, id).Scan(&user.Id, &user.FirstName, &user.LastName, &user.SlackHandle)
+	`, id))
+
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.NotFound).Msg("no user found").Err()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Update changes the fields which are set. Users can update their own details, but only admins
+// can update others or make someone an admin.
+//
+//encore:api auth method=PATCH path=/users/:id
+func Update(ctx context.Context, id int, params *UpdateParams) (*User, error) {
+	eb := errs.B().Meta("userId", id, "params", params)
+	// the auth service depends on users, so we compare with its UID format directly
+	actor, _ := auth.UserID()
+	if actor != auth.UID(fmt.Sprintf("user:%d", id)) || params.Admin != nil {
+		if err := authz.RequireAdmin("update other users"); err != nil {
+			return nil, err
+		}
+	}
+
+	before, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if before.DeactivatedAt != nil {
+		return nil, eb.Code(errs.FailedPrecondition).Msg("user is deactivated").Err()
+	}
+
+	user := *before
+	if params.FirstName != nil {
+		user.FirstName = *params.FirstName
+	}
+	if params.LastName != nil {
+		user.LastName = *params.LastName
+	}
+	if params.SlackHandle != nil {
+		user.SlackHandle = *params.SlackHandle
+	}
+	if params.TimeZone != nil {
+		user.TimeZone = *params.TimeZone
+	}
+	if params.Admin != nil {
+		user.Admin = *params.Admin
+	}
+	if params.Email != nil && *params.Email != user.Email {
+		user.Email = *params.Email
+		user.SlackUserId = lookupSlackUserId(ctx, user.Email)
+	}
+	if params.Phone != nil {
+		user.Phone = *params.Phone
+	}
+
+	if len(user.FirstName) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("first name is empty").Err()
+	}
+	if len(user.LastName) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("last name is empty").Err()
+	}
+	if len(user.SlackHandle) == 0 {
+		return nil, eb.Code(errs.InvalidArgument).Msg("slack handle is empty").Err()
+	}
+	if _, err := time.LoadLocation(user.TimeZone); err != nil {
+		return nil, eb.Code(errs.InvalidArgument).Msg("time zone is not a valid IANA time zone").Err()
+	}
+	if err := verifyContactDetails(ctx, id, user.Email, user.Phone); err != nil {
+		return nil, err
+	}
+
+	after, err := RowToUser(sqldb.QueryRow(ctx, `
+		UPDATE users
+		SET first_name = $1, last_name = $2, slack_handle = $3, time_zone = $4, is_admin = $5,
+		    email = $6, phone = $7, slack_user_id = $8, updated_by = NULLIF($9, '')
+		WHERE id = $10
+		RETURNING id, first_name, last_name, slack_handle, time_zone, is_admin, deactivated_at, email, phone, slack_user_id
+	`, user.FirstName, user.LastName, user.SlackHandle, user.TimeZone, user.Admin, user.Email, user.Phone, user.SlackUserId, string(actor), id))
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("update user").Err()
+	}
+
+	audit.Log(ctx, "user.update", "user", id, before, after)
+	return after, nil
+}
+
+// UpdateParams only changes the fields which are set
+type UpdateParams struct {
+	FirstName   *string
+	LastName    *string
+	SlackHandle *string
+	TimeZone    *string
+	Admin       *bool
+	Email       *string // changing it resolves the Slack member ID again
+	Phone       *string
+}
+
+// Deactivate marks a user as having left. It is private because the user's shifts and incidents
+// have to be handed over first, which is done by the incidents service's DeactivateUser.
+//
+//encore:api private
+func Deactivate(ctx context.Context, id int) (*User, error) {
+	eb := errs.B().Meta("userId", id)
+	actor, _ := auth.UserID()
+
+	before, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
 
+	after, err := RowToUser(sqldb.QueryRow(ctx, `
+		UPDATE users
+		SET deactivated_at = NOW(), deactivated_by = NULLIF($1, '')
+		WHERE id = $2
+		  AND deactivated_at IS NULL
+		RETURNING id, first_name, last_name, slack_handle, time_zone, is_admin, deactivated_at, email, phone, slack_user_id
+	`, string(actor), id))
 	if errors.Is(err, sqldb.ErrNoRows) {
-		return nil, eb.Code(errs.InvalidArgument).Msg("no user found").Err()
+		return nil, eb.Code(errs.FailedPrecondition).Msg("user is already deactivated").Err()
+	}
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("deactivate user").Err()
+	}
+
+	audit.Log(ctx, "user.deactivate", "user", id, before, after)
+	return after, nil
+}
+
+// Reactivate lets a user who came back be put on call again
+//
+//encore:api auth method=POST path=/users/:id/reactivate
+func Reactivate(ctx context.Context, id int) (*User, error) {
+	eb := errs.B().Meta("userId", id)
+	if err := authz.RequireAdmin("reactivate users"); err != nil {
+		return nil, err
 	}
 
+	before, err := Get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	return &user, nil
+	after, err := RowToUser(sqldb.QueryRow(ctx, `
+		UPDATE users
+		SET deactivated_at = NULL, deactivated_by = NULL
+		WHERE id = $1
+		  AND deactivated_at IS NOT NULL
+		RETURNING id, first_name, last_name, slack_handle, time_zone, is_admin, deactivated_at, email, phone, slack_user_id
+	`, id))
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, eb.Code(errs.FailedPrecondition).Msg("user is not deactivated").Err()
+	}
+	if err != nil {
+		return nil, eb.Code(errs.Unavailable).Cause(err).Msg("reactivate user").Err()
+	}
+
+	audit.Log(ctx, "user.reactivate", "user", id, before, after)
+	return after, nil
 }
 
+// ListUsers returns every user, with their contact details only to authenticated callers
+//
 //encore:api public method=GET path=/users
+func ListUsers(ctx context.Context) (*Users, error) {
+	users, err := List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users.Items {
+		Redact(&users.Items[i])
+	}
+	return users, nil
+}
+
+// List returns every user with their contact details, for other services
+//
+//encore:api private
 func List(ctx context.Context) (*Users, error) {
 	eb := errs.B()
 	rows, err := sqldb.Query(ctx, `
-		SELECT id, first_name, last_name, slack_handle
+		SELECT id, first_name, last_name, slack_handle, time_zone, is_admin, deactivated_at, email, phone, slack_user_id
 		FROM users
 	`)
 	if err != nil {
@@ -90,12 +304,46 @@ func List(ctx context.Context) (*Users, error) {
 
 	var users []User
 	for rows.Next() {
-		var user = User{}
-		if err := rows.Scan(&user.Id, &user.FirstName, &user.LastName, &user.SlackHandle); err != nil {
+		user, err := RowToUser(rows)
+		if err != nil {
 			return nil, eb.Code(errs.Unknown).Msgf("could not scan: %v", err).Err()
 		}
-		users = append(users, user)
+		users = append(users, *user)
 	}
 
 	return &Users{Items: users}, nil
 }
+
+// Redact Helper function removing the contact details of a user, and whether they are an admin,
+// from the response of a public endpoint when the caller isn't authenticated
+func Redact(user *User) {
+	if _, ok := auth.UserID(); ok {
+		return
+	}
+	user.Email, user.Phone, user.SlackUserId, user.Admin = "", "", "", false
+}
+
+// GetAssignable Helper function returning a user who can be put on call or assigned incidents,
+// i.e. one who exists and hasn't been deactivated
+func GetAssignable(ctx context.Context, id int) (*User, error) {
+	user, err := Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if user.DeactivatedAt != nil {
+		return nil, errs.B().Meta("userId", id).Code(errs.FailedPrecondition).Msgf("user %s %s is deactivated", user.FirstName, user.LastName).Err()
+	}
+	return user, nil
+}
+
+// RowToUser Helper function from Row to User
+func RowToUser(row interface {
+	Scan(dest ...interface{}) error
+}) (*User, error) {
+	var user = &User{}
+	err := row.Scan(&user.Id, &user.FirstName, &user.LastName, &user.SlackHandle, &user.TimeZone, &user.Admin, &user.DeactivatedAt, &user.Email, &user.Phone, &user.SlackUserId)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	_ "embed"
 	encore "encore.dev"
+	"encore.dev/beta/errs"
 	"encore.dev/storage/sqldb"
 	"log"
 	"reflect"
@@ -32,6 +33,23 @@ func TestUsersAndFindThemInList(t *testing.T) {
 		t.Fatal(err)
 	}
 	if reflect.DeepEqual(actual, expected) {
-		t.Fatalf("expected %q to match %q", expected, actual)
+		t.Fatalf("expected %v to match %v", expected, actual)
+	}
+}
+
+func TestGetUnknownUserIsNotFound(t *testing.T) {
+	_, err := Get(context.Background(), -1)
+	if errs.Code(err) != errs.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+}
+
+func TestGetUserHidesContactDetailsFromUnauthenticatedCallers(t *testing.T) {
+	user, err := GetUser(context.Background(), 1)
+	if err != nil {
+		t.Fatal("failed to get user", err)
+	}
+	if user.Email != "" || user.Phone != "" || user.SlackUserId != "" || user.Admin {
+		t.Fatalf("expected the contact details of %v to be hidden", user)
 	}
 }